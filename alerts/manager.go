@@ -0,0 +1,478 @@
+package alerts
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/muuid-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultEvaluationInterval = time.Minute
+	MaxDedupWindow            = 24 * time.Hour
+	notificationSampleSize    = 10
+
+	// LeaseName is the name of the lease that the replica which evaluates the threshold rules holds
+	LeaseName = "alerts"
+)
+
+// Lease is held by at most one replica at a time
+type Lease interface {
+	Acquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// Manager keeps the alert rules of every account, evaluates them and sends their notifications. Threshold rules
+// are evaluated against the trace store every Interval, match rules are evaluated inline by Ingest. If Lease is set,
+// the rules are shared by several replicas: every Interval the rules are reloaded from Rules and only the replica that
+// holds Lease evaluates the threshold rules
+type Manager struct {
+	TraceStore    storage.TraceStore
+	Rules         RuleStore
+	Notifier      *WebhookNotifier
+	Lease         Lease
+	UUIDGenerator *muuid.MUUIDGenerator
+	Logger        *zap.Logger
+	Interval      time.Duration
+
+	lock     sync.RWMutex
+	accounts map[string]map[string]Rule
+	fired    map[string]time.Time
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Start loads the stored rules and starts the notifier and the periodic evaluation. They stop when ctx is done
+func (manager *Manager) Start(ctx context.Context) error {
+	if manager.Interval <= 0 {
+		manager.Interval = DefaultEvaluationInterval
+	}
+
+	rules, err := manager.Rules.List()
+	if err != nil {
+		return err
+	}
+
+	manager.accounts = make(map[string]map[string]Rule)
+	manager.fired = make(map[string]time.Time)
+
+	for _, rule := range rules {
+		manager.cache(rule)
+	}
+
+	manager.Notifier.Start(ctx)
+
+	go manager.evaluate(ctx)
+
+	return nil
+}
+
+// cache stores rule in the in-memory index. The caller must hold the lock or own the manager
+func (manager *Manager) cache(rule Rule) {
+	if manager.accounts[rule.AccountID] == nil {
+		manager.accounts[rule.AccountID] = make(map[string]Rule)
+	}
+
+	manager.accounts[rule.AccountID][rule.ID] = rule
+}
+
+// lookup returns the rule with id if it belongs to accountID. Rules that other replicas saved since the last reload
+// are read from the store. The caller must hold the lock
+func (manager *Manager) lookup(accountID string, id string) (Rule, error) {
+	if rule, ok := manager.accounts[accountID][id]; ok {
+		return rule, nil
+	}
+
+	if manager.Lease == nil {
+		return Rule{}, ErrRuleNotFound
+	}
+
+	rule, err := manager.Rules.Get(id)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	if rule.AccountID != accountID {
+		return Rule{}, ErrRuleNotFound
+	}
+
+	return rule, nil
+}
+
+// Create stores a new rule for its account
+func (manager *Manager) Create(rule Rule) (Rule, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if len(manager.accounts[rule.AccountID]) >= MaxRulesPerAccount {
+		return Rule{}, ErrTooManyRules
+	}
+
+	now := formatTime(time.Now())
+	rule.ID = manager.UUIDGenerator.UUID().String()
+	rule.Object = "device-trace-alert-rule"
+	rule.Query.Account = rule.AccountID
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	if err := manager.Rules.Save(rule); err != nil {
+		return Rule{}, err
+	}
+
+	manager.cache(rule)
+
+	return rule, nil
+}
+
+// Update replaces the rule with the same ID and account
+func (manager *Manager) Update(rule Rule) (Rule, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	existing, err := manager.lookup(rule.AccountID, rule.ID)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	rule.Object = existing.Object
+	rule.Query.Account = rule.AccountID
+	rule.CreatedAt = existing.CreatedAt
+	rule.UpdatedAt = formatTime(time.Now())
+
+	if err := manager.Rules.Save(rule); err != nil {
+		return Rule{}, err
+	}
+
+	manager.cache(rule)
+
+	return rule, nil
+}
+
+// Get returns the rule with id if it belongs to accountID
+func (manager *Manager) Get(accountID string, id string) (Rule, error) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	return manager.lookup(accountID, id)
+}
+
+// List returns the rules of accountID, oldest first
+func (manager *Manager) List(accountID string) []Rule {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	rules := make([]Rule, 0, len(manager.accounts[accountID]))
+	for _, rule := range manager.accounts[accountID] {
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].CreatedAt == rules[j].CreatedAt {
+			return rules[i].ID < rules[j].ID
+		}
+
+		return rules[i].CreatedAt < rules[j].CreatedAt
+	})
+
+	return rules
+}
+
+// Delete removes the rule with id if it belongs to accountID
+func (manager *Manager) Delete(accountID string, id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if _, err := manager.lookup(accountID, id); err != nil {
+		return err
+	}
+
+	if err := manager.Rules.Delete(id); err != nil {
+		return err
+	}
+
+	delete(manager.accounts[accountID], id)
+
+	return nil
+}
+
+// Test posts a test notification of the rule with id to its webhook and waits for the delivery
+func (manager *Manager) Test(ctx context.Context, accountID string, id string) error {
+	rule, err := manager.Get(accountID, id)
+	if err != nil {
+		return err
+	}
+
+	notification := manager.newNotification(rule, time.Now())
+	notification.Test = true
+
+	_, err = manager.Notifier.Deliver(ctx, rule.Webhook, notification)
+
+	return err
+}
+
+// Ingest evaluates the match rules of accountID against newly stored traces
+func (manager *Manager) Ingest(accountID string, traces []storage.Trace) {
+	manager.lock.RLock()
+	rules := make([]Rule, 0, len(manager.accounts[accountID]))
+	for _, rule := range manager.accounts[accountID] {
+		if rule.Enabled && rule.Kind == RuleKindMatch {
+			rules = append(rules, rule)
+		}
+	}
+	manager.lock.RUnlock()
+
+	if len(rules) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	for _, rule := range rules {
+		// Matches are notified per device, so that one noisy device does not hide the others
+		matches := make(map[string][]storage.Trace)
+		var devices []string
+
+		for _, trace := range traces {
+			if matchTrace(rule.Query, trace) {
+				if matches[trace.DeviceID] == nil {
+					devices = append(devices, trace.DeviceID)
+				}
+				matches[trace.DeviceID] = append(matches[trace.DeviceID], trace)
+			}
+		}
+
+		for _, device := range devices {
+			if !manager.trigger(rule, rule.ID+"/"+device, now) {
+				continue
+			}
+
+			notification := manager.newNotification(rule, now)
+			notification.DeviceID = device
+			notification.Count = uint64(len(matches[device]))
+
+			for i, trace := range matches[device] {
+				if i >= notificationSampleSize {
+					break
+				}
+
+				notification.Traces = append(notification.Traces, storage.NewTraceResponse(trace))
+			}
+
+			manager.Notifier.Notify(rule.Webhook, notification)
+		}
+	}
+}
+
+// trigger reports whether a rule may notify for key at now. It records the notification so that the rule stays
+// quiet for key during its dedup window
+func (manager *Manager) trigger(rule Rule, key string, now time.Time) bool {
+	if rule.silenced(now) {
+		return false
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if last, ok := manager.fired[key]; ok && now.Sub(last) < rule.DedupWindow {
+		return false
+	}
+
+	manager.fired[key] = now
+	metrics.PrometheusAlertsTriggered.Inc()
+
+	return true
+}
+
+func (manager *Manager) newNotification(rule Rule, now time.Time) Notification {
+	return Notification{
+		ID:          manager.UUIDGenerator.UUID().String(),
+		Object:      "device-trace-alert",
+		RuleID:      rule.ID,
+		RuleName:    rule.Name,
+		AccountID:   rule.AccountID,
+		Kind:        rule.Kind,
+		Threshold:   rule.Threshold,
+		Traces:      []storage.TraceResponse{},
+		TriggeredAt: formatTime(now),
+	}
+}
+
+// reload replaces the cached rules with the stored ones, so that the rules that other replicas saved are seen
+func (manager *Manager) reload() {
+	rules, err := manager.Rules.List()
+	if err != nil {
+		manager.Logger.Warn("Could not reload the alert rules", zap.Error(err))
+		return
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.accounts = make(map[string]map[string]Rule)
+
+	for _, rule := range rules {
+		manager.cache(rule)
+	}
+}
+
+// evaluate runs the threshold rules every Interval until ctx is done, then releases the lease
+func (manager *Manager) evaluate(ctx context.Context) {
+	ticker := time.NewTicker(manager.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if manager.Lease != nil {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+				if err := manager.Lease.Release(releaseCtx); err != nil {
+					manager.Logger.Warn("Could not release the alerts lease.", zap.Error(err))
+				}
+				cancel()
+			}
+
+			return
+		case <-ticker.C:
+		}
+
+		if manager.Lease != nil {
+			manager.reload()
+
+			if leader, err := manager.Lease.Acquire(ctx); err != nil || !leader {
+				continue
+			}
+		}
+
+		now := time.Now()
+
+		manager.lock.Lock()
+		var rules []Rule
+		for _, accountRules := range manager.accounts {
+			for _, rule := range accountRules {
+				if rule.Enabled && rule.Kind == RuleKindThreshold && !rule.silenced(now) {
+					rules = append(rules, rule)
+				}
+			}
+		}
+
+		// Forget the notifications that are outside of every dedup window
+		for key, last := range manager.fired {
+			if now.Sub(last) > MaxDedupWindow {
+				delete(manager.fired, key)
+			}
+		}
+		manager.lock.Unlock()
+
+		for _, rule := range rules {
+			if ctx.Err() != nil {
+				return
+			}
+
+			manager.evaluateThreshold(ctx, rule, now)
+		}
+	}
+}
+
+// evaluateThreshold counts the traces of a threshold rule within its window and notifies if the threshold is reached
+func (manager *Manager) evaluateThreshold(parent context.Context, rule Rule, now time.Time) {
+	logger := manager.Logger.With(zap.String("rule_id", rule.ID), zap.String("account_id", rule.AccountID))
+
+	ctx, cancel := context.WithTimeout(parent, storage.CtxTimeout)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, httputil.ContextKeyRequestID, rule.ID)
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, rule.AccountID)
+
+	span := opentracing.StartSpan("Manager.evaluateThreshold")
+	span.SetTag("component", "alerts")
+	span.SetTag("rule_id", rule.ID)
+	defer span.Finish()
+
+	// One query returns both the count and the newest traces as a sample
+	query := rule.Query
+	query.After = now.Add(-rule.Window)
+	query.Before = now
+	query.Limit = notificationSampleSize
+	query.Sort = false
+
+	page, err := manager.TraceStore.SearchDeviceTrace(span, ctx, query, true)
+	if err != nil {
+		logger.Warn("Could not evaluate alert rule", zap.Error(err))
+		return
+	}
+
+	if page.TotalCount < rule.Threshold || !manager.trigger(rule, rule.ID, now) {
+		return
+	}
+
+	notification := manager.newNotification(rule, now)
+	notification.Count = page.TotalCount
+	notification.WindowStart = formatTime(query.After)
+	notification.WindowEnd = formatTime(query.Before)
+	notification.Traces = page.Data
+
+	logger.Info("Alert rule triggered", zap.Uint64("count", page.TotalCount))
+	manager.Notifier.Notify(rule.Webhook, notification)
+}
+
+// matchTrace reports whether trace matches the filters of query. Text filters match if every word of the filter
+// occurs in the field, ignoring case
+func matchTrace(query storage.TraceQuery, trace storage.Trace) bool {
+	if query.Account != "" && query.Account != trace.AccountID {
+		return false
+	}
+
+	if query.Device != nil {
+		found := false
+		for _, device := range query.Device {
+			if device == trace.DeviceID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return matchWords(query.AppName, trace.AppName) && matchWords(query.Type, trace.Type) && matchWords(query.Message, trace.Message)
+}
+
+func matchWords(filter string, value string) bool {
+	if filter == "" {
+		return true
+	}
+
+	words := make(map[string]bool)
+	for _, word := range splitWords(value) {
+		words[word] = true
+	}
+
+	for _, word := range splitWords(filter) {
+		if !words[word] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,224 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	RuleKindThreshold = "threshold"
+	RuleKindMatch     = "match"
+
+	DefaultDedupWindow     = 15 * time.Minute
+	MinRuleWindow          = time.Minute
+	MaxRuleWindow          = 24 * time.Hour
+	MaxRulesPerAccount     = 50
+	MaxRuleNameLength      = 128
+	MinWebhookSecretLength = 16
+)
+
+// Errors that might be returned by a RuleStore or the Manager
+var (
+	ErrRuleNotFound = errors.New("Alert rule not found")
+	ErrTooManyRules = errors.New("Too many alert rules for the account")
+)
+
+// Webhook is the endpoint that the notifications of a rule are posted to. Secret signs the notifications
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// Rule is an alert rule of an account. Threshold rules fire when at least Threshold traces match Query within
+// Window. Match rules fire for every ingested trace that matches Query
+type Rule struct {
+	ID            string             `json:"id"`
+	Object        string             `json:"object"`
+	AccountID     string             `json:"account_id"`
+	Name          string             `json:"name"`
+	Kind          string             `json:"kind"`
+	Enabled       bool               `json:"enabled"`
+	Query         storage.TraceQuery `json:"query"`
+	Filters       map[string]string  `json:"filters"`
+	Threshold     uint64             `json:"threshold,omitempty"`
+	Window        time.Duration      `json:"window,omitempty"`
+	DedupWindow   time.Duration      `json:"dedup_window"`
+	SilencedUntil time.Time          `json:"silenced_until"`
+	Webhook       Webhook            `json:"webhook"`
+	CreatedAt     string             `json:"created_at"`
+	UpdatedAt     string             `json:"updated_at"`
+}
+
+// silenced reports whether the rule must not notify at now
+func (rule Rule) silenced(now time.Time) bool {
+	return now.Before(rule.SilencedUntil)
+}
+
+// RuleStore persists alert rules
+type RuleStore interface {
+	Save(rule Rule) error
+	Get(id string) (Rule, error)
+	List() ([]Rule, error)
+	Delete(id string) error
+}
+
+// FileRuleStore implements RuleStore with one JSON file per rule in a local directory
+type FileRuleStore struct {
+	Dir string
+}
+
+// NewFileRuleStore returns a FileRuleStore on dir, creating dir if needed
+func NewFileRuleStore(dir string) (*FileRuleStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileRuleStore{Dir: dir}, nil
+}
+
+func (ruleStore *FileRuleStore) path(id string) string {
+	return filepath.Join(ruleStore.Dir, filepath.Base(id)+".json")
+}
+
+// Save writes the rule, replacing the file atomically
+func (ruleStore *FileRuleStore) Save(rule Rule) error {
+	encoded, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	tmp := ruleStore.path(rule.ID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ruleStore.path(rule.ID))
+}
+
+// Get reads the rule with id
+func (ruleStore *FileRuleStore) Get(id string) (Rule, error) {
+	var rule Rule
+
+	encoded, err := ioutil.ReadFile(ruleStore.path(id))
+	if os.IsNotExist(err) {
+		return Rule{}, ErrRuleNotFound
+	} else if err != nil {
+		return Rule{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &rule); err != nil {
+		return Rule{}, err
+	}
+
+	return rule, nil
+}
+
+// List reads every stored rule
+func (ruleStore *FileRuleStore) List() ([]Rule, error) {
+	files, err := ioutil.ReadDir(ruleStore.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]Rule, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		rule, err := ruleStore.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Delete removes the rule with id. Deleting a missing rule is not an error
+func (ruleStore *FileRuleStore) Delete(id string) error {
+	err := os.Remove(ruleStore.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// ESRuleStore implements RuleStore on an elastic search document index, so that every replica sees the same rules
+type ESRuleStore struct {
+	Documents *storage.ESDocumentStore
+}
+
+// Save stores the rule, replacing an existing one with the same ID
+func (ruleStore *ESRuleStore) Save(rule Rule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	return ruleStore.Documents.Save(ctx, rule.ID, rule)
+}
+
+// Get reads the rule with id
+func (ruleStore *ESRuleStore) Get(id string) (Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	var rule Rule
+
+	if err := ruleStore.Documents.Get(ctx, id, &rule); err == storage.ErrDocumentNotFound {
+		return Rule{}, ErrRuleNotFound
+	} else if err != nil {
+		return Rule{}, err
+	}
+
+	return rule, nil
+}
+
+// List reads every stored rule
+func (ruleStore *ESRuleStore) List() ([]Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	documents, err := ruleStore.Documents.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]Rule, 0, len(documents))
+
+	for _, document := range documents {
+		var rule Rule
+
+		if err := json.Unmarshal(document, &rule); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Delete removes the rule with id. Deleting a missing rule is not an error
+func (ruleStore *ESRuleStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	if err := ruleStore.Documents.Delete(ctx, id); err != nil && err != storage.ErrDocumentNotFound {
+		return err
+	}
+
+	return nil
+}
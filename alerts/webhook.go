@@ -0,0 +1,372 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SignatureHeader = "X-Trace-Signature"
+	DeliveryHeader  = "X-Trace-Delivery"
+
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookAttempts    = 5
+	DefaultWebhookBackoff     = time.Second
+	DefaultMaxWebhookBackoff  = time.Minute
+	DefaultSignatureTolerance = 5 * time.Minute
+	webhookQueueSize          = 1000
+	webhookWorkers            = 2
+)
+
+// Errors that might be returned when delivering or receiving notifications
+var (
+	ErrDeliveryFailed   = errors.New("The webhook did not accept the notification")
+	ErrInvalidSignature = errors.New("Invalid webhook signature")
+	ErrWebhookURL       = errors.New("An absolute https URL is required")
+	ErrWebhookAddress   = errors.New("The webhook host is not a public address")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which is not public either
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddress reports whether a webhook may be posted to ip. Loopback, link-local, private, shared, unspecified
+// and multicast addresses reach the network of the service rather than the account, so they are refused
+func publicAddress(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsPrivate() &&
+		!ip.IsUnspecified() && !ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// parseWebhookURL parses an absolute https URL and rejects literal hosts that are not public addresses
+func parseWebhookURL(rawURL string) (*url.URL, error) {
+	webhookURL, err := url.Parse(rawURL)
+	if err != nil || webhookURL.Scheme != "https" || webhookURL.Hostname() == "" {
+		return nil, ErrWebhookURL
+	}
+
+	if ip := net.ParseIP(webhookURL.Hostname()); ip != nil && !publicAddress(ip) {
+		return nil, ErrWebhookAddress
+	}
+
+	return webhookURL, nil
+}
+
+// ValidateWebhookURL checks that rawURL is an absolute https URL whose host is a public address, or a name that
+// resolves to public addresses only. Names that do not resolve yet are accepted, the client of NewWebhookClient
+// checks the address again when it connects
+func ValidateWebhookURL(ctx context.Context, rawURL string) error {
+	webhookURL, err := parseWebhookURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if net.ParseIP(webhookURL.Hostname()) != nil {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, webhookURL.Hostname())
+	if err != nil {
+		return nil
+	}
+
+	for _, address := range addresses {
+		if !publicAddress(address.IP) {
+			return ErrWebhookAddress
+		}
+	}
+
+	return nil
+}
+
+// NewWebhookClient returns a client that only connects to public addresses. The address is checked after the name
+// is resolved, so that a name cannot be pointed at an internal address after the rule was saved. The client does
+// not use a proxy and does not follow redirects
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !publicAddress(net.ParseIP(host)) {
+				return ErrWebhookAddress
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Notification is the body posted to the webhook of a rule when it fires
+type Notification struct {
+	ID          string                  `json:"id"`
+	Object      string                  `json:"object"`
+	RuleID      string                  `json:"rule_id"`
+	RuleName    string                  `json:"rule_name"`
+	AccountID   string                  `json:"account_id"`
+	Kind        string                  `json:"kind"`
+	DeviceID    string                  `json:"device_id,omitempty"`
+	Count       uint64                  `json:"count"`
+	Threshold   uint64                  `json:"threshold,omitempty"`
+	WindowStart string                  `json:"window_start,omitempty"`
+	WindowEnd   string                  `json:"window_end,omitempty"`
+	Traces      []storage.TraceResponse `json:"traces"`
+	TriggeredAt string                  `json:"triggered_at"`
+	Test        bool                    `json:"test,omitempty"`
+}
+
+// Sign returns the signature header value of body. The signature is the hex encoded HMAC-SHA256 of
+// "<timestamp>.<body>" with the webhook secret
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	return fmt.Sprintf("t=%s,v1=%s", unix, signature(secret, unix, body))
+}
+
+func signature(secret string, unix string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature header of a received notification. Signatures older than tolerance are
+// rejected to prevent replays
+func VerifySignature(secret string, header string, body []byte, tolerance time.Duration) error {
+	var unix, expected string
+
+	for _, part := range strings.Split(header, ",") {
+		if strings.HasPrefix(part, "t=") {
+			unix = strings.TrimPrefix(part, "t=")
+		} else if strings.HasPrefix(part, "v1=") {
+			expected = strings.TrimPrefix(part, "v1=")
+		}
+	}
+
+	timestamp, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || expected == "" {
+		return ErrInvalidSignature
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(signature(secret, unix, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// delivery is a notification waiting to be posted
+type delivery struct {
+	Webhook      Webhook
+	Notification Notification
+}
+
+// WebhookNotifier posts notifications to webhooks in the background and retries failed deliveries with
+// exponential backoff
+type WebhookNotifier struct {
+	Client         *http.Client
+	Logger         *zap.Logger
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	queue chan delivery
+}
+
+// Start starts the delivery workers. They stop when ctx is done
+func (notifier *WebhookNotifier) Start(ctx context.Context) {
+	if notifier.Client == nil {
+		notifier.Client = NewWebhookClient(DefaultWebhookTimeout)
+	}
+
+	if notifier.MaxAttempts <= 0 {
+		notifier.MaxAttempts = DefaultWebhookAttempts
+	}
+
+	if notifier.InitialBackoff <= 0 {
+		notifier.InitialBackoff = DefaultWebhookBackoff
+	}
+
+	if notifier.MaxBackoff <= 0 {
+		notifier.MaxBackoff = DefaultMaxWebhookBackoff
+	}
+
+	notifier.queue = make(chan delivery, webhookQueueSize)
+
+	for i := 0; i < webhookWorkers; i++ {
+		go notifier.work(ctx)
+	}
+}
+
+// Notify queues a notification. It is dropped if the queue is full
+func (notifier *WebhookNotifier) Notify(webhook Webhook, notification Notification) {
+	select {
+	case notifier.queue <- delivery{Webhook: webhook, Notification: notification}:
+	default:
+		metrics.PrometheusAlertNotificationsFailed.Inc()
+		notifier.Logger.Error("Dropping alert notification, the queue is full", zap.String("rule_id", notification.RuleID), zap.String("notification_id", notification.ID))
+	}
+}
+
+func (notifier *WebhookNotifier) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case queued := <-notifier.queue:
+			logger := notifier.Logger.With(zap.String("rule_id", queued.Notification.RuleID), zap.String("account_id", queued.Notification.AccountID), zap.String("notification_id", queued.Notification.ID))
+
+			if _, err := notifier.Deliver(ctx, queued.Webhook, queued.Notification); err != nil {
+				metrics.PrometheusAlertNotificationsFailed.Inc()
+				logger.Warn("Could not deliver alert notification", zap.Error(err))
+			} else {
+				metrics.PrometheusAlertNotificationsSent.Inc()
+				logger.Debug("Delivered alert notification")
+			}
+		}
+	}
+}
+
+// Deliver posts a notification and retries until the webhook accepts it, the attempts are exhausted or ctx is
+// done. Client errors other than 429 are not retried. It returns the status code of the last response
+func (notifier *WebhookNotifier) Deliver(ctx context.Context, webhook Webhook, notification Notification) (int, error) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return 0, err
+	}
+
+	backoff := notifier.InitialBackoff
+	statusCode := 0
+
+	for attempt := 1; ; attempt++ {
+		var retry bool
+
+		statusCode, retry, err = notifier.post(ctx, webhook, notification.ID, body)
+		if err == nil || !retry || attempt >= notifier.MaxAttempts {
+			return statusCode, err
+		}
+
+		notifier.Logger.Debug("Retrying alert notification", zap.String("notification_id", notification.ID), zap.Int("attempt", attempt), zap.Error(err))
+
+		// Wait with +/- 20% jitter so that retries of many notifications spread out
+		wait := backoff + time.Duration((rand.Float64()*0.4-0.2)*float64(backoff))
+
+		select {
+		case <-ctx.Done():
+			return statusCode, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > notifier.MaxBackoff {
+			backoff = notifier.MaxBackoff
+		}
+	}
+}
+
+// post makes one delivery attempt. It reports whether a failed attempt may be retried
+func (notifier *WebhookNotifier) post(ctx context.Context, webhook Webhook, id string, body []byte) (int, bool, error) {
+	webhookURL, err := parseWebhookURL(webhook.URL)
+	if err != nil {
+		return 0, false, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, webhookURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "edge-gw-trace-service")
+	request.Header.Set(DeliveryHeader, id)
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, time.Now(), body))
+
+	response, err := notifier.Client.Do(request)
+	if err != nil {
+		return 0, ctx.Err() == nil && !errors.Is(err, ErrWebhookAddress), err
+	}
+	defer response.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response.StatusCode, false, nil
+	}
+
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+
+	return response.StatusCode, retry, fmt.Errorf("%s: %s", ErrDeliveryFailed.Error(), response.Status)
+}
+
+// ReceiverHandler returns a handler that verifies the signature of posted notifications and passes them to
+// handle. It can serve as a local webhook receiver for testing rules
+func ReceiverHandler(secret string, handle func(Notification)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 10*1024*1024))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := VerifySignature(secret, r.Header.Get(SignatureHeader), body, DefaultSignatureTolerance); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var notification Notification
+		if err := json.Unmarshal(body, &notification); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		handle(notification)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,376 @@
+package anomalies
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/muuid-go"
+)
+
+const (
+	DirectionSpike = "spike"
+	DirectionDrop  = "drop"
+
+	StatusActive   = "active"
+	StatusResolved = "resolved"
+
+	DefaultBucketSize      = time.Minute
+	DefaultBaselineWindow  = time.Hour
+	MinBaselineBuckets     = 30
+	MinSpikeCount          = 20
+	MinDropBaseline        = 5
+	MaxAnomaliesPerAccount = 1000
+	DefaultAnomalyLimit    = 50
+	MaxAnomalyLimit        = 1000
+	DefaultMaxSeries       = 10000
+	seriesIdleExpiration   = 24 * time.Hour
+)
+
+// Anomaly is a spike or drop of the log rate of one device, type and app_name. It stays active while the rate is
+// outside of the baseline
+type Anomaly struct {
+	ID        string  `json:"id"`
+	Object    string  `json:"object"`
+	AccountID string  `json:"account_id"`
+	DeviceID  string  `json:"device_id"`
+	Type      string  `json:"type"`
+	AppName   string  `json:"app_name"`
+	Direction string  `json:"direction"`
+	Status    string  `json:"status"`
+	Count     uint64  `json:"count"`
+	Expected  float64 `json:"expected"`
+	Score     float64 `json:"score"`
+	StartedAt string  `json:"started_at"`
+	UpdatedAt string  `json:"updated_at"`
+	EndedAt   string  `json:"ended_at,omitempty"`
+}
+
+// Query selects the anomalies of an account. Empty fields match every anomaly, except an empty non-nil Devices which
+// matches none
+type Query struct {
+	AccountID string
+	Devices   []string
+	Status    string
+	Direction string
+	After     string
+	Limit     int
+}
+
+type seriesKey struct {
+	AccountID string
+	DeviceID  string
+	Type      string
+	AppName   string
+}
+
+// series is the rolling baseline of the log rate of one key. The mean and variance are exponentially weighted
+// over the baseline window
+type series struct {
+	current  uint64
+	mean     float64
+	variance float64
+	buckets  int
+	idle     int
+	active   *Anomaly
+}
+
+// activeKey is the label set of the gauge of the active anomalies
+type activeKey struct {
+	AccountID string
+	Direction string
+}
+
+// Detector counts the ingested traces per device, type and app_name in fixed buckets and flags the buckets that
+// deviate from the rolling baseline by more than the sensitivity of the account allows. An account has at most
+// MaxSeries series, the traces of further series are not counted until idle series expire
+type Detector struct {
+	Settings       SettingsStore
+	UUIDGenerator  *muuid.MUUIDGenerator
+	Logger         *zap.Logger
+	BucketSize     time.Duration
+	BaselineWindow time.Duration
+	MaxSeries      int
+
+	lock          sync.Mutex
+	series        map[seriesKey]*series
+	accountSeries map[string]int
+	active        map[activeKey]int
+	anomalies     map[string][]*Anomaly
+	sensitivity   map[string]string
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Start loads the stored settings and starts closing buckets every BucketSize until ctx is done
+func (detector *Detector) Start(ctx context.Context) error {
+	if detector.BucketSize <= 0 {
+		detector.BucketSize = DefaultBucketSize
+	}
+
+	if detector.BaselineWindow < detector.BucketSize {
+		detector.BaselineWindow = DefaultBaselineWindow
+	}
+
+	if detector.MaxSeries <= 0 {
+		detector.MaxSeries = DefaultMaxSeries
+	}
+
+	list, err := detector.Settings.List()
+	if err != nil {
+		return err
+	}
+
+	detector.series = make(map[seriesKey]*series)
+	detector.accountSeries = make(map[string]int)
+	detector.active = make(map[activeKey]int)
+	detector.anomalies = make(map[string][]*Anomaly)
+	detector.sensitivity = make(map[string]string)
+
+	for _, settings := range list {
+		detector.sensitivity[settings.AccountID] = settings.Sensitivity
+	}
+
+	go func() {
+		ticker := time.NewTicker(detector.BucketSize)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				detector.roll(now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Observe counts newly stored traces of accountID into the current bucket
+func (detector *Detector) Observe(accountID string, traces []storage.Trace) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+
+	for _, trace := range traces {
+		key := seriesKey{AccountID: accountID, DeviceID: trace.DeviceID, Type: trace.Type, AppName: trace.AppName}
+
+		s, ok := detector.series[key]
+		if !ok {
+			if detector.accountSeries[accountID] >= detector.MaxSeries {
+				metrics.PrometheusDroppedLogRateSeries.Inc()
+				continue
+			}
+
+			s = &series{}
+			detector.series[key] = s
+			detector.accountSeries[accountID]++
+		}
+
+		s.current++
+	}
+}
+
+// GetSettings returns the settings of accountID, or the defaults if the account has none
+func (detector *Detector) GetSettings(accountID string) Settings {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+
+	settings, err := detector.Settings.Get(accountID)
+	if err != nil {
+		return Settings{AccountID: accountID, Object: "device-trace-anomaly-settings", Sensitivity: DefaultSensitivity}
+	}
+
+	return settings
+}
+
+// SaveSettings stores the settings of an account. They apply from the next bucket on
+func (detector *Detector) SaveSettings(settings Settings) (Settings, error) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+
+	settings.Object = "device-trace-anomaly-settings"
+	settings.UpdatedAt = formatTime(time.Now())
+
+	if err := detector.Settings.Save(settings); err != nil {
+		return Settings{}, err
+	}
+
+	detector.sensitivity[settings.AccountID] = settings.Sensitivity
+
+	return settings, nil
+}
+
+// List returns the anomalies matching query, newest first, and whether there are more
+func (detector *Detector) List(query Query) ([]Anomaly, bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+
+	devices := make(map[string]bool, len(query.Devices))
+	for _, device := range query.Devices {
+		devices[device] = true
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = DefaultAnomalyLimit
+	}
+
+	result := []Anomaly{}
+	accountAnomalies := detector.anomalies[query.AccountID]
+
+	for i := len(accountAnomalies) - 1; i >= 0; i-- {
+		anomaly := accountAnomalies[i]
+
+		if query.After != "" && anomaly.ID >= query.After {
+			continue
+		}
+
+		if (query.Devices != nil && !devices[anomaly.DeviceID]) || (query.Status != "" && query.Status != anomaly.Status) || (query.Direction != "" && query.Direction != anomaly.Direction) {
+			continue
+		}
+
+		if len(result) == query.Limit {
+			return result, true
+		}
+
+		result = append(result, *anomaly)
+	}
+
+	return result, false
+}
+
+// roll closes the current bucket of every series at now, flags or resolves their anomalies and updates their
+// baselines
+func (detector *Detector) roll(now time.Time) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+
+	// Weight the buckets so that the baseline follows the rate of roughly the last BaselineWindow
+	alpha := 2 / (float64(detector.BaselineWindow/detector.BucketSize) + 1)
+	idleBuckets := int(seriesIdleExpiration / detector.BucketSize)
+
+	for key, s := range detector.series {
+		count := float64(s.current)
+		s.current = 0
+
+		sensitivity, ok := detector.sensitivity[key.AccountID]
+		if !ok {
+			sensitivity = DefaultSensitivity
+		}
+
+		if s.buckets >= MinBaselineBuckets && sensitivity != SensitivityOff {
+			// Counts are roughly Poisson distributed, so the deviation is at least the square root of the mean
+			deviation := math.Max(math.Sqrt(s.variance), math.Max(math.Sqrt(s.mean), 1))
+			score := (count - s.mean) / deviation
+			threshold := sensitivityScores[sensitivity]
+
+			direction := ""
+			if score >= threshold && count >= MinSpikeCount {
+				direction = DirectionSpike
+			} else if score <= -threshold && s.mean >= MinDropBaseline {
+				direction = DirectionDrop
+			}
+
+			detector.update(key, s, direction, uint64(count), score, now)
+		} else if s.active != nil {
+			detector.resolve(key, s, now)
+		}
+
+		if s.buckets == 0 {
+			s.mean = count
+		} else {
+			diff := count - s.mean
+			increment := alpha * diff
+			s.mean += increment
+			s.variance = (1 - alpha) * (s.variance + diff*increment)
+		}
+
+		s.buckets++
+
+		if count == 0 {
+			s.idle++
+		} else {
+			s.idle = 0
+		}
+
+		if s.idle >= idleBuckets && s.active == nil {
+			delete(detector.series, key)
+
+			if detector.accountSeries[key.AccountID]--; detector.accountSeries[key.AccountID] <= 0 {
+				delete(detector.accountSeries, key.AccountID)
+			}
+		}
+	}
+}
+
+// update opens, extends or resolves the anomaly of a series after a bucket closed in direction. The caller must
+// hold the lock
+func (detector *Detector) update(key seriesKey, s *series, direction string, count uint64, score float64, now time.Time) {
+	if s.active != nil && s.active.Direction != direction {
+		detector.resolve(key, s, now)
+	}
+
+	if direction == "" {
+		return
+	}
+
+	if s.active == nil {
+		s.active = &Anomaly{
+			ID:        detector.UUIDGenerator.UUID().String(),
+			Object:    "device-trace-anomaly",
+			AccountID: key.AccountID,
+			DeviceID:  key.DeviceID,
+			Type:      key.Type,
+			AppName:   key.AppName,
+			Direction: direction,
+			Status:    StatusActive,
+			StartedAt: formatTime(now),
+		}
+
+		anomalies := append(detector.anomalies[key.AccountID], s.active)
+		if len(anomalies) > MaxAnomaliesPerAccount {
+			anomalies = anomalies[len(anomalies)-MaxAnomaliesPerAccount:]
+		}
+		detector.anomalies[key.AccountID] = anomalies
+
+		metrics.PrometheusLogRateAnomalies.WithLabelValues(direction).Inc()
+
+		active := activeKey{AccountID: key.AccountID, Direction: direction}
+		detector.active[active]++
+		metrics.PrometheusActiveLogRateAnomalies.WithLabelValues(active.AccountID, active.Direction).Set(float64(detector.active[active]))
+
+		detector.Logger.Info("Log rate anomaly detected", zap.String("account_id", key.AccountID), zap.String("device_id", key.DeviceID), zap.String("type", key.Type), zap.String("app_name", key.AppName), zap.String("direction", direction), zap.Uint64("count", count), zap.Float64("expected", s.mean))
+	}
+
+	s.active.Count = count
+	s.active.Expected = math.Round(s.mean*100) / 100
+	s.active.Score = math.Round(score*100) / 100
+	s.active.UpdatedAt = formatTime(now)
+}
+
+// resolve ends the active anomaly of a series. The caller must hold the lock
+func (detector *Detector) resolve(key seriesKey, s *series, now time.Time) {
+	s.active.Status = StatusResolved
+	s.active.EndedAt = formatTime(now)
+
+	// Delete the series of the gauge once the account has no active anomaly in the direction, so that its label
+	// values do not stay around
+	active := activeKey{AccountID: key.AccountID, Direction: s.active.Direction}
+	if detector.active[active]--; detector.active[active] <= 0 {
+		delete(detector.active, active)
+		metrics.PrometheusActiveLogRateAnomalies.DeleteLabelValues(active.AccountID, active.Direction)
+	} else {
+		metrics.PrometheusActiveLogRateAnomalies.WithLabelValues(active.AccountID, active.Direction).Set(float64(detector.active[active]))
+	}
+
+	s.active = nil
+}
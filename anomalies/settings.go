@@ -0,0 +1,131 @@
+package anomalies
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SensitivityOff    = "off"
+	SensitivityLow    = "low"
+	SensitivityMedium = "medium"
+	SensitivityHigh   = "high"
+
+	DefaultSensitivity = SensitivityMedium
+)
+
+// Errors that might be returned by a SettingsStore
+var (
+	ErrSettingsNotFound = errors.New("Anomaly settings not found")
+)
+
+// sensitivityScores maps each sensitivity to the number of standard deviations from the baseline that a bucket
+// has to reach to be flagged
+var sensitivityScores = map[string]float64{
+	SensitivityLow:    6,
+	SensitivityMedium: 4,
+	SensitivityHigh:   3,
+}
+
+// IsSensitivity reports whether value is a valid sensitivity
+func IsSensitivity(value string) bool {
+	_, ok := sensitivityScores[value]
+
+	return ok || value == SensitivityOff
+}
+
+// Settings are the anomaly detection settings of an account
+type Settings struct {
+	AccountID   string `json:"account_id"`
+	Object      string `json:"object"`
+	Sensitivity string `json:"sensitivity"`
+	UpdatedAt   string `json:"updated_at,omitempty"`
+}
+
+// SettingsStore persists the anomaly detection settings of the accounts
+type SettingsStore interface {
+	Save(settings Settings) error
+	Get(accountID string) (Settings, error)
+	List() ([]Settings, error)
+}
+
+// FileSettingsStore implements SettingsStore with one JSON file per account in a local directory
+type FileSettingsStore struct {
+	Dir string
+}
+
+// NewFileSettingsStore returns a FileSettingsStore on dir, creating dir if needed
+func NewFileSettingsStore(dir string) (*FileSettingsStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileSettingsStore{Dir: dir}, nil
+}
+
+func (settingsStore *FileSettingsStore) path(accountID string) string {
+	return filepath.Join(settingsStore.Dir, filepath.Base(accountID)+".json")
+}
+
+// Save writes the settings of an account, replacing the file atomically
+func (settingsStore *FileSettingsStore) Save(settings Settings) error {
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	tmp := settingsStore.path(settings.AccountID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, settingsStore.path(settings.AccountID))
+}
+
+// Get reads the settings of accountID
+func (settingsStore *FileSettingsStore) Get(accountID string) (Settings, error) {
+	var settings Settings
+
+	encoded, err := ioutil.ReadFile(settingsStore.path(accountID))
+	if os.IsNotExist(err) {
+		return Settings{}, ErrSettingsNotFound
+	} else if err != nil {
+		return Settings{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &settings); err != nil {
+		return Settings{}, err
+	}
+
+	return settings, nil
+}
+
+// List reads the settings of every account
+func (settingsStore *FileSettingsStore) List() ([]Settings, error) {
+	files, err := ioutil.ReadDir(settingsStore.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Settings, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		settings, err := settingsStore.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, settings)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/deletions"
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultArchiveInterval = time.Hour
+	DefaultArchiveDays     = 30
+
+	// ArchiveRequestID is the request id of the deletions of archived traces
+	ArchiveRequestID = "archive"
+
+	// LeaseName is the name of the lease that the replica which archives the traces holds
+	LeaseName = "archive"
+
+	// settleTime is how long a trace is in the trace store before it is archived. Traces that were received later
+	// may not be searchable yet, they are left for the next run so that no trace is deleted unarchived
+	settleTime = time.Minute
+
+	runLayout = "20060102T150405Z"
+)
+
+// Lease is held by at most one replica at a time
+type Lease interface {
+	Acquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// Archiver moves the traces older than Days to Blobs. Every Interval it writes the traces of every device and day
+// before the threshold to an archive file, then deletes them from the trace store through Deletions, so that archived
+// traces are part of the audit trail. Traces that arrive for an archived day later are archived by a later run, in
+// another archive file of the day. Only the replica that holds Lease archives
+type Archiver struct {
+	Traces    storage.TraceArchiveStore
+	Deletions *deletions.Manager
+	Blobs     BlobStore
+	Lease     Lease
+	Logger    *zap.Logger
+	Interval  time.Duration
+	Days      int
+}
+
+// storeContext returns a context with the request id and the account id that the stores log
+func storeContext(ctx context.Context, requestID string, accountID string) context.Context {
+	ctx = context.WithValue(ctx, httputil.ContextKeyRequestID, requestID)
+
+	return context.WithValue(ctx, httputil.ContextKeyAccountID, accountID)
+}
+
+// Start archives the traces every Interval until ctx is done, then releases the lease
+func (archiver *Archiver) Start(ctx context.Context) {
+	if archiver.Interval <= 0 {
+		archiver.Interval = DefaultArchiveInterval
+	}
+
+	if archiver.Days <= 0 {
+		archiver.Days = DefaultArchiveDays
+	}
+
+	go func() {
+		ticker := time.NewTicker(archiver.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				releaseCtx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+				if err := archiver.Lease.Release(releaseCtx); err != nil {
+					archiver.Logger.Warn("Could not release the archive lease.", zap.Error(err))
+				}
+				cancel()
+
+				return
+			case <-ticker.C:
+				archiver.archive(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+// archive archives the days before the threshold at now, oldest first. The lease is renewed before every day
+func (archiver *Archiver) archive(ctx context.Context, now time.Time) {
+	span := opentracing.StartSpan("archive.Archiver.archive()")
+	defer span.Finish()
+
+	threshold := Day(now).AddDate(0, 0, -archiver.Days)
+	run := now.UTC().Format(runLayout)
+
+	oldest, found, err := archiver.Traces.OldestDeviceTrace(span, storeContext(ctx, ArchiveRequestID, ""), threshold.Add(-time.Millisecond))
+	if err != nil {
+		archiver.Logger.Warn("Could not find the oldest trace.", zap.Error(err))
+		return
+	}
+
+	if !found {
+		return
+	}
+
+	for day := Day(oldest); day.Before(threshold); day = day.AddDate(0, 0, 1) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if leader, err := archiver.Lease.Acquire(ctx); err != nil || !leader {
+			return
+		}
+
+		archiver.archiveDay(span, ctx, day, run)
+	}
+}
+
+// archiveDay archives the traces of every device on day
+func (archiver *Archiver) archiveDay(span opentracing.Span, ctx context.Context, day time.Time, run string) {
+	query := storage.TraceQuery{
+		After:         day,
+		Before:        day.AddDate(0, 0, 1).Add(-time.Millisecond),
+		CreatedBefore: time.Now().Add(-settleTime),
+		Sort:          true,
+	}
+
+	counts, err := archiver.Traces.CountDeviceTrace(span, storeContext(ctx, ArchiveRequestID, ""), query)
+	if err != nil {
+		archiver.Logger.Warn("Could not count the traces of the devices.", zap.String("day", day.Format(dayLayout)), zap.Error(err))
+		return
+	}
+
+	for _, count := range counts {
+		if ctx.Err() != nil {
+			return
+		}
+
+		deviceQuery := query
+		deviceQuery.Account = count.AccountID
+		deviceQuery.Device = []string{count.DeviceID}
+
+		key := ArchiveKey(count.AccountID, count.DeviceID, day, run)
+		logger := archiver.Logger.With(zap.String("account_id", count.AccountID), zap.String("device_id", count.DeviceID), zap.String("key", key))
+
+		index, err := archiver.archiveDevice(span, storeContext(ctx, ArchiveRequestID, count.AccountID), deviceQuery, key, day)
+		if err != nil {
+			metrics.PrometheusArchiveFiles.WithLabelValues("failed").Inc()
+			logger.Warn("Could not archive the traces of the device.", zap.Error(err))
+			continue
+		}
+
+		metrics.PrometheusArchiveFiles.WithLabelValues("archived").Inc()
+		metrics.PrometheusArchivedTraces.Add(float64(index.Count))
+		logger.Info("Archived the traces of the device.", zap.Int64("count", index.Count), zap.Int64("size", index.Size))
+	}
+}
+
+// archiveDevice writes the traces matching query to the archive file at key and its index, then deletes them
+func (archiver *Archiver) archiveDevice(span opentracing.Span, ctx context.Context, query storage.TraceQuery, key string, day time.Time) (Index, error) {
+	index, err := archiver.write(span, ctx, query, Index{
+		Key:       key,
+		AccountID: query.Account,
+		DeviceID:  query.Device[0],
+		Day:       day.Format(dayLayout),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err != nil || index.Count == 0 {
+		archiver.Blobs.Delete(key)
+		return index, err
+	}
+
+	encoded, err := json.Marshal(index)
+	if err != nil {
+		return Index{}, err
+	}
+
+	if err := archiver.Blobs.Put(IndexKey(key), bytes.NewReader(encoded)); err != nil {
+		archiver.Blobs.Delete(key)
+		return Index{}, err
+	}
+
+	filters := map[string]string{
+		"device_id__in":  query.Device[0],
+		"timestamp__gte": query.After.UTC().Format(time.RFC3339),
+		"timestamp__lte": query.Before.UTC().Format(time.RFC3339Nano),
+		"archive":        key,
+	}
+
+	// The archive file stays when the deletion fails, the next run archives the traces again in another file
+	deletion, err := archiver.Deletions.Delete(span, ctx, query.Account, ArchiveRequestID, query, filters)
+	if err != nil {
+		return index, err
+	}
+
+	if deletion.DeletedCount != index.Count {
+		archiver.Logger.Warn("Deleted another number of traces than were archived.", zap.String("key", key), zap.Int64("archived_count", index.Count), zap.Int64("deleted_count", deletion.DeletedCount))
+	}
+
+	return index, nil
+}
+
+// write streams the traces matching query to the blob at index.Key
+func (archiver *Archiver) write(span opentracing.Span, ctx context.Context, query storage.TraceQuery, index Index) (Index, error) {
+	reader, writer := io.Pipe()
+	written := make(chan error, 1)
+
+	go func() {
+		written <- archiver.Blobs.Put(index.Key, reader)
+
+		// Unblock the scan if the blob store stopped reading early
+		reader.Close()
+	}()
+
+	archiveWriter := NewWriter(writer, index)
+
+	err := archiver.Traces.ScanTraces(span, ctx, query, archiveWriter.Write)
+	if err == nil {
+		index, err = archiveWriter.Close()
+	}
+
+	writer.CloseWithError(err)
+
+	if putErr := <-written; err == nil {
+		err = putErr
+	}
+
+	return index, err
+}
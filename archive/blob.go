@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Errors that might be returned by a BlobStore
+var (
+	ErrBlobNotFound   = errors.New("Archive file not found")
+	ErrInvalidBlobKey = errors.New("Invalid archive file key")
+)
+
+// BlobStore stores the archive files under keys of slash separated segments. Archive files are written once and
+// read in ranges, which object stores support as well as a filesystem
+type BlobStore interface {
+	// Put stores the content of r under key. The blob is visible under key only once it is complete
+	Put(key string, r io.Reader) error
+	// Get reads the whole blob
+	Get(key string) (io.ReadCloser, error)
+	// GetRange reads length bytes of the blob from offset
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// List returns the keys that start with prefix, sorted
+	List(prefix string) ([]string, error)
+	// Delete removes the blob. Deleting a missing blob is not an error
+	Delete(key string) error
+}
+
+// FileBlobStore implements BlobStore on a local directory, with one file per blob
+type FileBlobStore struct {
+	Dir string
+}
+
+// NewFileBlobStore returns a FileBlobStore on dir, creating dir if needed
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+// validKey reports whether every segment of key is a name, so that keys map to paths under a root
+func validKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsRune(segment, filepath.Separator) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// path returns the file of key. Keys cannot leave Dir
+func (blobStore *FileBlobStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidBlobKey
+	}
+
+	return filepath.Join(blobStore.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file that is synced and renamed to the file of key
+func (blobStore *FileBlobStore) Put(key string, r io.Reader) error {
+	path, err := blobStore.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(file.Name(), 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Get opens the file of key
+func (blobStore *FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := blobStore.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return file, err
+}
+
+// fileRange reads a range of an open file
+type fileRange struct {
+	io.Reader
+	io.Closer
+}
+
+// GetRange opens the file of key at offset
+func (blobStore *FileBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	path, err := blobStore.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return fileRange{Reader: io.NewSectionReader(file, offset, length), Closer: file}, nil
+}
+
+// List walks the directory of prefix for the files whose key starts with prefix
+func (blobStore *FileBlobStore) List(prefix string) ([]string, error) {
+	root := blobStore.Dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, err := blobStore.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+
+		root = dir
+	}
+
+	keys := make([]string, 0)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Temporary files of unfinished writes are not blobs
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(blobStore.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(relative); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Delete removes the file of key
+func (blobStore *FileBlobStore) Delete(key string) error {
+	path, err := blobStore.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
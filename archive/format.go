@@ -0,0 +1,219 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	// FormatVersion is the version of the archive format that this service writes
+	FormatVersion = 1
+
+	// BlockSize is the number of traces in a block of an archive file
+	BlockSize = 1000
+
+	// ArchiveExtension is the extension of the archive files, IndexExtension that of their indices
+	ArchiveExtension = ".ndjson.gz"
+	IndexExtension   = ".index.json"
+
+	dayLayout = "2006-01-02"
+)
+
+// Block is a gzip member of an archive file. Every block can be decompressed on its own, so that a time range of an
+// archive file is read without reading the blocks before it
+type Block struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Count  int   `json:"count"`
+	// From and To are the timestamps of the oldest and the newest trace of the block, in milliseconds
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// Index describes an archive file of the traces of a device on a day. It is stored next to the archive file, which
+// is complete once its index exists
+type Index struct {
+	Version   int     `json:"version"`
+	Key       string  `json:"key"`
+	AccountID string  `json:"account_id"`
+	DeviceID  string  `json:"device_id"`
+	Day       string  `json:"day"`
+	Count     int64   `json:"count"`
+	Size      int64   `json:"size"`
+	From      int64   `json:"from"`
+	To        int64   `json:"to"`
+	CreatedAt string  `json:"created_at"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// Overlaps reports whether the block may hold traces between after and before, both included
+func (block Block) Overlaps(after int64, before int64) bool {
+	return block.To >= after && block.From <= before
+}
+
+// Day returns the UTC day of t
+func Day(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// DevicePrefix returns the prefix of the keys of the archive files of a device
+func DevicePrefix(accountID string, deviceID string) string {
+	return url.PathEscape(accountID) + "/" + url.PathEscape(deviceID) + "/"
+}
+
+// ArchiveKey returns the key of the archive file of a device on day, written by the archive run run. A device
+// has an archive file per run that found traces of the day
+func ArchiveKey(accountID string, deviceID string, day time.Time, run string) string {
+	return DevicePrefix(accountID, deviceID) + day.Format(dayLayout) + "/" + run + ArchiveExtension
+}
+
+// IndexKey returns the key of the index of the archive file at key
+func IndexKey(key string) string {
+	return strings.TrimSuffix(key, ArchiveExtension) + IndexExtension
+}
+
+// keyDay returns the day of the archive file or index at key
+func keyDay(key string) (time.Time, bool) {
+	segments := strings.Split(key, "/")
+	if len(segments) != 4 {
+		return time.Time{}, false
+	}
+
+	day, err := time.Parse(dayLayout, segments[2])
+
+	return day, err == nil
+}
+
+// countingWriter counts the bytes written to an archive file
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+
+	return n, err
+}
+
+// Writer writes the traces of an archive file in blocks of BlockSize and builds its index
+type Writer struct {
+	writer  *countingWriter
+	pending []storage.Trace
+	index   Index
+}
+
+// NewWriter returns a Writer of the archive file of index.Key to w
+func NewWriter(w io.Writer, index Index) *Writer {
+	index.Version = FormatVersion
+	index.Blocks = make([]Block, 0)
+
+	return &Writer{writer: &countingWriter{Writer: w}, index: index}
+}
+
+// Write adds traces to the archive file
+func (writer *Writer) Write(traces []storage.Trace) error {
+	for _, trace := range traces {
+		writer.pending = append(writer.pending, trace)
+
+		if len(writer.pending) == BlockSize {
+			if err := writer.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// flush writes the pending traces as a block
+func (writer *Writer) flush() error {
+	if len(writer.pending) == 0 {
+		return nil
+	}
+
+	block := Block{Offset: writer.writer.count, Count: len(writer.pending), From: writer.pending[0].Timestamp, To: writer.pending[0].Timestamp}
+
+	gzipWriter := gzip.NewWriter(writer.writer)
+	encoder := json.NewEncoder(gzipWriter)
+
+	for _, trace := range writer.pending {
+		if trace.Timestamp < block.From {
+			block.From = trace.Timestamp
+		}
+
+		if trace.Timestamp > block.To {
+			block.To = trace.Timestamp
+		}
+
+		if err := encoder.Encode(trace); err != nil {
+			return err
+		}
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+
+	block.Length = writer.writer.count - block.Offset
+
+	if len(writer.index.Blocks) == 0 || block.From < writer.index.From {
+		writer.index.From = block.From
+	}
+
+	if len(writer.index.Blocks) == 0 || block.To > writer.index.To {
+		writer.index.To = block.To
+	}
+
+	writer.index.Blocks = append(writer.index.Blocks, block)
+	writer.index.Count += int64(block.Count)
+	writer.index.Size = writer.writer.count
+	writer.pending = writer.pending[:0]
+
+	return nil
+}
+
+// Close writes the last block and returns the index of the archive file. It does not close the underlying writer
+func (writer *Writer) Close() (Index, error) {
+	if err := writer.flush(); err != nil {
+		return Index{}, err
+	}
+
+	return writer.index, nil
+}
+
+// ReadBlock decodes the traces of a block
+func ReadBlock(r io.Reader) ([]storage.Trace, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer gzipReader.Close()
+
+	traces := make([]storage.Trace, 0, BlockSize)
+	decoder := json.NewDecoder(bufio.NewReader(gzipReader))
+
+	for {
+		var trace storage.Trace
+
+		err := decoder.Decode(&trace)
+		if err == io.EOF {
+			return traces, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		traces = append(traces, trace)
+	}
+}
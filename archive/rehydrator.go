@@ -0,0 +1,684 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/muuid-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	RehydrationStatusQueued    = "queued"
+	RehydrationStatusRunning   = "running"
+	RehydrationStatusCompleted = "completed"
+	RehydrationStatusFailed    = "failed"
+
+	DefaultRehydrationIndexPrefix     = "device-trace-rehydrated"
+	DefaultRehydrationExpiration      = 24 * time.Hour
+	DefaultMaxRehydrationsPerAccount  = 3
+	DefaultMaxRehydrationDays         = 31
+	DefaultRehydrationWorkers         = 2
+	DefaultRehydrationCleanupInterval = 10 * time.Minute
+	DefaultRehydrationPollInterval    = 10 * time.Second
+	rehydrationQueueSize              = 100
+
+	// RehydrationLeaseName is the name of the lease that the replica which loads the rehydrations holds
+	RehydrationLeaseName = "rehydration"
+)
+
+// Errors that might be returned by the Rehydrator
+var (
+	ErrTooManyRehydrations   = errors.New("Too many rehydrations for the account")
+	ErrRehydrationQueueFull  = errors.New("The rehydration queue is full")
+	ErrRehydrationNotReady   = errors.New("The rehydration has not completed")
+	ErrRehydrationRangeLimit = errors.New("The time range of the rehydration is too long")
+)
+
+// Rehydration loads the archived traces of a device between After and Before into a temporary index
+type Rehydration struct {
+	ID           string    `json:"id"`
+	Object       string    `json:"object"`
+	AccountID    string    `json:"account_id"`
+	RequestID    string    `json:"request_id"`
+	DeviceID     string    `json:"device_id"`
+	After        time.Time `json:"after"`
+	Before       time.Time `json:"before"`
+	Index        string    `json:"index"`
+	Status       string    `json:"status"`
+	ArchiveCount int       `json:"archive_count"`
+	LoadedCount  int64     `json:"loaded_count"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    string    `json:"created_at"`
+	StartedAt    string    `json:"started_at,omitempty"`
+	CompletedAt  string    `json:"completed_at,omitempty"`
+	ExpiresAt    string    `json:"expires_at,omitempty"`
+}
+
+// loading reports whether the rehydration is still to be loaded
+func (rehydration Rehydration) loading() bool {
+	return rehydration.Status == RehydrationStatusQueued || rehydration.Status == RehydrationStatusRunning
+}
+
+// expired reports whether a finished rehydration is past its expiration
+func (rehydration Rehydration) expired(now time.Time) bool {
+	if rehydration.ExpiresAt == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, rehydration.ExpiresAt)
+
+	return err == nil && now.After(expiresAt)
+}
+
+// refresher is implemented by the trace stores whose added traces are not searchable right away
+type refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// Rehydrator loads archived traces back into temporary indices of Traces in the background, where they are searched
+// until they expire. An account has at most MaxPerAccount rehydrations, of at most MaxDays each.
+//
+// Without Lease the rehydrations are loaded by the replica that they were submitted to. With Lease, Blobs and
+// Rehydrations are shared by the replicas, any replica takes requests and only the replica that holds Lease loads and
+// cleans up the rehydrations, which it looks for every PollInterval. A rehydration deleted on another replica stops
+// loading once its worker saves its progress
+type Rehydrator struct {
+	Traces          storage.TraceIndexStore
+	Blobs           BlobStore
+	Rehydrations    RehydrationStore
+	Lease           Lease
+	UUIDGenerator   *muuid.MUUIDGenerator
+	Logger          *zap.Logger
+	IndexPrefix     string
+	Expiration      time.Duration
+	MaxPerAccount   int
+	MaxDays         int
+	Workers         int
+	CleanupInterval time.Duration
+	PollInterval    time.Duration
+
+	lock    sync.Mutex
+	cancels map[string]context.CancelFunc
+	pending map[string]bool
+	queue   chan string
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Start re-queues the rehydrations that were interrupted by a restart, or with Lease starts looking for rehydrations
+// to load, and starts the workers and the cleanup of expired rehydrations. They stop when ctx is done
+func (rehydrator *Rehydrator) Start(ctx context.Context) error {
+	if rehydrator.IndexPrefix == "" {
+		rehydrator.IndexPrefix = DefaultRehydrationIndexPrefix
+	}
+
+	if rehydrator.Expiration <= 0 {
+		rehydrator.Expiration = DefaultRehydrationExpiration
+	}
+
+	if rehydrator.MaxPerAccount <= 0 {
+		rehydrator.MaxPerAccount = DefaultMaxRehydrationsPerAccount
+	}
+
+	if rehydrator.MaxDays <= 0 {
+		rehydrator.MaxDays = DefaultMaxRehydrationDays
+	}
+
+	if rehydrator.Workers <= 0 {
+		rehydrator.Workers = DefaultRehydrationWorkers
+	}
+
+	if rehydrator.CleanupInterval <= 0 {
+		rehydrator.CleanupInterval = DefaultRehydrationCleanupInterval
+	}
+
+	if rehydrator.PollInterval <= 0 {
+		rehydrator.PollInterval = DefaultRehydrationPollInterval
+	}
+
+	rehydrator.cancels = make(map[string]context.CancelFunc)
+	rehydrator.pending = make(map[string]bool)
+	rehydrator.queue = make(chan string, rehydrationQueueSize)
+
+	if rehydrator.Lease != nil {
+		go rehydrator.dispatch(ctx)
+	} else {
+		rehydrations, err := rehydrator.Rehydrations.List()
+		if err != nil {
+			return err
+		}
+
+		// Rehydrations are resumed oldest first. Loading the traces again replaces those loaded before the restart
+		sort.Slice(rehydrations, func(i, j int) bool { return rehydrations[i].CreatedAt < rehydrations[j].CreatedAt })
+
+		for _, rehydration := range rehydrations {
+			if !rehydration.loading() {
+				continue
+			}
+
+			rehydrator.Logger.Info("Resuming rehydration", zap.String("rehydration_id", rehydration.ID), zap.String("account_id", rehydration.AccountID))
+
+			if !rehydrator.enqueue(rehydration.ID) {
+				rehydrator.fail(rehydration, ErrRehydrationQueueFull)
+			}
+		}
+	}
+
+	for i := 0; i < rehydrator.Workers; i++ {
+		go rehydrator.work(ctx)
+	}
+
+	go rehydrator.cleanup(ctx)
+
+	return nil
+}
+
+// Submit creates a rehydration of the traces of the device between after and before, both included, and queues it
+func (rehydrator *Rehydrator) Submit(accountID string, requestID string, deviceID string, after time.Time, before time.Time) (Rehydration, error) {
+	if before.Sub(after) > time.Duration(rehydrator.MaxDays)*24*time.Hour {
+		return Rehydration{}, ErrRehydrationRangeLimit
+	}
+
+	rehydrator.lock.Lock()
+	defer rehydrator.lock.Unlock()
+
+	// Every rehydration holds an index until it expires
+	rehydrations, err := rehydrator.List(accountID)
+	if err != nil {
+		return Rehydration{}, err
+	}
+
+	if len(rehydrations) >= rehydrator.MaxPerAccount {
+		return Rehydration{}, ErrTooManyRehydrations
+	}
+
+	// With Lease the queue of the replica that holds it takes the rehydration once there is room
+	if rehydrator.Lease == nil && len(rehydrator.queue) >= cap(rehydrator.queue) {
+		return Rehydration{}, ErrRehydrationQueueFull
+	}
+
+	id := rehydrator.UUIDGenerator.UUID().String()
+
+	rehydration := Rehydration{
+		ID:        id,
+		Object:    "device-trace-rehydration",
+		AccountID: accountID,
+		RequestID: requestID,
+		DeviceID:  deviceID,
+		After:     after.UTC(),
+		Before:    before.UTC(),
+		Index:     rehydrator.IndexPrefix + "-" + strings.ToLower(id),
+		Status:    RehydrationStatusQueued,
+		CreatedAt: formatTime(time.Now()),
+	}
+
+	if err := rehydrator.Rehydrations.Save(rehydration); err != nil {
+		return Rehydration{}, err
+	}
+
+	if rehydrator.Lease == nil {
+		rehydrator.enqueue(rehydration.ID)
+	}
+
+	return rehydration, nil
+}
+
+// enqueue queues the rehydration with id for a worker unless it is queued or loading already, and reports whether
+// it is. It is called with lock held, or before the workers start
+func (rehydrator *Rehydrator) enqueue(id string) bool {
+	if rehydrator.pending[id] {
+		return true
+	}
+
+	select {
+	case rehydrator.queue <- id:
+		rehydrator.pending[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch queues the rehydrations to load every PollInterval while the replica holds Lease, oldest first, until ctx
+// is done and then releases the lease. A rehydration that was loading on a replica which lost the lease is loaded
+// again, which replaces the traces loaded before
+func (rehydrator *Rehydrator) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(rehydrator.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+			if err := rehydrator.Lease.Release(releaseCtx); err != nil {
+				rehydrator.Logger.Warn("Could not release the rehydration lease.", zap.Error(err))
+			}
+			cancel()
+
+			return
+		case <-ticker.C:
+		}
+
+		if leader, err := rehydrator.Lease.Acquire(ctx); err != nil || !leader {
+			continue
+		}
+
+		rehydrations, err := rehydrator.Rehydrations.List()
+		if err != nil {
+			rehydrator.Logger.Error("Could not list rehydrations to load", zap.Error(err))
+			continue
+		}
+
+		sort.Slice(rehydrations, func(i, j int) bool { return rehydrations[i].CreatedAt < rehydrations[j].CreatedAt })
+
+		rehydrator.lock.Lock()
+		for _, rehydration := range rehydrations {
+			// The rehydrations that do not fit in the queue are queued on a later tick
+			if rehydration.loading() && !rehydrator.enqueue(rehydration.ID) {
+				break
+			}
+		}
+		rehydrator.lock.Unlock()
+	}
+}
+
+// Get returns the rehydration with id if it belongs to accountID
+func (rehydrator *Rehydrator) Get(accountID string, id string) (Rehydration, error) {
+	rehydration, err := rehydrator.Rehydrations.Get(id)
+	if err != nil {
+		return Rehydration{}, err
+	}
+
+	if rehydration.AccountID != accountID {
+		return Rehydration{}, ErrRehydrationNotFound
+	}
+
+	return rehydration, nil
+}
+
+// List returns the rehydrations of accountID, newest first
+func (rehydrator *Rehydrator) List(accountID string) ([]Rehydration, error) {
+	rehydrations, err := rehydrator.Rehydrations.List()
+	if err != nil {
+		return nil, err
+	}
+
+	accountRehydrations := make([]Rehydration, 0)
+
+	for _, rehydration := range rehydrations {
+		if rehydration.AccountID == accountID {
+			accountRehydrations = append(accountRehydrations, rehydration)
+		}
+	}
+
+	sort.Slice(accountRehydrations, func(i, j int) bool { return accountRehydrations[i].CreatedAt > accountRehydrations[j].CreatedAt })
+
+	return accountRehydrations, nil
+}
+
+// TraceStore returns the store that searches the traces of a completed rehydration of accountID
+func (rehydrator *Rehydrator) TraceStore(accountID string, id string) (storage.TraceStore, error) {
+	rehydration, err := rehydrator.Get(accountID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rehydration.Status != RehydrationStatusCompleted {
+		return nil, ErrRehydrationNotReady
+	}
+
+	return rehydrator.Traces.IndexTraceStore(rehydration.Index), nil
+}
+
+// Delete cancels the rehydration of accountID if it is running and removes it with its index
+func (rehydrator *Rehydrator) Delete(accountID string, id string) error {
+	rehydration, err := rehydrator.Get(accountID, id)
+	if err != nil {
+		return err
+	}
+
+	// A rehydration loading on this replica is removed by its worker once it has stopped loading. The lock keeps the
+	// worker from starting or finishing it in between. A worker on another replica stops once it saves its progress
+	rehydrator.lock.Lock()
+	defer rehydrator.lock.Unlock()
+
+	if cancel, running := rehydrator.cancels[id]; running {
+		cancel()
+		return nil
+	}
+
+	span := opentracing.StartSpan("Rehydrator.Delete")
+	defer span.Finish()
+
+	return rehydrator.remove(span, context.Background(), rehydration)
+}
+
+func (rehydrator *Rehydrator) remove(span opentracing.Span, ctx context.Context, rehydration Rehydration) error {
+	ctx = storeContext(ctx, rehydration.RequestID, rehydration.AccountID)
+
+	if err := rehydrator.Traces.DeleteTraceIndex(span, ctx, rehydration.Index); err != nil {
+		return err
+	}
+
+	return rehydrator.Rehydrations.Delete(rehydration.ID)
+}
+
+func (rehydrator *Rehydrator) fail(rehydration Rehydration, err error) {
+	now := time.Now()
+
+	rehydration.Status = RehydrationStatusFailed
+	rehydration.Error = err.Error()
+	rehydration.CompletedAt = formatTime(now)
+	rehydration.ExpiresAt = formatTime(now.Add(rehydrator.Expiration))
+
+	metrics.PrometheusRehydrations.WithLabelValues(RehydrationStatusFailed).Inc()
+
+	if saveErr := rehydrator.Rehydrations.Update(rehydration); saveErr != nil && saveErr != ErrRehydrationNotFound {
+		rehydrator.Logger.Error("Could not save failed rehydration", zap.String("rehydration_id", rehydration.ID), zap.Error(saveErr))
+	}
+}
+
+func (rehydrator *Rehydrator) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-rehydrator.queue:
+			rehydrator.run(ctx, id)
+		}
+	}
+}
+
+func (rehydrator *Rehydrator) run(parent context.Context, id string) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// The rehydration is read and marked as loading at once, so that Delete either removes it before or cancels it
+	// after
+	rehydrator.lock.Lock()
+	rehydration, err := rehydrator.Rehydrations.Get(id)
+	if err == nil && rehydration.loading() {
+		rehydrator.cancels[id] = cancel
+	}
+	rehydrator.lock.Unlock()
+
+	defer func() {
+		rehydrator.lock.Lock()
+		delete(rehydrator.cancels, id)
+		delete(rehydrator.pending, id)
+		rehydrator.lock.Unlock()
+	}()
+
+	if err != nil || !rehydration.loading() {
+		// The rehydration was deleted while it was queued, or finished before it was queued again
+		rehydrator.Logger.Debug("Skipping rehydration", zap.String("rehydration_id", id), zap.Error(err))
+		return
+	}
+
+	logger := rehydrator.Logger.With(zap.String("rehydration_id", rehydration.ID), zap.String("account_id", rehydration.AccountID), zap.String("request_id", rehydration.RequestID))
+
+	span := opentracing.StartSpan("Rehydrator.run")
+	span.SetTag("component", "archive")
+	span.SetTag("rehydration_id", rehydration.ID)
+	defer span.Finish()
+
+	rehydration.Status = RehydrationStatusRunning
+	rehydration.StartedAt = formatTime(time.Now())
+	rehydration.ArchiveCount = 0
+	rehydration.LoadedCount = 0
+
+	if err := rehydrator.Rehydrations.Update(rehydration); err == ErrRehydrationNotFound {
+		logger.Info("Rehydration deleted")
+		return
+	} else if err != nil {
+		logger.Error("Could not save rehydration", zap.Error(err))
+		return
+	}
+
+	logger.Info("Starting rehydration")
+
+	err = rehydrator.load(span, storeContext(ctx, rehydration.RequestID, rehydration.AccountID), &rehydration)
+
+	if err == nil {
+		rehydration.Status = RehydrationStatusCompleted
+	} else if err != ErrRehydrationNotFound && ctx.Err() == nil {
+		logger.Error("Rehydration failed", zap.Error(err))
+		rehydrator.Traces.DeleteTraceIndex(span, storeContext(context.Background(), rehydration.RequestID, rehydration.AccountID), rehydration.Index)
+
+		rehydration.Status = RehydrationStatusFailed
+		rehydration.Error = err.Error()
+	}
+
+	if rehydration.Status != RehydrationStatusRunning {
+		now := time.Now()
+		rehydration.CompletedAt = formatTime(now)
+		rehydration.ExpiresAt = formatTime(now.Add(rehydrator.Expiration))
+
+		if err = rehydrator.finish(ctx, rehydration); err == nil {
+			metrics.PrometheusRehydrations.WithLabelValues(rehydration.Status).Inc()
+
+			if rehydration.Status == RehydrationStatusCompleted {
+				logger.Info("Rehydration completed", zap.Int("archive_count", rehydration.ArchiveCount), zap.Int64("loaded_count", rehydration.LoadedCount))
+			}
+
+			return
+		}
+	}
+
+	if ctx.Err() != nil {
+		if parent.Err() != nil {
+			// Shutting down, the rehydration is resumed on the next start
+			logger.Info("Rehydration interrupted")
+		} else {
+			logger.Info("Rehydration cancelled")
+
+			if err := rehydrator.remove(span, context.Background(), rehydration); err != nil {
+				logger.Error("Could not remove cancelled rehydration", zap.Error(err))
+			}
+		}
+
+		return
+	}
+
+	if err == ErrRehydrationNotFound {
+		rehydrator.deleted(span, logger, rehydration)
+		return
+	}
+
+	logger.Error("Could not save finished rehydration", zap.Error(err))
+}
+
+// finish saves a finished rehydration unless it was cancelled, whose worker removes it instead. A finished
+// rehydration is no longer loading, so that Delete removes it itself
+func (rehydrator *Rehydrator) finish(ctx context.Context, rehydration Rehydration) error {
+	rehydrator.lock.Lock()
+	defer rehydrator.lock.Unlock()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := rehydrator.Rehydrations.Update(rehydration); err != nil {
+		return err
+	}
+
+	delete(rehydrator.cancels, rehydration.ID)
+
+	return nil
+}
+
+// deleted removes the index of a rehydration that was deleted on another replica while it was loading, which the
+// traces loaded since may have created again
+func (rehydrator *Rehydrator) deleted(span opentracing.Span, logger *zap.Logger, rehydration Rehydration) {
+	logger.Info("Rehydration deleted")
+
+	if err := rehydrator.Traces.DeleteTraceIndex(span, storeContext(context.Background(), rehydration.RequestID, rehydration.AccountID), rehydration.Index); err != nil {
+		logger.Error("Could not remove the index of a deleted rehydration", zap.Error(err))
+	}
+}
+
+// load reads the blocks of the archive files of the device that overlap the time range into the index of the
+// rehydration. It saves the progress after every archive file, and fails with ErrRehydrationNotFound once the
+// rehydration was deleted
+func (rehydrator *Rehydrator) load(span opentracing.Span, ctx context.Context, rehydration *Rehydration) error {
+	if err := rehydrator.Traces.CreateTraceIndex(span, ctx, rehydration.Index); err != nil {
+		return err
+	}
+
+	keys, err := rehydrator.Blobs.List(DevicePrefix(rehydration.AccountID, rehydration.DeviceID))
+	if err != nil {
+		return err
+	}
+
+	after := rehydration.After.UnixNano() / int64(time.Millisecond)
+	before := rehydration.Before.UnixNano() / int64(time.Millisecond)
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, IndexExtension) {
+			continue
+		}
+
+		day, ok := keyDay(key)
+		if !ok || day.Before(Day(rehydration.After)) || day.After(rehydration.Before) {
+			continue
+		}
+
+		index, err := rehydrator.readIndex(key)
+		if err != nil {
+			return err
+		}
+
+		if index.To < after || index.From > before {
+			continue
+		}
+
+		for _, block := range index.Blocks {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if !block.Overlaps(after, before) {
+				continue
+			}
+
+			traces, err := rehydrator.readBlock(index.Key, block)
+			if err != nil {
+				return err
+			}
+
+			matched := make([]storage.Trace, 0, len(traces))
+			for _, trace := range traces {
+				if trace.Timestamp >= after && trace.Timestamp <= before {
+					matched = append(matched, trace)
+				}
+			}
+
+			if err := rehydrator.Traces.IndexTraces(span, ctx, rehydration.Index, matched); err != nil {
+				return err
+			}
+
+			rehydration.LoadedCount += int64(len(matched))
+		}
+
+		rehydration.ArchiveCount++
+
+		if err := rehydrator.Rehydrations.Update(*rehydration); err != nil {
+			return err
+		}
+	}
+
+	if store, ok := rehydrator.Traces.IndexTraceStore(rehydration.Index).(refresher); ok {
+		return store.Refresh(ctx)
+	}
+
+	return nil
+}
+
+func (rehydrator *Rehydrator) readIndex(key string) (Index, error) {
+	var index Index
+
+	blob, err := rehydrator.Blobs.Get(key)
+	if err != nil {
+		return Index{}, err
+	}
+
+	defer blob.Close()
+
+	encoded, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return Index{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &index); err != nil {
+		return Index{}, err
+	}
+
+	return index, nil
+}
+
+func (rehydrator *Rehydrator) readBlock(key string, block Block) ([]storage.Trace, error) {
+	blob, err := rehydrator.Blobs.GetRange(key, block.Offset, block.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	defer blob.Close()
+
+	return ReadBlock(blob)
+}
+
+func (rehydrator *Rehydrator) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(rehydrator.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if rehydrator.Lease != nil {
+				if leader, err := rehydrator.Lease.Acquire(ctx); err != nil || !leader {
+					continue
+				}
+			}
+
+			rehydrations, err := rehydrator.Rehydrations.List()
+			if err != nil {
+				rehydrator.Logger.Error("Could not list rehydrations for cleanup", zap.Error(err))
+				continue
+			}
+
+			span := opentracing.StartSpan("Rehydrator.cleanup")
+			now := time.Now()
+
+			for _, rehydration := range rehydrations {
+				if !rehydration.expired(now) {
+					continue
+				}
+
+				if err := rehydrator.remove(span, ctx, rehydration); err != nil {
+					rehydrator.Logger.Error("Could not remove expired rehydration", zap.String("rehydration_id", rehydration.ID), zap.Error(err))
+					continue
+				}
+
+				rehydrator.Logger.Info("Removed expired rehydration", zap.String("rehydration_id", rehydration.ID), zap.String("account_id", rehydration.AccountID))
+			}
+
+			span.Finish()
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package archive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	// DefaultS3Region is the region that requests are signed for if none is given
+	DefaultS3Region = "us-east-1"
+
+	// s3Timeout bounds a whole request, including the transfer of an archive file
+	s3Timeout = 10 * time.Minute
+
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DateLayout    = "20060102T150405Z"
+	s3EmptyPayload  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3ListPageLimit = "1000"
+)
+
+// S3BlobStore implements BlobStore on a bucket of an S3 compatible object store, which every replica reads and
+// writes. Objects are addressed path style, as <Endpoint>/<Bucket>/<key>, and requests are signed with AWS signature
+// version 4
+type S3BlobStore struct {
+	Endpoint        *url.URL
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// s3Error is the error document of a failed request
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (err *s3Error) Error() string {
+	return fmt.Sprintf("S3 request failed with status %d: %s %s", err.Status, err.Code, err.Message)
+}
+
+// s3ListResult is a page of the keys of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// NewS3BlobStore returns an S3BlobStore on bucket at endpoint and checks that the bucket can be reached with the
+// credentials. sessionToken is only needed for temporary credentials
+func NewS3BlobStore(endpoint string, bucket string, region string, accessKeyID string, secretAccessKey string, sessionToken string) (*S3BlobStore, error) {
+	endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+	}
+
+	if !validKey(bucket) || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("Invalid S3 bucket %q", bucket)
+	}
+
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("The S3 credentials are missing")
+	}
+
+	if region == "" {
+		region = DefaultS3Region
+	}
+
+	blobStore := &S3BlobStore{
+		Endpoint:        endpointURL,
+		Bucket:          bucket,
+		Region:          region,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Client:          &http.Client{Timeout: s3Timeout},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	response, err := blobStore.do(ctx, "HEAD", "", nil, nil, nil, s3EmptyPayload, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &s3Error{Status: response.StatusCode, Code: "HeadBucket", Message: "the bucket can not be reached"}
+	}
+
+	return blobStore, nil
+}
+
+// s3Escape escapes s as signature version 4 expects, every byte but the unreserved characters of RFC 3986 and, in
+// paths, the slash
+func s3Escape(s string, path bool) string {
+	var escaped strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// s3Query encodes params sorted by name, which is both the query string and its canonical form
+func s3Query(params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var pairs []string
+
+	for _, name := range names {
+		values := append([]string(nil), params[name]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// sign adds the signature version 4 headers to request for a payload with the hex SHA-256 payloadHash. The host,
+// the range and the x-amz-* headers are signed
+func (blobStore *S3BlobStore) sign(request *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format(s3DateLayout)
+	scope := date[:8] + "/" + blobStore.Region + "/s3/aws4_request"
+
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if blobStore.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", blobStore.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := s3HMAC([]byte("AWS4"+blobStore.SecretAccessKey), date[:8])
+	key = s3HMAC(key, blobStore.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	request.Header.Set("Authorization", s3Algorithm+" Credential="+blobStore.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(s3HMAC(key, stringToSign)))
+}
+
+// do sends a signed request for key, or for the bucket if key is empty
+func (blobStore *S3BlobStore) do(ctx context.Context, method string, key string, params url.Values, headers map[string]string, body io.Reader, payloadHash string, length int64) (*http.Response, error) {
+	path := "/" + blobStore.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	target := *blobStore.Endpoint
+	target.Path = blobStore.Endpoint.Path + path
+	target.RawPath = blobStore.Endpoint.EscapedPath() + s3Escape(path, true)
+	target.RawQuery = s3Query(params)
+
+	request, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+	request.ContentLength = length
+
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	blobStore.sign(request, payloadHash, time.Now())
+
+	return blobStore.Client.Do(request)
+}
+
+// failed reads the error of a response with an unexpected status and closes it
+func failed(response *http.Response) error {
+	defer response.Body.Close()
+
+	err := &s3Error{Status: response.StatusCode}
+
+	encoded, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64<<10))
+	xml.Unmarshal(encoded, err)
+
+	return err
+}
+
+// Put uploads the blob in a single request. The object is only visible once the upload is complete. The content is
+// spooled to a temporary file first, because the signature covers its hash and the request needs its length
+func (blobStore *S3BlobStore) Put(key string, r io.Reader) error {
+	if !validKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	spool, err := ioutil.TempFile("", "archive-upload-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+
+	length, err := io.Copy(io.MultiWriter(spool, hash), r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	response, err := blobStore.do(context.Background(), "PUT", key, nil, nil, spool, hex.EncodeToString(hash.Sum(nil)), length)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return failed(response)
+	}
+
+	response.Body.Close()
+
+	return nil
+}
+
+// Get downloads the blob
+func (blobStore *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	response, err := blobStore.do(context.Background(), "GET", key, nil, nil, nil, s3EmptyPayload, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	default:
+		return nil, failed(response)
+	}
+}
+
+// GetRange downloads length bytes of the blob from offset
+func (blobStore *S3BlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	if length <= 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	headers := map[string]string{"Range": "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)}
+
+	response, err := blobStore.do(context.Background(), "GET", key, nil, headers, nil, s3EmptyPayload, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		return response.Body, nil
+	case http.StatusOK:
+		// The store ignored the range and sends the whole blob
+		if _, err := io.CopyN(ioutil.Discard, response.Body, offset); err != nil {
+			response.Body.Close()
+			return nil, err
+		}
+
+		return fileRange{Reader: io.LimitReader(response.Body, length), Closer: response.Body}, nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	default:
+		return nil, failed(response)
+	}
+}
+
+// List pages through the keys that start with prefix. The keys come sorted from the store
+func (blobStore *S3BlobStore) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+
+	for {
+		params := url.Values{}
+		params.Set("list-type", "2")
+		params.Set("prefix", prefix)
+		params.Set("max-keys", s3ListPageLimit)
+		if token != "" {
+			params.Set("continuation-token", token)
+		}
+
+		response, err := blobStore.do(context.Background(), "GET", "", params, nil, nil, s3EmptyPayload, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode != http.StatusOK {
+			return nil, failed(response)
+		}
+
+		var page s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+
+		token = page.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Delete removes the blob
+func (blobStore *S3BlobStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	response, err := blobStore.do(context.Background(), "DELETE", key, nil, nil, nil, s3EmptyPayload, 0)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		response.Body.Close()
+		return nil
+	default:
+		return failed(response)
+	}
+}
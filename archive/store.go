@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+// Errors that might be returned by a RehydrationStore
+var (
+	ErrRehydrationNotFound = errors.New("Rehydration not found")
+)
+
+// RehydrationStore persists rehydrations so that they survive a restart of the service
+type RehydrationStore interface {
+	Save(rehydration Rehydration) error
+	// Update replaces a stored rehydration, or fails with ErrRehydrationNotFound if it was deleted
+	Update(rehydration Rehydration) error
+	Get(id string) (Rehydration, error)
+	List() ([]Rehydration, error)
+	Delete(id string) error
+}
+
+// FileRehydrationStore implements RehydrationStore with one JSON file per rehydration in a local directory
+type FileRehydrationStore struct {
+	Dir string
+
+	lock sync.Mutex
+}
+
+// NewFileRehydrationStore returns a FileRehydrationStore on dir, creating dir if needed
+func NewFileRehydrationStore(dir string) (*FileRehydrationStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileRehydrationStore{Dir: dir}, nil
+}
+
+func (rehydrationStore *FileRehydrationStore) path(id string) string {
+	return filepath.Join(rehydrationStore.Dir, filepath.Base(id)+".json")
+}
+
+// Save writes the rehydration, replacing the file atomically
+func (rehydrationStore *FileRehydrationStore) Save(rehydration Rehydration) error {
+	rehydrationStore.lock.Lock()
+	defer rehydrationStore.lock.Unlock()
+
+	return rehydrationStore.write(rehydration)
+}
+
+// Update writes the rehydration if its file exists
+func (rehydrationStore *FileRehydrationStore) Update(rehydration Rehydration) error {
+	rehydrationStore.lock.Lock()
+	defer rehydrationStore.lock.Unlock()
+
+	if _, err := os.Stat(rehydrationStore.path(rehydration.ID)); os.IsNotExist(err) {
+		return ErrRehydrationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return rehydrationStore.write(rehydration)
+}
+
+func (rehydrationStore *FileRehydrationStore) write(rehydration Rehydration) error {
+	encoded, err := json.Marshal(rehydration)
+	if err != nil {
+		return err
+	}
+
+	tmp := rehydrationStore.path(rehydration.ID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, rehydrationStore.path(rehydration.ID))
+}
+
+// Get reads the rehydration with id
+func (rehydrationStore *FileRehydrationStore) Get(id string) (Rehydration, error) {
+	var rehydration Rehydration
+
+	encoded, err := ioutil.ReadFile(rehydrationStore.path(id))
+	if os.IsNotExist(err) {
+		return Rehydration{}, ErrRehydrationNotFound
+	} else if err != nil {
+		return Rehydration{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &rehydration); err != nil {
+		return Rehydration{}, err
+	}
+
+	return rehydration, nil
+}
+
+// List reads every stored rehydration
+func (rehydrationStore *FileRehydrationStore) List() ([]Rehydration, error) {
+	files, err := ioutil.ReadDir(rehydrationStore.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rehydrations := make([]Rehydration, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		rehydration, err := rehydrationStore.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		rehydrations = append(rehydrations, rehydration)
+	}
+
+	return rehydrations, nil
+}
+
+// Delete removes the rehydration with id. Deleting a missing rehydration is not an error
+func (rehydrationStore *FileRehydrationStore) Delete(id string) error {
+	rehydrationStore.lock.Lock()
+	defer rehydrationStore.lock.Unlock()
+
+	err := os.Remove(rehydrationStore.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// ESRehydrationStore implements RehydrationStore on an elastic search document index, so that every replica sees the
+// same rehydrations
+type ESRehydrationStore struct {
+	Documents *storage.ESDocumentStore
+}
+
+// Save stores the rehydration, replacing an existing one
+func (rehydrationStore *ESRehydrationStore) Save(rehydration Rehydration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	return rehydrationStore.Documents.Save(ctx, rehydration.ID, rehydration)
+}
+
+// Update replaces the stored rehydration if it was not deleted
+func (rehydrationStore *ESRehydrationStore) Update(rehydration Rehydration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	if err := rehydrationStore.Documents.Update(ctx, rehydration.ID, rehydration); err == storage.ErrDocumentNotFound {
+		return ErrRehydrationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get reads the rehydration with id
+func (rehydrationStore *ESRehydrationStore) Get(id string) (Rehydration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	var rehydration Rehydration
+
+	if err := rehydrationStore.Documents.Get(ctx, id, &rehydration); err == storage.ErrDocumentNotFound {
+		return Rehydration{}, ErrRehydrationNotFound
+	} else if err != nil {
+		return Rehydration{}, err
+	}
+
+	return rehydration, nil
+}
+
+// List reads every stored rehydration
+func (rehydrationStore *ESRehydrationStore) List() ([]Rehydration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	documents, err := rehydrationStore.Documents.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rehydrations := make([]Rehydration, 0, len(documents))
+
+	for _, document := range documents {
+		var rehydration Rehydration
+
+		if err := json.Unmarshal(document, &rehydration); err != nil {
+			return nil, err
+		}
+
+		rehydrations = append(rehydrations, rehydration)
+	}
+
+	return rehydrations, nil
+}
+
+// Delete removes the rehydration with id. Deleting a missing rehydration is not an error
+func (rehydrationStore *ESRehydrationStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	if err := rehydrationStore.Documents.Delete(ctx, id); err != nil && err != storage.ErrDocumentNotFound {
+		return err
+	}
+
+	return nil
+}
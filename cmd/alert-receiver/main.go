@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/alerts"
+)
+
+// alert-receiver is a local webhook receiver for testing alert rules. It verifies the signature of every
+// notification and prints it to stdout
+func main() {
+	var addr string
+	var secret string
+	flag.StringVar(&addr, "addr", ":9090", "The address to listen on")
+	flag.StringVar(&secret, "secret", "", "The webhook secret of the alert rules")
+	flag.Parse()
+
+	if secret == "" {
+		fmt.Fprintf(os.Stderr, "Argument \"secret\" is required.\n")
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	handler := alerts.ReceiverHandler(secret, func(notification alerts.Notification) {
+		encoder.Encode(notification)
+	})
+
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		fmt.Fprintf(os.Stderr, "Server Setup Error: %s\n", err)
+		os.Exit(1)
+	}
+}
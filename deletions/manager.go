@@ -0,0 +1,295 @@
+package deletions
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/muuid-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+
+	DefaultPollInterval  = 30 * time.Second
+	DefaultDeletionLimit = 50
+	pollBatchSize        = 100
+)
+
+// Errors that might be returned by the Manager
+var (
+	ErrTraceNotFound  = errors.New("Could not retreive trace by this ID")
+	ErrMissingAccount = errors.New("A deletion must be scoped to an account")
+)
+
+// Manager deletes traces and records every deletion in the audit trail. Deletions of a single trace and those of
+// Delete are synchronous, the others run as background tasks of the trace store that the manager follows until they
+// finish
+type Manager struct {
+	Traces        storage.TraceDeleteStore
+	Deletions     storage.DeletionStore
+	UUIDGenerator *muuid.MUUIDGenerator
+	Logger        *zap.Logger
+	PollInterval  time.Duration
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// storeContext returns a context with the request id and the account id that the stores log
+func storeContext(ctx context.Context, requestID string, accountID string) context.Context {
+	ctx = context.WithValue(ctx, httputil.ContextKeyRequestID, requestID)
+
+	return context.WithValue(ctx, httputil.ContextKeyAccountID, accountID)
+}
+
+// Start follows the deletions that are still running, including those started before a restart, until ctx is done
+func (manager *Manager) Start(ctx context.Context) {
+	if manager.PollInterval <= 0 {
+		manager.PollInterval = DefaultPollInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(manager.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				manager.poll(ctx)
+			}
+		}
+	}()
+}
+
+// poll updates the progress of the running deletions
+func (manager *Manager) poll(ctx context.Context) {
+	span := opentracing.StartSpan("deletions.Manager.poll()")
+	defer span.Finish()
+
+	running, err := manager.Deletions.ListDeletionsWithStatus(span, storeContext(ctx, "", ""), StatusRunning, pollBatchSize)
+	if err != nil {
+		manager.Logger.Warn("Could not list the running deletions.", zap.Error(err))
+		return
+	}
+
+	for _, deletion := range running {
+		manager.refresh(span, storeContext(ctx, deletion.RequestID, deletion.AccountID), deletion)
+	}
+}
+
+// newDeletion returns a pending deletion
+func (manager *Manager) newDeletion(accountID string, requestID string, query storage.TraceQuery, filters map[string]string) storage.Deletion {
+	now := formatTime(time.Now())
+
+	return storage.Deletion{
+		ID:        manager.UUIDGenerator.UUID().String(),
+		Object:    "device-trace-deletion",
+		AccountID: accountID,
+		RequestID: requestID,
+		Status:    StatusPending,
+		Filters:   filters,
+		Query:     query,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// finish records the outcome of a deletion
+func (manager *Manager) finish(deletion *storage.Deletion, progress storage.DeleteProgress) {
+	deletion.TotalCount = progress.Total
+	deletion.DeletedCount = progress.Deleted
+	deletion.Failures = progress.Failures
+	deletion.UpdatedAt = formatTime(time.Now())
+
+	if !progress.Completed {
+		return
+	}
+
+	deletion.CompletedAt = deletion.UpdatedAt
+	deletion.Status = StatusCompleted
+
+	if len(progress.Failures) > 0 {
+		deletion.Status = StatusFailed
+	}
+
+	metrics.PrometheusTraceDeletions.WithLabelValues(deletion.Status).Inc()
+	metrics.PrometheusDeletedTraces.Add(float64(progress.Deleted))
+
+	manager.Logger.Info("Audit: trace deletion finished.",
+		zap.String("deletion_id", deletion.ID),
+		zap.String("account_id", deletion.AccountID),
+		zap.String("request_id", deletion.RequestID),
+		zap.String("status", deletion.Status),
+		zap.Int64("deleted_count", deletion.DeletedCount),
+		zap.Strings("failures", deletion.Failures))
+}
+
+// fail records a deletion that could not be carried out
+func (manager *Manager) fail(parentSpan opentracing.Span, ctx context.Context, deletion *storage.Deletion, err error) {
+	deletion.Status = StatusFailed
+	deletion.Failures = []string{err.Error()}
+	deletion.UpdatedAt = formatTime(time.Now())
+	deletion.CompletedAt = deletion.UpdatedAt
+
+	metrics.PrometheusTraceDeletions.WithLabelValues(StatusFailed).Inc()
+
+	manager.Logger.Warn("Audit: trace deletion failed.",
+		zap.String("deletion_id", deletion.ID),
+		zap.String("account_id", deletion.AccountID),
+		zap.String("request_id", deletion.RequestID),
+		zap.Error(err))
+
+	if saveErr := manager.Deletions.SaveDeletion(parentSpan, ctx, *deletion); saveErr != nil {
+		manager.Logger.Error("Could not record the failed deletion.", zap.String("deletion_id", deletion.ID), zap.Error(saveErr))
+	}
+}
+
+// audit records a new deletion before any trace is deleted, so that no deletion is missing from the audit trail
+func (manager *Manager) audit(parentSpan opentracing.Span, ctx context.Context, deletion storage.Deletion) error {
+	manager.Logger.Info("Audit: trace deletion requested.",
+		zap.String("deletion_id", deletion.ID),
+		zap.String("account_id", deletion.AccountID),
+		zap.String("request_id", deletion.RequestID),
+		zap.Any("filters", deletion.Filters))
+
+	return manager.Deletions.SaveDeletion(parentSpan, ctx, deletion)
+}
+
+// DeleteTrace deletes a single trace of the account and waits until it is gone
+func (manager *Manager) DeleteTrace(parentSpan opentracing.Span, ctx context.Context, accountID string, requestID string, traceID string) (storage.Deletion, error) {
+	query := storage.TraceQuery{Account: accountID, ID: traceID}
+
+	deletion, err := manager.Delete(parentSpan, ctx, accountID, requestID, query, map[string]string{"id": traceID})
+	if err != nil {
+		return deletion, err
+	}
+
+	if deletion.DeletedCount == 0 && deletion.Status == StatusCompleted {
+		return deletion, ErrTraceNotFound
+	}
+
+	return deletion, nil
+}
+
+// Delete deletes the traces of the account that match query and waits until they are gone. filters are the request
+// parameters that the query was built from, kept for the audit trail
+func (manager *Manager) Delete(parentSpan opentracing.Span, ctx context.Context, accountID string, requestID string, query storage.TraceQuery, filters map[string]string) (storage.Deletion, error) {
+	if accountID == "" {
+		return storage.Deletion{}, ErrMissingAccount
+	}
+
+	query.Account = accountID
+	deletion := manager.newDeletion(accountID, requestID, query, filters)
+
+	if err := manager.audit(parentSpan, ctx, deletion); err != nil {
+		return storage.Deletion{}, err
+	}
+
+	progress, err := manager.Traces.DeleteDeviceTrace(parentSpan, ctx, query)
+	if err != nil {
+		manager.fail(parentSpan, ctx, &deletion, err)
+		return deletion, err
+	}
+
+	manager.finish(&deletion, progress)
+
+	if err := manager.Deletions.SaveDeletion(parentSpan, ctx, deletion); err != nil {
+		return deletion, err
+	}
+
+	return deletion, nil
+}
+
+// Submit starts deleting the traces of the account that match query in the background. filters are the request
+// parameters that the query was built from, kept for the audit trail
+func (manager *Manager) Submit(parentSpan opentracing.Span, ctx context.Context, accountID string, requestID string, query storage.TraceQuery, filters map[string]string) (storage.Deletion, error) {
+	if accountID == "" {
+		return storage.Deletion{}, ErrMissingAccount
+	}
+
+	query.Account = accountID
+	deletion := manager.newDeletion(accountID, requestID, query, filters)
+
+	if err := manager.audit(parentSpan, ctx, deletion); err != nil {
+		return storage.Deletion{}, err
+	}
+
+	taskID, err := manager.Traces.StartDeleteDeviceTrace(parentSpan, ctx, query)
+	if err != nil {
+		manager.fail(parentSpan, ctx, &deletion, err)
+		return deletion, err
+	}
+
+	deletion.TaskID = taskID
+	deletion.Status = StatusRunning
+	deletion.UpdatedAt = formatTime(time.Now())
+
+	if err := manager.Deletions.SaveDeletion(parentSpan, ctx, deletion); err != nil {
+		return deletion, err
+	}
+
+	return deletion, nil
+}
+
+// refresh updates a running deletion with the progress of its task
+func (manager *Manager) refresh(parentSpan opentracing.Span, ctx context.Context, deletion storage.Deletion) storage.Deletion {
+	if deletion.Status != StatusRunning {
+		return deletion
+	}
+
+	progress, err := manager.Traces.DeleteTaskProgress(parentSpan, ctx, deletion.TaskID)
+	if err == storage.ErrDeleteTaskNotFound {
+		manager.fail(parentSpan, ctx, &deletion, err)
+		return deletion
+	} else if err != nil {
+		// Keep the last known progress, the next refresh tries again
+		return deletion
+	}
+
+	manager.finish(&deletion, progress)
+
+	if err := manager.Deletions.SaveDeletion(parentSpan, ctx, deletion); err != nil {
+		manager.Logger.Warn("Could not record the deletion progress.", zap.String("deletion_id", deletion.ID), zap.Error(err))
+	}
+
+	return deletion
+}
+
+// Get returns a deletion of the account with its current progress
+func (manager *Manager) Get(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (storage.Deletion, error) {
+	deletion, err := manager.Deletions.GetDeletion(parentSpan, ctx, accountID, id)
+	if err != nil {
+		return storage.Deletion{}, err
+	}
+
+	return manager.refresh(parentSpan, ctx, deletion), nil
+}
+
+// List returns up to limit deletions of the account with an id before after, newest first
+func (manager *Manager) List(parentSpan opentracing.Span, ctx context.Context, accountID string, limit int, after string) ([]storage.Deletion, bool, error) {
+	deletions, hasMore, err := manager.Deletions.ListDeletions(parentSpan, ctx, accountID, limit, strings.TrimSpace(after))
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := range deletions {
+		deletions[i] = manager.refresh(parentSpan, ctx, deletions[i])
+	}
+
+	return deletions, hasMore, nil
+}
@@ -23,10 +23,10 @@
 #                   "type": "date",
 #                   "format": "strict_date_optional_time||epoch_millis"
 #                   },
-#         "app_name": {"type": "text"},
+#         "app_name": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
 #         "level": {"type": "text"},
 #         "message": {"type": "text"},
-#         "type": {"type": "text"},
+#         "type": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
 #         "timestring": {
 #                   "type": "date",
 #                   "format": "strict_date_optional_time_nanos"
@@ -64,10 +64,10 @@ curl -H "Content-Type: application/json" -XPUT "http://localhost:9200/_template/
                   "type": "date",
                   "format": "strict_date_optional_time||epoch_millis"
                   },
-        "app_name": {"type": "text"},
+        "app_name": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
         "level": {"type": "text"},
         "message": {"type": "text"},
-        "type": {"type": "text"},
+        "type": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
         "timestring": {
                   "type": "date",
                   "format": "strict_date_optional_time_nanos"
@@ -0,0 +1,79 @@
+package export
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Errors that might be returned by a BlobStore
+var (
+	ErrBlobNotFound = errors.New("Export file not found")
+)
+
+// Blob is an export file opened for reading
+type Blob struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores the result files of export jobs
+type BlobStore interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (Blob, error)
+	Delete(name string) error
+}
+
+// FileBlobStore implements BlobStore on a local directory
+type FileBlobStore struct {
+	Dir string
+}
+
+// NewFileBlobStore returns a FileBlobStore on dir, creating dir if needed
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+func (blobStore *FileBlobStore) path(name string) string {
+	return filepath.Join(blobStore.Dir, filepath.Base(name))
+}
+
+// Create creates or truncates the named file
+func (blobStore *FileBlobStore) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(blobStore.path(name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+}
+
+// Open opens the named file for reading
+func (blobStore *FileBlobStore) Open(name string) (Blob, error) {
+	file, err := os.Open(blobStore.path(name))
+	if os.IsNotExist(err) {
+		return Blob{}, ErrBlobNotFound
+	} else if err != nil {
+		return Blob{}, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Blob{}, err
+	}
+
+	return Blob{ReadSeekCloser: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the named file. Deleting a missing file is not an error
+func (blobStore *FileBlobStore) Delete(name string) error {
+	err := os.Remove(blobStore.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
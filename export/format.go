@@ -0,0 +1,113 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// Errors that might be returned when encoding traces
+var (
+	ErrUnknownFormat = errors.New("Unknown export format")
+)
+
+// csvHeader lists the columns of a CSV export
+var csvHeader = []string{"id", "account_id", "device_id", "timestamp", "created_at", "app_name", "type", "message"}
+
+// TraceWriter encodes traces in one of the export formats
+type TraceWriter interface {
+	Write(traces []storage.TraceResponse) error
+	Flush() error
+}
+
+// IsFormat reports whether format is a supported export format
+func IsFormat(format string) bool {
+	return format == FormatNDJSON || format == FormatCSV
+}
+
+// ContentType returns the media type of an export format
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+
+	return "application/x-ndjson"
+}
+
+// NewTraceWriter returns a TraceWriter that encodes traces as format to w
+func NewTraceWriter(w io.Writer, format string) (TraceWriter, error) {
+	switch format {
+	case FormatNDJSON:
+		buffered := bufio.NewWriter(w)
+
+		return &ndjsonWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	case FormatCSV:
+		return &csvWriter{writer: csv.NewWriter(w)}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+type ndjsonWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (w *ndjsonWriter) Write(traces []storage.TraceResponse) error {
+	for _, trace := range traces {
+		if err := w.encoder.Encode(trace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.buffered.Flush()
+}
+
+type csvWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func (w *csvWriter) Write(traces []storage.TraceResponse) error {
+	if !w.headerWritten {
+		if err := w.writer.Write(csvHeader); err != nil {
+			return err
+		}
+		w.headerWritten = true
+	}
+
+	for _, trace := range traces {
+		record := []string{trace.ID, trace.AccountID, trace.DeviceID, trace.Timestamp, trace.CreatedAt, trace.AppName, trace.Type, trace.Message}
+
+		if err := w.writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *csvWriter) Flush() error {
+	if !w.headerWritten {
+		if err := w.Write(nil); err != nil {
+			return err
+		}
+	}
+
+	w.writer.Flush()
+
+	return w.writer.Error()
+}
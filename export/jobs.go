@@ -0,0 +1,553 @@
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/muuid-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+
+	DefaultJobExpiration       = 24 * time.Hour
+	DefaultMaxJobsPerAccount   = 2
+	DefaultJobWorkers          = 4
+	DefaultJobCleanupInterval  = 10 * time.Minute
+	jobQueueSize               = 1000
+	jobProgressPersistInterval = 5 * time.Second
+)
+
+// Errors that might be returned by the JobManager
+var (
+	ErrTooManyJobs = errors.New("Too many export jobs in progress for the account")
+	ErrQueueFull   = errors.New("The export queue is full")
+	ErrJobNotReady = errors.New("The export job has not completed")
+)
+
+// JobSpec specifies what an export job exports
+type JobSpec struct {
+	Query       storage.TraceQuery `json:"query"`
+	Format      string             `json:"format"`
+	Compression string             `json:"compression"`
+	Filters     map[string]string  `json:"filters"`
+}
+
+// Job is an asynchronous export and its progress
+type Job struct {
+	ID            string  `json:"id"`
+	Object        string  `json:"object"`
+	AccountID     string  `json:"account_id"`
+	RequestID     string  `json:"request_id"`
+	Status        string  `json:"status"`
+	Spec          JobSpec `json:"spec"`
+	ExportedCount uint64  `json:"exported_count"`
+	TotalCount    uint64  `json:"total_count"`
+	Size          int64   `json:"size"`
+	Error         string  `json:"error,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	StartedAt     string  `json:"started_at,omitempty"`
+	CompletedAt   string  `json:"completed_at,omitempty"`
+	ExpiresAt     string  `json:"expires_at,omitempty"`
+}
+
+// FileName returns the name of the result file of the job
+func (job Job) FileName() string {
+	name := fmt.Sprintf("device-trace-%s.%s", job.ID, job.Spec.Format)
+
+	if job.Spec.Compression == CompressionGzip {
+		name += ".gz"
+	}
+
+	return name
+}
+
+// expired reports whether a finished job is past its expiration
+func (job Job) expired(now time.Time) bool {
+	if job.ExpiresAt == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, job.ExpiresAt)
+
+	return err == nil && now.After(expiresAt)
+}
+
+// JobManager runs export jobs in the background and keeps track of their state
+type JobManager struct {
+	TraceStore        storage.TraceStore
+	Jobs              JobStore
+	Blobs             BlobStore
+	UUIDGenerator     *muuid.MUUIDGenerator
+	Logger            *zap.Logger
+	Expiration        time.Duration
+	MaxJobsPerAccount int
+	Workers           int
+	CleanupInterval   time.Duration
+
+	lock    sync.Mutex
+	active  map[string]int
+	cancels map[string]context.CancelFunc
+	queue   chan queuedJob
+}
+
+// queuedJob identifies a job waiting for a worker
+type queuedJob struct {
+	ID        string
+	AccountID string
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Start re-queues the jobs that were interrupted by a restart and starts the workers and the cleanup of expired jobs.
+// They stop when ctx is done
+func (manager *JobManager) Start(ctx context.Context) error {
+	if manager.Expiration <= 0 {
+		manager.Expiration = DefaultJobExpiration
+	}
+
+	if manager.MaxJobsPerAccount <= 0 {
+		manager.MaxJobsPerAccount = DefaultMaxJobsPerAccount
+	}
+
+	if manager.Workers <= 0 {
+		manager.Workers = DefaultJobWorkers
+	}
+
+	if manager.CleanupInterval <= 0 {
+		manager.CleanupInterval = DefaultJobCleanupInterval
+	}
+
+	manager.active = make(map[string]int)
+	manager.cancels = make(map[string]context.CancelFunc)
+	manager.queue = make(chan queuedJob, jobQueueSize)
+
+	jobs, err := manager.Jobs.List()
+	if err != nil {
+		return err
+	}
+
+	// Jobs are restarted from scratch, oldest first
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt < jobs[j].CreatedAt })
+
+	for _, job := range jobs {
+		if job.Status != JobStatusQueued && job.Status != JobStatusRunning {
+			continue
+		}
+
+		manager.Logger.Info("Resuming export job", zap.String("job_id", job.ID), zap.String("account_id", job.AccountID))
+
+		job.Status = JobStatusQueued
+		job.ExportedCount = 0
+		job.StartedAt = ""
+
+		if err := manager.Jobs.Save(job); err != nil {
+			return err
+		}
+
+		manager.active[job.AccountID]++
+
+		select {
+		case manager.queue <- queuedJob{ID: job.ID, AccountID: job.AccountID}:
+		default:
+			manager.active[job.AccountID]--
+			manager.fail(job, ErrQueueFull)
+		}
+	}
+
+	for i := 0; i < manager.Workers; i++ {
+		go manager.work(ctx)
+	}
+
+	go manager.cleanup(ctx)
+
+	return nil
+}
+
+// Submit creates a job for spec and queues it
+func (manager *JobManager) Submit(accountID string, requestID string, spec JobSpec) (Job, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.active[accountID] >= manager.MaxJobsPerAccount {
+		return Job{}, ErrTooManyJobs
+	}
+
+	if len(manager.queue) >= cap(manager.queue) {
+		return Job{}, ErrQueueFull
+	}
+
+	spec.Query.Account = accountID
+
+	job := Job{
+		ID:        manager.UUIDGenerator.UUID().String(),
+		Object:    "device-trace-export",
+		AccountID: accountID,
+		RequestID: requestID,
+		Status:    JobStatusQueued,
+		Spec:      spec,
+		CreatedAt: formatTime(time.Now()),
+	}
+
+	if err := manager.Jobs.Save(job); err != nil {
+		return Job{}, err
+	}
+
+	manager.active[accountID]++
+	manager.queue <- queuedJob{ID: job.ID, AccountID: accountID}
+
+	return job, nil
+}
+
+// Get returns the job with id if it belongs to accountID
+func (manager *JobManager) Get(accountID string, id string) (Job, error) {
+	job, err := manager.Jobs.Get(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if job.AccountID != accountID {
+		return Job{}, ErrJobNotFound
+	}
+
+	return job, nil
+}
+
+// List returns the jobs of accountID, newest first
+func (manager *JobManager) List(accountID string) ([]Job, error) {
+	jobs, err := manager.Jobs.List()
+	if err != nil {
+		return nil, err
+	}
+
+	accountJobs := make([]Job, 0)
+
+	for _, job := range jobs {
+		if job.AccountID == accountID {
+			accountJobs = append(accountJobs, job)
+		}
+	}
+
+	sort.Slice(accountJobs, func(i, j int) bool { return accountJobs[i].CreatedAt > accountJobs[j].CreatedAt })
+
+	return accountJobs, nil
+}
+
+// Open opens the result file of a completed job of accountID
+func (manager *JobManager) Open(accountID string, id string) (Job, Blob, error) {
+	job, err := manager.Get(accountID, id)
+	if err != nil {
+		return Job{}, Blob{}, err
+	}
+
+	if job.Status != JobStatusCompleted {
+		return Job{}, Blob{}, ErrJobNotReady
+	}
+
+	blob, err := manager.Blobs.Open(job.FileName())
+
+	return job, blob, err
+}
+
+// Delete cancels the job of accountID if it is running and removes it with its result file
+func (manager *JobManager) Delete(accountID string, id string) error {
+	job, err := manager.Get(accountID, id)
+	if err != nil {
+		return err
+	}
+
+	// A running job is removed by its worker once it has stopped writing. The lock keeps the worker from
+	// starting or finishing the job in between
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if cancel, running := manager.cancels[id]; running {
+		cancel()
+		return nil
+	}
+
+	return manager.remove(job)
+}
+
+func (manager *JobManager) remove(job Job) error {
+	if err := manager.Blobs.Delete(job.FileName()); err != nil {
+		return err
+	}
+
+	return manager.Jobs.Delete(job.ID)
+}
+
+func (manager *JobManager) release(queued queuedJob) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.active[queued.AccountID]--
+	if manager.active[queued.AccountID] <= 0 {
+		delete(manager.active, queued.AccountID)
+	}
+
+	delete(manager.cancels, queued.ID)
+}
+
+// save writes the job of a worker unless the job was cancelled, whose worker removes it instead. A finished job is
+// no longer running, so that Delete removes it itself
+func (manager *JobManager) save(ctx context.Context, job Job, finished bool) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := manager.Jobs.Save(job); err != nil {
+		return err
+	}
+
+	if finished {
+		delete(manager.cancels, job.ID)
+	}
+
+	return nil
+}
+
+func (manager *JobManager) fail(job Job, err error) {
+	now := time.Now()
+
+	job.Status = JobStatusFailed
+	job.Error = err.Error()
+	job.CompletedAt = formatTime(now)
+	job.ExpiresAt = formatTime(now.Add(manager.Expiration))
+
+	if saveErr := manager.Jobs.Save(job); saveErr != nil {
+		manager.Logger.Error("Could not save failed export job", zap.String("job_id", job.ID), zap.Error(saveErr))
+	}
+}
+
+func (manager *JobManager) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case queued := <-manager.queue:
+			manager.run(ctx, queued)
+		}
+	}
+}
+
+func (manager *JobManager) run(parent context.Context, queued queuedJob) {
+	defer manager.release(queued)
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// The job is read and marked as running at once, so that Delete either removes it before or cancels it after
+	manager.lock.Lock()
+	job, err := manager.Jobs.Get(queued.ID)
+	if err == nil {
+		manager.cancels[job.ID] = cancel
+	}
+	manager.lock.Unlock()
+
+	if err != nil {
+		// The job was deleted while it was queued
+		manager.Logger.Debug("Skipping export job", zap.String("job_id", queued.ID), zap.Error(err))
+		return
+	}
+
+	logger := manager.Logger.With(zap.String("job_id", job.ID), zap.String("account_id", job.AccountID), zap.String("request_id", job.RequestID))
+
+	ctx = context.WithValue(ctx, httputil.ContextKeyRequestID, job.RequestID)
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, job.AccountID)
+
+	span := opentracing.StartSpan("JobManager.run")
+	span.SetTag("component", "export")
+	span.SetTag("job_id", job.ID)
+	defer span.Finish()
+
+	job.Status = JobStatusRunning
+	job.StartedAt = formatTime(time.Now())
+
+	// The total count is an estimate, traces may still arrive while the job runs
+	countQuery := job.Spec.Query
+	countQuery.Limit = 1
+	if page, err := manager.TraceStore.SearchDeviceTrace(span, ctx, countQuery, true); err == nil {
+		job.TotalCount = page.TotalCount
+	}
+
+	if err := manager.save(ctx, job, false); err != nil && ctx.Err() == nil {
+		logger.Error("Could not save export job", zap.Error(err))
+		return
+	}
+
+	if ctx.Err() == nil {
+		logger.Info("Starting export job")
+	}
+
+	size, err := manager.write(ctx, span, &job)
+	if err != nil && ctx.Err() == nil {
+		logger.Error("Export job failed", zap.Error(err))
+		manager.Blobs.Delete(job.FileName())
+
+		now := time.Now()
+		job.Status = JobStatusFailed
+		job.Error = err.Error()
+		job.CompletedAt = formatTime(now)
+		job.ExpiresAt = formatTime(now.Add(manager.Expiration))
+	} else if err == nil {
+		now := time.Now()
+		job.Status = JobStatusCompleted
+		job.Size = size
+		job.CompletedAt = formatTime(now)
+		job.ExpiresAt = formatTime(now.Add(manager.Expiration))
+	}
+
+	if err := manager.save(ctx, job, true); err == nil {
+		if job.Status == JobStatusCompleted {
+			logger.Info("Export job completed", zap.Uint64("exported", job.ExportedCount), zap.Int64("size", size))
+		}
+
+		return
+	} else if ctx.Err() == nil {
+		logger.Error("Could not save finished export job", zap.Error(err))
+		return
+	}
+
+	if parent.Err() != nil {
+		// Shutting down, the job is resumed on the next start
+		logger.Info("Export job interrupted")
+		return
+	}
+
+	logger.Info("Export job cancelled")
+
+	if err := manager.remove(job); err != nil {
+		logger.Error("Could not remove cancelled export job", zap.Error(err))
+	}
+}
+
+// countingWriter counts the bytes written to the result file
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+
+	return n, err
+}
+
+func (manager *JobManager) write(ctx context.Context, span opentracing.Span, job *Job) (int64, error) {
+	file, err := manager.Blobs.Create(job.FileName())
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	counter := &countingWriter{Writer: file}
+
+	var body io.Writer = counter
+	var gzipWriter *gzip.Writer
+
+	if job.Spec.Compression == CompressionGzip {
+		gzipWriter = gzip.NewWriter(counter)
+		body = gzipWriter
+	}
+
+	traceWriter, err := NewTraceWriter(body, job.Spec.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	lastPersisted := time.Now()
+
+	err = storage.ScanDeviceTrace(manager.TraceStore, span, ctx, job.Spec.Query, func(traces []storage.TraceResponse) error {
+		if err := traceWriter.Write(traces); err != nil {
+			return err
+		}
+
+		job.ExportedCount += uint64(len(traces))
+
+		if time.Since(lastPersisted) >= jobProgressPersistInterval && ctx.Err() == nil {
+			lastPersisted = time.Now()
+
+			return manager.save(ctx, *job, false)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := traceWriter.Flush(); err != nil {
+		return 0, err
+	}
+
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	return counter.count, nil
+}
+
+func (manager *JobManager) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(manager.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			jobs, err := manager.Jobs.List()
+			if err != nil {
+				manager.Logger.Error("Could not list export jobs for cleanup", zap.Error(err))
+				continue
+			}
+
+			now := time.Now()
+
+			for _, job := range jobs {
+				if !job.expired(now) {
+					continue
+				}
+
+				if err := manager.remove(job); err != nil {
+					manager.Logger.Error("Could not remove expired export job", zap.String("job_id", job.ID), zap.Error(err))
+					continue
+				}
+
+				manager.Logger.Info("Removed expired export job", zap.String("job_id", job.ID), zap.String("account_id", job.AccountID))
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Errors that might be returned by a JobStore
+var (
+	ErrJobNotFound = errors.New("Export job not found")
+)
+
+// JobStore persists export jobs so that they survive a restart of the service
+type JobStore interface {
+	Save(job Job) error
+	Get(id string) (Job, error)
+	List() ([]Job, error)
+	Delete(id string) error
+}
+
+// FileJobStore implements JobStore with one JSON file per job in a local directory
+type FileJobStore struct {
+	Dir string
+}
+
+// NewFileJobStore returns a FileJobStore on dir, creating dir if needed
+func NewFileJobStore(dir string) (*FileJobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileJobStore{Dir: dir}, nil
+}
+
+func (jobStore *FileJobStore) path(id string) string {
+	return filepath.Join(jobStore.Dir, filepath.Base(id)+".json")
+}
+
+// Save writes the job, replacing the file atomically
+func (jobStore *FileJobStore) Save(job Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tmp := jobStore.path(job.ID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, jobStore.path(job.ID))
+}
+
+// Get reads the job with id
+func (jobStore *FileJobStore) Get(id string) (Job, error) {
+	var job Job
+
+	encoded, err := ioutil.ReadFile(jobStore.path(id))
+	if os.IsNotExist(err) {
+		return Job{}, ErrJobNotFound
+	} else if err != nil {
+		return Job{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &job); err != nil {
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// List reads every stored job
+func (jobStore *FileJobStore) List() ([]Job, error) {
+	files, err := ioutil.ReadDir(jobStore.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		job, err := jobStore.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// Delete removes the job with id. Deleting a missing job is not an error
+func (jobStore *FileJobStore) Delete(id string) error {
+	err := os.Remove(jobStore.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -7,6 +7,7 @@ require (
 	github.com/codahale/hdrhistogram v0.9.0 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/olivere/elastic/v7 v7.0.20
@@ -15,5 +16,6 @@ require (
 	github.com/prometheus/client_golang v1.7.1
 	github.com/uber/jaeger-client-go v2.25.0+incompatible
 	github.com/uber/jaeger-lib v2.4.0+incompatible
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.16.0
 )
@@ -9,9 +9,17 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 	"github.com/armPelionEdge/muuid-go"
+	"github.com/armPelionEdge/edge-gw-trace-service/alerts"
+	"github.com/armPelionEdge/edge-gw-trace-service/anomalies"
+	"github.com/armPelionEdge/edge-gw-trace-service/archive"
+	"github.com/armPelionEdge/edge-gw-trace-service/deletions"
+	"github.com/armPelionEdge/edge-gw-trace-service/export"
 	"github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/retention"
+	"github.com/armPelionEdge/edge-gw-trace-service/rollover"
 	"github.com/armPelionEdge/edge-gw-trace-service/routes"
 	"github.com/armPelionEdge/edge-gw-trace-service/storage"
 	"github.com/armPelionEdge/edge-gw-trace-service/tracing"
@@ -33,37 +41,312 @@ func main() {
 	var esURL string
 	var esSearchAlias string
 	var esActiveAlias string
+	var esSavedSearchIndex string
+	var esDeletionIndex string
+	var esBootstrap bool
+	var esILMPolicy string
+	var esShards int
+	var esReplicas int
+	var esTotalShardsPerNode int
+	var migrateOnly bool
+	var storageBackend string
+	var memoryMaxTraces int
+	var diskDir string
+	var esEngine string
+	var lokiURL string
+	var lokiTenant string
+	var lokiMaxLookback time.Duration
+	var esTenantRouting string
+	var esTenantIndexPrefix string
+	var migrateTenant string
+	var esRolloverInterval time.Duration
+	var esRolloverMaxAge string
+	var esRolloverMaxDocs int64
+	var esRolloverMaxSize string
+	var esLeaseIndex string
+	var deletionPollInterval time.Duration
+	var retentionDir string
+	var esRetentionIndex string
+	var retentionInterval time.Duration
+	var retentionMaxDays int
+	var archiveDir string
+	var archiveS3Endpoint string
+	var archiveS3Bucket string
+	var archiveS3Region string
+	var esRehydrationIndex string
+	var replicas int
+	var archiveDays int
+	var archiveInterval time.Duration
+	var rehydrationIndexPrefix string
+	var rehydrationExpiration time.Duration
+	var rehydrationMaxPerAccount int
 	var loggingLevel string
 	var uuidNetworkInterface string
 	var jwtKey string
 	var deviceDirectoryURLStr string
+	var deviceSelectionTTL time.Duration
+	var deviceSelectionMax int
+	var deviceValidationTTL time.Duration
+	var deviceIDsMax int
+	var deviceValidationLenient bool
+	var deviceDirectoryTimeout time.Duration
+	var deviceDirectoryRetries int
+	var deviceDirectoryBreakerThreshold int
+	var deviceDirectoryBreakerCooldown time.Duration
+	var deviceCacheTTL time.Duration
+	var deviceCacheStaleTTL time.Duration
+	var deviceCacheSize int
 	var jwtIssuer string
 	var jwtExpSeconds int64
 	var jwtSigningKeyFile string
+	var exportDir string
+	var exportExpiration time.Duration
+	var exportMaxJobsPerAccount int
+	var exportWorkers int
+	var alertDir string
+	var esAlertIndex string
+	var alertInterval time.Duration
+	var alertWebhookTimeout time.Duration
+	var alertWebhookAttempts int
+	var anomalyDir string
+	var anomalyBucket time.Duration
+	var anomalyBaseline time.Duration
+	var anomalyMaxSeries int
+	flag.StringVar(&storageBackend, "storage", "elasticsearch", "The trace store, elasticsearch, loki, disk or memory")
+	flag.IntVar(&memoryMaxTraces, "memoryMaxTraces", storage.DefaultMemoryMaxTraces, "Maximum number of traces kept by the memory storage, the oldest are dropped first")
+	flag.StringVar(&diskDir, "diskDir", "", "Directory for the trace database and the deletions of the disk storage")
+	flag.StringVar(&lokiURL, "lokiURL", "", "The host address for the Loki of the loki storage")
+	flag.StringVar(&lokiTenant, "lokiTenant", "", "The Loki tenant, sent as X-Scope-OrgID if not empty")
+	flag.DurationVar(&lokiMaxLookback, "lokiMaxLookback", storage.DefaultLokiMaxLookback, "How far back the searches of the loki storage look. Every search reads the lines of this long ago")
 	flag.StringVar(&esURL, "esURL", "", "The host address for elastic search service")
+	flag.StringVar(&esEngine, "esEngine", "", "The search engine at esURL, elasticsearch7, elasticsearch8 or opensearch. It is detected from the cluster if empty")
 	flag.StringVar(&esSearchAlias, "esSearchAlias", "", "The search alias name for the elastic search service")
 	flag.StringVar(&esActiveAlias, "esActiveAlias", "", "The active alias name for the elastic search service")
+	flag.StringVar(&esSavedSearchIndex, "esSavedSearchIndex", "device-trace-saved-searches", "The index name for saved searches in the elastic search service")
+	flag.BoolVar(&esBootstrap, "esBootstrap", false, "Create or upgrade the index template, the ILM policy, the first index and the aliases on startup")
+	flag.StringVar(&esILMPolicy, "esILMPolicy", storage.DefaultILMPolicy, "The ILM policy that rolls the active index over. ILM is not used if empty or if esRolloverInterval is set")
+	flag.IntVar(&esShards, "esShards", storage.KeepSetting, "Number of primary shards of each trace index. -1 keeps the setting of the existing index template, or is 1 for a new one")
+	flag.IntVar(&esReplicas, "esReplicas", storage.KeepSetting, "Number of replicas of each trace index. -1 keeps the setting of the existing index template, or is 0 for a new one")
+	flag.IntVar(&esTotalShardsPerNode, "esTotalShardsPerNode", storage.KeepSetting, "Maximum number of shards of a trace index on one node. -1 keeps the setting of the existing index template, or is 1 for a new one")
+	flag.DurationVar(&esRolloverInterval, "esRolloverInterval", rollover.DefaultInterval, "How often the rollover manager checks the rollover conditions of the active index. The rollover manager is used instead of ILM if set, or if esILMPolicy is empty")
+	flag.StringVar(&esRolloverMaxAge, "esRolloverMaxAge", storage.DefaultRolloverMaxAge, "The age after which the active index is rolled over. Not a condition if empty")
+	flag.Int64Var(&esRolloverMaxDocs, "esRolloverMaxDocs", 0, "The number of traces after which the active index is rolled over. Not a condition if 0")
+	flag.StringVar(&esRolloverMaxSize, "esRolloverMaxSize", storage.DefaultRolloverMaxSize, "The primary shard size after which the active index is rolled over. Not a condition if empty")
+	flag.StringVar(&esLeaseIndex, "esLeaseIndex", "device-trace-leases", "The index name for the leases that elect the replica which rolls the active index over")
+	flag.StringVar(&esTenantRouting, "esTenantRouting", "", "The filepath to the JSON file of the accounts routed to dedicated index families or by _routing")
+	flag.StringVar(&esTenantIndexPrefix, "esTenantIndexPrefix", storage.DefaultTenantIndexPrefix, "The prefix of the aliases and indices of the dedicated index families")
+	flag.StringVar(&migrateTenant, "migrate-tenant", "", "Move the traces that this account wrote before it was routed to where esTenantRouting routes them and exit")
+	flag.BoolVar(&migrateOnly, "migrate-only", false, "Create or upgrade the elastic search schema and exit")
+	flag.StringVar(&esDeletionIndex, "esDeletionIndex", "device-trace-deletions", "The index name for the audit trail of trace deletions. Trace deletion is disabled if empty")
+	flag.StringVar(&retentionDir, "retentionDir", "", "Directory for the retention policies of the accounts with the disk storage. Retention policies are disabled if empty")
+	flag.StringVar(&esRetentionIndex, "esRetentionIndex", "", "The index name for the retention policies of the accounts in the elastic search service, shared by every replica. Retention policies with the elasticsearch storage are disabled if empty")
+	flag.DurationVar(&retentionInterval, "retentionInterval", retention.DefaultPurgeInterval, "How often traces past their retention are purged")
+	flag.IntVar(&retentionMaxDays, "retentionMaxDays", retention.DefaultMaxDays, "Maximum retention in days that a policy may set")
+	flag.StringVar(&archiveDir, "archiveDir", "", "Directory for the archive files of old traces and the rehydrations of a single replica. Archiving is disabled if empty and archiveS3Bucket is not set")
+	flag.StringVar(&archiveS3Endpoint, "archiveS3Endpoint", "", "The endpoint of the S3 compatible object store for the archive files shared by every replica")
+	flag.StringVar(&archiveS3Bucket, "archiveS3Bucket", "", "The bucket for the archive files in archiveS3Endpoint. Archiving is disabled if empty and archiveDir is not set")
+	flag.StringVar(&archiveS3Region, "archiveS3Region", archive.DefaultS3Region, "The region of archiveS3Bucket that the requests are signed for")
+	flag.StringVar(&esRehydrationIndex, "esRehydrationIndex", "", "The index name for the rehydrations in the elastic search service, shared by every replica. Required with archiveS3Bucket")
+	flag.IntVar(&replicas, "replicas", 1, "The number of replicas of the service. archiveDir, exportDir, alertDir and anomalyDir, which the replicas do not share, are rejected if more than 1")
+	flag.IntVar(&archiveDays, "archiveDays", archive.DefaultArchiveDays, "Age in days after which traces are moved to the archive")
+	flag.DurationVar(&archiveInterval, "archiveInterval", archive.DefaultArchiveInterval, "How often traces past archiveDays are archived")
+	flag.StringVar(&rehydrationIndexPrefix, "rehydrationIndexPrefix", archive.DefaultRehydrationIndexPrefix, "The prefix of the temporary indices that archived traces are rehydrated into")
+	flag.DurationVar(&rehydrationExpiration, "rehydrationExpiration", archive.DefaultRehydrationExpiration, "How long rehydrated traces are searchable")
+	flag.IntVar(&rehydrationMaxPerAccount, "rehydrationMaxPerAccount", archive.DefaultMaxRehydrationsPerAccount, "Maximum number of rehydrations per account")
+	flag.DurationVar(&deletionPollInterval, "deletionPollInterval", deletions.DefaultPollInterval, "How often the progress of running trace deletions is checked")
 	flag.StringVar(&loggingLevel, "loggingLevel", "debug", "The level of logging desired")
 	flag.StringVar(&uuidNetworkInterface, "uuidNetworkInterface", "eth0", "The network interface to be used for uuid generation")
 	flag.StringVar(&jwtKey, "jwtKey", "", "Public key used for decoding token")
 	flag.StringVar(&deviceDirectoryURLStr, "deviceDirectoryURL", "", "Root URL of the device directory service")
+	flag.DurationVar(&deviceSelectionTTL, "deviceSelectionTTL", services.DefaultSelectionTTL, "How long the devices of a device group or filter are cached")
+	flag.IntVar(&deviceSelectionMax, "deviceSelectionMax", services.DefaultMaxSelectionDevices, "Maximum number of devices that a device group or filter may select")
+	flag.DurationVar(&deviceValidationTTL, "deviceValidationTTL", services.DefaultValidationTTL, "How long the ownership of a device in device_id__in is cached")
+	flag.IntVar(&deviceIDsMax, "deviceIDsMax", services.DefaultMaxDeviceIDs, "Maximum number of device ids in device_id__in")
+	flag.DurationVar(&deviceDirectoryTimeout, "deviceDirectoryTimeout", services.DefaultClientTimeout, "Timeout of each device directory request")
+	flag.IntVar(&deviceDirectoryRetries, "deviceDirectoryRetries", services.DefaultRetries, "How many times a failed device directory GET request is retried")
+	flag.IntVar(&deviceDirectoryBreakerThreshold, "deviceDirectoryBreakerThreshold", services.DefaultBreakerThreshold, "Consecutive device directory failures that open the circuit breaker")
+	flag.DurationVar(&deviceDirectoryBreakerCooldown, "deviceDirectoryBreakerCooldown", services.DefaultBreakerCooldown, "How long the open circuit breaker rejects device directory requests")
+	flag.DurationVar(&deviceCacheTTL, "deviceCacheTTL", services.DefaultDeviceCacheTTL, "How long a device lookup is cached")
+	flag.DurationVar(&deviceCacheStaleTTL, "deviceCacheStaleTTL", services.DefaultDeviceCacheStaleTTL, "How long a cached device is used while the device directory is failing")
+	flag.IntVar(&deviceCacheSize, "deviceCacheSize", services.DefaultDeviceCacheSize, "Maximum number of cached device lookups")
+	flag.BoolVar(&deviceValidationLenient, "deviceValidationLenient", false, "Ignore unknown device ids in device_id__in instead of rejecting the request")
 	flag.StringVar(&jwtIssuer, "jwtIssuer", "gateway-trace", "Issuer field for JWT tokens")
 	flag.Int64Var(&jwtExpSeconds, "jwtExpiration", 60, "JWT expiration time in seconds")
 	flag.StringVar(&jwtSigningKeyFile, "jwtSigningKey", "", "Private key used for JWT signing")
+	flag.StringVar(&exportDir, "exportDir", "", "Directory for asynchronous export jobs and their files. Export jobs are disabled if empty")
+	flag.DurationVar(&exportExpiration, "exportExpiration", export.DefaultJobExpiration, "How long export files are kept after the job finishes")
+	flag.IntVar(&exportMaxJobsPerAccount, "exportMaxJobsPerAccount", export.DefaultMaxJobsPerAccount, "Maximum number of queued or running export jobs per account")
+	flag.IntVar(&exportWorkers, "exportWorkers", export.DefaultJobWorkers, "Number of export jobs run concurrently")
+	flag.StringVar(&alertDir, "alertDir", "", "Directory for alert rules of the disk and loki storages. Alerting is disabled if empty")
+	flag.StringVar(&esAlertIndex, "esAlertIndex", "", "The index name for alert rules in the elastic search service, shared by every replica. Alerting with the elasticsearch storage is disabled if empty")
+	flag.DurationVar(&alertInterval, "alertInterval", alerts.DefaultEvaluationInterval, "How often threshold alert rules are evaluated")
+	flag.DurationVar(&alertWebhookTimeout, "alertWebhookTimeout", alerts.DefaultWebhookTimeout, "Timeout of a single alert webhook request")
+	flag.IntVar(&alertWebhookAttempts, "alertWebhookAttempts", alerts.DefaultWebhookAttempts, "Maximum number of attempts to deliver an alert notification")
+	flag.StringVar(&anomalyDir, "anomalyDir", "", "Directory for the anomaly detection settings of the accounts. Anomaly detection is disabled if empty")
+	flag.DurationVar(&anomalyBucket, "anomalyBucket", anomalies.DefaultBucketSize, "Size of the buckets that log rates are counted in")
+	flag.DurationVar(&anomalyBaseline, "anomalyBaseline", anomalies.DefaultBaselineWindow, "Time window that the log rate baselines follow")
+	flag.IntVar(&anomalyMaxSeries, "anomalyMaxSeries", anomalies.DefaultMaxSeries, "Maximum number of device, type and app_name series that log rates are counted for per account")
 	flag.Parse()
 
-	if esURL == "" {
-		fmt.Fprintf(os.Stderr, "Argument \"esURL\" is required.\n")
+	// Set up zap logging component
+	atom := zap.NewAtomicLevel()
+	logger := zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.Lock(os.Stdout),
+		atom,
+	), zap.AddCaller())
+
+	// Set Logging Level
+	atom.SetLevel(log.ZapLogLevel(loggingLevel))
+
+	// The trace store is elastic search, loki, disk for single node deployments or memory for running the service locally
+	var traceStore storage.TraceStore
+	var esTraceStore *storage.ESTraceStore
+	var diskTraceStore *storage.DiskTraceStore
+	var err error
+
+	if storageBackend != "elasticsearch" && (migrateOnly || migrateTenant != "") {
+		fmt.Fprintf(os.Stderr, "Arguments \"migrate-only\" and \"migrate-tenant\" need \"storage=elasticsearch\".\n")
 		os.Exit(1)
 	}
 
-	if esSearchAlias == "" {
-		fmt.Fprintf(os.Stderr, "Argument \"esSearchAlias\" is required.\n")
+	// The ILM policy and the rollover manager both roll the active index over, only one of them is used. The one that
+	// is set explicitly wins over the default of the other
+	explicitFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	if explicitFlags["esILMPolicy"] && esILMPolicy != "" && explicitFlags["esRolloverInterval"] && esRolloverInterval > 0 {
+		fmt.Fprintf(os.Stderr, "Arguments \"esILMPolicy\" and \"esRolloverInterval\" can not be used together, set \"esILMPolicy=\" or \"esRolloverInterval=0\".\n")
 		os.Exit(1)
 	}
 
-	if esActiveAlias == "" {
-		fmt.Fprintf(os.Stderr, "Argument \"esActiveAlias\" is required.\n")
+	if explicitFlags["esRolloverInterval"] && esRolloverInterval > 0 {
+		esILMPolicy = ""
+	} else if esILMPolicy != "" {
+		esRolloverInterval = 0
+	}
+
+	switch storageBackend {
+	case "loki":
+		if lokiURL == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"lokiURL\" is required.\n")
+			os.Exit(1)
+		}
+
+		lokiTraceStore := storage.NewLokiTraceStore(logger.With(zap.String("component", "storage.LokiTraceStore")), lokiURL, lokiTenant)
+		lokiTraceStore.MaxLookback = lokiMaxLookback
+
+		traceStore = lokiTraceStore
+	case "disk":
+		if diskDir == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"diskDir\" is required.\n")
+			os.Exit(1)
+		}
+
+		diskTraceStore, err = storage.NewDiskTraceStore(logger.With(zap.String("component", "storage.DiskTraceStore")), filepath.Join(diskDir, "traces"))
+
+		if err != nil {
+			logger.Error("main(): Failed to open the trace database.", zap.String("diskDir", diskDir), zap.Error(err))
+			os.Exit(1)
+		}
+
+		traceStore = diskTraceStore
+	case "memory":
+		logger.Warn("main(): Traces are kept in memory, they are lost when the service stops.", zap.Int("memoryMaxTraces", memoryMaxTraces))
+
+		traceStore = storage.NewMemoryTraceStore(memoryMaxTraces)
+	case "elasticsearch":
+		if esURL == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"esURL\" is required.\n")
+			os.Exit(1)
+		}
+
+		if esSearchAlias == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"esSearchAlias\" is required.\n")
+			os.Exit(1)
+		}
+
+		if esActiveAlias == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"esActiveAlias\" is required.\n")
+			os.Exit(1)
+		}
+
+		if migrateTenant != "" && esTenantRouting == "" {
+			fmt.Fprintf(os.Stderr, "Argument \"migrate-tenant\" needs \"esTenantRouting\".\n")
+			os.Exit(1)
+		}
+
+		// Initialize an instance of the ESTraceStore
+		esTraceStore, err = storage.NewESTraceStore(logger.With(zap.String("component", "storage.ESTraceStore")), esURL, esSearchAlias, esActiveAlias, esEngine)
+
+		if err != nil {
+			logger.Error("main(): Failed to connect to the ElasticSearch server.", zap.String("esURL", esURL), zap.Error(err))
+			os.Exit(1)
+		}
+
+		// Route the designated accounts to their index families or shards
+		if esTenantRouting != "" {
+			esTraceStore.Routing, err = storage.LoadIndexRouting(esTenantRouting, esTenantIndexPrefix)
+
+			if err != nil {
+				logger.Error("main(): Failed to load the tenant routing.", zap.String("esTenantRouting", esTenantRouting), zap.Error(err))
+				os.Exit(1)
+			}
+		}
+
+		// Create or upgrade the trace indices, of the shared aliases and of every index family, before anything reads or writes them
+		if esBootstrap || migrateOnly {
+			aliases := [][2]string{{esActiveAlias, esSearchAlias}}
+
+			for _, family := range esTraceStore.Routing.Families() {
+				familyActiveAlias, familySearchAlias := esTraceStore.Routing.FamilyAliases(family)
+				aliases = append(aliases, [2]string{familyActiveAlias, familySearchAlias})
+			}
+
+			for _, alias := range aliases {
+				bootstrap := storage.NewBootstrap(logger.With(zap.String("component", "storage.Bootstrap")).With(zap.String("alias", alias[0])), esTraceStore)
+				bootstrap.ElasticActiveAlias = alias[0]
+				bootstrap.ElasticSearchAlias = alias[1]
+				bootstrap.ILMPolicy = esILMPolicy
+				bootstrap.Shards = esShards
+				bootstrap.Replicas = esReplicas
+				bootstrap.TotalShardsPerNode = esTotalShardsPerNode
+				bootstrap.Rollover = storage.RolloverConditions{MaxAge: esRolloverMaxAge, MaxDocs: esRolloverMaxDocs, MaxSize: esRolloverMaxSize}
+
+				previousVersion, err := bootstrap.Run(context.Background())
+
+				if err != nil {
+					logger.Error("main(): Failed to bootstrap the ElasticSearch schema.", zap.String("esActiveAlias", alias[0]), zap.Int("schema_version", previousVersion), zap.Error(err))
+					os.Exit(1)
+				}
+
+				logger.Info("main(): ElasticSearch schema is up to date.", zap.String("esActiveAlias", alias[0]), zap.Int("previous_version", previousVersion), zap.Int("schema_version", storage.SchemaVersion))
+			}
+		}
+
+		if migrateOnly {
+			os.Exit(0)
+		}
+
+		// Move the traces of a tenant and exit
+		if migrateTenant != "" {
+			migration, err := esTraceStore.MigrateTenant(context.Background(), migrateTenant)
+
+			if err != nil {
+				logger.Error("main(): Failed to migrate the tenant.", zap.String("account_id", migrateTenant), zap.Any("migration", migration), zap.Error(err))
+				os.Exit(1)
+			}
+
+			logger.Info("main(): Migrated the tenant, set \"migrated\" in esTenantRouting.", zap.Any("migration", migration))
+			os.Exit(0)
+		}
+
+		traceStore = esTraceStore
+
+	default:
+		fmt.Fprintf(os.Stderr, "Argument \"storage\" must be elasticsearch, loki, disk or memory.\n")
 		os.Exit(1)
 	}
 
@@ -120,17 +403,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Set up zap logging component
-	atom := zap.NewAtomicLevel()
-	logger := zap.New(zapcore.NewCore(
-		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-		zapcore.Lock(os.Stdout),
-		atom,
-	), zap.AddCaller())
-
-	// Set Logging Level
-	atom.SetLevel(log.ZapLogLevel(loggingLevel))
-
 	// Initialize an muuid generator
 	var muuidGeneratorBuilder muuid.MUUIDGeneratorBuilder = muuid.MUUIDGeneratorBuilder{
 		NetworkInterface: uuidNetworkInterface,
@@ -152,12 +424,18 @@ func main() {
 		PublicKey: publicKey,
 	}
 
-	// Initialize an instance of the ESTraceStore
-	esTraceStore, err := storage.NewESTraceStore(logger.With(zap.String("component", "storage.ESTraceStore")), esURL, esSearchAlias, esActiveAlias)
+	// Initialize the saved search store on the same elastic search cluster
+	var savedSearches storage.SavedSearchStore
 
-	if err != nil {
-		logger.Error("main(): Failed to connect to the ElasticSearch server.", zap.String("esURL", esURL), zap.Error(err))
-		os.Exit(1)
+	if esTraceStore != nil {
+		esSavedSearchStore, err := storage.NewESSavedSearchStore(logger.With(zap.String("component", "storage.ESSavedSearchStore")), esTraceStore.ElasticSearchClient, esSavedSearchIndex)
+
+		if err != nil {
+			logger.Error("main(): Failed to initialize the saved search index.", zap.String("esSavedSearchIndex", esSavedSearchIndex), zap.Error(err))
+			os.Exit(1)
+		}
+
+		savedSearches = esSavedSearchStore
 	}
 
 	router := mux.NewRouter()
@@ -170,22 +448,439 @@ func main() {
 	}
 	logger.Debug("main(): Setting up web server.. ")
 
+	// The device directory validates device ids and resolves device groups and filters
+	deviceDirectoryClient := &services.DeviceDirectoryImpl {
+		Client : services.Client {
+			Client       : services.NewHTTPClient(deviceDirectoryTimeout),
+			JWTFactory   : &tokenFactory,
+			Logger       : logger.With(zap.String("component", "device-directory-client")),
+			Retries      : deviceDirectoryRetries,
+			RetryBackoff : services.DefaultRetryBackoff,
+			Breaker      : services.NewCircuitBreaker(deviceDirectoryBreakerThreshold, deviceDirectoryBreakerCooldown),
+		},
+		DeviceDirectoryServiceURL : deviceDirectoryURL,
+	}
+	deviceDirectory := services.NewCachedDeviceDirectory(deviceDirectoryClient, deviceCacheTTL, deviceCacheStaleTTL, deviceCacheSize)
+
 	// Initialize an instance of the TraceEndpoint and initialize TraceStore with the instance of ESTraceStore
 	TraceEndpoint := routes.TraceEndpoint {
-		TraceStore            : esTraceStore,
+		TraceStore            : traceStore,
 		AccessTokenMiddleware : middleware.ArmAccessTokenMiddleware(armAccessTokenGetter, armAccessTokenDecoder),
 		UUIDGenerator         : &uuidGenerator,
-		DeviceDirectory       : &services.DeviceDirectoryImpl {
-			Client : services.Client {
-				Client    : http.DefaultClient,
-				JWTFactory: &tokenFactory,
-				Logger    : logger.With(zap.String("component", "device-directory-client")),
-			},
-			DeviceDirectoryServiceURL : deviceDirectoryURL,
-		},
+		DeviceDirectory       : deviceDirectory,
+		DeviceSelector        : services.NewDeviceSelector(deviceDirectory, deviceSelectionTTL, deviceSelectionMax),
+		DeviceValidator       : services.NewDeviceValidator(deviceDirectory, deviceValidationTTL),
+		MaxDeviceIDs          : deviceIDsMax,
+		LenientDeviceValidation : deviceValidationLenient,
+		SavedSearches         : savedSearches,
 		Logger                : logger.With(zap.String("component", "routes.TraceEndpoint")),
 	}
 
+	// Background work stops when the server shuts down
+	backgroundCtx, backgroundCancel := context.WithCancel(context.Background())
+	defer backgroundCancel()
+
+	// Start the asynchronous export jobs. The jobs and their files are on the local disk, a job created on one replica
+	// could not be polled or downloaded on another
+	if exportDir != "" {
+		if replicas > 1 {
+			logger.Error("main(): exportDir is not shared by the replicas, export jobs need a single replica.", zap.Int("replicas", replicas))
+			os.Exit(1)
+		}
+
+		jobStore, err := export.NewFileJobStore(filepath.Join(exportDir, "jobs"))
+
+		if err != nil {
+			logger.Error("main(): Failed to open the export job directory.", zap.String("exportDir", exportDir), zap.Error(err))
+			os.Exit(1)
+		}
+
+		blobStore, err := export.NewFileBlobStore(filepath.Join(exportDir, "files"))
+
+		if err != nil {
+			logger.Error("main(): Failed to open the export file directory.", zap.String("exportDir", exportDir), zap.Error(err))
+			os.Exit(1)
+		}
+
+		TraceEndpoint.ExportJobs = &export.JobManager{
+			TraceStore        : traceStore,
+			Jobs              : jobStore,
+			Blobs             : blobStore,
+			UUIDGenerator     : &uuidGenerator,
+			Logger            : logger.With(zap.String("component", "export.JobManager")),
+			Expiration        : exportExpiration,
+			MaxJobsPerAccount : exportMaxJobsPerAccount,
+			Workers           : exportWorkers,
+		}
+
+		if err := TraceEndpoint.ExportJobs.Start(backgroundCtx); err != nil {
+			logger.Error("main(): Failed to start the export jobs.", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	// Start following the trace deletions, with the audit trail next to the traces
+	var traceDeleteStore storage.TraceDeleteStore
+	var deletionStore storage.DeletionStore
+
+	if esTraceStore != nil && esDeletionIndex != "" {
+		esDeletionStore, err := storage.NewESDeletionStore(logger.With(zap.String("component", "storage.ESDeletionStore")), esTraceStore.ElasticSearchClient, esDeletionIndex)
+
+		if err != nil {
+			logger.Error("main(): Failed to initialize the deletion index.", zap.String("esDeletionIndex", esDeletionIndex), zap.Error(err))
+			os.Exit(1)
+		}
+
+		traceDeleteStore = esTraceStore
+		deletionStore = esDeletionStore
+	}
+
+	if diskTraceStore != nil {
+		fileDeletionStore, err := storage.NewFileDeletionStore(logger.With(zap.String("component", "storage.FileDeletionStore")), filepath.Join(diskDir, "deletions"))
+
+		if err != nil {
+			logger.Error("main(): Failed to initialize the deletion directory.", zap.String("diskDir", diskDir), zap.Error(err))
+			os.Exit(1)
+		}
+
+		traceDeleteStore = diskTraceStore
+		deletionStore = fileDeletionStore
+	}
+
+	if deletionStore != nil {
+		TraceEndpoint.Deletions = &deletions.Manager{
+			Traces        : traceDeleteStore,
+			Deletions     : deletionStore,
+			UUIDGenerator : &uuidGenerator,
+			Logger        : logger.With(zap.String("component", "deletions.Manager")),
+			PollInterval  : deletionPollInterval,
+		}
+
+		TraceEndpoint.Deletions.Start(backgroundCtx)
+	}
+
+	// Start the retention purges, which delete through the trace deletions. With the elasticsearch storage the
+	// policies are shared and only the replica that holds the retention lease purges
+	if retentionDir != "" || esRetentionIndex != "" {
+		if TraceEndpoint.Deletions == nil {
+			logger.Error("main(): Retention policies need trace deletion, set esDeletionIndex or use the disk storage.")
+			os.Exit(1)
+		}
+
+		var policyStore retention.PolicyStore
+		var retentionLease retention.Lease
+
+		if esTraceStore != nil {
+			if retentionDir != "" {
+				logger.Error("main(): The retention policies of the elasticsearch storage are shared by the replicas, set esRetentionIndex instead of retentionDir.")
+				os.Exit(1)
+			}
+
+			documentStore, err := storage.NewESDocumentStore(logger.With(zap.String("component", "storage.ESDocumentStore")), esTraceStore.ElasticSearchClient, esRetentionIndex)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the retention policy index.", zap.String("esRetentionIndex", esRetentionIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			hostname, _ := os.Hostname()
+			holder := hostname + "-" + uuidGenerator.UUID().String()
+
+			esLease, err := storage.NewESLease(logger.With(zap.String("component", "storage.ESLease")), esTraceStore.ElasticSearchClient, esLeaseIndex, retention.LeaseName, holder, 3 * retentionInterval)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the lease index.", zap.String("esLeaseIndex", esLeaseIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			policyStore = &retention.ESPolicyStore{Documents: documentStore}
+			retentionLease = esLease
+		} else {
+			if esRetentionIndex != "" {
+				logger.Error("main(): esRetentionIndex needs the elasticsearch storage, set retentionDir instead.")
+				os.Exit(1)
+			}
+
+			filePolicyStore, err := retention.NewFilePolicyStore(retentionDir)
+
+			if err != nil {
+				logger.Error("main(): Failed to open the retention policy directory.", zap.String("retentionDir", retentionDir), zap.Error(err))
+				os.Exit(1)
+			}
+
+			policyStore = filePolicyStore
+		}
+
+		TraceEndpoint.Retention = &retention.Purger{
+			Policies  : policyStore,
+			Deletions : TraceEndpoint.Deletions,
+			Lease     : retentionLease,
+			Logger    : logger.With(zap.String("component", "retention.Purger")),
+			Interval  : retentionInterval,
+			MaxDays   : retentionMaxDays,
+		}
+
+		TraceEndpoint.Retention.Start(backgroundCtx)
+	}
+
+	// Start archiving old traces, on the replica that holds the archive lease, and rehydrating them on request. With
+	// the archive files in S3 every replica takes rehydration requests and the replica that holds the rehydration
+	// lease loads them
+	if archiveDir != "" || archiveS3Bucket != "" {
+		if esTraceStore == nil {
+			logger.Error("main(): The trace archive needs the elasticsearch storage.")
+			os.Exit(1)
+		}
+
+		if TraceEndpoint.Deletions == nil {
+			logger.Error("main(): The trace archive needs trace deletion, set esDeletionIndex.")
+			os.Exit(1)
+		}
+
+		if archiveDir != "" && archiveS3Bucket != "" {
+			logger.Error("main(): Set either archiveDir or archiveS3Bucket.")
+			os.Exit(1)
+		}
+
+		hostname, _ := os.Hostname()
+		holder := hostname + "-" + uuidGenerator.UUID().String()
+
+		var archiveBlobStore archive.BlobStore
+		var rehydrationStore archive.RehydrationStore
+		var rehydrationLease archive.Lease
+
+		if archiveS3Bucket != "" {
+			if archiveS3Endpoint == "" || esRehydrationIndex == "" {
+				logger.Error("main(): The archive in S3 needs archiveS3Endpoint and esRehydrationIndex.")
+				os.Exit(1)
+			}
+
+			// The credentials are read from the environment like the AWS tools do, so that they are not in the arguments
+			s3BlobStore, err := archive.NewS3BlobStore(archiveS3Endpoint, archiveS3Bucket, archiveS3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+
+			if err != nil {
+				logger.Error("main(): Failed to open the archive bucket.", zap.String("archiveS3Endpoint", archiveS3Endpoint), zap.String("archiveS3Bucket", archiveS3Bucket), zap.Error(err))
+				os.Exit(1)
+			}
+
+			documentStore, err := storage.NewESDocumentStore(logger.With(zap.String("component", "storage.ESDocumentStore")), esTraceStore.ElasticSearchClient, esRehydrationIndex)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the rehydration index.", zap.String("esRehydrationIndex", esRehydrationIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			esLease, err := storage.NewESLease(logger.With(zap.String("component", "storage.ESLease")), esTraceStore.ElasticSearchClient, esLeaseIndex, archive.RehydrationLeaseName, holder, 3 * archive.DefaultRehydrationPollInterval)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the lease index.", zap.String("esLeaseIndex", esLeaseIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			archiveBlobStore = s3BlobStore
+			rehydrationStore = &archive.ESRehydrationStore{Documents: documentStore}
+			rehydrationLease = esLease
+		} else {
+			if replicas > 1 {
+				logger.Error("main(): archiveDir is not shared by the replicas, set archiveS3Bucket instead.", zap.Int("replicas", replicas))
+				os.Exit(1)
+			}
+
+			if esRehydrationIndex != "" {
+				logger.Error("main(): esRehydrationIndex needs archiveS3Bucket.")
+				os.Exit(1)
+			}
+
+			fileBlobStore, err := archive.NewFileBlobStore(filepath.Join(archiveDir, "files"))
+
+			if err != nil {
+				logger.Error("main(): Failed to open the archive file directory.", zap.String("archiveDir", archiveDir), zap.Error(err))
+				os.Exit(1)
+			}
+
+			fileRehydrationStore, err := archive.NewFileRehydrationStore(filepath.Join(archiveDir, "rehydrations"))
+
+			if err != nil {
+				logger.Error("main(): Failed to open the rehydration directory.", zap.String("archiveDir", archiveDir), zap.Error(err))
+				os.Exit(1)
+			}
+
+			archiveBlobStore = fileBlobStore
+			rehydrationStore = fileRehydrationStore
+		}
+
+		archiveLease, err := storage.NewESLease(logger.With(zap.String("component", "storage.ESLease")), esTraceStore.ElasticSearchClient, esLeaseIndex, archive.LeaseName, holder, 3 * archiveInterval)
+
+		if err != nil {
+			logger.Error("main(): Failed to initialize the lease index.", zap.String("esLeaseIndex", esLeaseIndex), zap.Error(err))
+			os.Exit(1)
+		}
+
+		archiver := &archive.Archiver{
+			Traces    : esTraceStore,
+			Deletions : TraceEndpoint.Deletions,
+			Blobs     : archiveBlobStore,
+			Lease     : archiveLease,
+			Logger    : logger.With(zap.String("component", "archive.Archiver")),
+			Interval  : archiveInterval,
+			Days      : archiveDays,
+		}
+
+		archiver.Start(backgroundCtx)
+
+		TraceEndpoint.Rehydrations = &archive.Rehydrator{
+			Traces        : esTraceStore,
+			Blobs         : archiveBlobStore,
+			Rehydrations  : rehydrationStore,
+			Lease         : rehydrationLease,
+			UUIDGenerator : &uuidGenerator,
+			Logger        : logger.With(zap.String("component", "archive.Rehydrator")),
+			IndexPrefix   : rehydrationIndexPrefix,
+			Expiration    : rehydrationExpiration,
+			MaxPerAccount : rehydrationMaxPerAccount,
+		}
+
+		if err := TraceEndpoint.Rehydrations.Start(backgroundCtx); err != nil {
+			logger.Error("main(): Failed to start the rehydrations.", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	// Start rolling the active index over, on the replica that holds the rollover lease
+	if esTraceStore != nil && esRolloverInterval > 0 {
+		rolloverConditions := storage.RolloverConditions{MaxAge: esRolloverMaxAge, MaxDocs: esRolloverMaxDocs, MaxSize: esRolloverMaxSize}
+
+		if rolloverConditions.Empty() {
+			logger.Error("main(): The rollover manager needs a condition, set esRolloverMaxAge, esRolloverMaxDocs or esRolloverMaxSize.")
+			os.Exit(1)
+		}
+
+		hostname, _ := os.Hostname()
+		holder := hostname + "-" + uuidGenerator.UUID().String()
+
+		rolloverLease, err := storage.NewESLease(logger.With(zap.String("component", "storage.ESLease")), esTraceStore.ElasticSearchClient, esLeaseIndex, rollover.LeaseName, holder, 3 * esRolloverInterval)
+
+		if err != nil {
+			logger.Error("main(): Failed to initialize the lease index.", zap.String("esLeaseIndex", esLeaseIndex), zap.Error(err))
+			os.Exit(1)
+		}
+
+		rolloverManager := &rollover.Manager{
+			Indices    : esTraceStore,
+			Lease      : rolloverLease,
+			Conditions : rolloverConditions,
+			Logger     : logger.With(zap.String("component", "rollover.Manager")),
+			Interval   : esRolloverInterval,
+		}
+
+		rolloverManager.Start(backgroundCtx)
+	}
+
+	// Start the alert rule evaluation. With the elasticsearch storage the rules are shared and only the replica that
+	// holds the alerts lease evaluates the threshold rules
+	if alertDir != "" || esAlertIndex != "" {
+		var ruleStore alerts.RuleStore
+		var alertLease alerts.Lease
+
+		if esTraceStore != nil {
+			if alertDir != "" {
+				logger.Error("main(): The alert rules of the elasticsearch storage are shared by the replicas, set esAlertIndex instead of alertDir.")
+				os.Exit(1)
+			}
+
+			documentStore, err := storage.NewESDocumentStore(logger.With(zap.String("component", "storage.ESDocumentStore")), esTraceStore.ElasticSearchClient, esAlertIndex)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the alert rule index.", zap.String("esAlertIndex", esAlertIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			hostname, _ := os.Hostname()
+			holder := hostname + "-" + uuidGenerator.UUID().String()
+
+			esLease, err := storage.NewESLease(logger.With(zap.String("component", "storage.ESLease")), esTraceStore.ElasticSearchClient, esLeaseIndex, alerts.LeaseName, holder, 3 * alertInterval)
+
+			if err != nil {
+				logger.Error("main(): Failed to initialize the lease index.", zap.String("esLeaseIndex", esLeaseIndex), zap.Error(err))
+				os.Exit(1)
+			}
+
+			ruleStore = &alerts.ESRuleStore{Documents: documentStore}
+			alertLease = esLease
+		} else {
+			if esAlertIndex != "" {
+				logger.Error("main(): esAlertIndex needs the elasticsearch storage, set alertDir instead.")
+				os.Exit(1)
+			}
+
+			// The rules under alertDir are not seen by the other replicas and no lease elects the one that evaluates
+			// them, each replica would fire its own copy of every alert
+			if replicas > 1 {
+				logger.Error("main(): alertDir is not shared by the replicas, alerting with the disk and loki storages needs a single replica.", zap.Int("replicas", replicas))
+				os.Exit(1)
+			}
+
+			fileRuleStore, err := alerts.NewFileRuleStore(alertDir)
+
+			if err != nil {
+				logger.Error("main(): Failed to open the alert rule directory.", zap.String("alertDir", alertDir), zap.Error(err))
+				os.Exit(1)
+			}
+
+			ruleStore = fileRuleStore
+		}
+
+		TraceEndpoint.Alerts = &alerts.Manager{
+			TraceStore    : traceStore,
+			Rules         : ruleStore,
+			Lease         : alertLease,
+			Notifier      : &alerts.WebhookNotifier{
+				Client      : alerts.NewWebhookClient(alertWebhookTimeout),
+				Logger      : logger.With(zap.String("component", "alerts.WebhookNotifier")),
+				MaxAttempts : alertWebhookAttempts,
+			},
+			UUIDGenerator : &uuidGenerator,
+			Logger        : logger.With(zap.String("component", "alerts.Manager")),
+			Interval      : alertInterval,
+		}
+
+		if err := TraceEndpoint.Alerts.Start(backgroundCtx); err != nil {
+			logger.Error("main(): Failed to start the alert rules.", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	// Start the log rate anomaly detection. The rates and baselines are counted in memory from the traces posted to
+	// the replica and the settings are on its local disk, the other replicas would neither see them nor count the
+	// same traces
+	if anomalyDir != "" {
+		if replicas > 1 {
+			logger.Error("main(): The log rates and anomalyDir are not shared by the replicas, anomaly detection needs a single replica.", zap.Int("replicas", replicas))
+			os.Exit(1)
+		}
+
+		settingsStore, err := anomalies.NewFileSettingsStore(anomalyDir)
+
+		if err != nil {
+			logger.Error("main(): Failed to open the anomaly settings directory.", zap.String("anomalyDir", anomalyDir), zap.Error(err))
+			os.Exit(1)
+		}
+
+		TraceEndpoint.Anomalies = &anomalies.Detector{
+			Settings       : settingsStore,
+			UUIDGenerator  : &uuidGenerator,
+			Logger         : logger.With(zap.String("component", "anomalies.Detector")),
+			BucketSize     : anomalyBucket,
+			BaselineWindow : anomalyBaseline,
+			MaxSeries      : anomalyMaxSeries,
+		}
+
+		if err := TraceEndpoint.Anomalies.Start(backgroundCtx); err != nil {
+			logger.Error("main(): Failed to start the anomaly detection.", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
 	// Attach the router to the TraceEndpoint
 	TraceEndpoint.Attach(router)
 
@@ -217,6 +912,7 @@ func main() {
 	defer cancel()
 
 	srv.Shutdown(ctx)
+	backgroundCancel()
 	logger.Debug("main(): Server Shutting down")
 	os.Exit(0)
 }
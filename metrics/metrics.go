@@ -88,8 +88,184 @@ var (
 		Name:      "post_logs_number_counter",
 		Help:      "The number of accumulative number of posted trace logs",
 	})
+
+	PrometheusActiveTailStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "active_tail_streams",
+		Help:      "The number of open live tail streams",
+	})
+
+	PrometheusTailTracesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "tail_traces_sent_counter",
+		Help:      "The number of accumulative trace logs sent over live tail streams",
+	})
+
+	PrometheusExportedTraces = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "exported_traces_counter",
+		Help:      "The number of accumulative trace logs written by exports",
+	})
+
+	PrometheusExportJobsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "export_jobs_created_counter",
+		Help:      "The number of accumulative export jobs submitted",
+	})
+
+	PrometheusAlertsTriggered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "alerts_triggered_counter",
+		Help:      "The number of accumulative alert rule notifications triggered",
+	})
+
+	PrometheusAlertNotificationsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "alert_notifications_sent_counter",
+		Help:      "The number of accumulative alert notifications accepted by webhooks",
+	})
+
+	PrometheusAlertNotificationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "alert_notifications_failed_counter",
+		Help:      "The number of accumulative alert notifications that could not be delivered",
+	})
+
+	PrometheusLogRateAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "log_rate_anomalies_counter",
+		Help:      "The number of accumulative log rate anomalies detected, by direction",
+	}, []string{"direction"})
+
+	PrometheusActiveLogRateAnomalies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "active_log_rate_anomalies",
+		Help:      "The number of active log rate anomalies, by account and direction",
+	}, []string{"account_id", "direction"})
+
+	PrometheusDroppedLogRateSeries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "dropped_log_rate_series_counter",
+		Help:      "The number of accumulative traces not counted for anomaly detection because their account has too many series",
+	})
+
+	PrometheusDeviceCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_cache_lookups_counter",
+		Help:      "The number of accumulative device lookups, by result (hit, miss, shared or stale)",
+	}, []string{"result"})
+
+	PrometheusDeviceCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_cache_entries",
+		Help:      "The number of devices in the device lookup cache",
+	})
+
+	PrometheusDeviceDirectoryRequestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_directory_request_durations_seconds",
+		Help:      "The duration of each device directory request attempt, by status code or error",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	PrometheusDeviceDirectoryRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_directory_retries_counter",
+		Help:      "The number of accumulative device directory requests that were retried",
+	})
+
+	PrometheusDeviceDirectoryCircuitState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_directory_circuit_state",
+		Help:      "The state of the device directory circuit breaker, 0 closed, 1 half-open and 2 open",
+	})
+
+	PrometheusDeviceDirectoryCircuitRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "device_directory_circuit_rejections_counter",
+		Help:      "The number of accumulative device directory requests rejected by the open circuit breaker",
+	})
+
+	PrometheusTraceDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "trace_deletions_counter",
+		Help:      "The number of accumulative finished trace deletions, by status",
+	}, []string{"status"})
+
+	PrometheusDeletedTraces = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "deleted_traces_counter",
+		Help:      "The number of accumulative traces deleted on request",
+	})
+
+	PrometheusRetentionPurges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "retention_purges_counter",
+		Help:      "The number of accumulative retention purges, by result (started, skipped or failed)",
+	}, []string{"result"})
+
+	PrometheusRollovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "index_rollovers_counter",
+		Help:      "The number of accumulative rollover checks of the active trace index, by result (rolled_over, not_needed or failed)",
+	}, []string{"result"})
+
+	PrometheusRolloverLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "index_rollover_leader",
+		Help:      "Whether this replica holds the rollover lease (1) or not (0)",
+	})
+
+	PrometheusArchiveFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "archive_files_counter",
+		Help:      "The number of accumulative archive files of a device and day, by result (archived or failed)",
+	}, []string{"result"})
+
+	PrometheusArchivedTraces = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "archived_traces_counter",
+		Help:      "The number of accumulative traces moved to the archive",
+	})
+
+	PrometheusRehydrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "rehydrations_counter",
+		Help:      "The number of accumulative rehydrations of archived traces, by status (completed or failed)",
+	}, []string{"status"})
+
+	PrometheusAccountTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway_trace_service",
+		Subsystem: "gateway_trace_service",
+		Name:      "account_tokens_counter",
+		Help:      "The number of accumulative account tokens used for service requests, by result (minted or reused)",
+	}, []string{"result"})
 )
 
 func init() {
-	prometheus.MustRegister(RequestCounter, ResponseDurationHist, WriteHeaderDurationHist, PrometheusGetRequestDurations, PrometheusPostRequestDurations, PrometheusPostRequestErrorCounter, PrometheusGetRequestErrorCounter, PrometheusGetRequestElasticSearchFailureCounter, PrometheusPostRequestElasticSearchFailureCounter, PrometheusPostTraceIndicator)
+	prometheus.MustRegister(RequestCounter, ResponseDurationHist, WriteHeaderDurationHist, PrometheusGetRequestDurations, PrometheusPostRequestDurations, PrometheusPostRequestErrorCounter, PrometheusGetRequestErrorCounter, PrometheusGetRequestElasticSearchFailureCounter, PrometheusPostRequestElasticSearchFailureCounter, PrometheusPostTraceIndicator, PrometheusActiveTailStreams, PrometheusTailTracesSent, PrometheusExportedTraces, PrometheusExportJobsCreated, PrometheusAlertsTriggered, PrometheusAlertNotificationsSent, PrometheusAlertNotificationsFailed, PrometheusLogRateAnomalies, PrometheusActiveLogRateAnomalies, PrometheusDroppedLogRateSeries, PrometheusDeviceCacheLookups, PrometheusDeviceCacheEntries, PrometheusDeviceDirectoryRequestDurations, PrometheusDeviceDirectoryRetries, PrometheusDeviceDirectoryCircuitState, PrometheusDeviceDirectoryCircuitRejections, PrometheusAccountTokens, PrometheusTraceDeletions, PrometheusDeletedTraces, PrometheusRetentionPurges, PrometheusRollovers, PrometheusRolloverLeader, PrometheusArchiveFiles, PrometheusArchivedTraces, PrometheusRehydrations)
 }
@@ -0,0 +1,233 @@
+package patterns
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	Wildcard = "<*>"
+
+	DefaultSimilarity  = 0.4
+	DefaultTreeDepth   = 3
+	DefaultMaxChildren = 100
+	MaxSampleIDs       = 5
+)
+
+// Tokens that vary between messages of the same kind are replaced by these placeholders before clustering
+const (
+	maskUUID = "<UUID>"
+	maskIP   = "<IP>"
+	maskHex  = "<HEX>"
+	maskNum  = "<NUM>"
+)
+
+var (
+	uuidPattern   = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	ipPattern     = regexp.MustCompile(`^\d{1,3}(\.\d{1,3}){3}(:\d+)?$`)
+	hexPattern    = regexp.MustCompile(`^(0[xX][0-9a-fA-F]+|[0-9a-fA-F]*[0-9][0-9a-fA-F]*)$`)
+	numberPattern = regexp.MustCompile(`^[-+]?\d+([.,]\d+)*([eE][-+]?\d+)?[a-zA-Z%]{0,3}$`)
+)
+
+// Pattern is a message template and the traces that it groups
+type Pattern struct {
+	Template  string   `json:"template"`
+	Count     uint64   `json:"count"`
+	FirstSeen string   `json:"first_seen"`
+	LastSeen  string   `json:"last_seen"`
+	SampleIDs []string `json:"sample_ids"`
+
+	tokens []string
+}
+
+// similarity returns the share of positions where tokens equal the template. Wildcards do not count as equal
+func (pattern *Pattern) similarity(tokens []string) float64 {
+	equal := 0
+
+	for i, token := range tokens {
+		if pattern.tokens[i] == token && token != Wildcard {
+			equal++
+		}
+	}
+
+	return float64(equal) / float64(len(tokens))
+}
+
+// add merges a trace into the pattern, replacing the tokens that differ from the template by wildcards
+func (pattern *Pattern) add(tokens []string, trace storage.TraceResponse) {
+	for i, token := range tokens {
+		if pattern.tokens[i] != token {
+			pattern.tokens[i] = Wildcard
+		}
+	}
+
+	pattern.Count++
+
+	if pattern.FirstSeen == "" || trace.Timestamp < pattern.FirstSeen {
+		pattern.FirstSeen = trace.Timestamp
+	}
+
+	if trace.Timestamp > pattern.LastSeen {
+		pattern.LastSeen = trace.Timestamp
+	}
+
+	if len(pattern.SampleIDs) < MaxSampleIDs {
+		pattern.SampleIDs = append(pattern.SampleIDs, trace.ID)
+	}
+}
+
+// node is a node of the parse tree. Inner nodes route by token, leaves hold patterns
+type node struct {
+	children map[string]*node
+	patterns []*Pattern
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+// Drain groups messages into templates with the Drain algorithm: messages are routed through a fixed depth tree by
+// their length and first tokens, and joined with the most similar pattern of the leaf if it is similar enough
+type Drain struct {
+	Similarity  float64
+	Depth       int
+	MaxChildren int
+
+	root     *node
+	patterns []*Pattern
+}
+
+// NewDrain returns a Drain with the default parameters
+func NewDrain() *Drain {
+	return &Drain{
+		Similarity:  DefaultSimilarity,
+		Depth:       DefaultTreeDepth,
+		MaxChildren: DefaultMaxChildren,
+		root:        newNode(),
+	}
+}
+
+// Add groups the message of trace into a pattern
+func (drain *Drain) Add(trace storage.TraceResponse) {
+	tokens := Tokenize(trace.Message)
+	if len(tokens) == 0 {
+		tokens = []string{""}
+	}
+
+	leaf := drain.leaf(tokens)
+
+	var best *Pattern
+	bestSimilarity := -1.0
+
+	for _, pattern := range leaf.patterns {
+		if similarity := pattern.similarity(tokens); similarity > bestSimilarity {
+			best = pattern
+			bestSimilarity = similarity
+		}
+	}
+
+	if best == nil || bestSimilarity < drain.Similarity {
+		best = &Pattern{tokens: append([]string(nil), tokens...), SampleIDs: []string{}}
+		leaf.patterns = append(leaf.patterns, best)
+		drain.patterns = append(drain.patterns, best)
+	}
+
+	best.add(tokens, trace)
+}
+
+// leaf walks the tree by the number of tokens and the first Depth-2 tokens, creating nodes as needed. Tokens
+// with digits and tokens beyond MaxChildren share the wildcard child
+func (drain *Drain) leaf(tokens []string) *node {
+	current := drain.child(drain.root, strconv.Itoa(len(tokens)), false)
+
+	for depth := 0; depth < drain.Depth-2 && depth < len(tokens); depth++ {
+		token := tokens[depth]
+		if strings.HasPrefix(token, "<") || strings.IndexFunc(token, unicode.IsDigit) >= 0 {
+			token = Wildcard
+		}
+
+		current = drain.child(current, token, true)
+	}
+
+	return current
+}
+
+func (drain *Drain) child(parent *node, key string, limited bool) *node {
+	if child, ok := parent.children[key]; ok {
+		return child
+	}
+
+	if limited && len(parent.children) >= drain.MaxChildren {
+		key = Wildcard
+		if child, ok := parent.children[key]; ok {
+			return child
+		}
+	}
+
+	child := newNode()
+	parent.children[key] = child
+
+	return child
+}
+
+// Patterns returns the patterns found so far, most frequent first
+func (drain *Drain) Patterns() []Pattern {
+	patterns := make([]Pattern, 0, len(drain.patterns))
+
+	for _, pattern := range drain.patterns {
+		result := *pattern
+		result.Template = strings.Join(pattern.tokens, " ")
+		patterns = append(patterns, result)
+	}
+
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if patterns[i].Count != patterns[j].Count {
+			return patterns[i].Count > patterns[j].Count
+		}
+
+		return patterns[i].FirstSeen < patterns[j].FirstSeen
+	})
+
+	return patterns
+}
+
+// Tokenize splits a message into words and masks the words that vary between messages of the same kind, such as
+// numbers, hex values, IP addresses and UUIDs. Structural characters of the JSON encoded messages are dropped
+func Tokenize(message string) []string {
+	words := strings.FieldsFunc(message, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`{}[]()",;=`, r)
+	})
+
+	tokens := make([]string, 0, len(words))
+
+	for _, word := range words {
+		word = strings.Trim(word, ":'.!?")
+		if word == "" {
+			continue
+		}
+
+		tokens = append(tokens, mask(word))
+	}
+
+	return tokens
+}
+
+func mask(word string) string {
+	switch {
+	case uuidPattern.MatchString(word):
+		return maskUUID
+	case ipPattern.MatchString(word):
+		return maskIP
+	case numberPattern.MatchString(word):
+		return maskNum
+	case hexPattern.MatchString(word) && (len(word) >= 8 || strings.HasPrefix(strings.ToLower(word), "0x")):
+		return maskHex
+	default:
+		return word
+	}
+}
@@ -0,0 +1,198 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+)
+
+const (
+	DefaultMaxDays      = 365
+	MaxPolicyTypes      = 20
+	MaxPolicyTypeLength = 64
+)
+
+// Errors that might be returned by a PolicyStore
+var (
+	ErrPolicyNotFound = errors.New("Retention policy not found")
+)
+
+// Policy is the retention policy of an account. Traces are deleted Days days after their timestamp, or after the
+// days in Types for the traces of those types. A Days of 0 keeps the traces of the other types
+type Policy struct {
+	AccountID string         `json:"account_id"`
+	Object    string         `json:"object"`
+	Days      int            `json:"days"`
+	Types     map[string]int `json:"types"`
+	UpdatedAt string         `json:"updated_at,omitempty"`
+}
+
+// PolicyStore persists the retention policies of the accounts
+type PolicyStore interface {
+	Save(policy Policy) error
+	Get(accountID string) (Policy, error)
+	Delete(accountID string) error
+	List() ([]Policy, error)
+}
+
+// FilePolicyStore implements PolicyStore with one JSON file per account in a local directory
+type FilePolicyStore struct {
+	Dir string
+}
+
+// NewFilePolicyStore returns a FilePolicyStore on dir, creating dir if needed
+func NewFilePolicyStore(dir string) (*FilePolicyStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FilePolicyStore{Dir: dir}, nil
+}
+
+func (policyStore *FilePolicyStore) path(accountID string) string {
+	return filepath.Join(policyStore.Dir, filepath.Base(accountID)+".json")
+}
+
+// Save writes the policy of an account, replacing the file atomically
+func (policyStore *FilePolicyStore) Save(policy Policy) error {
+	encoded, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	tmp := policyStore.path(policy.AccountID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, policyStore.path(policy.AccountID))
+}
+
+// Get reads the policy of accountID
+func (policyStore *FilePolicyStore) Get(accountID string) (Policy, error) {
+	var policy Policy
+
+	encoded, err := ioutil.ReadFile(policyStore.path(accountID))
+	if os.IsNotExist(err) {
+		return Policy{}, ErrPolicyNotFound
+	} else if err != nil {
+		return Policy{}, err
+	}
+
+	if err := json.Unmarshal(encoded, &policy); err != nil {
+		return Policy{}, err
+	}
+
+	return policy, nil
+}
+
+// Delete removes the policy of accountID
+func (policyStore *FilePolicyStore) Delete(accountID string) error {
+	err := os.Remove(policyStore.path(accountID))
+	if os.IsNotExist(err) {
+		return ErrPolicyNotFound
+	}
+
+	return err
+}
+
+// List reads the policy of every account
+func (policyStore *FilePolicyStore) List() ([]Policy, error) {
+	files, err := ioutil.ReadDir(policyStore.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Policy, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		policy, err := policyStore.Get(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, policy)
+	}
+
+	return list, nil
+}
+
+// ESPolicyStore implements PolicyStore on an elastic search document index, so that every replica sees the same
+// policies
+type ESPolicyStore struct {
+	Documents *storage.ESDocumentStore
+}
+
+// Save stores the policy of an account, replacing an existing one
+func (policyStore *ESPolicyStore) Save(policy Policy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	return policyStore.Documents.Save(ctx, policy.AccountID, policy)
+}
+
+// Get reads the policy of accountID
+func (policyStore *ESPolicyStore) Get(accountID string) (Policy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	var policy Policy
+
+	if err := policyStore.Documents.Get(ctx, accountID, &policy); err == storage.ErrDocumentNotFound {
+		return Policy{}, ErrPolicyNotFound
+	} else if err != nil {
+		return Policy{}, err
+	}
+
+	return policy, nil
+}
+
+// Delete removes the policy of accountID
+func (policyStore *ESPolicyStore) Delete(accountID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	if err := policyStore.Documents.Delete(ctx, accountID); err == storage.ErrDocumentNotFound {
+		return ErrPolicyNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// List reads the policy of every account
+func (policyStore *ESPolicyStore) List() ([]Policy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+	defer cancel()
+
+	documents, err := policyStore.Documents.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Policy, 0, len(documents))
+
+	for _, document := range documents {
+		var policy Policy
+
+		if err := json.Unmarshal(document, &policy); err != nil {
+			return nil, err
+		}
+
+		list = append(list, policy)
+	}
+
+	return list, nil
+}
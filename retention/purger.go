@@ -0,0 +1,223 @@
+package retention
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/deletions"
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultPurgeInterval = time.Hour
+
+	// PurgeRequestID is the request id of the deletions started by the purger
+	PurgeRequestID = "retention-purge"
+
+	// LeaseName is the name of the lease that the replica which purges the traces holds
+	LeaseName = "retention"
+)
+
+// Lease is held by at most one replica at a time
+type Lease interface {
+	Acquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// Purger enforces the retention policies of the accounts. Every Interval it deletes the traces that are past their
+// retention through Deletions, so that purges are part of the audit trail. An account is skipped while its previous
+// purge is still running. If Lease is set, only the replica that holds it purges
+type Purger struct {
+	Policies  PolicyStore
+	Deletions *deletions.Manager
+	Lease     Lease
+	Logger    *zap.Logger
+	Interval  time.Duration
+	MaxDays   int
+
+	lock    sync.Mutex
+	running map[string][]string
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// GetPolicy returns the policy of the account, or an empty policy if it has none
+func (purger *Purger) GetPolicy(accountID string) (Policy, error) {
+	policy, err := purger.Policies.Get(accountID)
+	if err == ErrPolicyNotFound {
+		return Policy{AccountID: accountID, Object: "device-trace-retention-policy", Types: map[string]int{}}, nil
+	}
+
+	return policy, err
+}
+
+// SavePolicy replaces the policy of the account
+func (purger *Purger) SavePolicy(policy Policy) (Policy, error) {
+	policy.Object = "device-trace-retention-policy"
+	policy.UpdatedAt = formatTime(time.Now())
+
+	if policy.Types == nil {
+		policy.Types = map[string]int{}
+	}
+
+	if err := purger.Policies.Save(policy); err != nil {
+		return Policy{}, err
+	}
+
+	return policy, nil
+}
+
+// DeletePolicy removes the policy of the account, its traces are kept from then on
+func (purger *Purger) DeletePolicy(accountID string) error {
+	return purger.Policies.Delete(accountID)
+}
+
+// Start purges the traces past their retention every Interval until ctx is done, then releases the lease
+func (purger *Purger) Start(ctx context.Context) {
+	if purger.Interval <= 0 {
+		purger.Interval = DefaultPurgeInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(purger.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if purger.Lease != nil {
+					releaseCtx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+					if err := purger.Lease.Release(releaseCtx); err != nil {
+						purger.Logger.Warn("Could not release the retention lease.", zap.Error(err))
+					}
+					cancel()
+				}
+
+				return
+			case <-ticker.C:
+				if purger.Lease != nil {
+					if leader, err := purger.Lease.Acquire(ctx); err != nil || !leader {
+						continue
+					}
+				}
+
+				purger.purge(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+// purge starts the deletions of every account whose previous purge has finished
+func (purger *Purger) purge(ctx context.Context, now time.Time) {
+	span := opentracing.StartSpan("retention.Purger.purge()")
+	defer span.Finish()
+
+	policies, err := purger.Policies.List()
+	if err != nil {
+		purger.Logger.Warn("Could not list the retention policies.", zap.Error(err))
+		return
+	}
+
+	for _, policy := range policies {
+		if ctx.Err() != nil {
+			return
+		}
+
+		storeCtx := context.WithValue(ctx, httputil.ContextKeyRequestID, PurgeRequestID)
+		storeCtx = context.WithValue(storeCtx, httputil.ContextKeyAccountID, policy.AccountID)
+
+		if purger.busy(span, storeCtx, policy.AccountID) {
+			metrics.PrometheusRetentionPurges.WithLabelValues("skipped").Inc()
+			continue
+		}
+
+		var started []string
+
+		for _, query := range purgeQueries(policy, now) {
+			filters := map[string]string{
+				"retention_days": strconv.Itoa(policy.Days),
+				"timestamp__lte": formatTime(query.Before),
+			}
+
+			if len(query.Types) == 1 {
+				filters["retention_days"] = strconv.Itoa(policy.Types[query.Types[0]])
+				filters["type__eq"] = query.Types[0]
+			}
+
+			deletion, err := purger.Deletions.Submit(span, storeCtx, policy.AccountID, PurgeRequestID, query, filters)
+			if err != nil {
+				metrics.PrometheusRetentionPurges.WithLabelValues("failed").Inc()
+				purger.Logger.Warn("Could not start a retention purge.", zap.String("account_id", policy.AccountID), zap.Error(err))
+				continue
+			}
+
+			metrics.PrometheusRetentionPurges.WithLabelValues("started").Inc()
+			started = append(started, deletion.ID)
+		}
+
+		purger.lock.Lock()
+		if purger.running == nil {
+			purger.running = make(map[string][]string)
+		}
+		purger.running[policy.AccountID] = started
+		purger.lock.Unlock()
+	}
+}
+
+// busy reports whether a purge of the account is still running
+func (purger *Purger) busy(span opentracing.Span, ctx context.Context, accountID string) bool {
+	purger.lock.Lock()
+	ids := purger.running[accountID]
+	purger.lock.Unlock()
+
+	for _, id := range ids {
+		deletion, err := purger.Deletions.Get(span, ctx, accountID, id)
+		if err == nil && (deletion.Status == deletions.StatusPending || deletion.Status == deletions.StatusRunning) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purgeQueries returns the queries of the traces of an account that are past their retention at now. Types with
+// their own retention are excluded from the query of the account wide retention. Type names are matched exactly
+func purgeQueries(policy Policy, now time.Time) []storage.TraceQuery {
+	var queries []storage.TraceQuery
+	var types []string
+
+	for traceType := range policy.Types {
+		types = append(types, traceType)
+	}
+
+	sort.Strings(types)
+
+	for _, traceType := range types {
+		queries = append(queries, storage.TraceQuery{
+			Account: policy.AccountID,
+			Types:   []string{traceType},
+			Before:  now.AddDate(0, 0, -policy.Types[traceType]),
+		})
+	}
+
+	if policy.Days > 0 {
+		queries = append(queries, storage.TraceQuery{
+			Account:      policy.AccountID,
+			ExcludeTypes: types,
+			Before:       now.AddDate(0, 0, -policy.Days),
+		})
+	}
+
+	return queries
+}
@@ -0,0 +1,96 @@
+package rollover
+
+import (
+	"context"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultInterval = 5 * time.Minute
+
+	// LeaseName is the name of the lease that the replica which rolls the active index over holds
+	LeaseName = "rollover"
+)
+
+// Lease is held by at most one replica at a time
+type Lease interface {
+	Acquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// IndexRoller rolls the active trace indices over
+type IndexRoller interface {
+	ActiveAliases() []string
+	RolloverIndex(ctx context.Context, alias string, conditions storage.RolloverConditions) (storage.RolloverResult, error)
+}
+
+// Manager rolls the active trace indices over every Interval once any of Conditions is met. Only the replica that
+// holds Lease rolls over, the others only renew their attempt to take the lease
+type Manager struct {
+	Indices    IndexRoller
+	Lease      Lease
+	Conditions storage.RolloverConditions
+	Logger     *zap.Logger
+	Interval   time.Duration
+}
+
+// Start checks the conditions every Interval until ctx is done, then releases the lease
+func (manager *Manager) Start(ctx context.Context) {
+	if manager.Interval <= 0 {
+		manager.Interval = DefaultInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(manager.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				releaseCtx, cancel := context.WithTimeout(context.Background(), storage.CtxTimeout)
+				if err := manager.Lease.Release(releaseCtx); err != nil {
+					manager.Logger.Warn("Could not release the rollover lease.", zap.Error(err))
+				}
+				cancel()
+
+				metrics.PrometheusRolloverLeader.Set(0)
+				return
+			case <-ticker.C:
+				manager.rollover(ctx)
+			}
+		}
+	}()
+}
+
+// rollover rolls the active indices over if this replica holds the lease
+func (manager *Manager) rollover(ctx context.Context) {
+	leader, err := manager.Lease.Acquire(ctx)
+	if err != nil || !leader {
+		metrics.PrometheusRolloverLeader.Set(0)
+		return
+	}
+
+	metrics.PrometheusRolloverLeader.Set(1)
+
+	for _, alias := range manager.Indices.ActiveAliases() {
+		result, err := manager.Indices.RolloverIndex(ctx, alias, manager.Conditions)
+		if err != nil {
+			metrics.PrometheusRollovers.WithLabelValues("failed").Inc()
+			manager.Logger.Error("Could not roll the active trace index over.", zap.String("alias", alias), zap.Error(err))
+			continue
+		}
+
+		if !result.RolledOver {
+			metrics.PrometheusRollovers.WithLabelValues("not_needed").Inc()
+			continue
+		}
+
+		metrics.PrometheusRollovers.WithLabelValues("rolled_over").Inc()
+		manager.Logger.Info("Rolled the active trace index over.", zap.String("alias", alias), zap.String("old_index", result.OldIndex), zap.String("new_index", result.NewIndex), zap.Any("conditions", result.Conditions))
+	}
+}
@@ -0,0 +1,491 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/alerts"
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+// PostAlertRule struct specifies the attibutes acceptable in the body of POST and PUT /v3/device-trace-alert-rules
+type PostAlertRule struct {
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind"`
+	Enabled       *bool             `json:"enabled"`
+	Filters       map[string]string `json:"filters"`
+	Threshold     uint64            `json:"threshold"`
+	Window        string            `json:"window"`
+	DedupWindow   string            `json:"dedup_window"`
+	SilencedUntil string            `json:"silenced_until"`
+	Webhook       alerts.Webhook    `json:"webhook"`
+}
+
+// AlertWebhookResponse struct specifies the attibutes of the webhook of an alert rule. The secret is never returned
+type AlertWebhookResponse struct {
+	URL string `json:"url"`
+}
+
+// AlertRuleResponse struct specifies the attibutes of an alert rule
+type AlertRuleResponse struct {
+	ID            string               `json:"id"`
+	Object        string               `json:"object"`
+	AccountID     string               `json:"account_id"`
+	Name          string               `json:"name"`
+	Kind          string               `json:"kind"`
+	Enabled       bool                 `json:"enabled"`
+	Filters       map[string]string    `json:"filters"`
+	Threshold     uint64               `json:"threshold,omitempty"`
+	Window        string               `json:"window,omitempty"`
+	DedupWindow   string               `json:"dedup_window"`
+	SilencedUntil string               `json:"silenced_until,omitempty"`
+	Webhook       AlertWebhookResponse `json:"webhook"`
+	CreatedAt     string               `json:"created_at"`
+	UpdatedAt     string               `json:"updated_at"`
+}
+
+// AlertRulePage specifies the return result for the list of alert rules
+type AlertRulePage struct {
+	Object string              `json:"object"`
+	Data   []AlertRuleResponse `json:"data"`
+}
+
+// AlertDeliveryResponse specifies the return result of a test notification. The response of the webhook is not
+// returned, so that the test cannot probe the network of the service
+type AlertDeliveryResponse struct {
+	Object    string `json:"object"`
+	Delivered bool   `json:"delivered"`
+}
+
+func newAlertRuleResponse(rule alerts.Rule) AlertRuleResponse {
+	response := AlertRuleResponse{
+		ID:          rule.ID,
+		Object:      rule.Object,
+		AccountID:   rule.AccountID,
+		Name:        rule.Name,
+		Kind:        rule.Kind,
+		Enabled:     rule.Enabled,
+		Filters:     rule.Filters,
+		Threshold:   rule.Threshold,
+		DedupWindow: rule.DedupWindow.String(),
+		Webhook:     AlertWebhookResponse{URL: rule.Webhook.URL},
+		CreatedAt:   rule.CreatedAt,
+		UpdatedAt:   rule.UpdatedAt,
+	}
+
+	if rule.Kind == alerts.RuleKindThreshold {
+		response.Window = rule.Window.String()
+	}
+
+	if !rule.SilencedUntil.IsZero() {
+		response.SilencedUntil = rule.SilencedUntil.UTC().Format(time.RFC3339)
+	}
+
+	return response
+}
+
+// alertRuleDevices validates the device_id__in filter of an alert rule like the query field of the search routes,
+// so that the device ids are deduplicated, capped and checked against the device directory
+func (traceEndpoint *TraceEndpoint) alertRuleDevices(span opentracing.Span, r *http.Request, requestID string, accountID string, body PostAlertRule) ([]string, *httputil.PublicError) {
+	value, ok := body.Filters["device_id__in"]
+	if !ok {
+		return nil, nil
+	}
+
+	devices, publicError := traceEndpoint.validateDevices(span, r, requestID, accountID, strings.Split(value, ","))
+	if publicError != nil {
+		for i := range publicError.Fields {
+			publicError.Fields[i].Name = "filters." + publicError.Fields[i].Name
+		}
+	}
+
+	return devices, publicError
+}
+
+// parseAlertRule validates the body of an alert rule request into a rule of accountID on the resolved devices. The
+// webhook secret may be omitted if the rule already has one. It returns the invalid field on error
+func parseAlertRule(ctx context.Context, body PostAlertRule, accountID string, devices []string, existing *alerts.Rule) (alerts.Rule, string, error) {
+	var filters traceFilters
+
+	rule := alerts.Rule{
+		AccountID:   accountID,
+		Name:        strings.TrimSpace(body.Name),
+		Kind:        body.Kind,
+		Enabled:     body.Enabled == nil || *body.Enabled,
+		Filters:     body.Filters,
+		DedupWindow: alerts.DefaultDedupWindow,
+		Webhook:     body.Webhook,
+	}
+
+	if len(rule.Name) == 0 || len(rule.Name) > alerts.MaxRuleNameLength {
+		return rule, "name", fmt.Errorf("Invalid 'name'. Acceptable length is 1-%d.", alerts.MaxRuleNameLength)
+	}
+
+	if rule.Filters == nil {
+		rule.Filters = map[string]string{}
+	}
+
+	for field, value := range rule.Filters {
+		isFilter, fieldErr := filters.parseField(field, value)
+		if field == "timestamp__gte" || field == "timestamp__lte" {
+			fieldErr = errors.New("Time ranges are not supported by alert rules")
+		} else if !isFilter && field != "device_id__in" {
+			// device_id__in is resolved by alertRuleDevices
+			fieldErr = fmt.Errorf("Invalid field name '%s'", field)
+		}
+
+		if fieldErr != nil {
+			return rule, "filters." + field, fieldErr
+		}
+	}
+
+	if devices != nil {
+		rule.Filters["device_id__in"] = strings.Join(devices, ",")
+	}
+
+	rule.Query = filters.traceQuery(accountID, devices)
+
+	switch rule.Kind {
+	case alerts.RuleKindThreshold:
+		if body.Threshold < 1 {
+			return rule, "threshold", errors.New("Invalid 'threshold'. Acceptable value is at least 1.")
+		}
+		rule.Threshold = body.Threshold
+
+		window, err := time.ParseDuration(body.Window)
+		if err != nil || window < alerts.MinRuleWindow || window > alerts.MaxRuleWindow {
+			return rule, "window", fmt.Errorf("Invalid 'window'. Acceptable value is a duration of %s-%s such as 5m or 1h.", alerts.MinRuleWindow, alerts.MaxRuleWindow)
+		}
+		rule.Window = window
+
+	case alerts.RuleKindMatch:
+		if body.Threshold != 0 || body.Window != "" {
+			return rule, "kind", errors.New("Match rules do not take 'threshold' and 'window'")
+		}
+
+	default:
+		return rule, "kind", fmt.Errorf("Invalid 'kind'. Acceptable values [%s|%s]", alerts.RuleKindThreshold, alerts.RuleKindMatch)
+	}
+
+	if body.DedupWindow != "" {
+		dedupWindow, err := time.ParseDuration(body.DedupWindow)
+		if err != nil || dedupWindow < 0 || dedupWindow > alerts.MaxDedupWindow {
+			return rule, "dedup_window", fmt.Errorf("Invalid 'dedup_window'. Acceptable value is a duration of 0s-%s.", alerts.MaxDedupWindow)
+		}
+		rule.DedupWindow = dedupWindow
+	}
+
+	if body.SilencedUntil != "" {
+		silencedUntil, err := parseTimeExpression(body.SilencedUntil, filters.now(), true)
+		if err != nil {
+			return rule, "silenced_until", err
+		}
+		rule.SilencedUntil = silencedUntil
+	}
+
+	if err := alerts.ValidateWebhookURL(ctx, rule.Webhook.URL); err != nil {
+		return rule, "webhook.url", fmt.Errorf("Invalid 'webhook.url'. %s.", err.Error())
+	}
+
+	if rule.Webhook.Secret == "" && existing != nil {
+		rule.Webhook.Secret = existing.Webhook.Secret
+	}
+
+	if len(rule.Webhook.Secret) < alerts.MinWebhookSecretLength {
+		return rule, "webhook.secret", fmt.Errorf("Invalid 'webhook.secret'. Acceptable length is at least %d.", alerts.MinWebhookSecretLength)
+	}
+
+	return rule, "", nil
+}
+
+// alertsUnavailable writes the error response for when alerting is not configured
+func (traceEndpoint *TraceEndpoint) alertsUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.Alerts != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Alert rules are not enabled on this service", "", "", requestID)
+
+	logger.Warn("Alert rules are not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// alertRuleError writes the error response for an error of the alert manager
+func alertRuleError(w http.ResponseWriter, logger *zap.Logger, err error, requestID string) {
+	switch err {
+	case alerts.ErrRuleNotFound:
+		writePublicError(w, http.StatusNotFound, StatusNotFound, "Could not retreive alert rule by this ID", "", "", requestID)
+		logger.Warn("Alert rule not found.", zap.Int("response_code", http.StatusNotFound))
+	case alerts.ErrTooManyRules:
+		writePublicError(w, http.StatusConflict, StatusConflict, err.Error(), "", "", requestID)
+		logger.Warn("Too many alert rules.", zap.Int("response_code", http.StatusConflict))
+	default:
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+		logger.Error("An error occurred inside of the alert manager.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+	}
+}
+
+// decodeAlertRule reads and validates the body of an alert rule request. It writes the error response on failure
+func (traceEndpoint *TraceEndpoint) decodeAlertRule(w http.ResponseWriter, r *http.Request, logger *zap.Logger, span opentracing.Span, requestID string, accountID string, existing *alerts.Rule) (alerts.Rule, bool) {
+	var body PostAlertRule
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return alerts.Rule{}, false
+	}
+
+	devices, publicError := traceEndpoint.alertRuleDevices(span, r, requestID, accountID, body)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+		return alerts.Rule{}, false
+	}
+
+	rule, field, fieldErr := parseAlertRule(r.Context(), body, accountID, devices, existing)
+	if fieldErr != nil {
+		errMsg := fmt.Sprintf("Invalid field '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+		logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid field"),
+			trace_log.String("field", field),
+			trace_log.Error(fieldErr),
+		)
+		return alerts.Rule{}, false
+	}
+
+	return rule, true
+}
+
+// createAlertRuleHandler stores a new alert rule for the account
+func (traceEndpoint *TraceEndpoint) createAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "create-alert-rule-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	rule, ok := traceEndpoint.decodeAlertRule(w, r, logger, span, requestID, accountID, nil)
+	if !ok {
+		return
+	}
+
+	rule, err := traceEndpoint.Alerts.Create(rule)
+	if err != nil {
+		alertRuleError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAlertRuleResponse(rule))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusCreated), zap.String("alert_rule_id", rule.ID))
+}
+
+// listAlertRulesHandler lists the alert rules of the account
+func (traceEndpoint *TraceEndpoint) listAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-alert-rules-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	rules := traceEndpoint.Alerts.List(accountID)
+
+	page := AlertRulePage{
+		Object: "list",
+		Data:   make([]AlertRuleResponse, 0, len(rules)),
+	}
+
+	for _, rule := range rules {
+		page.Data = append(page.Data, newAlertRuleResponse(rule))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getAlertRuleHandler returns an alert rule of the account
+func (traceEndpoint *TraceEndpoint) getAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-alert-rule-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	rule, err := traceEndpoint.Alerts.Get(accountID, mux.Vars(r)["alert_rule_id"])
+	if err != nil {
+		alertRuleError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAlertRuleResponse(rule))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// updateAlertRuleHandler replaces an alert rule of the account
+func (traceEndpoint *TraceEndpoint) updateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "update-alert-rule-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	existing, err := traceEndpoint.Alerts.Get(accountID, mux.Vars(r)["alert_rule_id"])
+	if err != nil {
+		alertRuleError(w, logger, err, requestID)
+		return
+	}
+
+	rule, ok := traceEndpoint.decodeAlertRule(w, r, logger, span, requestID, accountID, &existing)
+	if !ok {
+		return
+	}
+	rule.ID = existing.ID
+
+	rule, err = traceEndpoint.Alerts.Update(rule)
+	if err != nil {
+		alertRuleError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAlertRuleResponse(rule))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// deleteAlertRuleHandler removes an alert rule of the account
+func (traceEndpoint *TraceEndpoint) deleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-alert-rule-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	if err := traceEndpoint.Alerts.Delete(accountID, mux.Vars(r)["alert_rule_id"]); err != nil {
+		alertRuleError(w, logger, err, requestID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent))
+}
+
+// testAlertRuleHandler posts a test notification to the webhook of an alert rule and reports the outcome
+func (traceEndpoint *TraceEndpoint) testAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "test-alert-rule-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.alertsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), alerts.DefaultWebhookTimeout)
+	defer cancel()
+
+	err := traceEndpoint.Alerts.Test(ctx, accountID, mux.Vars(r)["alert_rule_id"])
+	if err == alerts.ErrRuleNotFound {
+		alertRuleError(w, logger, err, requestID)
+		return
+	} else if err != nil {
+		logger.Warn("Could not deliver the test notification.", zap.Error(err))
+	}
+
+	delivery := AlertDeliveryResponse{
+		Object:    "webhook-delivery",
+		Delivered: err == nil,
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK), zap.Bool("delivered", delivery.Delivered))
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/anomalies"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+)
+
+// PutAnomalySettings struct specifies the attibutes acceptable in the body of PUT /v3/device-trace-anomaly-settings
+type PutAnomalySettings struct {
+	Sensitivity string `json:"sensitivity"`
+}
+
+// AnomalyPage specifies the return result for the list of log rate anomalies
+type AnomalyPage struct {
+	Object  string              `json:"object"`
+	Limit   int                 `json:"limit"`
+	After   string              `json:"after,omitempty"`
+	HasMore bool                `json:"has_more"`
+	Data    []anomalies.Anomaly `json:"data"`
+}
+
+// anomaliesUnavailable writes the error response for when anomaly detection is not configured
+func (traceEndpoint *TraceEndpoint) anomaliesUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.Anomalies != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Anomaly detection is not enabled on this service", "", "", requestID)
+
+	logger.Warn("Anomaly detection is not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// listAnomaliesHandler lists the log rate anomalies of the account or a single device
+func (traceEndpoint *TraceEndpoint) listAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-anomalies-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.anomaliesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+		return
+	}
+
+	query := anomalies.Query{
+		AccountID: accountID,
+		Devices:   devices,
+		Limit:     anomalies.DefaultAnomalyLimit,
+	}
+
+	for field, values := range r.URL.Query() {
+		value := values[0]
+		var fieldErr error
+
+		switch field {
+		case "device_id__in", "device_group_id__eq", "device_filter":
+			// Handled by requestDevices
+			if _, isDeviceRoute := mux.Vars(r)["device_id"]; isDeviceRoute {
+				fieldErr = errors.New("Field not supported for a single device")
+			}
+
+		case "status":
+			if value != anomalies.StatusActive && value != anomalies.StatusResolved {
+				fieldErr = fmt.Errorf("Invalid 'status'. Acceptable values [%s|%s]", anomalies.StatusActive, anomalies.StatusResolved)
+			}
+			query.Status = value
+
+		case "direction":
+			if value != anomalies.DirectionSpike && value != anomalies.DirectionDrop {
+				fieldErr = fmt.Errorf("Invalid 'direction'. Acceptable values [%s|%s]", anomalies.DirectionSpike, anomalies.DirectionDrop)
+			}
+			query.Direction = value
+
+		case "limit":
+			var limit uint64
+			limit, fieldErr = strconv.ParseUint(value, 10, 64)
+			if fieldErr == nil && (limit < 1 || limit > anomalies.MaxAnomalyLimit) {
+				fieldErr = fmt.Errorf("Invalid 'limit' provided. Acceptable value is 1-%d.", anomalies.MaxAnomalyLimit)
+			}
+			query.Limit = int(limit)
+
+		case "after":
+			query.After = value
+
+		default:
+			errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+			logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+	}
+
+	data, hasMore := traceEndpoint.Anomalies.List(query)
+
+	page := AnomalyPage{
+		Object:  "list",
+		Limit:   query.Limit,
+		After:   query.After,
+		HasMore: hasMore,
+		Data:    data,
+	}
+
+	writeJSON(w, http.StatusOK, page)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getAnomalySettingsHandler returns the anomaly detection settings of the account
+func (traceEndpoint *TraceEndpoint) getAnomalySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-anomaly-settings-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.anomaliesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, traceEndpoint.Anomalies.GetSettings(accountID))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// updateAnomalySettingsHandler replaces the anomaly detection settings of the account
+func (traceEndpoint *TraceEndpoint) updateAnomalySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "update-anomaly-settings-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.anomaliesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	var body PutAnomalySettings
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	if !anomalies.IsSensitivity(body.Sensitivity) {
+		fieldMsg := fmt.Sprintf("Invalid 'sensitivity'. Acceptable values [%s|%s|%s|%s]", anomalies.SensitivityOff, anomalies.SensitivityLow, anomalies.SensitivityMedium, anomalies.SensitivityHigh)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Invalid field 'sensitivity'", "sensitivity", fieldMsg, requestID)
+
+		logger.Warn("Invalid sensitivity.", zap.String("sensitivity", body.Sensitivity), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	settings, err := traceEndpoint.Anomalies.SaveSettings(anomalies.Settings{AccountID: accountID, Sensitivity: body.Sensitivity})
+	if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("Could not save the anomaly settings.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settings)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
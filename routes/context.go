@@ -0,0 +1,251 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseContextSize parses the number of neighbours requested on one side of the anchor
+func parseContextSize(field string, value string) (uint64, error) {
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || size > storage.MaxContextSize {
+		return 0, fmt.Errorf("Invalid '%s' provided. Acceptable value is 0-%d.", field, storage.MaxContextSize)
+	}
+
+	return size, nil
+}
+
+// contextHandler serves a trace together with the traces logged right before and after it on the same device
+func (traceEndpoint *TraceEndpoint) contextHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-device-trace-context-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+	span.SetTag("request_id", requestID)
+
+	contextStore, ok := traceEndpoint.TraceStore.(storage.TraceContextStore)
+	if !ok {
+		writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Trace context is not supported by the configured trace store", "", "", requestID)
+
+		logger.Warn("Trace store does not support trace context.", zap.Int("response_code", http.StatusNotImplemented))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	id := mux.Vars(r)["device_trace_id"]
+	span.SetTag("device_trace_id", id)
+
+	var filters traceFilters
+	var same []string
+	size := uint64(storage.DefaultContextSize)
+	var beforeSize, afterSize *uint64
+
+	query := r.URL.Query()
+
+	var fieldErr error
+	// Verify query fields
+	for field := range query {
+		value := query[field][0]
+
+		var isFilter bool
+		isFilter, fieldErr = filters.parseField(field, value)
+		if !isFilter {
+			switch field {
+			case "size":
+				// Handle the size of both sides
+				size, fieldErr = parseContextSize(field, value)
+
+			case "size_before":
+				// Handle the size before the anchor
+				var sizeBefore uint64
+				sizeBefore, fieldErr = parseContextSize(field, value)
+				beforeSize = &sizeBefore
+
+			case "size_after":
+				// Handle the size after the anchor
+				var sizeAfter uint64
+				sizeAfter, fieldErr = parseContextSize(field, value)
+				afterSize = &sizeAfter
+
+			case "same":
+				// Handle the fields shared with the anchor
+				same = strings.Split(value, ",")
+				for _, sameField := range same {
+					if !storage.IsContextSameField(sameField) {
+						fieldErr = fmt.Errorf("Invalid 'same'. Acceptable values [%s|%s]", storage.ContextSameAppName, storage.ContextSameType)
+					}
+				}
+
+			default:
+				// Return error for invalid query field
+				errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+				writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+				logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid field name"),
+					trace_log.String("field", field),
+				)
+
+				timer.ObserveDuration()
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+				return
+			}
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field"),
+				trace_log.String("field", field),
+				trace_log.Error(fieldErr),
+			)
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+	}
+
+	if !filters.validRange() {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid time query"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	filters.clamp()
+
+	contextQuery := storage.ContextQuery{
+		TraceQuery: filters.traceQuery(accountID, nil),
+		BeforeSize: size,
+		AfterSize:  size,
+		Same:       same,
+	}
+	contextQuery.ID = id
+
+	if beforeSize != nil {
+		contextQuery.BeforeSize = *beforeSize
+	}
+
+	if afterSize != nil {
+		contextQuery.AfterSize = *afterSize
+	}
+
+	logger.Debug("Sending query to storage ContextDeviceTrace()", zap.Any("query", contextQuery))
+	span.LogFields(
+		trace_log.String("event", "send query to storage"),
+		trace_log.String("message", "Sending context query to storage"),
+		trace_log.Object("query", contextQuery),
+	)
+
+	ctx := buildContextWithValue(requestID, accountID)
+	traceContext, err := contextStore.ContextDeviceTrace(span, ctx, contextQuery)
+
+	if err == storage.ErrTraceNotFound {
+		writePublicError(w, http.StatusNotFound, StatusNotFound, "Could not retreive device trace by this ID", "", "", requestID)
+
+		logger.Warn("Could not find trace for id "+id, zap.Int("response_code", http.StatusNotFound))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "trace not found"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	} else if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("An error occurred inside of ContextDeviceTrace().", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "storage error occured"),
+			trace_log.Error(err),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		metrics.PrometheusGetRequestElasticSearchFailureCounter.Inc()
+		return
+	}
+
+	timer.ObserveDuration()
+
+	if err := writeJSON(w, http.StatusOK, traceContext); err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Warn("Could not encode result as json.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+	span.LogFields(
+		trace_log.String("event", "success"),
+		trace_log.String("message", "Successfully retreived trace context"),
+	)
+}
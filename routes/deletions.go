@@ -0,0 +1,360 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/deletions"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+// DeletionResponse struct specifies the attibutes of a trace deletion
+type DeletionResponse struct {
+	ID           string             `json:"id"`
+	Object       string             `json:"object"`
+	AccountID    string             `json:"account_id"`
+	RequestID    string             `json:"request_id"`
+	Status       string             `json:"status"`
+	Filters      map[string]string  `json:"filters"`
+	TimeRange    *storage.TimeRange `json:"time_range,omitempty"`
+	TotalCount   int64              `json:"total_count"`
+	DeletedCount int64              `json:"deleted_count"`
+	Failures     []string           `json:"failures,omitempty"`
+	CreatedAt    string             `json:"created_at"`
+	UpdatedAt    string             `json:"updated_at"`
+	CompletedAt  string             `json:"completed_at,omitempty"`
+}
+
+// DeletionPage specifies the return result for the list of trace deletions
+type DeletionPage struct {
+	Object  string             `json:"object"`
+	Limit   int                `json:"limit"`
+	After   string             `json:"after,omitempty"`
+	HasMore bool               `json:"has_more"`
+	Data    []DeletionResponse `json:"data"`
+}
+
+func newDeletionResponse(deletion storage.Deletion) DeletionResponse {
+	filters := traceFilters{
+		After:     deletion.Query.After,
+		Before:    deletion.Query.Before,
+		hasAfter:  !deletion.Query.After.IsZero(),
+		hasBefore: !deletion.Query.Before.IsZero(),
+	}
+
+	return DeletionResponse{
+		ID:           deletion.ID,
+		Object:       deletion.Object,
+		AccountID:    deletion.AccountID,
+		RequestID:    deletion.RequestID,
+		Status:       deletion.Status,
+		Filters:      deletion.Filters,
+		TimeRange:    filters.timeRange(),
+		TotalCount:   deletion.TotalCount,
+		DeletedCount: deletion.DeletedCount,
+		Failures:     deletion.Failures,
+		CreatedAt:    deletion.CreatedAt,
+		UpdatedAt:    deletion.UpdatedAt,
+		CompletedAt:  deletion.CompletedAt,
+	}
+}
+
+// deletionsUnavailable writes the error response for when trace deletion is not configured
+func (traceEndpoint *TraceEndpoint) deletionsUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.Deletions != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Trace deletion is not enabled on this service", "", "", requestID)
+
+	logger.Warn("Trace deletion is not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// deletionError writes the error response for an error of the deletion manager
+func deletionError(w http.ResponseWriter, logger *zap.Logger, err error, requestID string) {
+	switch err {
+	case storage.ErrDeletionNotFound:
+		writePublicError(w, http.StatusNotFound, StatusNotFound, err.Error(), "", "", requestID)
+		logger.Warn("Deletion not found.", zap.Int("response_code", http.StatusNotFound))
+	case deletions.ErrTraceNotFound:
+		writePublicError(w, http.StatusNotFound, StatusNotFound, err.Error(), "", "", requestID)
+		logger.Warn("Trace not found.", zap.Int("response_code", http.StatusNotFound))
+	default:
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+		logger.Error("An error occurred inside of the deletion manager.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+	}
+}
+
+// deleteTracesHandler starts deleting the traces of a device, or of the account in a time range or of a selection of
+// devices. It returns the deletion to follow its progress
+func (traceEndpoint *TraceEndpoint) deleteTracesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-device-trace-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.deletionsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	deviceID, isDeviceRoute := mux.Vars(r)["device_id"]
+
+	var filters traceFilters
+	auditFilters := map[string]string{}
+
+	for field, values := range r.URL.Query() {
+		value := values[0]
+		var fieldErr error
+
+		switch {
+		case field == "timestamp__gte" || field == "timestamp__lte":
+			_, fieldErr = filters.parseField(field, value)
+
+		case isDeviceSelectionField(field):
+			// Handled by requestDevices
+			if isDeviceRoute {
+				fieldErr = errors.New("Field not supported for a single device")
+			}
+
+		default:
+			errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+			logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+
+		auditFilters[field] = value
+	}
+
+	// Deleting every trace of the account takes an explicit time range or selection of devices
+	if !isDeviceRoute && len(auditFilters) == 0 {
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Missing deletion filter", "timestamp__lte", "Provide a time range or a selection of devices", requestID)
+
+		logger.Warn("Deletion without filters.", zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	if !filters.validRange() {
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Invalid query field 'timestamp__lte'", "timestamp__lte", "Invalid time range. timerange__gte should be after timerange__lte", requestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	if !filters.clamp() {
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Invalid query field 'timestamp__gte'", "timestamp__gte", "The time range cannot match any trace", requestID)
+
+		logger.Warn("Empty time range.", zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+		return
+	}
+
+	if isDeviceRoute {
+		auditFilters["device_id"] = deviceID
+	}
+
+	span.LogFields(
+		trace_log.String("event", "delete traces"),
+		trace_log.Object("filters", auditFilters),
+	)
+
+	ctx := buildContextWithValue(requestID, accountID)
+
+	deletion, err := traceEndpoint.Deletions.Submit(span, ctx, accountID, requestID, filters.traceQuery(accountID, devices), auditFilters)
+	if err != nil {
+		deletionError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, newDeletionResponse(deletion))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusAccepted), zap.String("deletion_id", deletion.ID))
+}
+
+// deleteTraceHandler deletes a single trace of the account
+func (traceEndpoint *TraceEndpoint) deleteTraceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-device-trace-by-id-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.deletionsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	for field := range r.URL.Query() {
+		errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+		logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	traceID := mux.Vars(r)["device_trace_id"]
+	ctx := buildContextWithValue(requestID, accountID)
+
+	deletion, err := traceEndpoint.Deletions.DeleteTrace(span, ctx, accountID, requestID, traceID)
+	if err != nil {
+		deletionError(w, logger, err, requestID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent), zap.String("deletion_id", deletion.ID))
+}
+
+// listDeletionsHandler lists the trace deletions of the account, newest first
+func (traceEndpoint *TraceEndpoint) listDeletionsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-deletions-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.deletionsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	limit := deletions.DefaultDeletionLimit
+	after := ""
+
+	for field, values := range r.URL.Query() {
+		value := values[0]
+		var fieldErr error
+
+		switch field {
+		case "limit":
+			var parsed uint64
+			parsed, fieldErr = strconv.ParseUint(value, 10, 64)
+			if fieldErr == nil && (parsed < 1 || parsed > storage.MaxDeletionListLimit) {
+				fieldErr = fmt.Errorf("Invalid 'limit' provided. Acceptable value is 1-%d.", storage.MaxDeletionListLimit)
+			}
+			limit = int(parsed)
+
+		case "after":
+			after = value
+
+		default:
+			errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+			logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+			return
+		}
+	}
+
+	ctx := buildRequestContextWithValue(r, requestID, accountID)
+
+	list, hasMore, err := traceEndpoint.Deletions.List(span, ctx, accountID, limit, after)
+	if err != nil {
+		deletionError(w, logger, err, requestID)
+		return
+	}
+
+	page := DeletionPage{
+		Object:  "list",
+		Limit:   limit,
+		After:   after,
+		HasMore: hasMore,
+		Data:    make([]DeletionResponse, 0, len(list)),
+	}
+
+	for _, deletion := range list {
+		page.Data = append(page.Data, newDeletionResponse(deletion))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getDeletionHandler returns the status and progress of a trace deletion
+func (traceEndpoint *TraceEndpoint) getDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-deletion-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.deletionsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	ctx := buildRequestContextWithValue(r, requestID, accountID)
+
+	deletion, err := traceEndpoint.Deletions.Get(span, ctx, accountID, mux.Vars(r)["deletion_id"])
+	if err != nil {
+		deletionError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newDeletionResponse(deletion))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
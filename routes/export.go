@@ -0,0 +1,303 @@
+package routes
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/export"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// ExportWriteTimeout bounds the time to write a single batch of an export to the client
+	ExportWriteTimeout = time.Second * 30
+)
+
+// acceptsGzip reports whether the client accepts a gzip encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exportHandler streams every trace matching the query as NDJSON or CSV. The traces are read from the store
+// in batches, so memory use does not depend on the size of the export
+func (traceEndpoint *TraceEndpoint) exportHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "export-device-trace-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+	span.SetTag("request_id", requestID)
+
+	devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	var filters traceFilters
+	format := export.FormatNDJSON
+	sort := true
+
+	if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = export.FormatCSV
+	}
+
+	query := r.URL.Query()
+
+	var fieldErr error
+	// Verify query fields
+	for field := range query {
+		value := query[field][0]
+
+		var isFilter bool
+		isFilter, fieldErr = filters.parseField(field, value)
+		if isFilter {
+			// Handled as a trace filter
+		} else if isDeviceSelectionField(field) {
+			// Handled by requestDevices
+			if _, isDeviceRoute := mux.Vars(r)["device_id"]; isDeviceRoute {
+				fieldErr = errors.New("Field not supported for a single device")
+			}
+		} else {
+			switch field {
+			case "format":
+				// Handle the format parameter
+				format = strings.ToLower(value)
+				if !export.IsFormat(format) {
+					fieldErr = fmt.Errorf("Invalid 'format'. Acceptable values [%s|%s]", export.FormatNDJSON, export.FormatCSV)
+				}
+
+			case "order":
+				// Handle the sort parameter
+				if strings.ToLower(value) == "desc" {
+					sort = false
+				} else if strings.ToLower(value) != "asc" {
+					fieldErr = errors.New("Invalid 'order'. Acceptable values [ASC|DESC]")
+				}
+
+			default:
+				// Return error for invalid query field
+				errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+				writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+				logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid field name"),
+					trace_log.String("field", field),
+				)
+
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+				return
+			}
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field"),
+				trace_log.String("field", field),
+				trace_log.Error(fieldErr),
+			)
+
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+	}
+
+	if !filters.validRange() {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	matchable := filters.clamp()
+
+	traceQuery := filters.traceQuery(accountID, devices)
+	traceQuery.Sort = sort
+
+	responseController := http.NewResponseController(w)
+	flusher, _ := w.(http.Flusher)
+
+	var body io.Writer = w
+	var gzipWriter *gzip.Writer
+	var traceWriter export.TraceWriter
+	var started bool
+	var exported int
+
+	// The response is started with the first batch, so that a failing query can still be reported as an error response
+	start := func() {
+		started = true
+
+		w.Header().Set("Content-Type", export.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"device-trace-%s.%s\"", time.Now().UTC().Format("20060102T150405Z"), format))
+		w.Header().Set("Vary", "Accept-Encoding")
+
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter = gzip.NewWriter(w)
+			body = gzipWriter
+		}
+
+		w.WriteHeader(http.StatusOK)
+		traceWriter, _ = export.NewTraceWriter(body, format)
+	}
+
+	flush := func() error {
+		if err := traceWriter.Flush(); err != nil {
+			return err
+		}
+
+		if gzipWriter != nil {
+			if err := gzipWriter.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	}
+
+	logger.Debug("Starting export", zap.Any("query", traceQuery), zap.String("format", format))
+	span.LogFields(
+		trace_log.String("event", "send query to storage"),
+		trace_log.String("message", "Scanning traces for export"),
+		trace_log.Object("query", traceQuery),
+	)
+
+	var err error
+	ctx := buildRequestContextWithValue(r, requestID, accountID)
+
+	// The first batch may take longer than the server write timeout to arrive
+	responseController.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+
+	if matchable {
+		err = storage.ScanDeviceTrace(traceEndpoint.TraceStore, span, ctx, traceQuery, func(traces []storage.TraceResponse) error {
+			if !started {
+				start()
+			}
+
+			// Each batch gets its own write deadline instead of the server wide one
+			responseController.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+
+			if err := traceWriter.Write(traces); err != nil {
+				return err
+			}
+
+			exported += len(traces)
+			metrics.PrometheusExportedTraces.Add(float64(len(traces)))
+
+			return flush()
+		})
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			logger.Info("Export cancelled by the client.", zap.Int("exported", exported))
+			return
+		}
+
+		logger.Error("An error occurred while exporting traces.", zap.Error(err), zap.Int("exported", exported))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "export failed"),
+			trace_log.Error(err),
+		)
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+
+		if !started {
+			writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+			metrics.PrometheusGetRequestElasticSearchFailureCounter.Inc()
+			return
+		}
+
+		// Abort the connection so that the client does not take a truncated export as complete
+		panic(http.ErrAbortHandler)
+	}
+
+	if !started {
+		start()
+	}
+
+	responseController.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+
+	if err := flush(); err != nil {
+		logger.Warn("Could not flush the export.", zap.Error(err))
+		return
+	}
+
+	if gzipWriter != nil {
+		gzipWriter.Close()
+	}
+
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK), zap.Int("exported", exported))
+	span.LogFields(
+		trace_log.String("event", "success"),
+		trace_log.String("message", "Successfully exported traces"),
+		trace_log.Int("exported", exported),
+	)
+}
@@ -0,0 +1,502 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/export"
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PostExportJob struct specifies the attibutes acceptable in POST /v3/device-trace-exports body
+type PostExportJob struct {
+	Format      string            `json:"format"`
+	Compression string            `json:"compression"`
+	Filters     map[string]string `json:"filters"`
+}
+
+// ExportJobResponse struct specifies the attibutes of an export job
+type ExportJobResponse struct {
+	ID            string            `json:"id"`
+	Object        string            `json:"object"`
+	AccountID     string            `json:"account_id"`
+	Status        string            `json:"status"`
+	Format        string            `json:"format"`
+	Compression   string            `json:"compression"`
+	Filters       map[string]string `json:"filters"`
+	ExportedCount uint64            `json:"exported_count"`
+	TotalCount    uint64            `json:"total_count"`
+	Size          int64             `json:"size"`
+	Error         string            `json:"error,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+	StartedAt     string            `json:"started_at,omitempty"`
+	CompletedAt   string            `json:"completed_at,omitempty"`
+	ExpiresAt     string            `json:"expires_at,omitempty"`
+	DownloadURL   string            `json:"download_url,omitempty"`
+}
+
+// ExportJobPage specifies the return result for the list of export jobs
+type ExportJobPage struct {
+	Object string              `json:"object"`
+	Data   []ExportJobResponse `json:"data"`
+}
+
+func newExportJobResponse(job export.Job) ExportJobResponse {
+	response := ExportJobResponse{
+		ID:            job.ID,
+		Object:        job.Object,
+		AccountID:     job.AccountID,
+		Status:        job.Status,
+		Format:        job.Spec.Format,
+		Compression:   job.Spec.Compression,
+		Filters:       job.Spec.Filters,
+		ExportedCount: job.ExportedCount,
+		TotalCount:    job.TotalCount,
+		Size:          job.Size,
+		Error:         job.Error,
+		CreatedAt:     job.CreatedAt,
+		StartedAt:     job.StartedAt,
+		CompletedAt:   job.CompletedAt,
+		ExpiresAt:     job.ExpiresAt,
+	}
+
+	if job.Status == export.JobStatusCompleted {
+		response.DownloadURL = fmt.Sprintf("/v3/device-trace-exports/%s/download", job.ID)
+	}
+
+	return response
+}
+
+// deadlineWriter pushes the write deadline forward on every write, so that a download is bounded by
+// how long the client stalls rather than by its total duration
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.controller.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+
+	return w.ResponseWriter.Write(p)
+}
+
+// exportJobsUnavailable writes the error response for when async exports are not configured
+func (traceEndpoint *TraceEndpoint) exportJobsUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.ExportJobs != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Export jobs are not enabled on this service", "", "", requestID)
+
+	logger.Warn("Export jobs are not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// exportJobError writes the error response for an error of the export job manager
+func exportJobError(w http.ResponseWriter, logger *zap.Logger, err error, requestID string) {
+	switch err {
+	case export.ErrJobNotFound:
+		writePublicError(w, http.StatusNotFound, StatusNotFound, "Could not retreive export by this ID", "", "", requestID)
+		logger.Warn("Export job not found.", zap.Int("response_code", http.StatusNotFound))
+	case export.ErrJobNotReady:
+		writePublicError(w, http.StatusConflict, StatusConflict, err.Error(), "", "", requestID)
+		logger.Warn("Export job not ready.", zap.Int("response_code", http.StatusConflict))
+	case export.ErrTooManyJobs:
+		writePublicError(w, http.StatusTooManyRequests, StatusTooManyRequests, err.Error(), "", "", requestID)
+		logger.Warn("Export job rejected.", zap.Error(err), zap.Int("response_code", http.StatusTooManyRequests))
+	case export.ErrQueueFull:
+		writePublicError(w, http.StatusServiceUnavailable, StatusServiceUnavailable, err.Error(), "", "", requestID)
+		logger.Warn("Export job rejected.", zap.Error(err), zap.Int("response_code", http.StatusServiceUnavailable))
+	default:
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+		logger.Error("An error occurred inside of the export job manager.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+	}
+}
+
+// exportJobDevices resolves the device selection fields of the filters of an export job like those of the query of
+// the streaming export, so that device_id__in is validated and capped the same way
+func (traceEndpoint *TraceEndpoint) exportJobDevices(span opentracing.Span, r *http.Request, requestID string, accountID string, body PostExportJob) ([]string, *httputil.PublicError) {
+	query := url.Values{}
+	for field, value := range body.Filters {
+		if isDeviceSelectionField(field) {
+			query.Set(field, value)
+		}
+	}
+
+	deviceRequest := r.Clone(r.Context())
+	deviceRequest.URL.RawQuery = query.Encode()
+
+	devices, publicError := traceEndpoint.requestDevices(span, deviceRequest, requestID, accountID)
+	if publicError != nil {
+		for i := range publicError.Fields {
+			publicError.Fields[i].Name = "filters." + publicError.Fields[i].Name
+		}
+	}
+
+	return devices, publicError
+}
+
+// parseExportJob validates the body of an export job request into a job spec of the resolved devices
+func parseExportJob(body PostExportJob, accountID string, devices []string) (export.JobSpec, string, error) {
+	var filters traceFilters
+	sort := true
+
+	spec := export.JobSpec{
+		Format:      strings.ToLower(body.Format),
+		Compression: strings.ToLower(body.Compression),
+		Filters:     body.Filters,
+	}
+
+	if spec.Format == "" {
+		spec.Format = export.FormatNDJSON
+	}
+
+	if !export.IsFormat(spec.Format) {
+		return spec, "format", fmt.Errorf("Invalid 'format'. Acceptable values [%s|%s]", export.FormatNDJSON, export.FormatCSV)
+	}
+
+	if spec.Compression == "" {
+		spec.Compression = export.CompressionGzip
+	}
+
+	if spec.Compression != export.CompressionGzip && spec.Compression != export.CompressionNone {
+		return spec, "compression", fmt.Errorf("Invalid 'compression'. Acceptable values [%s|%s]", export.CompressionGzip, export.CompressionNone)
+	}
+
+	for field, value := range body.Filters {
+		isFilter, fieldErr := filters.parseField(field, value)
+		if !isFilter && !isDeviceSelectionField(field) {
+			// Device selection fields are resolved by exportJobDevices
+			switch field {
+			case "order":
+				// Handle the sort parameter
+				if strings.ToLower(value) == "desc" {
+					sort = false
+				} else if strings.ToLower(value) != "asc" {
+					fieldErr = errors.New("Invalid 'order'. Acceptable values [ASC|DESC]")
+				}
+
+			default:
+				fieldErr = fmt.Errorf("Invalid field name '%s'", field)
+			}
+		}
+
+		if fieldErr != nil {
+			return spec, "filters." + field, fieldErr
+		}
+	}
+
+	if !filters.validRange() {
+		return spec, "filters.timestamp__lte", errors.New("Invalid time range. timerange__gte should be after timerange__lte")
+	}
+
+	if !filters.clamp() {
+		return spec, "filters.timestamp__gte", errors.New("The time range cannot match any trace")
+	}
+
+	spec.Query = filters.traceQuery(accountID, devices)
+	spec.Query.Sort = sort
+
+	return spec, "", nil
+}
+
+// createExportJobHandler queues an asynchronous export
+func (traceEndpoint *TraceEndpoint) createExportJobHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusPostRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "create-export-job-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.exportJobsUnavailable(w, logger, requestID) {
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	dataStream, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error reading request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not read request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	var body PostExportJob
+	dec := json.NewDecoder(strings.NewReader(string(dataStream)))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	devices, publicError := traceEndpoint.exportJobDevices(span, r, requestID, accountID, body)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	spec, field, fieldErr := parseExportJob(body, accountID, devices)
+	if fieldErr != nil {
+		errMsg := fmt.Sprintf("Invalid field '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+		logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid field"),
+			trace_log.String("field", field),
+			trace_log.Error(fieldErr),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	job, err := traceEndpoint.ExportJobs.Submit(accountID, requestID, spec)
+	if err != nil {
+		exportJobError(w, logger, err, requestID)
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	metrics.PrometheusExportJobsCreated.Inc()
+	timer.ObserveDuration()
+
+	writeJSON(w, http.StatusAccepted, newExportJobResponse(job))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusAccepted), zap.String("job_id", job.ID))
+}
+
+// listExportJobsHandler lists the export jobs of the account
+func (traceEndpoint *TraceEndpoint) listExportJobsHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-export-jobs-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.exportJobsUnavailable(w, logger, requestID) {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	jobs, err := traceEndpoint.ExportJobs.List(accountID)
+	if err != nil {
+		exportJobError(w, logger, err, requestID)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	page := ExportJobPage{
+		Object: "list",
+		Data:   make([]ExportJobResponse, 0, len(jobs)),
+	}
+
+	for _, job := range jobs {
+		page.Data = append(page.Data, newExportJobResponse(job))
+	}
+
+	timer.ObserveDuration()
+
+	writeJSON(w, http.StatusOK, page)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getExportJobHandler returns the status and progress of an export job
+func (traceEndpoint *TraceEndpoint) getExportJobHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-export-job-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.exportJobsUnavailable(w, logger, requestID) {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	job, err := traceEndpoint.ExportJobs.Get(accountID, mux.Vars(r)["export_id"])
+	if err != nil {
+		exportJobError(w, logger, err, requestID)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	timer.ObserveDuration()
+
+	writeJSON(w, http.StatusOK, newExportJobResponse(job))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// downloadExportJobHandler serves the result file of a completed export job. Range requests are
+// supported so that an interrupted download can be resumed
+func (traceEndpoint *TraceEndpoint) downloadExportJobHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "download-export-job-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.exportJobsUnavailable(w, logger, requestID) {
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	job, blob, err := traceEndpoint.ExportJobs.Open(accountID, mux.Vars(r)["export_id"])
+	if err == export.ErrBlobNotFound {
+		err = export.ErrJobNotFound
+	}
+
+	if err != nil {
+		exportJobError(w, logger, err, requestID)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	defer blob.Close()
+
+	// The duration covers finding the file, not the download
+	timer.ObserveDuration()
+
+	contentType := export.ContentType(job.Spec.Format)
+	if job.Spec.Compression == export.CompressionGzip {
+		contentType = "application/gzip"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", job.FileName()))
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", job.ID))
+
+	http.ServeContent(&deadlineWriter{ResponseWriter: w, controller: http.NewResponseController(w)}, r, job.FileName(), blob.ModTime, blob)
+	logger.Info("Success Request.", zap.String("job_id", job.ID))
+}
+
+// deleteExportJobHandler cancels an export job and removes its result file
+func (traceEndpoint *TraceEndpoint) deleteExportJobHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusPostRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-export-job-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.exportJobsUnavailable(w, logger, requestID) {
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	if err := traceEndpoint.ExportJobs.Delete(accountID, mux.Vars(r)["export_id"]); err != nil {
+		exportJobError(w, logger, err, requestID)
+
+		timer.ObserveDuration()
+		metrics.PrometheusPostRequestErrorCounter.Inc()
+		return
+	}
+
+	timer.ObserveDuration()
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent))
+}
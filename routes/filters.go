@@ -0,0 +1,541 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/services"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+// traceFilters holds the trace filter query fields shared by the endpoints that search traces
+type traceFilters struct {
+	After     time.Time
+	Before    time.Time
+	AppName   string
+	Type      string
+	Message   string
+	hasAfter  bool
+	hasBefore bool
+	clock     time.Time
+}
+
+// now returns the time that relative time expressions of the request resolve against. It is fixed on first use so
+// that every bound of a request shares it
+func (filters *traceFilters) now() time.Time {
+	if filters.clock.IsZero() {
+		filters.clock = time.Now().UTC()
+	}
+
+	return filters.clock
+}
+
+// parseField parses a filter query field. It returns false if field is not a filter field
+func (filters *traceFilters) parseField(field string, value string) (bool, error) {
+	var err error
+
+	switch field {
+	case "timestamp__gte":
+		// Handle the After Timestamp
+		filters.hasAfter = true
+		filters.After, err = parseTimeExpression(value, filters.now(), false)
+		if err != nil {
+			return true, err
+		}
+
+	case "timestamp__lte":
+		// Handle the Before Timestamp
+		filters.hasBefore = true
+		filters.Before, err = parseTimeExpression(value, filters.now(), true)
+		if err != nil {
+			return true, err
+		}
+
+	case "app_name__eq":
+		// Handle the app_name parameter
+		if len(value) == 0 {
+			return true, errors.New("Invalid field value ''")
+		}
+		filters.AppName = value
+
+	case "type__eq":
+		// Handle the type parameter
+		if len(value) == 0 {
+			return true, errors.New("Invalid field value ''")
+		}
+		filters.Type = value
+
+	case "message__eq":
+		// Handle the message parameter
+		if len(value) == 0 {
+			return true, errors.New("Invalid field value ''")
+		}
+		filters.Message = value
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// validRange reports whether the time range is not inverted
+func (filters *traceFilters) validRange() bool {
+	return !(filters.hasAfter && filters.hasBefore && filters.Before.Before(filters.After))
+}
+
+// timeRange returns the resolved bounds of the request, or nil if it has none
+func (filters *traceFilters) timeRange() *storage.TimeRange {
+	if !filters.hasAfter && !filters.hasBefore {
+		return nil
+	}
+
+	timeRange := &storage.TimeRange{}
+
+	if filters.hasAfter {
+		timeRange.Gte = filters.After.UTC().Format(time.RFC3339Nano)
+	}
+
+	if filters.hasBefore {
+		timeRange.Lte = filters.Before.UTC().Format(time.RFC3339Nano)
+	}
+
+	return timeRange
+}
+
+// clamp drops the time bounds that lie outside of the storable timestamps. It returns false if
+// the time range cannot match any stored trace
+func (filters *traceFilters) clamp() bool {
+	var MinTime time.Time = time.Unix(0, 0)
+	var MaxTime time.Time = time.Unix(MaxTimestamp/1000, (MaxTimestamp%1000)*1000000)
+
+	// If gte > MaxTime or lte < MinTime, nothing can match
+	if filters.After.After(MaxTime) || (filters.hasBefore && filters.Before.Before(MinTime)) {
+		return false
+	}
+
+	// If lte > MaxTime, don't use the query
+	if filters.hasBefore && filters.Before.After(MaxTime) {
+		filters.Before = time.Time{}
+	}
+
+	// If gte < MinTime, don't use the query
+	if filters.hasAfter && filters.After.Before(MinTime) {
+		filters.After = time.Time{}
+	}
+
+	return true
+}
+
+// traceQuery builds the storage query for the filters
+func (filters *traceFilters) traceQuery(accountID string, devices []string) storage.TraceQuery {
+	return storage.TraceQuery{
+		Device:  devices,
+		Account: accountID,
+		After:   filters.After,
+		Before:  filters.Before,
+		AppName: filters.AppName,
+		Type:    filters.Type,
+		Message: filters.Message,
+	}
+}
+
+// parseTraceFields parses the comma separated fields parameter into the trace properties to return
+func parseTraceFields(value string) ([]string, error) {
+	if len(value) == 0 {
+		return nil, errors.New("Invalid field value ''")
+	}
+
+	var fields []string
+	var unknown []string
+
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !storage.IsTraceColumn(field) {
+			unknown = append(unknown, fmt.Sprintf("'%s'", field))
+			continue
+		}
+
+		fields = append(fields, field)
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown fields %s. Acceptable values [%s]", strings.Join(unknown, ", "), strings.Join(storage.TraceColumns, "|"))
+	}
+
+	return fields, nil
+}
+
+// writePublicError writes a PublicError response
+func writePublicError(w http.ResponseWriter, code int, typ string, msg string, fName string, fMsg string, requestID string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf8")
+	w.WriteHeader(code)
+	io.WriteString(w, encodePublicErrorObject(code, typ, msg, fName, fMsg, requestID))
+}
+
+// writeJSON writes obj as the JSON response body
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) error {
+	encoded, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf8")
+	w.WriteHeader(code)
+	io.WriteString(w, string(encoded)+"\n")
+
+	return nil
+}
+
+// deviceSelectionFields lists the query fields that select the devices of a request on the account routes
+var deviceSelectionFields = map[string]bool{
+	"device_id__in":       true,
+	"device_group_id__eq": true,
+	"device_filter":       true,
+}
+
+// isDeviceSelectionField reports whether field is handled by requestDevices
+func isDeviceSelectionField(field string) bool {
+	return deviceSelectionFields[field]
+}
+
+var (
+	deviceGroupIDPattern     = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+	deviceFilterFieldPattern = regexp.MustCompile(`^[a-z_]+__(eq|neq|in|nin|gte|lte)$`)
+)
+
+// parseDeviceFilter parses a device_filter value, a URL encoded set of device directory query fields such as
+// state__eq=registered&host_gateway__eq=016a...
+func parseDeviceFilter(value string) (url.Values, error) {
+	filter, err := url.ParseQuery(value)
+	if err != nil || len(filter) == 0 {
+		return nil, errors.New("Invalid field value. Expected URL encoded device query fields such as state__eq=registered.")
+	}
+
+	for field, values := range filter {
+		if !deviceFilterFieldPattern.MatchString(field) {
+			return nil, fmt.Errorf("Invalid device query field '%s'", field)
+		}
+
+		if len(values) != 1 || values[0] == "" {
+			return nil, fmt.Errorf("Invalid value of device query field '%s'", field)
+		}
+	}
+
+	return filter, nil
+}
+
+// deviceSelectionError returns the error response for an invalid device selection field
+func deviceSelectionError(field string, message string, requestID string) *httputil.PublicError {
+	return &httputil.PublicError{
+		Object:    "error",
+		Code:      http.StatusBadRequest,
+		Type:      StatusValidationErrType,
+		Message:   fmt.Sprintf("Invalid query field '%s'", field),
+		Fields:    []httputil.PublicErrorField{{Name: field, Message: message}},
+		RequestID: requestID,
+	}
+}
+
+// intersectDevices returns the devices of selected that are also in devices. A nil devices selects every device
+func intersectDevices(devices []string, selected []string) []string {
+	if devices == nil {
+		return selected
+	}
+
+	selectedSet := make(map[string]bool, len(selected))
+	for _, device := range selected {
+		selectedSet[device] = true
+	}
+
+	intersection := []string{}
+	for _, device := range devices {
+		if selectedSet[device] {
+			intersection = append(intersection, device)
+		}
+	}
+
+	return intersection
+}
+
+// selectDevices resolves the device_group_id__eq and device_filter fields of a request into device ids. It returns
+// nil if the request has neither
+func (traceEndpoint *TraceEndpoint) selectDevices(span opentracing.Span, r *http.Request, requestID string, accountID string) ([]string, *httputil.PublicError) {
+	query := r.URL.Query()
+
+	if len(query["device_group_id__eq"]) == 0 && len(query["device_filter"]) == 0 {
+		return nil, nil
+	}
+
+	if traceEndpoint.DeviceSelector == nil {
+		return nil, &httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusNotImplemented,
+			Type:      StatusNotImplemented,
+			Message:   "Device groups and filters are not supported by this service",
+			RequestID: requestID,
+		}
+	}
+
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyRequestID, requestID)
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyAccountID, accountID)
+	ctx := opentracing.ContextWithSpan(r.Context(), span)
+
+	var devices []string
+
+	if len(query["device_group_id__eq"]) > 0 {
+		groupID := query.Get("device_group_id__eq")
+		if !deviceGroupIDPattern.MatchString(groupID) {
+			return nil, deviceSelectionError("device_group_id__eq", "Invalid device group id", requestID)
+		}
+
+		selected, publicError := traceEndpoint.DeviceSelector.GroupDevices(span, ctx, groupID)
+		if publicError != nil {
+			return nil, directorySelectionError(span, publicError, "device_group_id__eq", requestID)
+		}
+
+		devices = intersectDevices(devices, selected)
+	}
+
+	if len(query["device_filter"]) > 0 {
+		filter, err := parseDeviceFilter(query.Get("device_filter"))
+		if err != nil {
+			return nil, deviceSelectionError("device_filter", err.Error(), requestID)
+		}
+
+		selected, publicError := traceEndpoint.DeviceSelector.FilterDevices(span, ctx, filter)
+		if publicError != nil {
+			return nil, directorySelectionError(span, publicError, "device_filter", requestID)
+		}
+
+		devices = intersectDevices(devices, selected)
+	}
+
+	span.LogFields(
+		trace_log.String("event", "devices selected"),
+		trace_log.Int("device-count", len(devices)),
+	)
+
+	return devices, nil
+}
+
+// directorySelectionError prepares an error of the device directory for the response
+func directorySelectionError(span opentracing.Span, publicError *httputil.PublicError, field string, requestID string) *httputil.PublicError {
+	span.LogFields(
+		trace_log.String("event", "error"),
+		trace_log.String("message", "device selection failed"),
+		trace_log.Object("error", publicError),
+	)
+
+	if publicError.Code == http.StatusUnauthorized {
+		publicError = &httputil.PublicError{
+			Object:  "error",
+			Code:    http.StatusInternalServerError,
+			Type:    StatusInternalServerErrType,
+			Message: "Could not generate valid access token, error: " + publicError.Message,
+		}
+	}
+
+	if publicError.Code != http.StatusBadRequest {
+		publicError.Message = fmt.Sprintf("Failed resolving %s: %s", field, publicError.Message)
+	}
+	publicError.RequestID = requestID
+
+	return publicError
+}
+
+// validateDevices removes duplicates from the ids of device_id__in and checks them against the device directory.
+// Ids that do not belong to the account are reported as field errors, or dropped in lenient mode
+func (traceEndpoint *TraceEndpoint) validateDevices(span opentracing.Span, r *http.Request, requestID string, accountID string, ids []string) ([]string, *httputil.PublicError) {
+	devices := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return nil, deviceSelectionError("device_id__in", "Invalid field value. Device ids must not be empty.", requestID)
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			devices = append(devices, id)
+		}
+	}
+
+	maxDeviceIDs := traceEndpoint.MaxDeviceIDs
+	if maxDeviceIDs <= 0 {
+		maxDeviceIDs = services.DefaultMaxDeviceIDs
+	}
+
+	if len(devices) > maxDeviceIDs {
+		return nil, deviceSelectionError("device_id__in", fmt.Sprintf("Too many device ids. Acceptable number is 1-%d.", maxDeviceIDs), requestID)
+	}
+
+	if traceEndpoint.DeviceValidator == nil {
+		return devices, nil
+	}
+
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyRequestID, requestID)
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyAccountID, accountID)
+	ctx := opentracing.ContextWithSpan(r.Context(), span)
+
+	unknown, publicError := traceEndpoint.DeviceValidator.UnknownDevices(span, ctx, devices)
+	if publicError != nil {
+		return nil, directorySelectionError(span, publicError, "device_id__in", requestID)
+	}
+
+	if len(unknown) == 0 {
+		return devices, nil
+	}
+
+	span.LogFields(
+		trace_log.String("event", "unknown devices"),
+		trace_log.Int("unknown-count", len(unknown)),
+		trace_log.Bool("lenient", traceEndpoint.LenientDeviceValidation),
+	)
+
+	if !traceEndpoint.LenientDeviceValidation {
+		fields := make([]httputil.PublicErrorField, 0, len(unknown))
+		for _, id := range unknown {
+			fields = append(fields, httputil.PublicErrorField{Name: "device_id__in", Message: fmt.Sprintf("Unknown device id '%s'", id)})
+		}
+
+		return nil, &httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusBadRequest,
+			Type:      StatusValidationErrType,
+			Message:   "Invalid query field 'device_id__in'",
+			Fields:    fields,
+			RequestID: requestID,
+		}
+	}
+
+	unknownSet := make(map[string]bool, len(unknown))
+	for _, id := range unknown {
+		unknownSet[id] = true
+	}
+
+	known := []string{}
+	for _, id := range devices {
+		if !unknownSet[id] {
+			known = append(known, id)
+		}
+	}
+
+	return known, nil
+}
+
+// requestDevices resolves the devices that a request is scoped to. Requests under /v3/devices/{device_id} are
+// validated against the device directory, other requests may narrow the account with device_id__in,
+// device_group_id__eq and device_filter. When several are given the request is scoped to the devices in all of them
+func (traceEndpoint *TraceEndpoint) requestDevices(span opentracing.Span, r *http.Request, requestID string, accountID string) ([]string, *httputil.PublicError) {
+	deviceID, ok := mux.Vars(r)["device_id"]
+	if !ok {
+		query := r.URL.Query()
+
+		var devices []string
+
+		if len(query["device_id__in"]) > 0 {
+			if query["device_id__in"][0] == "" {
+				return nil, deviceSelectionError("device_id__in", "Invalid field value ''", requestID)
+			}
+
+			var publicError *httputil.PublicError
+			devices, publicError = traceEndpoint.validateDevices(span, r, requestID, accountID, strings.Split(query["device_id__in"][0], ","))
+			if publicError != nil {
+				return nil, publicError
+			}
+		}
+
+		selected, publicError := traceEndpoint.selectDevices(span, r, requestID, accountID)
+		if publicError != nil {
+			return nil, publicError
+		}
+
+		if selected != nil {
+			devices = intersectDevices(devices, selected)
+		}
+
+		return devices, nil
+	}
+
+	span.SetTag("device_id", deviceID)
+	span.LogFields(
+		trace_log.String("event", "device validation"),
+		trace_log.String("message", "Starting to validate device id"),
+	)
+
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyRequestID, requestID)
+	r, _ = httputil.WithContextValue(r, httputil.ContextKeyAccountID, accountID)
+
+	ctx := opentracing.ContextWithSpan(r.Context(), span)
+	deviceData, publicError := traceEndpoint.DeviceDirectory.DeviceRetrieve(span, ctx, deviceID)
+
+	if publicError != nil {
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "device validation failed"),
+			trace_log.Object("error", publicError),
+		)
+
+		if publicError.Code == http.StatusUnauthorized {
+			publicError = &httputil.PublicError{
+				Object:  "error",
+				Code:    http.StatusInternalServerError,
+				Type:    StatusInternalServerErrType,
+				Message: "Could not generate valid access token, error: " + publicError.Message,
+			}
+		}
+
+		publicError.Message = fmt.Sprintf("Failed validating device_id: %s", publicError.Message)
+		publicError.RequestID = requestID
+
+		return nil, publicError
+	}
+
+	span.LogFields(
+		trace_log.String("event", "device validated"),
+		trace_log.String("message", "device exists in account"),
+		trace_log.Object("device-data", deviceData),
+	)
+
+	return []string{deviceID}, nil
+}
+
+// requestAccessToken returns the access token that AccessTokenMiddleware stored in the request context. It writes the
+// error response if the token is missing
+func requestAccessToken(w http.ResponseWriter, r *http.Request, span opentracing.Span, logger *zap.Logger) (token.ArmAccessToken, bool) {
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		return armAccessToken, false
+	}
+
+	span.SetTag("request_id", armAccessToken.RequestID)
+
+	return armAccessToken, true
+}
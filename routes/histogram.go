@@ -0,0 +1,299 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultHistogramRange = 24 * time.Hour
+	MinHistogramInterval  = time.Second
+)
+
+// parseHistogramInterval parses a fixed histogram interval such as 30s, 5m, 1h or 1d
+func parseHistogramInterval(value string) (time.Duration, error) {
+	var interval time.Duration
+	var err error
+
+	if strings.HasSuffix(value, "d") {
+		var days uint64
+		days, err = strconv.ParseUint(strings.TrimSuffix(value, "d"), 10, 16)
+		interval = time.Duration(days) * 24 * time.Hour
+	} else {
+		interval, err = time.ParseDuration(value)
+	}
+
+	if err != nil || interval < MinHistogramInterval || interval%time.Millisecond != 0 {
+		return 0, errors.New("Invalid 'interval'. Acceptable values are 'auto' or a duration of at least 1s such as 30s, 5m, 1h or 1d.")
+	}
+
+	return interval, nil
+}
+
+// histogramHandler serves the trace volume histogram of an account or a single device
+func (traceEndpoint *TraceEndpoint) histogramHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-device-trace-histogram-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+	span.SetTag("request_id", requestID)
+
+	histogramStore, ok := traceEndpoint.TraceStore.(storage.TraceHistogramStore)
+	if !ok {
+		writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Trace histograms are not supported by the configured trace store", "", "", requestID)
+
+		logger.Warn("Trace store does not support histograms.", zap.Int("response_code", http.StatusNotImplemented))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	var filters traceFilters
+	var interval time.Duration
+	timeField := storage.HistogramTimeFieldDevice
+	splitBy := ""
+	splitSize := storage.DefaultHistogramSplits
+
+	query := r.URL.Query()
+
+	var fieldErr error
+	// Verify query fields
+	for field := range query {
+		value := query[field][0]
+
+		var isFilter bool
+		isFilter, fieldErr = filters.parseField(field, value)
+		if isFilter {
+			// Handled as a trace filter
+		} else if isDeviceSelectionField(field) {
+			// Handled by requestDevices
+			if _, isDeviceRoute := mux.Vars(r)["device_id"]; isDeviceRoute {
+				fieldErr = errors.New("Field not supported for a single device")
+			}
+		} else {
+			switch field {
+			case "interval":
+				// Handle the interval parameter
+				if value != "auto" {
+					interval, fieldErr = parseHistogramInterval(value)
+				}
+
+			case "time_field":
+				// Handle the time_field parameter
+				if value != storage.HistogramTimeFieldDevice && value != storage.HistogramTimeFieldCloud {
+					fieldErr = fmt.Errorf("Invalid 'time_field'. Acceptable values [%s|%s]", storage.HistogramTimeFieldDevice, storage.HistogramTimeFieldCloud)
+				}
+				timeField = value
+
+			case "split_by":
+				// Handle the split_by parameter
+				if !storage.IsHistogramSplitField(value) {
+					fieldErr = fmt.Errorf("Invalid 'split_by'. Acceptable values [%s|%s]", storage.HistogramSplitByAppName, storage.HistogramSplitByLevel)
+				}
+				splitBy = value
+
+			case "split_limit":
+				// Handle the split_limit parameter
+				var limit uint64
+				limit, fieldErr = strconv.ParseUint(value, 10, 64)
+				if fieldErr == nil && (limit < 1 || limit > storage.MaxHistogramSplits) {
+					fieldErr = fmt.Errorf("Invalid 'split_limit' provided. Acceptable value is 1-%d.", storage.MaxHistogramSplits)
+				}
+				splitSize = int(limit)
+
+			default:
+				// Return error for invalid query field
+				errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+				writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+				logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid field name"),
+					trace_log.String("field", field),
+				)
+
+				timer.ObserveDuration()
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+				return
+			}
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field"),
+				trace_log.String("field", field),
+				trace_log.Error(fieldErr),
+			)
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+	}
+
+	// Default to the last day when the time range is open
+	if !filters.hasBefore {
+		filters.Before = filters.now()
+	}
+
+	if !filters.hasAfter {
+		filters.After = filters.Before.Add(-DefaultHistogramRange)
+	}
+
+	if filters.Before.Before(filters.After) {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid time query"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	if interval == 0 {
+		interval = storage.AutoHistogramInterval(filters.After, filters.Before)
+	}
+
+	if storage.HistogramBucketCount(filters.After, filters.Before, interval) > storage.MaxHistogramBuckets {
+		fieldMsg := fmt.Sprintf("The interval produces more than %d buckets for the time range.", storage.MaxHistogramBuckets)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Invalid query field 'interval'", "interval", fieldMsg, requestID)
+
+		logger.Warn("Too many histogram buckets.", zap.Duration("interval", interval), zap.Int("response_code", http.StatusBadRequest))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	histogramQuery := storage.HistogramQuery{
+		TraceQuery: filters.traceQuery(accountID, devices),
+		Interval:   interval,
+		TimeField:  timeField,
+		SplitBy:    splitBy,
+		SplitSize:  splitSize,
+	}
+
+	logger.Debug("Sending query to storage HistogramDeviceTrace()", zap.Any("query", histogramQuery))
+	span.LogFields(
+		trace_log.String("event", "send query to storage"),
+		trace_log.String("message", "Sending histogram query to storage"),
+		trace_log.Object("query", histogramQuery),
+	)
+
+	ctx := buildContextWithValue(requestID, accountID)
+	histogram, err := histogramStore.HistogramDeviceTrace(span, ctx, histogramQuery)
+
+	if err == storage.ErrKeywordFieldsMissing {
+		writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, err.Error(), "", "", requestID)
+
+		logger.Warn("The trace indices cannot be split.", zap.Error(err), zap.Int("response_code", http.StatusNotImplemented))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("An error occurred inside of HistogramDeviceTrace().", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "storage error occured"),
+			trace_log.Error(err),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		metrics.PrometheusGetRequestElasticSearchFailureCounter.Inc()
+		return
+	}
+
+	timer.ObserveDuration()
+
+	if err := writeJSON(w, http.StatusOK, histogram); err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Warn("Could not encode result as json.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+	span.LogFields(
+		trace_log.String("event", "success"),
+		trace_log.String("message", "Successfully retreived trace histogram"),
+	)
+}
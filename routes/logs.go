@@ -14,8 +14,14 @@ import (
 	"strings"
 	"time"
 	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/alerts"
+	"github.com/armPelionEdge/edge-gw-trace-service/anomalies"
+	"github.com/armPelionEdge/edge-gw-trace-service/archive"
+	"github.com/armPelionEdge/edge-gw-trace-service/deletions"
+	"github.com/armPelionEdge/edge-gw-trace-service/export"
 	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
 	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/retention"
 	"github.com/armPelionEdge/edge-gw-trace-service/services"
 	"github.com/armPelionEdge/edge-gw-trace-service/storage"
 	"github.com/armPelionEdge/edge-gw-trace-service/tracing"
@@ -42,16 +48,31 @@ const (
 	StatusValidationErrType     = "validation_error"
 	StatusNotFound              = "not_found"
 	StatusUnauthorized          = "invalid_auth"
+	StatusNotImplemented        = "not_implemented"
+	StatusConflict              = "conflict"
+	StatusTooManyRequests       = "too_many_requests"
+	StatusServiceUnavailable    = "service_unavailable"
 	MaxTimestamp int64          = 9223372036854
 )
 
 // TraceEndpoint specifies the interfaces for the gateway trace service
 type TraceEndpoint struct {
-	TraceStore            storage.TraceStore
-	AccessTokenMiddleware mux.MiddlewareFunc
-	UUIDGenerator         *muuid.MUUIDGenerator
-	DeviceDirectory       services.DeviceDirectory
-	Logger                *zap.Logger
+	TraceStore              storage.TraceStore
+	AccessTokenMiddleware   mux.MiddlewareFunc
+	UUIDGenerator           *muuid.MUUIDGenerator
+	DeviceDirectory         services.DeviceDirectory
+	DeviceSelector          *services.DeviceSelector
+	DeviceValidator         *services.DeviceValidator
+	MaxDeviceIDs            int
+	LenientDeviceValidation bool
+	ExportJobs              *export.JobManager
+	SavedSearches           storage.SavedSearchStore
+	Alerts                  *alerts.Manager
+	Anomalies               *anomalies.Detector
+	Deletions               *deletions.Manager
+	Retention               *retention.Purger
+	Rehydrations            *archive.Rehydrator
+	Logger                  *zap.Logger
 }
 
 // PostTrace struct specifies the attibutes acceptable in POST gateway_trace_service body
@@ -100,6 +121,14 @@ func buildContextWithValue(requestID string, accountID string) context.Context {
 	return ctx
 }
 
+// buildRequestContextWithValue is like buildContextWithValue but is cancelled when the client goes away
+func buildRequestContextWithValue(r *http.Request, requestID string, accountID string) context.Context {
+	ctx := context.WithValue(r.Context(), httputil.ContextKeyRequestID, requestID)
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, accountID)
+
+	return ctx
+}
+
 // Parse timestamp as milliseconds from mUUID
 func timestampFromUUID(muuid muuid.MUUID) int64 {
 	var timestamp int64 = 0
@@ -319,6 +348,16 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 
 				return
 			}
+
+			// Evaluate the match rules of the account against the new traces
+			if traceEndpoint.Alerts != nil {
+				traceEndpoint.Alerts.Ingest(accountID, Logs)
+			}
+
+			// Count the new traces into the log rates of their devices
+			if traceEndpoint.Anomalies != nil {
+				traceEndpoint.Anomalies.Observe(accountID, Logs)
+			}
 		} else {
 			logger.Debug("There is nothing to commit.")
 		}
@@ -344,7 +383,7 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 	v3GetRouter.Use(traceEndpoint.AccessTokenMiddleware)
 	v3GetRouter.Use(middleware.RequestLoggerMiddleware())
 
-	var TraceHandler = func(span opentracing.Span, w http.ResponseWriter, r *http.Request, timer *prometheus.Timer, devices []string) {
+	var TraceHandler = func(span opentracing.Span, w http.ResponseWriter, r *http.Request, timer *prometheus.Timer, devices []string, traceStore storage.TraceStore) {
 		armAccessToken, _ := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
 		requestID := armAccessToken.RequestID
 		accountID := armAccessToken.AccountID
@@ -352,15 +391,13 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 		logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("function", "TraceHandler")).With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
 
 		var err error
-		var MinTime time.Time = time.Unix(0, 0)
-		var MaxTime time.Time = time.Unix(MaxTimestamp / 1000, (MaxTimestamp % 1000) * 1000000)
-		var afterTime time.Time
-		var beforeTime time.Time
-		var appName string
-		var typ string
-		var message string
+		var filters traceFilters
 		var after []interface{}
 		var include bool
+		var highlight bool
+		var fields []string
+		preTag := storage.DefaultHighlightPreTag
+		postTag := storage.DefaultHighlightPostTag
 		limit := DefaultLimit
 		sort := DefalutSort
 
@@ -371,43 +408,9 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 		for field := range query {
 			switch field {
 
-			case "timestamp__gte":
-				// Handle the After Timestamp
-				afterTime, err = time.Parse(time.RFC3339, query[field][0])
-				if err != nil {
-					fieldErr = errors.New("Invalid field value. Could not parse as RFC3339 format.")
-				}
-
-			case "timestamp__lte":
-				// Handle the Before Timestamp
-				beforeTime, err = time.Parse(time.RFC3339, query[field][0])
-				if err != nil {
-					fieldErr = errors.New("Invalid field value. Could not parse as RFC3339 format.")
-				}
-
-			case "app_name__eq":
-				// Handle the app_name parameter
-				if len(query[field][0]) != 0 {
-					appName = query[field][0]
-				} else {
-					fieldErr = errors.New("Invalid field value ''")
-				}
-
-			case "type__eq":
-				// Handle the type parameter
-				if len(query[field][0]) != 0 {
-					typ = query[field][0]
-				} else {
-					fieldErr = errors.New("Invalid field value ''")
-				}
-
-			case "message__eq":
-				// Handle the message parameter
-				if len(query[field][0]) != 0 {
-					message = query[field][0]
-				} else {
-					fieldErr = errors.New("Invalid field value ''")
-				}
+			case "timestamp__gte", "timestamp__lte", "app_name__eq", "type__eq", "message__eq":
+				// Handle the trace filters
+				_, fieldErr = filters.parseField(field, query[field][0])
 
 			case "limit":
 				// Handle the limit parameter
@@ -455,6 +458,28 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 					fieldErr = errors.New("Invalid field value ''")
 				}
 
+			case "highlight":
+				// Handle the highlight parameter
+				highlight, fieldErr = strconv.ParseBool(query[field][0])
+				if fieldErr != nil {
+					fieldErr = errors.New("Invalid 'highlight'. Acceptable values [true|false]")
+				}
+
+			case "highlight_pre_tag", "highlight_post_tag":
+				// Handle the highlight tags
+				tag := query[field][0]
+				if len(tag) == 0 || len(tag) > storage.MaxHighlightTagLength {
+					fieldErr = fmt.Errorf("Invalid highlight tag. Acceptable length is 1-%d.", storage.MaxHighlightTagLength)
+				} else if field == "highlight_pre_tag" {
+					preTag = tag
+				} else {
+					postTag = tag
+				}
+
+			case "fields":
+				// Handle the fields parameter
+				fields, fieldErr = parseTraceFields(query[field][0])
+
 			default:
 				// Return error for invalid query field
 				w.Header().Set("Content-Type", "application/json; charset=utf8")
@@ -496,30 +521,29 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 			}
 		}
 
-		if len(query["timestamp__gte"]) != 0 && len(query["timestamp__lte"]) != 0 {
-			// Check the provided whether the provided before Time is after the after Time
-			if beforeTime.Before(afterTime) {
-				w.Header().Set("Content-Type", "application/json; charset=utf8")
-				w.WriteHeader(http.StatusBadRequest)
-				io.WriteString(w, encodePublicErrorObject(http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID))
+		// Check the provided whether the provided before Time is after the after Time
+		if !filters.validRange() {
+			w.Header().Set("Content-Type", "application/json; charset=utf8")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, encodePublicErrorObject(http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID))
 
-				logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+			logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
 
-				span.LogFields(
-					trace_log.String("event", "error"),
-					trace_log.String("message", "invalid time query"),
-				)
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid time query"),
+			)
 
-				timer.ObserveDuration()
-				metrics.PrometheusGetRequestErrorCounter.Inc()
-				return
-			}
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
 		}
 
 		var results storage.TracePage
+		timeRange := filters.timeRange()
 
-		// If gte > MaxTime or lte < MinTime, retuen empty page
-		if afterTime.After(MaxTime) || (len(query["timestamp__lte"]) != 0 && beforeTime.Before(MinTime)) {
+		// If the time range is out of the storable range, return empty page
+		if !filters.clamp() {
 			results = storage.TracePage {
 				Object: "list",
 				HasMore: false,
@@ -540,29 +564,15 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 				results.TotalCount = 0
 			}
 		} else {
-			// If lte > MaxTime, don't use the query
-			if len(query["timestamp__lte"]) != 0 && beforeTime.After(MaxTime) {
-				beforeTime = time.Time{}
-			}
-
-			// If gte < MinTime, don't use the query
-			if len(query["timestamp__gte"]) != 0 && afterTime.Before(MinTime) {
-				afterTime = time.Time{}
-			}
-
 			// Initialize the query by the parameters that handled before
-			var query storage.TraceQuery
-			query = storage.TraceQuery{
-				Device     : devices,
-				Account    : accountID,
-				After      : afterTime,
-				Before     : beforeTime,
-				AppName    : appName,
-				Type       : typ,
-				Limit      : limit,
-				Message    : message,
-				Sort       : sort,
-				AfterCursor: after,
+			query := filters.traceQuery(accountID, devices)
+			query.Limit = limit
+			query.Sort = sort
+			query.AfterCursor = after
+			query.Fields = fields
+
+			if highlight {
+				query.Highlight = &storage.HighlightQuery{PreTag: preTag, PostTag: postTag}
 			}
 
 			logger.Debug("Sending query to storage SearchDeviceTrace()", zap.Any("query", query))
@@ -573,7 +583,25 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 			)
 
 			ctx := buildContextWithValue(requestID, accountID)
-			results, err = traceEndpoint.TraceStore.SearchDeviceTrace(span, ctx, query, include)
+			results, err = traceStore.SearchDeviceTrace(span, ctx, query, include)
+
+			if err == storage.ErrQueryBeyondLookback {
+				w.Header().Set("Content-Type", "application/json; charset=utf8")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, encodePublicErrorObject(http.StatusBadRequest, StatusValidationErrType, err.Error(), "timestamp__gte", "The time range must start within the lookback of the trace store", requestID))
+
+				logger.Warn("The time range starts before the lookback of the trace store.", zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid time query"),
+				)
+
+				timer.ObserveDuration()
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+
+				return
+			}
 
 			if err != nil {
 				w.Header().Set("Content-Type", "application/json; charset=utf8")
@@ -596,6 +624,9 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 			}
 		}
 
+		// Echo the resolved time range so that clients can repeat the query exactly
+		results.TimeRange = timeRange
+
 		// Encode the results into json format
 		encodedResults, err := json.Marshal(results)
 
@@ -668,36 +699,41 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 		logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
 		span.SetTag("request_id", requestID)
 
-		query := r.URL.Query()
+		// Merge the saved search into the query
+		if publicError := traceEndpoint.applySavedSearch(span, r, requestID, accountID); publicError != nil {
+			writeJSON(w, publicError.Code, publicError)
+
+			logger.Warn(publicError.Message, zap.Int("response_code", publicError.Code))
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
 
 		// Handle the device_id query
-		var devices []string
-		if len(query["device_id__in"]) != 0 {
-			if query["device_id__in"][0] != "" {
-				devices = strings.Split(query["device_id__in"][0], ",")
-			} else {
-				w.Header().Set("Content-Type", "application/json; charset=utf8")
-				w.WriteHeader(http.StatusBadRequest)
-				errMsg := "Invalid query field 'device_id__in'"
-				io.WriteString(w, encodePublicErrorObject(http.StatusBadRequest, StatusValidationErrType, errMsg, "device_id__in", "Invalid field value ''", requestID))
+		devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+		if publicError != nil {
+			writeJSON(w, publicError.Code, publicError)
 
-				logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+			logger.Warn(publicError.Message, zap.Int("response_code", publicError.Code))
 
-				span.LogFields(
-					trace_log.String("event", "error"),
-					trace_log.String("message", "invalid query field 'device_id__in'"),
-				)
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field 'device_id__in'"),
+			)
 
-				timer.ObserveDuration()
-				metrics.PrometheusGetRequestErrorCounter.Inc()
-				return
-			}
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
 		}
 
-		query.Del("device_id__in")
+		query := r.URL.Query()
+		for field := range deviceSelectionFields {
+			query.Del(field)
+		}
 		r.URL.RawQuery = query.Encode()
 
-		TraceHandler(span, w, r, timer, devices)
+		TraceHandler(span, w, r, timer, devices, traceEndpoint.TraceStore)
 	})).Methods("GET")
 
 	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace{route:\\/?}", instrument(func(w http.ResponseWriter, r *http.Request) {
@@ -735,72 +771,179 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 		requestID := armAccessToken.RequestID
 		accountID := armAccessToken.AccountID
 
-		r, _ = httputil.WithContextValue(r, httputil.ContextKeyRequestID, requestID)
-		r, _ = httputil.WithContextValue(r, httputil.ContextKeyAccountID, accountID)
-
 		logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
 		span.SetTag("request_id", requestID)
 
-		params := mux.Vars(r)
+		// Merge the saved search into the query
+		if publicError := traceEndpoint.applySavedSearch(span, r, requestID, accountID); publicError != nil {
+			writeJSON(w, publicError.Code, publicError)
 
-		deviceID := params["device_id"]
-		span.SetTag("device_id", deviceID)
+			logger.Warn(publicError.Message, zap.Int("response_code", publicError.Code))
 
-		span.LogFields(
-			trace_log.String("event", "device validation"),
-			trace_log.String("message", "Starting to validate device id"),
-		)
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
 
 		// Validate device_id
-		ctx := opentracing.ContextWithSpan(r.Context(), span)
-		deviceData, publicError := traceEndpoint.DeviceDirectory.DeviceRetrieve(span, ctx, deviceID)
+		devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
 
 		if publicError != nil {
 			logger.Debug("DeviceDirectory.DeviceRetrieve responded with error.", zap.Any("error", publicError))
 
-			span.LogFields(
-				trace_log.String("event", "error"),
-				trace_log.String("message", "device validation failed"),
-				trace_log.Object("error", publicError),
-			)
+			writeJSON(w, publicError.Code, publicError)
 
-			if publicError.Code == http.StatusUnauthorized {
-				publicError = &httputil.PublicError{
-					Object    : "error",
-					Code     : http.StatusInternalServerError,
-					Type     : "internal_server_error",
-					Message  : "Could not generate valid access token, error: " + publicError.Message,
-				}
-			}
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
 
-			publicError.Message = fmt.Sprintf("Failed validating device_id: %s", publicError.Message)
-			publicError.RequestID = requestID
-			pe, _ := json.Marshal(publicError)
+			return
+		}
 
-			w.Header().Set("Content-Type", "application/json; charset=utf8")
-			w.WriteHeader(publicError.Code)
-			io.WriteString(w, string(pe))
+		logger.Debug("DeviceRetrieve: Success response", zap.Any("devices", devices))
+
+		TraceHandler(span, w, r, timer, devices, traceEndpoint.TraceStore)
+	})).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-rehydrations/{rehydration_id}/device-trace{route:\\/?}", instrument(func(w http.ResponseWriter, r *http.Request) {
+		timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
 
+		logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-rehydrated-device-trace-handler"))
+
+		span := opentracing.SpanFromContext(r.Context())
+		span.SetTag("http.method", "GET")
+		span.SetTag("http.url", r.URL.String())
+		defer span.Finish()
+
+		armAccessToken, ok := requestAccessToken(w, r, span, logger)
+		if !ok {
 			timer.ObserveDuration()
 			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+		requestID := armAccessToken.RequestID
+		accountID := armAccessToken.AccountID
+
+		logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+		span.SetTag("request_id", requestID)
 
+		if traceEndpoint.rehydrationsUnavailable(w, logger, requestID) {
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
 			return
-		} else {
-			logger.Debug("DeviceRetrieve: Success response", zap.Any("response", deviceData))
+		}
 
-			span.LogFields(
-				trace_log.String("event", "device validated"),
-				trace_log.String("message", "device exists in account"),
-				trace_log.Object("device-data", deviceData),
-			)
+		// Search the index of the rehydration instead of the trace store
+		rehydrationID := mux.Vars(r)["rehydration_id"]
+
+		rehydration, err := traceEndpoint.Rehydrations.Get(accountID, rehydrationID)
+		if err != nil {
+			rehydrationError(w, logger, err, requestID)
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
 		}
 
-		// Handle the device_id path param
-		var devices = []string { deviceID }
+		traceStore, err := traceEndpoint.Rehydrations.TraceStore(accountID, rehydrationID)
+		if err != nil {
+			rehydrationError(w, logger, err, requestID)
 
-		TraceHandler(span, w, r, timer, devices)
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+
+		TraceHandler(span, w, r, timer, []string{rehydration.DeviceID}, traceStore)
 	})).Methods("GET")
 
+	v3GetRouter.HandleFunc("/v3/device-trace/histogram{route:\\/?}", instrument(traceEndpoint.histogramHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/histogram{route:\\/?}", instrument(traceEndpoint.histogramHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace/patterns{route:\\/?}", instrument(traceEndpoint.patternsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/patterns{route:\\/?}", instrument(traceEndpoint.patternsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace/anomalies{route:\\/?}", instrument(traceEndpoint.listAnomaliesHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/anomalies{route:\\/?}", instrument(traceEndpoint.listAnomaliesHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-anomaly-settings{route:\\/?}", instrument(traceEndpoint.getAnomalySettingsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace/export{route:\\/?}", instrumentStream(traceEndpoint.exportHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/export{route:\\/?}", instrumentStream(traceEndpoint.exportHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/tail{route:\\/?}", instrumentStream(traceEndpoint.tailHandler)).Methods("GET")
+	v3GetRouter.HandleFunc("/v3/devices/{device_id}/trace/tail/ws{route:\\/?}", instrumentStream(traceEndpoint.tailWebSocketHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-searches{route:\\/?}", instrument(traceEndpoint.listSavedSearchesHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-searches/{saved_search_id}{route:\\/?}", instrument(traceEndpoint.getSavedSearchHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-alert-rules{route:\\/?}", instrument(traceEndpoint.listAlertRulesHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-alert-rules/{alert_rule_id}{route:\\/?}", instrument(traceEndpoint.getAlertRuleHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace/{device_trace_id}/context{route:\\/?}", instrument(traceEndpoint.contextHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-retention{route:\\/?}", instrument(traceEndpoint.getRetentionPolicyHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-deletions{route:\\/?}", instrument(traceEndpoint.listDeletionsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-deletions/{deletion_id}{route:\\/?}", instrument(traceEndpoint.getDeletionHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-exports{route:\\/?}", instrument(traceEndpoint.listExportJobsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-exports/{export_id}{route:\\/?}", instrument(traceEndpoint.getExportJobHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-exports/{export_id}/download{route:\\/?}", instrumentStream(traceEndpoint.downloadExportJobHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-rehydrations{route:\\/?}", instrument(traceEndpoint.listRehydrationsHandler)).Methods("GET")
+
+	v3GetRouter.HandleFunc("/v3/device-trace-rehydrations/{rehydration_id}{route:\\/?}", instrument(traceEndpoint.getRehydrationHandler)).Methods("GET")
+
+	// Create a subrouter for /v3 requests that modify resources
+	v3WriteRouter := router.Methods("POST", "PUT", "DELETE").Subrouter()
+
+	// Add middlewares
+	v3WriteRouter.Use(traceEndpoint.AccessTokenMiddleware)
+	v3WriteRouter.Use(middleware.RequestLoggerMiddleware())
+
+	v3WriteRouter.HandleFunc("/v3/device-trace{route:\\/?}", instrument(traceEndpoint.deleteTracesHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/devices/{device_id}/trace{route:\\/?}", instrument(traceEndpoint.deleteTracesHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace/{device_trace_id}{route:\\/?}", instrument(traceEndpoint.deleteTraceHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-exports{route:\\/?}", instrument(traceEndpoint.createExportJobHandler)).Methods("POST")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-exports/{export_id}{route:\\/?}", instrument(traceEndpoint.deleteExportJobHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-rehydrations{route:\\/?}", instrument(traceEndpoint.createRehydrationHandler)).Methods("POST")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-rehydrations/{rehydration_id}{route:\\/?}", instrument(traceEndpoint.deleteRehydrationHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-alert-rules{route:\\/?}", instrument(traceEndpoint.createAlertRuleHandler)).Methods("POST")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-alert-rules/{alert_rule_id}{route:\\/?}", instrument(traceEndpoint.updateAlertRuleHandler)).Methods("PUT")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-alert-rules/{alert_rule_id}{route:\\/?}", instrument(traceEndpoint.deleteAlertRuleHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-alert-rules/{alert_rule_id}/test{route:\\/?}", instrument(traceEndpoint.testAlertRuleHandler)).Methods("POST")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-retention{route:\\/?}", instrument(traceEndpoint.updateRetentionPolicyHandler)).Methods("PUT")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-retention{route:\\/?}", instrument(traceEndpoint.deleteRetentionPolicyHandler)).Methods("DELETE")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-anomaly-settings{route:\\/?}", instrument(traceEndpoint.updateAnomalySettingsHandler)).Methods("PUT")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-searches{route:\\/?}", instrument(traceEndpoint.createSavedSearchHandler)).Methods("POST")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-searches/{saved_search_id}{route:\\/?}", instrument(traceEndpoint.updateSavedSearchHandler)).Methods("PUT")
+
+	v3WriteRouter.HandleFunc("/v3/device-trace-searches/{saved_search_id}{route:\\/?}", instrument(traceEndpoint.deleteSavedSearchHandler)).Methods("DELETE")
+
 	v3GetRouter.HandleFunc("/v3/device-trace/{device_trace_id}{route:\\/?}", instrument(func(w http.ResponseWriter, r *http.Request) {
 		timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
 
@@ -840,6 +983,33 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 		span.SetTag("request_id", requestID)
 
 		query := r.URL.Query()
+
+		var fields []string
+		if len(query["fields"]) > 0 {
+			var fieldErr error
+			fields, fieldErr = parseTraceFields(query.Get("fields"))
+			query.Del("fields")
+
+			if fieldErr != nil {
+				w.Header().Set("Content-Type", "application/json; charset=utf8")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, encodePublicErrorObject(http.StatusBadRequest, StatusValidationErrType, "Invalid query field 'fields'", "fields", fieldErr.Error(), requestID))
+
+				logger.Warn("Invalid query field 'fields'", zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid query field"),
+					trace_log.String("field", "fields"),
+					trace_log.Error(fieldErr),
+				)
+
+				timer.ObserveDuration()
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+				return
+			}
+		}
+
 		if len(query) > 0 {
 			w.Header().Set("Content-Type", "application/json; charset=utf8")
 			w.WriteHeader(http.StatusBadRequest)
@@ -871,6 +1041,7 @@ func (traceEndpoint *TraceEndpoint) Attach(router *mux.Router) {
 			Account : accountID,
 			ID      : id,
 			Limit   : MinLimit,
+			Fields  : fields,
 		}
 
 		span.LogFields(
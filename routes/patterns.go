@@ -0,0 +1,265 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/patterns"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultPatternLimit = 50
+	MaxPatternLimit     = 500
+	MaxPatternScanSize  = 100000
+	DefaultPatternRange = 24 * time.Hour
+)
+
+// errPatternScanLimit stops the scan once MaxPatternScanSize traces were clustered
+var errPatternScanLimit = errors.New("Pattern scan limit reached")
+
+// PatternPage is the response of the patterns endpoints
+type PatternPage struct {
+	Object        string             `json:"object"`
+	Start         string             `json:"start"`
+	End           string             `json:"end"`
+	ScannedCount  int                `json:"scanned_count"`
+	Truncated     bool               `json:"truncated"`
+	TotalPatterns int                `json:"total_patterns"`
+	Data          []patterns.Pattern `json:"data"`
+}
+
+// patternsHandler groups the trace messages of an account or a single device into templates
+func (traceEndpoint *TraceEndpoint) patternsHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(metrics.PrometheusGetRequestDurations)
+
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-device-trace-patterns-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+	span.SetTag("request_id", requestID)
+
+	devices, publicError := traceEndpoint.requestDevices(span, r, requestID, accountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	var filters traceFilters
+	limit := DefaultPatternLimit
+
+	query := r.URL.Query()
+
+	var fieldErr error
+	// Verify query fields
+	for field := range query {
+		value := query[field][0]
+
+		var isFilter bool
+		isFilter, fieldErr = filters.parseField(field, value)
+		if isFilter {
+			// Handled as a trace filter
+		} else if isDeviceSelectionField(field) {
+			// Handled by requestDevices
+			if _, isDeviceRoute := mux.Vars(r)["device_id"]; isDeviceRoute {
+				fieldErr = errors.New("Field not supported for a single device")
+			}
+		} else if field == "limit" {
+			// Handle the limit parameter
+			var parsed uint64
+			parsed, fieldErr = strconv.ParseUint(value, 10, 64)
+			if fieldErr == nil && (parsed < 1 || parsed > MaxPatternLimit) {
+				fieldErr = fmt.Errorf("Invalid 'limit' provided. Acceptable value is 1-%d.", MaxPatternLimit)
+			}
+			limit = int(parsed)
+		} else {
+			// Return error for invalid query field
+			errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", requestID)
+
+			logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid field name"),
+				trace_log.String("field", field),
+			)
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field"),
+				trace_log.String("field", field),
+				trace_log.Error(fieldErr),
+			)
+
+			timer.ObserveDuration()
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return
+		}
+	}
+
+	// Default to the last day when the time range is open
+	if !filters.hasBefore {
+		filters.Before = filters.now()
+	}
+
+	if !filters.hasAfter {
+		filters.After = filters.Before.Add(-DefaultPatternRange)
+	}
+
+	if filters.Before.Before(filters.After) {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", requestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid time query"),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	page := PatternPage{
+		Object: "patterns",
+		Start:  filters.After.UTC().Format(time.RFC3339Nano),
+		End:    filters.Before.UTC().Format(time.RFC3339Nano),
+	}
+
+	matchable := filters.clamp()
+
+	traceQuery := filters.traceQuery(accountID, devices)
+	traceQuery.Sort = true
+
+	logger.Debug("Scanning traces for patterns", zap.Any("query", traceQuery))
+	span.LogFields(
+		trace_log.String("event", "send query to storage"),
+		trace_log.String("message", "Scanning traces for patterns"),
+		trace_log.Object("query", traceQuery),
+	)
+
+	drain := patterns.NewDrain()
+
+	var err error
+	ctx := buildRequestContextWithValue(r, requestID, accountID)
+
+	if matchable {
+		err = storage.ScanDeviceTrace(traceEndpoint.TraceStore, span, ctx, traceQuery, func(traces []storage.TraceResponse) error {
+			for _, trace := range traces {
+				if page.ScannedCount >= MaxPatternScanSize {
+					page.Truncated = true
+					return errPatternScanLimit
+				}
+
+				drain.Add(trace)
+				page.ScannedCount++
+			}
+
+			return nil
+		})
+	}
+
+	if err != nil && err != errPatternScanLimit {
+		if ctx.Err() != nil {
+			logger.Info("Pattern scan cancelled by the client.", zap.Int("scanned", page.ScannedCount))
+			return
+		}
+
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("An error occurred while scanning traces for patterns.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "storage error occured"),
+			trace_log.Error(err),
+		)
+
+		timer.ObserveDuration()
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		metrics.PrometheusGetRequestElasticSearchFailureCounter.Inc()
+		return
+	}
+
+	page.Data = drain.Patterns()
+	page.TotalPatterns = len(page.Data)
+
+	if len(page.Data) > limit {
+		page.Data = page.Data[:limit]
+	}
+
+	timer.ObserveDuration()
+
+	if err := writeJSON(w, http.StatusOK, page); err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Warn("Could not encode result as json.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK), zap.Int("scanned", page.ScannedCount), zap.Int("patterns", page.TotalPatterns))
+	span.LogFields(
+		trace_log.String("event", "success"),
+		trace_log.String("message", "Successfully retreived trace patterns"),
+	)
+}
@@ -0,0 +1,311 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/archive"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+// PostRehydration struct specifies the attibutes acceptable in POST /v3/device-trace-rehydrations body
+type PostRehydration struct {
+	DeviceID     string `json:"device_id"`
+	TimestampGte string `json:"timestamp__gte"`
+	TimestampLte string `json:"timestamp__lte"`
+}
+
+// RehydrationResponse struct specifies the attibutes of a rehydration
+type RehydrationResponse struct {
+	ID           string             `json:"id"`
+	Object       string             `json:"object"`
+	AccountID    string             `json:"account_id"`
+	DeviceID     string             `json:"device_id"`
+	Status       string             `json:"status"`
+	TimeRange    *storage.TimeRange `json:"time_range"`
+	ArchiveCount int                `json:"archive_count"`
+	LoadedCount  int64              `json:"loaded_count"`
+	Error        string             `json:"error,omitempty"`
+	CreatedAt    string             `json:"created_at"`
+	StartedAt    string             `json:"started_at,omitempty"`
+	CompletedAt  string             `json:"completed_at,omitempty"`
+	ExpiresAt    string             `json:"expires_at,omitempty"`
+	SearchURL    string             `json:"search_url,omitempty"`
+}
+
+// RehydrationPage specifies the return result for the list of rehydrations
+type RehydrationPage struct {
+	Object string                `json:"object"`
+	Data   []RehydrationResponse `json:"data"`
+}
+
+func newRehydrationResponse(rehydration archive.Rehydration) RehydrationResponse {
+	filters := traceFilters{
+		After:     rehydration.After,
+		Before:    rehydration.Before,
+		hasAfter:  true,
+		hasBefore: true,
+	}
+
+	response := RehydrationResponse{
+		ID:           rehydration.ID,
+		Object:       rehydration.Object,
+		AccountID:    rehydration.AccountID,
+		DeviceID:     rehydration.DeviceID,
+		Status:       rehydration.Status,
+		TimeRange:    filters.timeRange(),
+		ArchiveCount: rehydration.ArchiveCount,
+		LoadedCount:  rehydration.LoadedCount,
+		Error:        rehydration.Error,
+		CreatedAt:    rehydration.CreatedAt,
+		StartedAt:    rehydration.StartedAt,
+		CompletedAt:  rehydration.CompletedAt,
+		ExpiresAt:    rehydration.ExpiresAt,
+	}
+
+	if rehydration.Status == archive.RehydrationStatusCompleted {
+		response.SearchURL = fmt.Sprintf("/v3/device-trace-rehydrations/%s/device-trace", rehydration.ID)
+	}
+
+	return response
+}
+
+// rehydrationsUnavailable writes the error response for when the trace archive is not configured
+func (traceEndpoint *TraceEndpoint) rehydrationsUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.Rehydrations != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "The trace archive is not enabled on this service", "", "", requestID)
+
+	logger.Warn("The trace archive is not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// rehydrationError writes the error response for an error of the rehydrator
+func rehydrationError(w http.ResponseWriter, logger *zap.Logger, err error, requestID string) {
+	switch err {
+	case archive.ErrRehydrationNotFound:
+		writePublicError(w, http.StatusNotFound, StatusNotFound, "Could not retreive rehydration by this ID", "", "", requestID)
+		logger.Warn("Rehydration not found.", zap.Int("response_code", http.StatusNotFound))
+	case archive.ErrRehydrationNotReady:
+		writePublicError(w, http.StatusConflict, StatusConflict, err.Error(), "", "", requestID)
+		logger.Warn("Rehydration not ready.", zap.Int("response_code", http.StatusConflict))
+	case archive.ErrRehydrationRangeLimit:
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, "Invalid field 'timestamp__gte'", "timestamp__gte", err.Error(), requestID)
+		logger.Warn("Rehydration rejected.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+	case archive.ErrTooManyRehydrations:
+		writePublicError(w, http.StatusTooManyRequests, StatusTooManyRequests, err.Error(), "", "", requestID)
+		logger.Warn("Rehydration rejected.", zap.Error(err), zap.Int("response_code", http.StatusTooManyRequests))
+	case archive.ErrRehydrationQueueFull:
+		writePublicError(w, http.StatusServiceUnavailable, StatusServiceUnavailable, err.Error(), "", "", requestID)
+		logger.Warn("Rehydration rejected.", zap.Error(err), zap.Int("response_code", http.StatusServiceUnavailable))
+	default:
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+		logger.Error("An error occurred inside of the rehydrator.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+	}
+}
+
+// parseRehydration validates the body of a rehydration request. Both ends of the time range are required
+func parseRehydration(body PostRehydration) (traceFilters, string, error) {
+	var filters traceFilters
+
+	if strings.TrimSpace(body.DeviceID) == "" {
+		return filters, "device_id", errors.New("Invalid field value ''")
+	}
+
+	for field, value := range map[string]string{"timestamp__gte": body.TimestampGte, "timestamp__lte": body.TimestampLte} {
+		if value == "" {
+			return filters, field, errors.New("Invalid field value ''")
+		}
+
+		if _, err := filters.parseField(field, value); err != nil {
+			return filters, field, err
+		}
+	}
+
+	if !filters.validRange() {
+		return filters, "timestamp__lte", errors.New("Invalid time range. timerange__gte should be after timerange__lte")
+	}
+
+	if !filters.clamp() {
+		return filters, "timestamp__gte", errors.New("The time range cannot match any trace")
+	}
+
+	return filters, "", nil
+}
+
+// createRehydrationHandler queues the loading of the archived traces of a device in a time range
+func (traceEndpoint *TraceEndpoint) createRehydrationHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "create-rehydration-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.rehydrationsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	dataStream, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error reading request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not read request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	var body PostRehydration
+	dec := json.NewDecoder(strings.NewReader(string(dataStream)))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	filters, field, fieldErr := parseRehydration(body)
+	if fieldErr != nil {
+		errMsg := fmt.Sprintf("Invalid field '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+		logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid field"),
+			trace_log.String("field", field),
+			trace_log.Error(fieldErr),
+		)
+		return
+	}
+
+	rehydration, err := traceEndpoint.Rehydrations.Submit(accountID, requestID, strings.TrimSpace(body.DeviceID), filters.After, filters.Before)
+	if err != nil {
+		rehydrationError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, newRehydrationResponse(rehydration))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusAccepted), zap.String("rehydration_id", rehydration.ID))
+}
+
+// listRehydrationsHandler lists the rehydrations of the account
+func (traceEndpoint *TraceEndpoint) listRehydrationsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-rehydrations-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.rehydrationsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	rehydrations, err := traceEndpoint.Rehydrations.List(accountID)
+	if err != nil {
+		rehydrationError(w, logger, err, requestID)
+		return
+	}
+
+	page := RehydrationPage{
+		Object: "list",
+		Data:   make([]RehydrationResponse, 0, len(rehydrations)),
+	}
+
+	for _, rehydration := range rehydrations {
+		page.Data = append(page.Data, newRehydrationResponse(rehydration))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getRehydrationHandler returns the status and progress of a rehydration
+func (traceEndpoint *TraceEndpoint) getRehydrationHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-rehydration-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.rehydrationsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	rehydration, err := traceEndpoint.Rehydrations.Get(accountID, mux.Vars(r)["rehydration_id"])
+	if err != nil {
+		rehydrationError(w, logger, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newRehydrationResponse(rehydration))
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// deleteRehydrationHandler cancels a rehydration and removes its index. The archive files are kept
+func (traceEndpoint *TraceEndpoint) deleteRehydrationHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-rehydration-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.rehydrationsUnavailable(w, logger, requestID) {
+		return
+	}
+
+	if err := traceEndpoint.Rehydrations.Delete(accountID, mux.Vars(r)["rehydration_id"]); err != nil {
+		rehydrationError(w, logger, err, requestID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent))
+}
@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/retention"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// PutRetentionPolicy struct specifies the attibutes acceptable in the body of PUT /v3/device-trace-retention
+type PutRetentionPolicy struct {
+	Days  int            `json:"days"`
+	Types map[string]int `json:"types"`
+}
+
+// retentionUnavailable writes the error response for when retention policies are not configured
+func (traceEndpoint *TraceEndpoint) retentionUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.Retention != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Retention policies are not enabled on this service", "", "", requestID)
+
+	logger.Warn("Retention policies are not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// validateRetentionPolicy returns the invalid field of a policy and why it is invalid
+func validateRetentionPolicy(body PutRetentionPolicy, maxDays int) (string, error) {
+	if body.Days < 0 || body.Days > maxDays {
+		return "days", fmt.Errorf("Invalid 'days'. Acceptable value is 0-%d.", maxDays)
+	}
+
+	if len(body.Types) > retention.MaxPolicyTypes {
+		return "types", fmt.Errorf("Too many types. Acceptable number is 0-%d.", retention.MaxPolicyTypes)
+	}
+
+	for traceType, days := range body.Types {
+		if traceType == "" || len(traceType) > retention.MaxPolicyTypeLength {
+			return "types", fmt.Errorf("Invalid type '%s'. Types have 1-%d characters.", traceType, retention.MaxPolicyTypeLength)
+		}
+
+		if days < 1 || days > maxDays {
+			return "types." + traceType, fmt.Errorf("Invalid days. Acceptable value is 1-%d.", maxDays)
+		}
+	}
+
+	if body.Days == 0 && len(body.Types) == 0 {
+		return "days", fmt.Errorf("Invalid policy. Set 'days' or 'types', or delete the policy to keep every trace.")
+	}
+
+	return "", nil
+}
+
+// getRetentionPolicyHandler returns the retention policy of the account
+func (traceEndpoint *TraceEndpoint) getRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-retention-policy-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.retentionUnavailable(w, logger, requestID) {
+		return
+	}
+
+	policy, err := traceEndpoint.Retention.GetPolicy(accountID)
+	if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("Could not read the retention policy.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// updateRetentionPolicyHandler replaces the retention policy of the account
+func (traceEndpoint *TraceEndpoint) updateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "update-retention-policy-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.retentionUnavailable(w, logger, requestID) {
+		return
+	}
+
+	var body PutRetentionPolicy
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	if field, fieldErr := validateRetentionPolicy(body, traceEndpoint.Retention.MaxDays); fieldErr != nil {
+		errMsg := fmt.Sprintf("Invalid field '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+		logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+		return
+	}
+
+	policy, err := traceEndpoint.Retention.SavePolicy(retention.Policy{AccountID: accountID, Days: body.Days, Types: body.Types})
+	if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("Could not save the retention policy.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK), zap.Int("days", policy.Days), zap.Any("types", policy.Types))
+}
+
+// deleteRetentionPolicyHandler removes the retention policy of the account
+func (traceEndpoint *TraceEndpoint) deleteRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-retention-policy-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.retentionUnavailable(w, logger, requestID) {
+		return
+	}
+
+	err := traceEndpoint.Retention.DeletePolicy(accountID)
+	if err == retention.ErrPolicyNotFound {
+		writePublicError(w, http.StatusNotFound, StatusNotFound, err.Error(), "", "", requestID)
+
+		logger.Warn("Retention policy not found.", zap.Int("response_code", http.StatusNotFound))
+		return
+	} else if err != nil {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+
+		logger.Error("Could not delete the retention policy.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent))
+}
@@ -0,0 +1,463 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+// PostSavedSearch struct specifies the attibutes acceptable in the body of POST and PUT /v3/device-trace-searches
+type PostSavedSearch struct {
+	Name    string            `json:"name"`
+	Filters map[string]string `json:"filters"`
+	Order   string            `json:"order"`
+	Columns []string          `json:"columns"`
+}
+
+// SavedSearchPage specifies the return result for the list of saved searches
+type SavedSearchPage struct {
+	Object string                `json:"object"`
+	Data   []storage.SavedSearch `json:"data"`
+}
+
+// savedSearchFilters lists the filters that can be saved in addition to the trace filters
+var savedSearchFilters = map[string]bool{
+	"device_id__in":       true,
+	"device_group_id__eq": true,
+	"device_filter":       true,
+}
+
+// parseSavedSearch validates the body of a saved search request. It returns the invalid field on error
+func parseSavedSearch(body *PostSavedSearch) (string, error) {
+	var filters traceFilters
+
+	body.Name = strings.TrimSpace(body.Name)
+	if len(body.Name) == 0 || len(body.Name) > storage.MaxSavedSearchNameLength {
+		return "name", fmt.Errorf("Invalid 'name'. Acceptable length is 1-%d.", storage.MaxSavedSearchNameLength)
+	}
+
+	if body.Filters == nil {
+		body.Filters = map[string]string{}
+	}
+
+	for field, value := range body.Filters {
+		isFilter, fieldErr := filters.parseField(field, value)
+		if !isFilter {
+			if !savedSearchFilters[field] {
+				fieldErr = fmt.Errorf("Invalid field name '%s'", field)
+			} else if value == "" {
+				fieldErr = errors.New("Invalid field value ''")
+			} else if field == "device_filter" {
+				_, fieldErr = parseDeviceFilter(value)
+			} else if field == "device_group_id__eq" && !deviceGroupIDPattern.MatchString(value) {
+				fieldErr = errors.New("Invalid device group id")
+			}
+		}
+
+		if fieldErr != nil {
+			return "filters." + field, fieldErr
+		}
+	}
+
+	if !filters.validRange() {
+		return "filters.timestamp__lte", errors.New("Invalid time range. timerange__gte should be after timerange__lte")
+	}
+
+	switch strings.ToUpper(body.Order) {
+	case "", "ASC", "DESC":
+		body.Order = strings.ToUpper(body.Order)
+	default:
+		return "order", errors.New("Invalid 'order'. Acceptable values [ASC|DESC]")
+	}
+
+	if body.Columns == nil {
+		body.Columns = []string{}
+	}
+
+	for _, column := range body.Columns {
+		if !storage.IsTraceColumn(column) {
+			return "columns", fmt.Errorf("Invalid column '%s'. Acceptable values [%s]", column, strings.Join(storage.TraceColumns, "|"))
+		}
+	}
+
+	return "", nil
+}
+
+// savedSearchError writes the error response for an error of the saved search store
+func savedSearchError(w http.ResponseWriter, logger *zap.Logger, span opentracing.Span, err error, requestID string) {
+	if err == storage.ErrSavedSearchNotFound {
+		writePublicError(w, http.StatusNotFound, StatusNotFound, err.Error(), "", "", requestID)
+		logger.Warn("Saved search not found.", zap.Int("response_code", http.StatusNotFound))
+		return
+	}
+
+	writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, err.Error(), "", "", requestID)
+	logger.Error("An error occurred inside of the saved search store.", zap.Error(err), zap.Int("response_code", http.StatusInternalServerError))
+
+	span.LogFields(
+		trace_log.String("event", "error"),
+		trace_log.String("message", "storage error occured"),
+		trace_log.Error(err),
+	)
+}
+
+// savedSearchesUnavailable writes the error response for when no saved search store is configured
+func (traceEndpoint *TraceEndpoint) savedSearchesUnavailable(w http.ResponseWriter, logger *zap.Logger, requestID string) bool {
+	if traceEndpoint.SavedSearches != nil {
+		return false
+	}
+
+	writePublicError(w, http.StatusNotImplemented, StatusNotImplemented, "Saved searches are not enabled on this service", "", "", requestID)
+
+	logger.Warn("Saved searches are not enabled.", zap.Int("response_code", http.StatusNotImplemented))
+
+	return true
+}
+
+// decodeSavedSearch reads and validates the body of a saved search request. It writes the error response on failure
+func decodeSavedSearch(w http.ResponseWriter, r *http.Request, logger *zap.Logger, span opentracing.Span, requestID string) (PostSavedSearch, bool) {
+	var body PostSavedSearch
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&body); err != nil {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, fmt.Sprintf("Error decoding request body: %s", err.Error()), "", "", requestID)
+
+		logger.Warn("Could not decode request body.", zap.Error(err), zap.Int("response_code", http.StatusBadRequest))
+		return body, false
+	}
+
+	if field, fieldErr := parseSavedSearch(&body); fieldErr != nil {
+		errMsg := fmt.Sprintf("Invalid field '%s'", field)
+		writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), requestID)
+
+		logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "invalid field"),
+			trace_log.String("field", field),
+			trace_log.Error(fieldErr),
+		)
+		return body, false
+	}
+
+	return body, true
+}
+
+// checkSavedSearchName writes a conflict response if another saved search of the account has name
+func checkSavedSearchName(w http.ResponseWriter, logger *zap.Logger, searches []storage.SavedSearch, id string, name string, requestID string) bool {
+	for _, search := range searches {
+		if search.ID != id && search.Name == name {
+			writePublicError(w, http.StatusConflict, StatusConflict, "A saved search with this name already exists", "name", fmt.Sprintf("Name '%s' is already used", name), requestID)
+
+			logger.Warn("Saved search name already used.", zap.Int("response_code", http.StatusConflict))
+			return false
+		}
+	}
+
+	return true
+}
+
+// createSavedSearchHandler stores a new saved search for the account
+func (traceEndpoint *TraceEndpoint) createSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "create-saved-search-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.savedSearchesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	body, ok := decodeSavedSearch(w, r, logger, span, requestID)
+	if !ok {
+		return
+	}
+
+	ctx := buildContextWithValue(requestID, accountID)
+	searches, err := traceEndpoint.SavedSearches.ListSavedSearches(span, ctx, accountID)
+	if err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	if len(searches) >= storage.MaxSavedSearchesPerAccount {
+		errMsg := fmt.Sprintf("An account can have at most %d saved searches", storage.MaxSavedSearchesPerAccount)
+		writePublicError(w, http.StatusConflict, StatusConflict, errMsg, "", "", requestID)
+
+		logger.Warn("Too many saved searches.", zap.Int("response_code", http.StatusConflict))
+		return
+	}
+
+	if !checkSavedSearchName(w, logger, searches, "", body.Name, requestID) {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	search := storage.SavedSearch{
+		ID:        traceEndpoint.UUIDGenerator.UUID().String(),
+		Object:    "device-trace-search",
+		AccountID: accountID,
+		Name:      body.Name,
+		Filters:   body.Filters,
+		Order:     body.Order,
+		Columns:   body.Columns,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := traceEndpoint.SavedSearches.CreateSavedSearch(span, ctx, search); err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, search)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusCreated), zap.String("saved_search_id", search.ID))
+}
+
+// listSavedSearchesHandler lists the saved searches of the account
+func (traceEndpoint *TraceEndpoint) listSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "list-saved-searches-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.savedSearchesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	ctx := buildContextWithValue(requestID, accountID)
+	searches, err := traceEndpoint.SavedSearches.ListSavedSearches(span, ctx, accountID)
+	if err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SavedSearchPage{Object: "list", Data: searches})
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// getSavedSearchHandler returns a saved search of the account
+func (traceEndpoint *TraceEndpoint) getSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "get-saved-search-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.savedSearchesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	ctx := buildContextWithValue(requestID, accountID)
+	search, err := traceEndpoint.SavedSearches.GetSavedSearch(span, ctx, accountID, mux.Vars(r)["saved_search_id"])
+	if err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, search)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// updateSavedSearchHandler replaces the name, filters and preferences of a saved search
+func (traceEndpoint *TraceEndpoint) updateSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "update-saved-search-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.savedSearchesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	body, ok := decodeSavedSearch(w, r, logger, span, requestID)
+	if !ok {
+		return
+	}
+
+	ctx := buildContextWithValue(requestID, accountID)
+	search, err := traceEndpoint.SavedSearches.GetSavedSearch(span, ctx, accountID, mux.Vars(r)["saved_search_id"])
+	if err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	searches, err := traceEndpoint.SavedSearches.ListSavedSearches(span, ctx, accountID)
+	if err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	if !checkSavedSearchName(w, logger, searches, search.ID, body.Name, requestID) {
+		return
+	}
+
+	search.Name = body.Name
+	search.Filters = body.Filters
+	search.Order = body.Order
+	search.Columns = body.Columns
+	search.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err := traceEndpoint.SavedSearches.UpdateSavedSearch(span, ctx, search); err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, search)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusOK))
+}
+
+// deleteSavedSearchHandler removes a saved search of the account
+func (traceEndpoint *TraceEndpoint) deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "delete-saved-search-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	defer span.Finish()
+
+	armAccessToken, ok := requestAccessToken(w, r, span, logger)
+	if !ok {
+		return
+	}
+	requestID := armAccessToken.RequestID
+	accountID := armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	if traceEndpoint.savedSearchesUnavailable(w, logger, requestID) {
+		return
+	}
+
+	ctx := buildContextWithValue(requestID, accountID)
+	if err := traceEndpoint.SavedSearches.DeleteSavedSearch(span, ctx, accountID, mux.Vars(r)["saved_search_id"]); err != nil {
+		savedSearchError(w, logger, span, err, requestID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Success Request.", zap.Int("response_code", http.StatusNoContent))
+}
+
+// applySavedSearch merges the saved search named by saved_search_id into the query of r. Fields of the request
+// override the saved ones. Requests under /v3/devices/{device_id} ignore the saved device selection
+func (traceEndpoint *TraceEndpoint) applySavedSearch(span opentracing.Span, r *http.Request, requestID string, accountID string) *httputil.PublicError {
+	query := r.URL.Query()
+	if len(query["saved_search_id"]) == 0 {
+		return nil
+	}
+
+	if traceEndpoint.SavedSearches == nil {
+		return &httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusNotImplemented,
+			Type:      StatusNotImplemented,
+			Message:   "Saved searches are not enabled on this service",
+			RequestID: requestID,
+		}
+	}
+
+	id := query["saved_search_id"][0]
+	span.SetTag("saved_search_id", id)
+
+	ctx := buildContextWithValue(requestID, accountID)
+	search, err := traceEndpoint.SavedSearches.GetSavedSearch(span, ctx, accountID, id)
+	if err == storage.ErrSavedSearchNotFound {
+		return &httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusBadRequest,
+			Type:      StatusValidationErrType,
+			Message:   "Invalid query field 'saved_search_id'",
+			Fields:    []httputil.PublicErrorField{{Name: "saved_search_id", Message: err.Error()}},
+			RequestID: requestID,
+		}
+	} else if err != nil {
+		return &httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusInternalServerError,
+			Type:      StatusInternalServerErrType,
+			Message:   err.Error(),
+			RequestID: requestID,
+		}
+	}
+
+	merged := url.Values{}
+	for field, value := range search.Filters {
+		merged.Set(field, value)
+	}
+
+	if _, isDeviceRoute := mux.Vars(r)["device_id"]; isDeviceRoute {
+		for field := range deviceSelectionFields {
+			merged.Del(field)
+		}
+	}
+
+	if search.Order != "" {
+		merged.Set("order", search.Order)
+	}
+
+	query.Del("saved_search_id")
+	for field, values := range query {
+		merged[field] = values
+	}
+
+	r.URL.RawQuery = merged.Encode()
+
+	span.LogFields(
+		trace_log.String("event", "saved search applied"),
+		trace_log.String("message", "merged the saved search into the query"),
+		trace_log.String("query", r.URL.RawQuery),
+	)
+
+	return nil
+}
@@ -0,0 +1,598 @@
+package routes
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+	"github.com/armPelionEdge/edge-gw-trace-service/tracing"
+
+	"go.uber.org/zap"
+
+	"github.com/armPelionEdge/edge-gw-services-go/middleware"
+	"github.com/armPelionEdge/edge-gw-services-go/token"
+	"github.com/gorilla/websocket"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	DefaultTailHistory    = uint64(100)
+	TailPollInterval      = time.Second * 2
+	TailHeartbeatInterval = time.Second * 15
+	MaxTailDuration       = time.Hour
+
+	// TailLookback is how far before the ingest time of the newest trace sent a poll starts. Traces become searchable
+	// after the refresh interval and the ingest lag, so a trace ingested earlier can show up after newer ones were sent
+	TailLookback = time.Second * 30
+
+	// TailSentSize is the number of sent trace ids a stream remembers to not send a trace twice
+	TailSentSize = 10000
+
+	// TailWriteTimeout is how long a WebSocket client has to accept a message
+	TailWriteTimeout = time.Second * 10
+)
+
+// instrumentStream instruments a handler that keeps its response open. The prometheus
+// wrappers are left out since they hide the writer from http.ResponseController and the WebSocket upgrade
+func instrumentStream(handler http.HandlerFunc) http.HandlerFunc {
+	return tracing.InstrumentHandler(handler)
+}
+
+// createdAt returns the ingest time of a trace
+func createdAt(trace storage.TraceResponse) (time.Time, bool) {
+	created, err := time.Parse(time.RFC3339Nano, trace.CreatedAt)
+
+	return created, err == nil
+}
+
+// sentTraces remembers the ids of the traces most recently sent by a stream
+type sentTraces struct {
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newSentTraces(size int) *sentTraces {
+	return &sentTraces{size: size, order: list.New(), ids: make(map[string]*list.Element)}
+}
+
+// add records id and reports whether it was not sent before. The least recently seen ids are forgotten first
+func (sent *sentTraces) add(id string) bool {
+	if element, ok := sent.ids[id]; ok {
+		sent.order.MoveToFront(element)
+		return false
+	}
+
+	sent.ids[id] = sent.order.PushFront(id)
+
+	for sent.order.Len() > sent.size {
+		oldest := sent.order.Back()
+		sent.order.Remove(oldest)
+		delete(sent.ids, oldest.Value.(string))
+	}
+
+	return true
+}
+
+// tailStream writes the events of a live tail to the client
+type tailStream interface {
+	// Traces sends traces to the client
+	Traces(traces []storage.TraceResponse) error
+	// Heartbeat keeps an idle connection open
+	Heartbeat() error
+	// Fail sends the error that ends the stream
+	Fail(publicError httputil.PublicError)
+}
+
+// writeServerSentEvent writes a single event of a text/event-stream response
+func writeServerSentEvent(w io.Writer, event string, id string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+
+	return err
+}
+
+// serverSentEvents is a tailStream of server-sent events
+type serverSentEvents struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (stream *serverSentEvents) Traces(traces []storage.TraceResponse) error {
+	for _, trace := range traces {
+		if err := writeServerSentEvent(stream.w, "trace", trace.ID, trace); err != nil {
+			return err
+		}
+	}
+
+	stream.flusher.Flush()
+
+	return nil
+}
+
+func (stream *serverSentEvents) Heartbeat() error {
+	if _, err := io.WriteString(stream.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+
+	stream.flusher.Flush()
+
+	return nil
+}
+
+func (stream *serverSentEvents) Fail(publicError httputil.PublicError) {
+	writeServerSentEvent(stream.w, "error", "", publicError)
+	stream.flusher.Flush()
+}
+
+// webSocketMessage is a message of a WebSocket tail, with the fields of a server-sent event
+type webSocketMessage struct {
+	Event string      `json:"event"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// webSocketStream is a tailStream of JSON messages over a WebSocket connection
+type webSocketStream struct {
+	conn *websocket.Conn
+}
+
+func (stream *webSocketStream) write(message webSocketMessage) error {
+	stream.conn.SetWriteDeadline(time.Now().Add(TailWriteTimeout))
+
+	return stream.conn.WriteJSON(message)
+}
+
+func (stream *webSocketStream) Traces(traces []storage.TraceResponse) error {
+	for _, trace := range traces {
+		if err := stream.write(webSocketMessage{Event: "trace", ID: trace.ID, Data: trace}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stream *webSocketStream) Heartbeat() error {
+	return stream.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(TailWriteTimeout))
+}
+
+func (stream *webSocketStream) Fail(publicError httputil.PublicError) {
+	if stream.write(webSocketMessage{Event: "error", Data: publicError}) == nil {
+		stream.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(TailWriteTimeout))
+	}
+}
+
+// tailRequest is a validated live tail request
+type tailRequest struct {
+	RequestID   string
+	AccountID   string
+	Devices     []string
+	Query       storage.TraceQuery
+	History     uint64
+	LastEventID string
+}
+
+// parseTailRequest validates a live tail request. It writes the error response and returns false if it is invalid
+func (traceEndpoint *TraceEndpoint) parseTailRequest(w http.ResponseWriter, r *http.Request, span opentracing.Span, logger *zap.Logger) (tailRequest, bool) {
+	var request tailRequest
+
+	armAccessToken, ok := r.Context().Value(middleware.ArmAccessTokenContextKey).(token.ArmAccessToken)
+	if !ok {
+		writePublicError(w, http.StatusUnauthorized, StatusUnauthorized, "Unable to decode token", "", "", armAccessToken.RequestID)
+
+		logger.Error("access token missing", zap.Int("response_code", http.StatusUnauthorized))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "access token missing"),
+		)
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return request, false
+	}
+	request.RequestID = armAccessToken.RequestID
+	request.AccountID = armAccessToken.AccountID
+
+	logger = logger.With(zap.String("request_id", request.RequestID)).With(zap.String("account_id", request.AccountID))
+	span.SetTag("request_id", request.RequestID)
+
+	// Validate device_id
+	devices, publicError := traceEndpoint.requestDevices(span, r, request.RequestID, request.AccountID)
+	if publicError != nil {
+		writeJSON(w, publicError.Code, publicError)
+
+		logger.Warn("Could not resolve devices.", zap.Any("error", publicError), zap.Int("response_code", publicError.Code))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return request, false
+	}
+	request.Devices = devices
+
+	var filters traceFilters
+	request.History = DefaultTailHistory
+	request.LastEventID = r.Header.Get("Last-Event-ID")
+
+	query := r.URL.Query()
+
+	var fieldErr error
+	// Verify query fields
+	for field := range query {
+		value := query[field][0]
+
+		var isFilter bool
+		isFilter, fieldErr = filters.parseField(field, value)
+		if !isFilter {
+			switch field {
+			case "history":
+				// Handle the history parameter
+				request.History, fieldErr = strconv.ParseUint(value, 10, 64)
+				if fieldErr == nil && request.History > MaxLimit {
+					fieldErr = errors.New("Invalid 'history' provided. Acceptable value is 0-1000.")
+				}
+
+			case "last_event_id":
+				// Clients that cannot set the Last-Event-ID header, like browser WebSockets, resume with the parameter
+				request.LastEventID = value
+				if !isValidUUID(value) {
+					fieldErr = errors.New("Invalid 'last_event_id' provided. It should be the id of a trace.")
+				}
+
+			default:
+				// Return error for invalid query field
+				errMsg := fmt.Sprintf("Invalid field name '%s'", field)
+				writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, errMsg, "", "", request.RequestID)
+
+				logger.Warn(errMsg, zap.Int("response_code", http.StatusBadRequest))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "invalid field name"),
+					trace_log.String("field", field),
+				)
+
+				metrics.PrometheusGetRequestErrorCounter.Inc()
+				return request, false
+			}
+		}
+
+		if fieldErr != nil {
+			errMsg := fmt.Sprintf("Invalid query field '%s'", field)
+			writePublicError(w, http.StatusBadRequest, StatusValidationErrType, errMsg, field, fieldErr.Error(), request.RequestID)
+
+			logger.Warn(errMsg, zap.Error(fieldErr), zap.Int("response_code", http.StatusBadRequest))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "invalid query field"),
+				trace_log.String("field", field),
+				trace_log.Error(fieldErr),
+			)
+
+			metrics.PrometheusGetRequestErrorCounter.Inc()
+			return request, false
+		}
+	}
+
+	if !filters.validRange() {
+		writePublicError(w, http.StatusBadRequest, StatusBadRequestErrType, "Invalid time range. timerange__gte should be after timerange__lte", "", "", request.RequestID)
+
+		logger.Warn("Invalid time range.", zap.Int("response_code", http.StatusBadRequest))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return request, false
+	}
+
+	filters.clamp()
+	request.Query = filters.traceQuery(request.AccountID, devices)
+
+	return request, true
+}
+
+// streamTail sends the most recent traces of request to stream and then polls the trace store for traces ingested
+// after the last one sent, until ctx, which holds the request id and account, is done or MaxTailDuration is reached. A poll asks for the traces ingested from
+// TailLookback before the newest trace sent, so that traces which became searchable late are sent too, and pages
+// after the last trace it has seen. The ids of the sent traces keep the polls from sending a trace twice
+func (traceEndpoint *TraceEndpoint) streamTail(ctx context.Context, span opentracing.Span, logger *zap.Logger, request tailRequest, stream tailStream) {
+	metrics.PrometheusActiveTailStreams.Inc()
+	defer metrics.PrometheusActiveTailStreams.Dec()
+
+	logger.Info("Started live tail.", zap.Strings("devices", request.Devices))
+	span.LogFields(
+		trace_log.String("event", "tail started"),
+		trace_log.String("message", "streaming device traces"),
+	)
+
+	send := func(traces []storage.TraceResponse) error {
+		if err := stream.Traces(traces); err != nil {
+			return err
+		}
+
+		metrics.PrometheusTailTracesSent.Add(float64(len(traces)))
+
+		return nil
+	}
+
+	fail := func(err error) {
+		logger.Error("An error occurred while tailing device traces.", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "storage error occured"),
+			trace_log.Error(err),
+		)
+
+		metrics.PrometheusGetRequestElasticSearchFailureCounter.Inc()
+
+		stream.Fail(httputil.PublicError{
+			Object:    "error",
+			Code:      http.StatusInternalServerError,
+			Type:      StatusInternalServerErrType,
+			Message:   err.Error(),
+			RequestID: request.RequestID,
+		})
+	}
+
+	// Resume from the ingest time of the last event the client received, or start with the recent history. Traces
+	// ingested before start are never sent by the polls
+	start := time.Now()
+	var newest time.Time
+	sent := newSentTraces(TailSentSize)
+
+	lastEventID := strings.ToLower(request.LastEventID)
+
+	if milliseconds, ok := storage.IDTimestamp(lastEventID); ok {
+		start = time.Unix(0, milliseconds*int64(time.Millisecond))
+		sent.add(lastEventID)
+	} else if request.History > 0 {
+		historyQuery := request.Query
+		historyQuery.Limit = request.History
+		historyQuery.Sort = false
+
+		page, err := traceEndpoint.TraceStore.SearchDeviceTrace(span, ctx, historyQuery, false)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for _, trace := range page.Data {
+			sent.add(trace.ID)
+
+			if created, ok := createdAt(trace); ok {
+				if created.Before(start) {
+					start = created
+				}
+
+				if created.After(newest) {
+					newest = created
+				}
+			}
+		}
+
+		// Send the history oldest first
+		for i, j := 0, len(page.Data)-1; i < j; i, j = i+1, j-1 {
+			page.Data[i], page.Data[j] = page.Data[j], page.Data[i]
+		}
+
+		if err := send(page.Data); err != nil {
+			logger.Debug("Client went away.", zap.Error(err))
+			return
+		}
+	}
+
+	poll := time.NewTicker(TailPollInterval)
+	defer poll.Stop()
+
+	heartbeat := time.NewTicker(TailHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	deadline := time.NewTimer(MaxTailDuration)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Live tail closed by the client.")
+			return
+
+		case <-deadline.C:
+			logger.Info("Live tail reached the maximum duration.")
+			return
+
+		case <-heartbeat.C:
+			if err := stream.Heartbeat(); err != nil {
+				logger.Debug("Client went away.", zap.Error(err))
+				return
+			}
+
+		case <-poll.C:
+			from := start
+			if lookback := newest.Add(-TailLookback); lookback.After(from) {
+				from = lookback
+			}
+
+			var lastSeen string
+
+			for {
+				pollQuery := request.Query
+				pollQuery.Limit = MaxLimit
+				pollQuery.Sort = true
+				pollQuery.CreatedAfter = from
+				if lastSeen != "" {
+					pollQuery.AfterCursor = []interface{}{lastSeen}
+				}
+
+				page, err := traceEndpoint.TraceStore.SearchDeviceTrace(span, ctx, pollQuery, false)
+				if err != nil {
+					if ctx.Err() != nil {
+						logger.Info("Live tail closed by the client.")
+						return
+					}
+
+					fail(err)
+					return
+				}
+
+				unsent := make([]storage.TraceResponse, 0, len(page.Data))
+				for _, trace := range page.Data {
+					if sent.add(trace.ID) {
+						unsent = append(unsent, trace)
+					}
+
+					if created, ok := createdAt(trace); ok && created.After(newest) {
+						newest = created
+					}
+				}
+
+				if len(page.Data) > 0 {
+					lastSeen = page.Data[len(page.Data)-1].ID
+				}
+
+				if err := send(unsent); err != nil {
+					logger.Debug("Client went away.", zap.Error(err))
+					return
+				}
+
+				if !page.HasMore {
+					break
+				}
+			}
+		}
+	}
+}
+
+// tailHandler streams the traces of a device as server-sent events, see streamTail
+func (traceEndpoint *TraceEndpoint) tailHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "tail-device-trace-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	request, ok := traceEndpoint.parseTailRequest(w, r, span, logger)
+	if !ok {
+		return
+	}
+
+	logger = logger.With(zap.String("request_id", request.RequestID)).With(zap.String("account_id", request.AccountID))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writePublicError(w, http.StatusInternalServerError, StatusInternalServerErrType, "Streaming is not supported by the connection", "", "", request.RequestID)
+
+		logger.Error("Response writer does not support flushing.", zap.Int("response_code", http.StatusInternalServerError))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+
+	// The stream outlives the server write timeout, it is bounded by MaxTailDuration instead
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(MaxTailDuration + TailHeartbeatInterval)); err != nil {
+		logger.Warn("Could not extend the write deadline of the stream.", zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := buildRequestContextWithValue(r, request.RequestID, request.AccountID)
+	traceEndpoint.streamTail(ctx, span, logger, request, &serverSentEvents{w: w, flusher: flusher})
+}
+
+// tailWebSocketUpgrader upgrades tail requests to WebSocket connections. Requests from a browser on another origin
+// are refused, like the default of the upgrader
+var tailWebSocketUpgrader = websocket.Upgrader{
+	HandshakeTimeout: TailWriteTimeout,
+}
+
+// tailWebSocketHandler streams the traces of a device over a WebSocket connection, see streamTail. Every message is
+// a JSON object with the event, id and data of the server-sent event it stands for. The client is pinged every
+// TailHeartbeatInterval and the stream ends if it does not answer
+func (traceEndpoint *TraceEndpoint) tailWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	logger := edge_log.WithContext(r.Context(), traceEndpoint.Logger).With(zap.String("url", r.URL.String())).With(zap.String("sub-component", "tail-device-trace-websocket-handler"))
+
+	span := opentracing.SpanFromContext(r.Context())
+	span.SetTag("http.method", "GET")
+	span.SetTag("http.url", r.URL.String())
+	defer span.Finish()
+
+	span.LogFields(
+		trace_log.String("event", "receive a request"),
+		trace_log.String("message", "starting to handle request"),
+	)
+
+	request, ok := traceEndpoint.parseTailRequest(w, r, span, logger)
+	if !ok {
+		return
+	}
+
+	logger = logger.With(zap.String("request_id", request.RequestID)).With(zap.String("account_id", request.AccountID))
+
+	// The upgrader writes the error response of a failed handshake
+	conn, err := tailWebSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("Could not upgrade to a WebSocket connection.", zap.Error(err))
+
+		metrics.PrometheusGetRequestErrorCounter.Inc()
+		return
+	}
+	defer conn.Close()
+
+	// The hijacked connection keeps the deadlines of the server, a pong or any message from the client extends the
+	// read deadline instead
+	conn.SetReadDeadline(time.Now().Add(2 * TailHeartbeatInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * TailHeartbeatInterval))
+	})
+
+	ctx, cancel := context.WithCancel(buildRequestContextWithValue(r, request.RequestID, request.AccountID))
+	defer cancel()
+
+	// The client sends nothing but control messages, reading them answers pings and notices a close or a timeout
+	go func() {
+		defer cancel()
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(2 * TailHeartbeatInterval))
+		}
+	}()
+
+	traceEndpoint.streamTail(ctx, span, logger, request, &webSocketStream{conn: conn})
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(TailWriteTimeout))
+}
@@ -0,0 +1,177 @@
+package routes
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidTimeExpression is returned for a time bound that is neither a timestamp nor a relative expression
+var ErrInvalidTimeExpression = errors.New("Invalid field value. Acceptable values are RFC3339 timestamps, epoch milliseconds or expressions such as now-15m and now/d.")
+
+var (
+	epochPattern    = regexp.MustCompile(`^-?\d+$`)
+	dateMathPattern = regexp.MustCompile(`([+-]\d+|/)(ms|[yMwdhHms])`)
+
+	// minTime and maxTime bound the time expressions to the years that RFC3339 can represent
+	minTime = time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxTime = time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+
+	// maxTimeAmounts are the amounts of each unit that span more than the whole range, larger amounts are rejected
+	// before the arithmetic can overflow
+	maxTimeAmounts = map[string]int64{
+		"y":  10000,
+		"M":  12 * 10000,
+		"w":  53 * 10000,
+		"d":  366 * 10000,
+		"h":  24 * 366 * 10000,
+		"H":  24 * 366 * 10000,
+		"m":  60 * 24 * 366 * 10000,
+		"s":  3600 * 24 * 366 * 10000,
+		"ms": 1000 * 3600 * 24 * 366 * 10000,
+	}
+)
+
+// parseTimeExpression resolves a time bound relative to now. It accepts RFC3339 with optional fractional seconds,
+// epoch milliseconds and expressions such as now-15m, now-1d/d or now/w built from now, additions and
+// subtractions and a final rounding with the units y, M, w, d, h (or H), m, s and ms. Rounding goes to the start
+// of the unit, or to its last millisecond if roundUp is set so that an upper bound includes the whole unit
+func parseTimeExpression(value string, now time.Time, roundUp bool) (time.Time, error) {
+	if epochPattern.MatchString(value) {
+		milliseconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || milliseconds < minTime.Unix()*1000 || milliseconds > maxTime.Unix()*1000+999 {
+			return time.Time{}, ErrInvalidTimeExpression
+		}
+
+		return time.Unix(milliseconds/1000, milliseconds%1000*int64(time.Millisecond)).UTC(), nil
+	}
+
+	if !strings.HasPrefix(value, "now") {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil || t.Before(minTime) || t.After(maxTime) {
+			return time.Time{}, ErrInvalidTimeExpression
+		}
+
+		return t, nil
+	}
+
+	t := now.UTC()
+	// An unencoded + in a query string arrives as a space
+	expression := strings.Replace(strings.TrimPrefix(value, "now"), " ", "+", -1)
+	rounded := false
+
+	for len(expression) > 0 {
+		match := dateMathPattern.FindStringSubmatchIndex(expression)
+		if match == nil || match[0] != 0 || rounded {
+			return time.Time{}, ErrInvalidTimeExpression
+		}
+
+		operation := expression[match[2]:match[3]]
+		unit := expression[match[4]:match[5]]
+		expression = expression[match[1]:]
+
+		if operation == "/" {
+			t = roundTime(t, unit, roundUp)
+			rounded = true
+			continue
+		}
+
+		amount, err := strconv.Atoi(operation)
+		if err != nil {
+			return time.Time{}, ErrInvalidTimeExpression
+		}
+
+		if t, err = addTime(t, unit, amount); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return t, nil
+}
+
+// addTime adds amount units to t. It fails if the result is outside of the years 1 to 9999
+func addTime(t time.Time, unit string, amount int) (time.Time, error) {
+	if int64(amount) > maxTimeAmounts[unit] || int64(amount) < -maxTimeAmounts[unit] {
+		return time.Time{}, ErrInvalidTimeExpression
+	}
+
+	switch unit {
+	case "y":
+		t = t.AddDate(amount, 0, 0)
+	case "M":
+		t = t.AddDate(0, amount, 0)
+	case "w":
+		t = t.AddDate(0, 0, 7*amount)
+	case "d":
+		t = t.AddDate(0, 0, amount)
+	case "h", "H":
+		t = addDuration(t, amount, time.Hour)
+	case "m":
+		t = addDuration(t, amount, time.Minute)
+	case "s":
+		t = addDuration(t, amount, time.Second)
+	default:
+		t = addDuration(t, amount, time.Millisecond)
+	}
+
+	if t.Before(minTime) || t.After(maxTime) {
+		return time.Time{}, ErrInvalidTimeExpression
+	}
+
+	return t, nil
+}
+
+// addDuration adds amount units to t in steps that fit a time.Duration
+func addDuration(t time.Time, amount int, unit time.Duration) time.Time {
+	step := int(math.MaxInt64 / unit)
+
+	for amount > step {
+		t = t.Add(time.Duration(step) * unit)
+		amount -= step
+	}
+
+	for amount < -step {
+		t = t.Add(-time.Duration(step) * unit)
+		amount += step
+	}
+
+	return t.Add(time.Duration(amount) * unit)
+}
+
+// roundTime rounds t down to the start of unit, or up to its last millisecond. Weeks start on Monday
+func roundTime(t time.Time, unit string, roundUp bool) time.Time {
+	var start time.Time
+
+	switch unit {
+	case "y":
+		start = time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	case "M":
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "w":
+		start = time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case "d":
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "h", "H":
+		start = t.Truncate(time.Hour)
+	case "m":
+		start = t.Truncate(time.Minute)
+	case "s":
+		start = t.Truncate(time.Second)
+	default:
+		start = t.Truncate(time.Millisecond)
+	}
+
+	if !roundUp {
+		return start
+	}
+
+	end, err := addTime(start, unit, 1)
+	if err != nil {
+		return maxTime.Truncate(time.Millisecond)
+	}
+
+	return end.Add(-time.Millisecond)
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+)
+
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// CircuitBreaker stops calls to a failing service. It opens after Threshold consecutive failures, rejects calls for
+// Cooldown and then lets a single probe through. The probe closes it again on success or reopens it on failure. A
+// probe that never reports back is replaced by another one after Cooldown
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may go through. A nil CircuitBreaker allows every call
+func (breaker *CircuitBreaker) Allow() bool {
+	if breaker == nil {
+		return true
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Since(breaker.openedAt) < breaker.Cooldown {
+			metrics.PrometheusDeviceDirectoryCircuitRejections.Inc()
+			return false
+		}
+
+		breaker.probedAt = time.Now()
+		breaker.setState(circuitHalfOpen)
+		return true
+
+	case circuitHalfOpen:
+		// Only the probe goes through until it finishes
+		if time.Since(breaker.probedAt) < breaker.Cooldown {
+			metrics.PrometheusDeviceDirectoryCircuitRejections.Inc()
+			return false
+		}
+
+		breaker.probedAt = time.Now()
+		return true
+	}
+
+	return true
+}
+
+// Success records a call that the service answered
+func (breaker *CircuitBreaker) Success() {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.failures = 0
+	breaker.setState(circuitClosed)
+}
+
+// Failure records a call that the service did not answer or answered with a server error
+func (breaker *CircuitBreaker) Failure() {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.failures++
+
+	if breaker.state == circuitHalfOpen || breaker.failures >= breaker.Threshold {
+		breaker.openedAt = time.Now()
+		breaker.setState(circuitOpen)
+	}
+}
+
+func (breaker *CircuitBreaker) setState(state int) {
+	breaker.state = state
+	metrics.PrometheusDeviceDirectoryCircuitState.Set(float64(state))
+}
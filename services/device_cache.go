@@ -0,0 +1,182 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultDeviceCacheTTL      = time.Minute
+	DefaultDeviceCacheStaleTTL = time.Hour
+	DefaultDeviceCacheSize     = 10000
+	DeviceCacheNegativeTTL     = 15 * time.Second
+)
+
+type deviceEntry struct {
+	key     string
+	device  DeviceData
+	err     *httputil.PublicError
+	fetched time.Time
+}
+
+type deviceCall struct {
+	done   chan struct{}
+	device DeviceData
+	err    *httputil.PublicError
+}
+
+// CachedDeviceDirectory caches the device lookups of a DeviceDirectory in a least recently used cache of Size
+// devices. Devices are fresh for TTL and unknown devices for DeviceCacheNegativeTTL. Concurrent lookups of the same
+// device share one request, and a device up to StaleTTL old is returned when the directory fails or is unavailable.
+// Device lists are not cached
+type CachedDeviceDirectory struct {
+	DeviceDirectory
+	TTL      time.Duration
+	StaleTTL time.Duration
+	Size     int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*deviceCall
+}
+
+// NewCachedDeviceDirectory returns a CachedDeviceDirectory on directory
+func NewCachedDeviceDirectory(directory DeviceDirectory, ttl time.Duration, staleTTL time.Duration, size int) *CachedDeviceDirectory {
+	return &CachedDeviceDirectory{
+		DeviceDirectory: directory,
+		TTL:             ttl,
+		StaleTTL:        staleTTL,
+		Size:            size,
+		entries:         make(map[string]*list.Element),
+		lru:             list.New(),
+		calls:           make(map[string]*deviceCall),
+	}
+}
+
+// copyError returns a copy of a shared error so that callers can change it
+func copyError(publicError *httputil.PublicError) *httputil.PublicError {
+	if publicError == nil {
+		return nil
+	}
+
+	copied := *publicError
+
+	return &copied
+}
+
+func (cache *CachedDeviceDirectory) DeviceRetrieve(parentSpan opentracing.Span, ctx context.Context, id string) (DeviceData, *httputil.PublicError) {
+	span := opentracing.StartSpan(
+		"CachedDeviceDirectory.DeviceRetrieve()",
+		opentracing.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	key := fmt.Sprintf("%s/%s", ctx.Value(httputil.ContextKeyAccountID), id)
+
+	cache.lock.Lock()
+
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*deviceEntry)
+		ttl := cache.TTL
+		if entry.err != nil {
+			ttl = DeviceCacheNegativeTTL
+		}
+
+		if time.Since(entry.fetched) < ttl {
+			cache.lru.MoveToFront(element)
+			cache.lock.Unlock()
+
+			metrics.PrometheusDeviceCacheLookups.WithLabelValues("hit").Inc()
+			span.SetTag("cache", "hit")
+
+			return entry.device, copyError(entry.err)
+		}
+	}
+
+	if call, ok := cache.calls[key]; ok {
+		cache.lock.Unlock()
+
+		metrics.PrometheusDeviceCacheLookups.WithLabelValues("shared").Inc()
+		span.SetTag("cache", "shared")
+
+		select {
+		case <-call.done:
+			return call.device, copyError(call.err)
+		case <-ctx.Done():
+			return DeviceData{}, &httputil.PublicError{
+				Object:  "error",
+				Code:    http.StatusInternalServerError,
+				Type:    StatusInternalServerErrType,
+				Message: fmt.Sprintf("Device lookup canceled: %s", ctx.Err()),
+			}
+		}
+	}
+
+	call := &deviceCall{done: make(chan struct{})}
+	cache.calls[key] = call
+	cache.lock.Unlock()
+
+	call.device, call.err = cache.DeviceDirectory.DeviceRetrieve(span, ctx, id)
+
+	cache.lock.Lock()
+	delete(cache.calls, key)
+
+	switch {
+	case call.err == nil, call.err.Code == http.StatusNotFound:
+		cache.store(key, call.device, call.err)
+		metrics.PrometheusDeviceCacheLookups.WithLabelValues("miss").Inc()
+		span.SetTag("cache", "miss")
+
+	case call.err.Code >= http.StatusInternalServerError:
+		if element, ok := cache.entries[key]; ok {
+			entry := element.Value.(*deviceEntry)
+
+			if entry.err == nil && time.Since(entry.fetched) < cache.StaleTTL {
+				call.device, call.err = entry.device, nil
+				metrics.PrometheusDeviceCacheLookups.WithLabelValues("stale").Inc()
+				span.SetTag("cache", "stale")
+				break
+			}
+		}
+
+		metrics.PrometheusDeviceCacheLookups.WithLabelValues("miss").Inc()
+		span.SetTag("cache", "miss")
+
+	default:
+		metrics.PrometheusDeviceCacheLookups.WithLabelValues("miss").Inc()
+		span.SetTag("cache", "miss")
+	}
+
+	cache.lock.Unlock()
+	close(call.done)
+
+	return call.device, copyError(call.err)
+}
+
+// store adds or replaces the entry of key and evicts the least recently used entries beyond Size
+func (cache *CachedDeviceDirectory) store(key string, device DeviceData, publicError *httputil.PublicError) {
+	entry := &deviceEntry{key: key, device: device, err: publicError, fetched: time.Now()}
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.lru.MoveToFront(element)
+	} else {
+		cache.entries[key] = cache.lru.PushFront(entry)
+	}
+
+	for cache.lru.Len() > cache.Size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*deviceEntry).key)
+	}
+
+	metrics.PrometheusDeviceCacheEntries.Set(float64(cache.lru.Len()))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
 	"github.com/opentracing/opentracing-go"
@@ -16,9 +17,20 @@ type DeviceData struct {
 	ID        string `json:"id"`
 }
 
+// DeviceList represents a page of devices returned by the device directory
+type DeviceList struct {
+	Object  string       `json:"object"`
+	Limit   int          `json:"limit"`
+	After   string       `json:"after"`
+	HasMore bool         `json:"has_more"`
+	Data    []DeviceData `json:"data"`
+}
+
 // The DeviceDirectory interface is a subset of functionality provided by the DeviceDirectory service
 type DeviceDirectory interface {
 	DeviceRetrieve(parentSpan opentracing.Span, ctx context.Context, id string) (DeviceData, *httputil.PublicError)
+	DeviceList(parentSpan opentracing.Span, ctx context.Context, filter url.Values, limit int, after string) (DeviceList, *httputil.PublicError)
+	DeviceGroupDevices(parentSpan opentracing.Span, ctx context.Context, groupID string, limit int, after string) (DeviceList, *httputil.PublicError)
 }
 
 type DeviceDirectoryImpl struct {
@@ -48,3 +60,72 @@ func (dd *DeviceDirectoryImpl) DeviceRetrieve(parentSpan opentracing.Span, ctx c
 
 	return deviceData, err
 }
+
+// DeviceList returns a page of the devices of the account matching filter, a set of directory query fields such as
+// state__eq or host_gateway__eq
+func (dd *DeviceDirectoryImpl) DeviceList(parentSpan opentracing.Span, ctx context.Context, filter url.Values, limit int, after string) (DeviceList, *httputil.PublicError) {
+	var deviceList DeviceList
+
+	span := opentracing.StartSpan(
+		"DeviceDirectory.DeviceList()",
+		opentracing.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	bearer, err := dd.accountToken(ctx)
+
+	if err != nil {
+		return DeviceList{}, err
+	}
+
+	query := url.Values{}
+	for field, values := range filter {
+		query[field] = values
+	}
+
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("order", "ASC")
+	if after != "" {
+		query.Set("after", after)
+	}
+
+	err = dd.doRequest(ctx, *dd.DeviceDirectoryServiceURL, "GET", url.URL{
+		Path:     "/v3/devices",
+		RawQuery: query.Encode(),
+	}, http.Header{
+		"Authorization": []string{"Bearer " + bearer},
+	}, nil, &deviceList)
+
+	return deviceList, err
+}
+
+// DeviceGroupDevices returns a page of the devices in a device group
+func (dd *DeviceDirectoryImpl) DeviceGroupDevices(parentSpan opentracing.Span, ctx context.Context, groupID string, limit int, after string) (DeviceList, *httputil.PublicError) {
+	var deviceList DeviceList
+
+	span := opentracing.StartSpan(
+		"DeviceDirectory.DeviceGroupDevices()",
+		opentracing.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	bearer, err := dd.accountToken(ctx)
+
+	if err != nil {
+		return DeviceList{}, err
+	}
+
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("order", "ASC")
+	if after != "" {
+		query.Set("after", after)
+	}
+
+	err = dd.doRequest(ctx, *dd.DeviceDirectoryServiceURL, "GET", url.URL{
+		Path:     fmt.Sprintf("/v3/device-groups/%s/devices", groupID),
+		RawQuery: query.Encode(),
+	}, http.Header{
+		"Authorization": []string{"Bearer " + bearer},
+	}, nil, &deviceList)
+
+	return deviceList, err
+}
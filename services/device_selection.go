@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultSelectionTTL        = time.Minute
+	DefaultMaxSelectionDevices = 10000
+	SelectionPageSize          = 1000
+	maxCachedSelections        = 1000
+
+	StatusValidationErrType = "validation_error"
+)
+
+type deviceSelection struct {
+	devices []string
+	expires time.Time
+}
+
+// DeviceSelector resolves device groups and device filters of the device directory into device ids. Results are
+// cached per account for TTL and a selection may not resolve to more than MaxDevices devices
+type DeviceSelector struct {
+	Directory  DeviceDirectory
+	TTL        time.Duration
+	MaxDevices int
+
+	lock       sync.Mutex
+	selections map[string]deviceSelection
+}
+
+// NewDeviceSelector returns a DeviceSelector on directory
+func NewDeviceSelector(directory DeviceDirectory, ttl time.Duration, maxDevices int) *DeviceSelector {
+	return &DeviceSelector{
+		Directory:  directory,
+		TTL:        ttl,
+		MaxDevices: maxDevices,
+		selections: make(map[string]deviceSelection),
+	}
+}
+
+// GroupDevices returns the ids of the devices in a device group of the account in ctx
+func (selector *DeviceSelector) GroupDevices(parentSpan opentracing.Span, ctx context.Context, groupID string) ([]string, *httputil.PublicError) {
+	return selector.resolve(ctx, "group:"+groupID, "device_group_id__eq", func(limit int, after string) (DeviceList, *httputil.PublicError) {
+		return selector.Directory.DeviceGroupDevices(parentSpan, ctx, groupID, limit, after)
+	})
+}
+
+// FilterDevices returns the ids of the devices of the account in ctx that match the directory query fields in filter
+func (selector *DeviceSelector) FilterDevices(parentSpan opentracing.Span, ctx context.Context, filter url.Values) ([]string, *httputil.PublicError) {
+	return selector.resolve(ctx, "filter:"+filter.Encode(), "device_filter", func(limit int, after string) (DeviceList, *httputil.PublicError) {
+		return selector.Directory.DeviceList(parentSpan, ctx, filter, limit, after)
+	})
+}
+
+// resolve returns the cached devices of a selection or pages through the directory with list
+func (selector *DeviceSelector) resolve(ctx context.Context, key string, field string, list func(limit int, after string) (DeviceList, *httputil.PublicError)) ([]string, *httputil.PublicError) {
+	key = fmt.Sprintf("%s/%s", ctx.Value(httputil.ContextKeyAccountID), key)
+	now := time.Now()
+
+	selector.lock.Lock()
+	selection, ok := selector.selections[key]
+	selector.lock.Unlock()
+
+	if ok && now.Before(selection.expires) {
+		return selection.devices, nil
+	}
+
+	devices := []string{}
+	after := ""
+
+	for {
+		page, publicError := list(SelectionPageSize, after)
+		if publicError != nil {
+			return nil, publicError
+		}
+
+		for _, device := range page.Data {
+			devices = append(devices, device.ID)
+		}
+
+		if len(devices) > selector.MaxDevices {
+			return nil, &httputil.PublicError{
+				Object:  "error",
+				Code:    http.StatusBadRequest,
+				Type:    StatusValidationErrType,
+				Message: fmt.Sprintf("Invalid query field '%s'", field),
+				Fields: []httputil.PublicErrorField{{
+					Name:    field,
+					Message: fmt.Sprintf("The selection matches more than %d devices. Narrow it down or use device_id__in.", selector.MaxDevices),
+				}},
+			}
+		}
+
+		if !page.HasMore || len(page.Data) == 0 {
+			break
+		}
+
+		after = page.Data[len(page.Data)-1].ID
+	}
+
+	selector.lock.Lock()
+	defer selector.lock.Unlock()
+
+	// Make room by dropping the expired selections, or all of them if none expired
+	if len(selector.selections) >= maxCachedSelections {
+		for cached, selection := range selector.selections {
+			if now.After(selection.expires) {
+				delete(selector.selections, cached)
+			}
+		}
+
+		if len(selector.selections) >= maxCachedSelections {
+			selector.selections = make(map[string]deviceSelection)
+		}
+	}
+
+	selector.selections[key] = deviceSelection{devices: devices, expires: now.Add(selector.TTL)}
+
+	return devices, nil
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultValidationTTL  = 5 * time.Minute
+	DefaultMaxDeviceIDs   = 100
+	ValidationBatchSize   = 100
+	maxCachedOwnedDevices = 100000
+)
+
+// DeviceValidator checks that device ids belong to the account of a request with bulk lookups in the device
+// directory. Owned devices are cached for TTL, unknown ids are looked up again on every request
+type DeviceValidator struct {
+	Directory DeviceDirectory
+	TTL       time.Duration
+
+	lock  sync.Mutex
+	owned map[string]time.Time
+}
+
+// NewDeviceValidator returns a DeviceValidator on directory
+func NewDeviceValidator(directory DeviceDirectory, ttl time.Duration) *DeviceValidator {
+	return &DeviceValidator{
+		Directory: directory,
+		TTL:       ttl,
+		owned:     make(map[string]time.Time),
+	}
+}
+
+// UnknownDevices returns the ids that do not belong to the account in ctx, in the order they were given
+func (validator *DeviceValidator) UnknownDevices(parentSpan opentracing.Span, ctx context.Context, ids []string) ([]string, *httputil.PublicError) {
+	span := opentracing.StartSpan(
+		"DeviceValidator.UnknownDevices()",
+		opentracing.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	accountID := fmt.Sprintf("%s", ctx.Value(httputil.ContextKeyAccountID))
+	now := time.Now()
+
+	var uncached []string
+
+	validator.lock.Lock()
+	for _, id := range ids {
+		if expires, ok := validator.owned[accountID+"/"+id]; !ok || now.After(expires) {
+			uncached = append(uncached, id)
+		}
+	}
+	validator.lock.Unlock()
+
+	span.SetTag("cached", len(ids)-len(uncached))
+
+	found := make(map[string]bool, len(uncached))
+
+	for start := 0; start < len(uncached); start += ValidationBatchSize {
+		end := start + ValidationBatchSize
+		if end > len(uncached) {
+			end = len(uncached)
+		}
+
+		filter := url.Values{}
+		filter.Set("id__in", strings.Join(uncached[start:end], ","))
+
+		after := ""
+
+		for {
+			page, publicError := validator.Directory.DeviceList(span, ctx, filter, ValidationBatchSize, after)
+			if publicError != nil {
+				return nil, publicError
+			}
+
+			for _, device := range page.Data {
+				found[device.ID] = true
+			}
+
+			if !page.HasMore || len(page.Data) == 0 {
+				break
+			}
+
+			after = page.Data[len(page.Data)-1].ID
+		}
+	}
+
+	validator.lock.Lock()
+	defer validator.lock.Unlock()
+
+	// Start over rather than grow without bounds, the cache refills on the following requests
+	if len(validator.owned)+len(found) > maxCachedOwnedDevices {
+		validator.owned = make(map[string]time.Time)
+	}
+
+	for id := range found {
+		validator.owned[accountID+"/"+id] = now.Add(validator.TTL)
+	}
+
+	unknown := []string{}
+	for _, id := range uncached {
+		if !found[id] {
+			unknown = append(unknown, id)
+		}
+	}
+
+	return unknown, nil
+}
@@ -8,10 +8,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/metrics"
 	"github.com/armPelionEdge/edge-gw-trace-service/tokens"
 	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
 	"github.com/opentracing/opentracing-go"
@@ -20,13 +26,111 @@ import (
 )
 
 const (
-	StatusInternalServerErrType = "internal_server_error"
+	StatusInternalServerErrType     = "internal_server_error"
+	StatusServiceUnavailableErrType = "service_unavailable"
+
+	DefaultClientTimeout = 10 * time.Second
+	DefaultRetries       = 2
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	TokenRefreshMargin   = 10 * time.Second
+	maxCachedTokens      = 10000
 )
 
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+type accountToken struct {
+	bearer  string
+	expires time.Time
+}
+
+// Client makes requests to other services with account tokens. GET requests that fail or get a server error are
+// retried Retries times, and Breaker stops all requests while the service keeps failing
 type Client struct {
-	Client     *http.Client
-	Logger     *zap.Logger
-	JWTFactory *tokens.JWTTokenFactory
+	Client       *http.Client
+	Logger       *zap.Logger
+	JWTFactory   *tokens.JWTTokenFactory
+	Retries      int
+	RetryBackoff time.Duration
+	Breaker      *CircuitBreaker
+
+	tokenLock sync.Mutex
+	tokens    map[string]accountToken
+}
+
+// NewHTTPClient returns an http.Client with connection, TLS handshake, response header and overall timeouts
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+		},
+	}
+}
+
+// send makes the request through the circuit breaker, retrying GET requests that failed or got a server error or a
+// 429 with jittered exponential backoff
+func (client *Client) send(ctx context.Context, logger *zap.Logger, req *http.Request) (*http.Response, error) {
+	if !client.Breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+
+	attempts := 1
+	if req.Method == http.MethodGet {
+		attempts += client.Retries
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := client.Client.Do(req.WithContext(ctx))
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		metrics.PrometheusDeviceDirectoryRequestDurations.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+
+		retryable := err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+				client.Breaker.Failure()
+			} else {
+				client.Breaker.Success()
+			}
+
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		// Wait between half and all of the exponential backoff
+		backoff := client.RetryBackoff << uint(attempt-1)
+		if backoff > 0 {
+			backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+
+		metrics.PrometheusDeviceDirectoryRetries.Inc()
+		logger.Warn("retrying request", zap.Int("attempt", attempt), zap.String("status", code), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
 func (client *Client) doRequest(ctx context.Context, service url.URL, method string, path url.URL, header http.Header, body interface{}, response interface{}) (publicError *httputil.PublicError) {
@@ -111,7 +215,20 @@ func (client *Client) doRequest(ctx context.Context, service url.URL, method str
 		opentracing.HTTPHeaders,
 		opentracing.HTTPHeadersCarrier(req.Header))
 
-	resp, err := client.Client.Do(req)
+	resp, err := client.send(ctx, logger, req)
+
+	if err == errCircuitOpen {
+		logger.Warn("circuit breaker is open")
+
+		publicError = &httputil.PublicError{
+			Object   : "error",
+			Code     : http.StatusServiceUnavailable,
+			Type     : StatusServiceUnavailableErrType,
+			Message  : "The service is unavailable, try again later",
+		}
+
+		return
+	}
 
 	if err != nil {
 		errMsg := fmt.Sprintf("Could not make request: %s", err)
@@ -184,11 +301,28 @@ func (client *Client) accountToken(ctx context.Context) (string, *httputil.Publi
 	accountID := fmt.Sprintf("%s", ctx.Value(httputil.ContextKeyAccountID))
 
 	logger := edge_log.WithContext(ctx, client.Logger).With(zap.String("function", "accountToken()")).With(zap.String("request_id", requestID)).With(zap.String("account_id", accountID))
+
+	// Tokens are reused until they are close to expiry, so they do not carry the request id
+	margin := TokenRefreshMargin
+	if margin > client.JWTFactory.TokenExp/2 {
+		margin = client.JWTFactory.TokenExp / 2
+	}
+
+	now := time.Now()
+
+	client.tokenLock.Lock()
+	cached, ok := client.tokens[accountID]
+	client.tokenLock.Unlock()
+
+	if ok && now.Before(cached.expires.Add(-margin)) {
+		metrics.PrometheusAccountTokens.WithLabelValues("reused").Inc()
+
+		return cached.bearer, nil
+	}
+
 	logger.Debug("Generating access token")
 
-	bearer, err := client.JWTFactory.CreateAccountToken(accountID, map[string]interface{}{
-		"request_id": ctx.Value(httputil.ContextKeyRequestID),
-	})
+	bearer, err := client.JWTFactory.CreateAccountToken(accountID, nil)
 
 	if err != nil {
 		logger.Error("Unable to generate access token", zap.Error(err))
@@ -208,6 +342,17 @@ func (client *Client) accountToken(ctx context.Context) (string, *httputil.Publi
 		}
 	}
 
+	metrics.PrometheusAccountTokens.WithLabelValues("minted").Inc()
+
+	client.tokenLock.Lock()
+	defer client.tokenLock.Unlock()
+
+	if client.tokens == nil || len(client.tokens) >= maxCachedTokens {
+		client.tokens = make(map[string]accountToken)
+	}
+
+	client.tokens[accountID] = accountToken{bearer: bearer, expires: now.Add(client.JWTFactory.TokenExp)}
+
 	span.LogFields(
 		trace_log.String("event", "token generated"),
 		trace_log.String("message", "successfully generated account token"),
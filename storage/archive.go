@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	deviceCountBatchSize = 1000
+)
+
+// Errors that might be returned by the archive and index functions
+var (
+	ErrCouldNotCountLogs        = errors.New("Failed to count the trace logs of the devices")
+	ErrCouldNotCreateTraceIndex = errors.New("Failed to create the trace index")
+	ErrCouldNotDeleteTraceIndex = errors.New("Failed to delete the trace index")
+)
+
+// DeviceTraceCount is the number of traces of a device
+type DeviceTraceCount struct {
+	AccountID string `json:"account_id"`
+	DeviceID  string `json:"device_id"`
+	Count     int64  `json:"count"`
+}
+
+// TraceArchiveStore is implemented by the trace stores that old traces can be archived from
+type TraceArchiveStore interface {
+	// OldestDeviceTrace returns the timestamp of the oldest trace at or before before, false if there is none
+	OldestDeviceTrace(parentSpan opentracing.Span, ctx context.Context, before time.Time) (time.Time, bool, error)
+	// CountDeviceTrace returns the number of traces matching query of every device that has any
+	CountDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) ([]DeviceTraceCount, error)
+	// ScanTraces calls batch with the stored traces matching query, at most ScanBatchSize traces at a time
+	ScanTraces(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, batch func([]Trace) error) error
+}
+
+// TraceIndexStore is implemented by the trace stores that can load traces into a standalone index, which is searched
+// apart from the other traces
+type TraceIndexStore interface {
+	// CreateTraceIndex creates the index with the trace mappings. Creating an existing index is not an error
+	CreateTraceIndex(parentSpan opentracing.Span, ctx context.Context, index string) error
+	// DeleteTraceIndex deletes the index. Deleting a missing index is not an error
+	DeleteTraceIndex(parentSpan opentracing.Span, ctx context.Context, index string) error
+	// IndexTraces writes traces to the index by their id, so that a trace that is written again replaces itself
+	IndexTraces(parentSpan opentracing.Span, ctx context.Context, index string, traces []Trace) error
+	// IndexTraceStore returns a TraceStore that searches the index
+	IndexTraceStore(index string) TraceStore
+}
+
+func (esTraceStore *ESTraceStore) startSpan(parentSpan opentracing.Span, ctx context.Context, function string) (opentracing.Span, *zap.Logger) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore."+function,
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", function+"()"))
+
+	return span, logger
+}
+
+// OldestDeviceTrace returns the timestamp of the oldest trace at or before before in every index family
+func (esTraceStore *ESTraceStore) OldestDeviceTrace(parentSpan opentracing.Span, ctx context.Context, before time.Time) (time.Time, bool, error) {
+	span, logger := esTraceStore.startSpan(parentSpan, ctx, "OldestDeviceTrace")
+	defer span.Finish()
+
+	indices, _ := esTraceStore.searchTarget("")
+
+	result, err := esTraceStore.ElasticSearchClient.Search().
+		Index(indices...).
+		Query(buildESBoolQuery(TraceQuery{Before: before})).
+		Sort("timestamp", true).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("timestamp")).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		logger.Warn("Error executing search query", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "search query failed"),
+			trace_log.Error(err),
+		)
+
+		return time.Time{}, false, ErrCouldNotQueryLogs
+	}
+
+	if len(result.Hits.Hits) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	var trace Trace
+	if err := json.Unmarshal(result.Hits.Hits[0].Source, &trace); err != nil {
+		logger.Warn("Error decoding response as trace data", zap.Error(err))
+		return time.Time{}, false, ErrCouldNotUnmarshalLogs
+	}
+
+	return time.Unix(0, trace.Timestamp*int64(time.Millisecond)).UTC(), true, nil
+}
+
+// CountDeviceTrace pages through a composite aggregation of the traces matching query by account and device
+func (esTraceStore *ESTraceStore) CountDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) ([]DeviceTraceCount, error) {
+	span, logger := esTraceStore.startSpan(parentSpan, ctx, "CountDeviceTrace")
+	defer span.Finish()
+
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
+	var counts []DeviceTraceCount
+	var afterKey map[string]interface{}
+
+	for {
+		aggregation := elastic.NewCompositeAggregation().
+			Sources(
+				elastic.NewCompositeAggregationTermsValuesSource("account_id").Field("account_id"),
+				elastic.NewCompositeAggregationTermsValuesSource("device_id").Field("device_id"),
+			).
+			Size(deviceCountBatchSize)
+
+		if afterKey != nil {
+			aggregation.AggregateAfter(afterKey)
+		}
+
+		search := esTraceStore.ElasticSearchClient.Search().
+			Index(indices...).
+			Query(buildESBoolQuery(query)).
+			Aggregation("devices", aggregation).
+			Size(0)
+
+		if routing != "" {
+			search.Routing(routing)
+		}
+
+		result, err := search.Do(ctx)
+		if err != nil {
+			logger.Warn("Error executing aggregation query", zap.Error(err))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "aggregation query failed"),
+				trace_log.Error(err),
+			)
+
+			return nil, ErrCouldNotCountLogs
+		}
+
+		devices, found := result.Aggregations.Composite("devices")
+		if !found {
+			return counts, nil
+		}
+
+		for _, bucket := range devices.Buckets {
+			accountID, _ := bucket.Key["account_id"].(string)
+			deviceID, _ := bucket.Key["device_id"].(string)
+
+			counts = append(counts, DeviceTraceCount{AccountID: accountID, DeviceID: deviceID, Count: bucket.DocCount})
+		}
+
+		if len(devices.Buckets) < deviceCountBatchSize || devices.AfterKey == nil {
+			return counts, nil
+		}
+
+		afterKey = devices.AfterKey
+	}
+}
+
+// CreateTraceIndex creates a single shard index with the trace mappings, outside of the index template
+func (esTraceStore *ESTraceStore) CreateTraceIndex(parentSpan opentracing.Span, ctx context.Context, index string) error {
+	span, logger := esTraceStore.startSpan(parentSpan, ctx, "CreateTraceIndex")
+	defer span.Finish()
+
+	exists, err := esTraceStore.ElasticSearchClient.IndexExists(index).Do(ctx)
+	if err != nil {
+		logger.Warn("Could not check the trace index", zap.String("index", index), zap.Error(err))
+		return ErrCouldNotCreateTraceIndex
+	}
+
+	if exists {
+		return nil
+	}
+
+	body := map[string]interface{}{
+		"settings": map[string]interface{}{
+			"number_of_shards":   1,
+			"number_of_replicas": 0,
+		},
+		"mappings": traceMappings,
+	}
+
+	if _, err := esTraceStore.ElasticSearchClient.CreateIndex(index).BodyJson(body).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+		logger.Warn("Could not create the trace index", zap.String("index", index), zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "create index failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotCreateTraceIndex
+	}
+
+	return nil
+}
+
+// DeleteTraceIndex deletes an index created by CreateTraceIndex
+func (esTraceStore *ESTraceStore) DeleteTraceIndex(parentSpan opentracing.Span, ctx context.Context, index string) error {
+	span, logger := esTraceStore.startSpan(parentSpan, ctx, "DeleteTraceIndex")
+	defer span.Finish()
+
+	if _, err := esTraceStore.ElasticSearchClient.DeleteIndex(index).Do(ctx); err != nil && !elastic.IsNotFound(err) {
+		logger.Warn("Could not delete the trace index", zap.String("index", index), zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "delete index failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotDeleteTraceIndex
+	}
+
+	return nil
+}
+
+// IndexTraces writes traces to index in a bulk request, with the trace id as the document id
+func (esTraceStore *ESTraceStore) IndexTraces(parentSpan opentracing.Span, ctx context.Context, index string, traces []Trace) error {
+	span, logger := esTraceStore.startSpan(parentSpan, ctx, "IndexTraces")
+	defer span.Finish()
+
+	if len(traces) == 0 {
+		return nil
+	}
+
+	bulkRequest := esTraceStore.ElasticSearchClient.Bulk().Index(index)
+	for _, trace := range traces {
+		trace.Timestring = Date(trace.Timestamp)
+		trace.CreatedAt = Date(trace.CloudTimestamp)
+
+		bulkRequest.Add(elastic.NewBulkIndexRequest().Id(trace.ID).Doc(trace))
+	}
+
+	response, err := bulkRequest.Do(ctx)
+	if err != nil {
+		logger.Warn("Fail to make bulk request", zap.String("index", index), zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "bulk request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotMakeBulkRequest
+	}
+
+	if response.Errors {
+		for _, item := range response.Failed() {
+			logger.Error("Bulk request failed item", zap.String("index", index), zap.Any("reason", item.Error.Reason))
+		}
+
+		return ErrCouldNotMakeBulkRequest
+	}
+
+	return nil
+}
+
+// IndexTraceStore returns an ESTraceStore whose aliases are index. Accounts are not routed in the index
+func (esTraceStore *ESTraceStore) IndexTraceStore(index string) TraceStore {
+	return &ESTraceStore{
+		ElasticSearchClient: esTraceStore.ElasticSearchClient,
+		ElasticSearchAlias:  index,
+		ElasticActiveAlias:  index,
+		Engine:              esTraceStore.Engine,
+		Logger:              esTraceStore.Logger,
+	}
+}
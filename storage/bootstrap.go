@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+const (
+	// SchemaVersion is the version of the trace index schema that this service writes. It is stored as the
+	// version of the index template
+	SchemaVersion = 2
+
+	// updatePollInterval is how often a migration checks the update by query task that it waits for
+	updatePollInterval = 5 * time.Second
+
+	DefaultILMPolicy          = "device-trace-logs"
+	DefaultShards             = 1
+	DefaultReplicas           = 0
+	DefaultTotalShardsPerNode = 1
+	DefaultRolloverMaxAge     = "1d"
+	DefaultRolloverMaxSize    = "50gb"
+
+	// KeepSetting leaves a setting of an existing index template as it is
+	KeepSetting = -1
+
+	// FirstIndexSuffix is the suffix of the first index behind the active alias, rollover increments it
+	FirstIndexSuffix = "-000001"
+
+	// AppNameKeywordField and TypeKeywordField are the keyword sub-fields that schema version 2 adds, for
+	// aggregations and exact matches
+	AppNameKeywordField = "app_name.keyword"
+	TypeKeywordField    = "type.keyword"
+)
+
+// Errors that might be returned by Bootstrap
+var (
+	ErrCouldNotMigrateSchema = errors.New("Failed to migrate the trace index schema")
+	ErrSchemaTooNew          = errors.New("The trace index schema is newer than this service")
+	ErrKeywordFieldsMissing  = errors.New("The trace indices have no keyword sub-fields, the schema needs to be migrated to version 2")
+)
+
+// traceMappings is the mapping of the trace indices. app_name and type have keyword sub-fields for aggregations
+var traceMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"id":         map[string]interface{}{"type": "keyword"},
+		"device_id":  map[string]interface{}{"type": "keyword"},
+		"account_id": map[string]interface{}{"type": "keyword"},
+		"timestamp":  map[string]interface{}{"type": "date", "format": "strict_date_optional_time||epoch_millis"},
+		"@timestamp": map[string]interface{}{"type": "date", "format": "strict_date_optional_time||epoch_millis"},
+		"app_name":   map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}}},
+		"level":      map[string]interface{}{"type": "text"},
+		"message":    map[string]interface{}{"type": "text"},
+		"type":       map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}}},
+		"timestring": map[string]interface{}{"type": "date", "format": "strict_date_optional_time_nanos"},
+		"created_at": map[string]interface{}{"type": "date", "format": "strict_date_optional_time_nanos"},
+	},
+}
+
+// CheckKeywordFields fails with ErrKeywordFieldsMissing unless every trace index has the keyword sub-fields, which
+// the exact type filters and the histogram splits need. Indices that were set up before schema version 2 have none,
+// and a query on them would silently match nothing
+func (esTraceStore *ESTraceStore) CheckKeywordFields(ctx context.Context, fields ...string) error {
+	indices, _ := esTraceStore.searchTarget("")
+
+	// The typeless field mapping API, which every engine has
+	response, err := esTraceStore.ElasticSearchClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/" + escapeNames(indices) + "/_mapping/field/" + escapeNames(fields),
+		Params: url.Values{"ignore_unavailable": []string{"true"}},
+	})
+	if err != nil {
+		esTraceStore.Logger.Warn("CheckKeywordFields(): Could not get the field mappings", zap.Error(err))
+
+		return ErrCouldNotQueryLogs
+	}
+
+	var mappings map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+
+	if err := json.Unmarshal(response.Body, &mappings); err != nil {
+		return ErrCouldNotUnmarshalLogs
+	}
+
+	for index, mapping := range mappings {
+		for _, field := range fields {
+			if _, ok := mapping.Mappings[field]; !ok {
+				esTraceStore.Logger.Warn("CheckKeywordFields(): A trace index has no keyword sub-field", zap.String("index", index), zap.String("field", field))
+
+				return ErrKeywordFieldsMissing
+			}
+		}
+	}
+
+	return nil
+}
+
+// Migration upgrades the trace indices to Version. Migrations are idempotent, a migration that was interrupted is
+// applied again on the next start
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context, bootstrap *Bootstrap) error
+}
+
+// Migrations lists the schema migrations in order of version
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Install the index template and the ILM policy, create the first index and the aliases",
+		Apply: func(ctx context.Context, bootstrap *Bootstrap) error {
+			if err := bootstrap.putILMPolicy(ctx); err != nil {
+				return err
+			}
+
+			if err := bootstrap.putTemplate(ctx, 1); err != nil {
+				return err
+			}
+
+			return bootstrap.createFirstIndex(ctx)
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add app_name, level, message and the keyword sub-fields to the existing trace indices and update their documents",
+		Apply: func(ctx context.Context, bootstrap *Bootstrap) error {
+			return bootstrap.upgradeIndices(ctx)
+		},
+	},
+}
+
+// Bootstrap owns the index template, the ILM policy, the first trace index and the active and search aliases.
+// Run creates them when they are missing and applies the migrations newer than the stored schema version
+type Bootstrap struct {
+	ElasticSearchClient *elastic.Client
+	ElasticSearchAlias  string
+	ElasticActiveAlias  string
+	Engine              SearchEngine
+	Logger              *zap.Logger
+
+	// ILMPolicy is the name of the ILM policy that rolls the active index over, ILM is not used if empty. It is an
+	// ISM policy on OpenSearch
+	ILMPolicy string
+
+	// Shards, Replicas and TotalShardsPerNode replace the settings of an existing index template unless they are
+	// KeepSetting. A new template gets the defaults of the kept ones. The other settings of an existing template,
+	// such as those of the setup script, are kept
+	Shards             int
+	Replicas           int
+	TotalShardsPerNode int
+	Rollover           RolloverConditions
+}
+
+// NewBootstrap returns a Bootstrap for the aliases of esTraceStore that keeps the settings of an existing template
+func NewBootstrap(logger *zap.Logger, esTraceStore *ESTraceStore) *Bootstrap {
+	return &Bootstrap{
+		ElasticSearchClient: esTraceStore.ElasticSearchClient,
+		ElasticSearchAlias:  esTraceStore.ElasticSearchAlias,
+		ElasticActiveAlias:  esTraceStore.ElasticActiveAlias,
+		Engine:              esTraceStore.Engine,
+		Logger:              logger,
+		ILMPolicy:           DefaultILMPolicy,
+		Shards:              KeepSetting,
+		Replicas:            KeepSetting,
+		TotalShardsPerNode:  KeepSetting,
+		Rollover:            RolloverConditions{MaxAge: DefaultRolloverMaxAge, MaxSize: DefaultRolloverMaxSize},
+	}
+}
+
+// templateName is the name of the index template, after the active alias as in the original setup script
+func (bootstrap *Bootstrap) templateName() string {
+	return bootstrap.ElasticActiveAlias
+}
+
+// indexPattern matches every index that was ever behind the active alias
+func (bootstrap *Bootstrap) indexPattern() string {
+	return bootstrap.ElasticActiveAlias + "-*"
+}
+
+// Run brings the trace indices to SchemaVersion and returns the version they were at before. It is safe to run
+// concurrently from several instances of the service
+func (bootstrap *Bootstrap) Run(ctx context.Context) (int, error) {
+	version, err := bootstrap.SchemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if version > SchemaVersion {
+		bootstrap.Logger.Error("Run(): The trace index schema is newer than this service", zap.Int("schema_version", version), zap.Int("supported_version", SchemaVersion))
+		return version, ErrSchemaTooNew
+	}
+
+	for _, migration := range Migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		bootstrap.Logger.Info("Run(): Applying schema migration", zap.Int("version", migration.Version), zap.String("description", migration.Description))
+
+		if err := migration.Apply(ctx, bootstrap); err != nil {
+			bootstrap.Logger.Error("Run(): Schema migration failed", zap.Int("version", migration.Version), zap.Error(err))
+			return version, ErrCouldNotMigrateSchema
+		}
+
+		if err := bootstrap.putTemplate(ctx, migration.Version); err != nil {
+			bootstrap.Logger.Error("Run(): Could not store the schema version", zap.Int("version", migration.Version), zap.Error(err))
+			return version, ErrCouldNotMigrateSchema
+		}
+	}
+
+	// The policy, the template and the first index are ensured on every start, so that changed settings are
+	// applied and an alias removed by hand is recreated
+	if err := bootstrap.putILMPolicy(ctx); err != nil {
+		bootstrap.Logger.Error("Run(): Could not install the ILM policy", zap.Error(err))
+		return version, ErrCouldNotMigrateSchema
+	}
+
+	if err := bootstrap.putTemplate(ctx, SchemaVersion); err != nil {
+		bootstrap.Logger.Error("Run(): Could not install the index template", zap.Error(err))
+		return version, ErrCouldNotMigrateSchema
+	}
+
+	if err := bootstrap.createFirstIndex(ctx); err != nil {
+		bootstrap.Logger.Error("Run(): Could not create the first trace index", zap.Error(err))
+		return version, ErrCouldNotMigrateSchema
+	}
+
+	return version, nil
+}
+
+// SchemaVersion returns the schema version stored in the index template, 0 if there is no template
+func (bootstrap *Bootstrap) SchemaVersion(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	templates, err := bootstrap.ElasticSearchClient.IndexGetTemplate(bootstrap.templateName()).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		bootstrap.Logger.Error("SchemaVersion(): Could not get the index template", zap.Error(err))
+		return 0, ErrCouldNotMigrateSchema
+	}
+
+	template, ok := templates[bootstrap.templateName()]
+	if !ok {
+		return 0, nil
+	}
+
+	return template.Version, nil
+}
+
+// settingName is the name of an index setting without the optional index. prefix, under which the cluster
+// returns every setting
+func settingName(name string) string {
+	return strings.TrimPrefix(name, "index.")
+}
+
+// flattenSettings adds the nested settings of a template to flat under their dotted names
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for name, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettings(prefix+name+".", nested, flat)
+			continue
+		}
+
+		flat[prefix+name] = value
+	}
+}
+
+// existingSettings returns the flattened settings of the installed index template, none if there is no template
+func (bootstrap *Bootstrap) existingSettings(ctx context.Context) (map[string]interface{}, error) {
+	templates, err := bootstrap.ElasticSearchClient.IndexGetTemplate(bootstrap.templateName()).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return map[string]interface{}{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{})
+	if template, ok := templates[bootstrap.templateName()]; ok {
+		flattenSettings("", template.Settings, settings)
+	}
+
+	return settings, nil
+}
+
+// settings returns the index settings of the template, the existing settings with the ones of the bootstrap
+func (bootstrap *Bootstrap) settings(existing map[string]interface{}) map[string]interface{} {
+	settings := make(map[string]interface{}, len(existing))
+	for name, value := range existing {
+		settings[name] = value
+	}
+
+	has := func(name string) bool {
+		for existingName := range settings {
+			if settingName(existingName) == settingName(name) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	remove := func(name string) {
+		for existingName := range settings {
+			if settingName(existingName) == settingName(name) {
+				delete(settings, existingName)
+			}
+		}
+	}
+
+	configured := []struct {
+		name     string
+		value    int
+		fallback int
+	}{
+		{"number_of_shards", bootstrap.Shards, DefaultShards},
+		{"number_of_replicas", bootstrap.Replicas, DefaultReplicas},
+		{"routing.allocation.total_shards_per_node", bootstrap.TotalShardsPerNode, DefaultTotalShardsPerNode},
+	}
+
+	for _, setting := range configured {
+		if setting.value != KeepSetting {
+			remove(setting.name)
+			settings[setting.name] = setting.value
+		} else if !has(setting.name) {
+			settings[setting.name] = setting.fallback
+		}
+	}
+
+	// Without a policy the lifecycle settings of a previous start are removed, so that ILM does not roll the indices
+	// over alongside the rollover manager
+	for name, value := range bootstrap.Engine.LifecycleSettings(bootstrap.ILMPolicy, bootstrap.ElasticActiveAlias) {
+		remove(name)
+
+		if bootstrap.ILMPolicy != "" {
+			settings[name] = value
+		}
+	}
+
+	return settings
+}
+
+// putTemplate installs the index template with version as its schema version, keeping the settings of the installed
+// template that the bootstrap does not set
+func (bootstrap *Bootstrap) putTemplate(ctx context.Context, version int) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	existing, err := bootstrap.existingSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{bootstrap.indexPattern()},
+		"version":        version,
+		"settings":       bootstrap.settings(existing),
+		"aliases":        map[string]interface{}{bootstrap.ElasticSearchAlias: map[string]interface{}{}},
+		"mappings":       traceMappings,
+	}
+
+	_, err = bootstrap.ElasticSearchClient.IndexPutTemplate(bootstrap.templateName()).BodyJson(template).Do(ctx)
+
+	return err
+}
+
+// putILMPolicy installs the ILM policy that rolls the active index over on the Rollover conditions
+func (bootstrap *Bootstrap) putILMPolicy(ctx context.Context) error {
+	if bootstrap.ILMPolicy == "" || bootstrap.Rollover.Empty() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	return bootstrap.Engine.PutLifecyclePolicy(ctx, bootstrap.ElasticSearchClient, bootstrap.ILMPolicy, bootstrap.indexPattern(), bootstrap.Rollover)
+}
+
+// createFirstIndex creates the -000001 index as the write index of the active alias, unless the alias exists
+func (bootstrap *Bootstrap) createFirstIndex(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	exists, err := bootstrap.ElasticSearchClient.IndexExists(bootstrap.ElasticActiveAlias).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"aliases": map[string]interface{}{
+			bootstrap.ElasticActiveAlias: map[string]interface{}{"is_write_index": true},
+		},
+	}
+
+	index := bootstrap.ElasticActiveAlias + FirstIndexSuffix
+
+	// Another instance might have created the index in the meantime
+	if _, err := bootstrap.ElasticSearchClient.CreateIndex(index).BodyJson(body).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+		return err
+	}
+
+	bootstrap.Logger.Info("createFirstIndex(): Created the first trace index", zap.String("index", index))
+
+	return nil
+}
+
+// upgradeIndices adds the current mapping and the search alias to the indices created before the template, updates
+// their documents so that the new sub-fields are indexed, and attaches the indices behind the active alias to the
+// ILM policy
+func (bootstrap *Bootstrap) upgradeIndices(parent context.Context) error {
+	ctx, cancel := context.WithTimeout(parent, CtxTimeout)
+	defer cancel()
+
+	settings, err := bootstrap.ElasticSearchClient.IndexGetSettings(bootstrap.indexPattern()).Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(settings) == 0 {
+		return nil
+	}
+
+	var indices []string
+	for index := range settings {
+		indices = append(indices, index)
+	}
+
+	sort.Strings(indices)
+
+	if _, err := bootstrap.ElasticSearchClient.PutMapping().Index(indices...).BodyJson(traceMappings).Do(ctx); err != nil {
+		return fmt.Errorf("Could not update the mapping of %v: %s", indices, err)
+	}
+
+	if err := bootstrap.updateKeywords(parent, indices); err != nil {
+		return err
+	}
+
+	aliases := bootstrap.ElasticSearchClient.Alias()
+	for _, index := range indices {
+		aliases.Add(index, bootstrap.ElasticSearchAlias)
+	}
+
+	if _, err := aliases.Do(ctx); err != nil {
+		return err
+	}
+
+	if bootstrap.ILMPolicy == "" {
+		return nil
+	}
+
+	// Indices that were rolled over by hand are not attached, ILM would try to roll them over again
+	active, err := bootstrap.ElasticSearchClient.Aliases().Alias(bootstrap.ElasticActiveAlias).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	writeIndices := active.IndicesByAlias(bootstrap.ElasticActiveAlias)
+	if len(writeIndices) == 0 {
+		return nil
+	}
+
+	return bootstrap.Engine.AttachLifecycle(ctx, bootstrap.ElasticSearchClient, writeIndices, bootstrap.ILMPolicy, bootstrap.ElasticActiveAlias)
+}
+
+// updateKeywords updates the documents of indices that miss the keyword sub-field of app_name or type, because they
+// were indexed before the mapping had it, and waits until the update by query is done. Only the documents that still
+// miss a sub-field are updated, so an interrupted update continues where it stopped
+func (bootstrap *Bootstrap) updateKeywords(ctx context.Context, indices []string) error {
+	query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+		elastic.NewBoolQuery().Must(elastic.NewExistsQuery("app_name")).MustNot(elastic.NewExistsQuery("app_name.keyword")),
+		elastic.NewBoolQuery().Must(elastic.NewExistsQuery("type")).MustNot(elastic.NewExistsQuery("type.keyword")),
+	)
+
+	startCtx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	task, err := bootstrap.ElasticSearchClient.UpdateByQuery(indices...).Query(query).Conflicts("proceed").Slices("auto").DoAsync(startCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Could not start updating the documents of %v: %s", indices, err)
+	}
+
+	bootstrap.Logger.Info("upgradeIndices(): Updating the documents without keyword sub-fields", zap.String("task_id", task.TaskId))
+
+	ticker := time.NewTicker(updatePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		pollCtx, cancel := context.WithTimeout(ctx, CtxTimeout)
+		response, err := bootstrap.ElasticSearchClient.PerformRequest(pollCtx, elastic.PerformRequestOptions{
+			Method: "GET",
+			Path:   "/_tasks/" + url.PathEscape(task.TaskId),
+		})
+		cancel()
+		if err != nil {
+			// The task keeps running, a failed poll is retried
+			bootstrap.Logger.Warn("upgradeIndices(): Could not get the update task", zap.String("task_id", task.TaskId), zap.Error(err))
+			continue
+		}
+
+		var progress esTaskResponse
+		if err := json.Unmarshal(response.Body, &progress); err != nil {
+			return fmt.Errorf("Could not decode the update task %s: %s", task.TaskId, err)
+		}
+
+		if !progress.Completed {
+			continue
+		}
+
+		if progress.Error != nil {
+			return fmt.Errorf("Could not update the documents of %v: %s: %s", indices, progress.Error.Type, progress.Error.Reason)
+		}
+
+		if progress.Response != nil && len(progress.Response.Failures) > 0 {
+			return fmt.Errorf("Could not update the documents of %v: %s", indices, strings.Join(deleteFailures(progress.Response), ", "))
+		}
+
+		return nil
+	}
+}
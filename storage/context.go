@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	DefaultContextSize = 10
+	MaxContextSize     = 500
+	ContextSameAppName = "app_name"
+	ContextSameType    = "type"
+)
+
+// Errors that might be returned by the context functions
+var (
+	ErrTraceNotFound = errors.New("Could not retreive device trace by this ID")
+)
+
+// contextSameFields lists the fields that neighbours can be required to share with the anchor
+var contextSameFields = map[string]func(query *TraceQuery, anchor Trace){
+	ContextSameAppName: func(query *TraceQuery, anchor Trace) { query.AppName = anchor.AppName },
+	ContextSameType:    func(query *TraceQuery, anchor Trace) { query.Type = anchor.Type },
+}
+
+// TraceContextStore is implemented by the trace stores that can list the neighbours of a trace on its device
+type TraceContextStore interface {
+	ContextDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query ContextQuery) (TraceContext, error)
+}
+
+// ContextQuery specifies the anchor trace and the window of neighbours around it. The filters of the embedded
+// TraceQuery apply to the neighbours only, they are always taken from the device of the anchor
+type ContextQuery struct {
+	TraceQuery
+	BeforeSize uint64   `json:"before_size"`
+	AfterSize  uint64   `json:"after_size"`
+	Same       []string `json:"same"`
+}
+
+// TraceContext specifies the return result of a context query. Before and After are ordered by device timestamp,
+// oldest first, so that Before, Anchor and After read as one sequence
+type TraceContext struct {
+	Object        string          `json:"object"`
+	Anchor        TraceResponse   `json:"anchor"`
+	Before        []TraceResponse `json:"before"`
+	After         []TraceResponse `json:"after"`
+	HasMoreBefore bool            `json:"has_more_before"`
+	HasMoreAfter  bool            `json:"has_more_after"`
+}
+
+// IsContextSameField reports whether field can be used in same
+func IsContextSameField(field string) bool {
+	_, ok := contextSameFields[field]
+
+	return ok
+}
+
+// neighbourQuery returns the filters that the neighbours of anchor must match
+func (query ContextQuery) neighbourQuery(anchor Trace) TraceQuery {
+	neighbourQuery := query.TraceQuery
+	neighbourQuery.ID = ""
+	neighbourQuery.Device = []string{anchor.DeviceID}
+
+	for _, field := range query.Same {
+		if same, ok := contextSameFields[field]; ok {
+			same(&neighbourQuery, anchor)
+		}
+	}
+
+	return neighbourQuery
+}
+
+// decodeTraceHits decodes the trace documents of a search response
+func decodeTraceHits(hits *elastic.SearchHits) ([]Trace, error) {
+	if hits == nil {
+		return []Trace{}, nil
+	}
+
+	traces := make([]Trace, 0, len(hits.Hits))
+
+	for _, hit := range hits.Hits {
+		var trace Trace
+
+		if err := json.Unmarshal(hit.Source, &trace); err != nil {
+			return nil, err
+		}
+
+		traces = append(traces, trace)
+	}
+
+	return traces, nil
+}
+
+// contextWindow converts the neighbours returned by a search into responses. It reports whether there were more
+// than size neighbours and reverses the order if the search walked back in time
+func contextWindow(traces []Trace, size uint64, reverse bool) ([]TraceResponse, bool) {
+	hasMore := uint64(len(traces)) > size
+	if hasMore {
+		traces = traces[:size]
+	}
+
+	window := make([]TraceResponse, len(traces))
+
+	for i, trace := range traces {
+		if reverse {
+			window[len(traces)-1-i] = NewTraceResponse(trace)
+		} else {
+			window[i] = NewTraceResponse(trace)
+		}
+	}
+
+	return window, hasMore
+}
+
+// ContextDeviceTrace returns the trace with query.ID and the traces logged right before and after it on the same
+// device, ordered by device timestamp. Traces with the same timestamp are ordered by id
+func (esTraceStore *ESTraceStore) ContextDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query ContextQuery) (TraceContext, error) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore.ContextDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "ContextDeviceTrace()"))
+
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
+	// Resolve the anchor trace
+	anchorSearch := esTraceStore.ElasticSearchClient.Search().
+		Index(indices...).
+		Query(buildESBoolQuery(TraceQuery{Account: query.Account, ID: query.ID})).
+		Size(1)
+
+	if routing != "" {
+		anchorSearch.Routing(routing)
+	}
+
+	anchorResult, err := anchorSearch.Do(ctx)
+	if err != nil {
+		logger.Warn("Error executing anchor query", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "anchor query failed"),
+			trace_log.Error(err),
+		)
+
+		return TraceContext{}, ErrCouldNotQueryLogs
+	}
+
+	anchors, err := decodeTraceHits(anchorResult.Hits)
+	if err != nil {
+		logger.Warn("Error decoding response as trace data", zap.Error(err))
+
+		return TraceContext{}, ErrCouldNotUnmarshalLogs
+	}
+
+	if len(anchors) == 0 {
+		return TraceContext{}, ErrTraceNotFound
+	}
+
+	anchor := anchors[0]
+
+	// The neighbours are searched from the anchor outwards on both sides
+	esQuery := buildESBoolQuery(query.neighbourQuery(anchor))
+
+	span.LogFields(
+		trace_log.String("event", "build es query"),
+		trace_log.String("message", "context query prepared"),
+		trace_log.Object("esQuery", esQuery),
+	)
+
+	neighbours := func(size uint64, ascending bool) *elastic.SearchRequest {
+		request := elastic.NewSearchRequest().
+			Index(indices...).
+			Query(esQuery).
+			Sort("timestamp", ascending).
+			Sort("id", ascending).
+			SearchAfter(anchor.Timestamp, anchor.ID).
+			Size(int(size) + 1) // ask for one more result than necessary to populate has_more
+
+		if routing != "" {
+			request.Routing(routing)
+		}
+
+		return request
+	}
+
+	result, err := esTraceStore.ElasticSearchClient.MultiSearch().
+		Add(neighbours(query.BeforeSize, false), neighbours(query.AfterSize, true)).
+		Do(ctx)
+	if err == nil && len(result.Responses) != 2 {
+		err = errors.New("unexpected number of responses")
+	}
+
+	if err == nil {
+		for _, response := range result.Responses {
+			if response.Error != nil {
+				err = errors.New(response.Error.Reason)
+			}
+		}
+	}
+
+	if err != nil {
+		logger.Warn("Error executing context query", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "context query failed"),
+			trace_log.Error(err),
+		)
+
+		return TraceContext{}, ErrCouldNotQueryLogs
+	}
+
+	before, err := decodeTraceHits(result.Responses[0].Hits)
+	if err != nil {
+		logger.Warn("Error decoding response as trace data", zap.Error(err))
+
+		return TraceContext{}, ErrCouldNotUnmarshalLogs
+	}
+
+	after, err := decodeTraceHits(result.Responses[1].Hits)
+	if err != nil {
+		logger.Warn("Error decoding response as trace data", zap.Error(err))
+
+		return TraceContext{}, ErrCouldNotUnmarshalLogs
+	}
+
+	traceContext := TraceContext{
+		Object: "device-trace-context",
+		Anchor: NewTraceResponse(anchor),
+	}
+
+	traceContext.Before, traceContext.HasMoreBefore = contextWindow(before, query.BeforeSize, true)
+	traceContext.After, traceContext.HasMoreAfter = contextWindow(after, query.AfterSize, false)
+
+	return traceContext, nil
+}
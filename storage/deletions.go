@@ -0,0 +1,456 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	MaxDeletionListLimit = 1000
+	maxDeletionFailures  = 10
+)
+
+// Errors that might be returned by the deletion functions
+var (
+	ErrCouldNotDeleteLogs       = errors.New("Failed to delete the trace logs")
+	ErrCouldNotGetDeleteTask    = errors.New("Failed to retrieve the status of the delete task")
+	ErrDeleteTaskNotFound       = errors.New("Could not find the delete task")
+	ErrDeletionNotFound         = errors.New("Could not retreive deletion by this ID")
+	ErrCouldNotSaveDeletion     = errors.New("Failed to store the deletion")
+	ErrCouldNotQueryDeletions   = errors.New("Failed to query the deletions")
+	ErrCouldNotInitDeletionList = errors.New("Failed to create the deletion index")
+)
+
+// DeleteProgress is the progress of a delete task
+type DeleteProgress struct {
+	Completed        bool
+	Total            int64
+	Deleted          int64
+	VersionConflicts int64
+	Failures         []string
+}
+
+// TraceDeleteStore is implemented by the trace stores that can delete traces
+type TraceDeleteStore interface {
+	// DeleteDeviceTrace deletes the traces matching query and waits until they are gone
+	DeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (DeleteProgress, error)
+	// StartDeleteDeviceTrace starts deleting the traces matching query in the background and returns the id of the task
+	StartDeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (string, error)
+	// DeleteTaskProgress returns the progress of a task started by StartDeleteDeviceTrace
+	DeleteTaskProgress(parentSpan opentracing.Span, ctx context.Context, taskID string) (DeleteProgress, error)
+}
+
+// esTaskResponse is the response of the elastic search task API for a delete by query task
+type esTaskResponse struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status struct {
+			Total            int64 `json:"total"`
+			Deleted          int64 `json:"deleted"`
+			VersionConflicts int64 `json:"version_conflicts"`
+		} `json:"status"`
+	} `json:"task"`
+	Response *elastic.BulkIndexByScrollResponse `json:"response,omitempty"`
+	Error    *elastic.ErrorDetails              `json:"error,omitempty"`
+}
+
+func (esTraceStore *ESTraceStore) deleteByQuery(query TraceQuery) *elastic.DeleteByQueryService {
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
+	deleteByQuery := esTraceStore.ElasticSearchClient.DeleteByQuery(indices...).
+		Query(buildESBoolQuery(query)).
+		ProceedOnVersionConflict().
+		Refresh("true")
+
+	if routing != "" {
+		deleteByQuery.Routing(routing)
+	}
+
+	return deleteByQuery
+}
+
+// checkExactTypes checks that the keyword sub-field of type exists if query matches type names exactly. Without it
+// the excluded types would not be excluded, and the traces of every type would be deleted
+func (esTraceStore *ESTraceStore) checkExactTypes(ctx context.Context, query TraceQuery) error {
+	if query.Types == nil && len(query.ExcludeTypes) == 0 {
+		return nil
+	}
+
+	return esTraceStore.CheckKeywordFields(ctx, TypeKeywordField)
+}
+
+// deleteFailures describes up to maxDeletionFailures failures of a delete by query
+func deleteFailures(response *elastic.BulkIndexByScrollResponse) []string {
+	var failures []string
+
+	for _, failure := range response.Failures {
+		if len(failures) == maxDeletionFailures {
+			break
+		}
+
+		failures = append(failures, fmt.Sprintf("%s/%s: status %d", failure.Index, failure.Id, failure.Status))
+	}
+
+	return failures
+}
+
+// DeleteDeviceTrace deletes the traces matching query and waits until they are gone
+func (esTraceStore *ESTraceStore) DeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (DeleteProgress, error) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore.DeleteDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "DeleteDeviceTrace()"))
+
+	if err := esTraceStore.checkExactTypes(ctx, query); err != nil {
+		return DeleteProgress{}, err
+	}
+
+	response, err := esTraceStore.deleteByQuery(query).Do(ctx)
+	if err != nil {
+		logger.Warn("Error executing delete by query", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "delete by query failed"),
+			trace_log.Error(err),
+		)
+
+		return DeleteProgress{}, ErrCouldNotDeleteLogs
+	}
+
+	return DeleteProgress{
+		Completed:        true,
+		Total:            response.Total,
+		Deleted:          response.Deleted,
+		VersionConflicts: response.VersionConflicts,
+		Failures:         deleteFailures(response),
+	}, nil
+}
+
+// StartDeleteDeviceTrace starts a delete by query task for the traces matching query
+func (esTraceStore *ESTraceStore) StartDeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (string, error) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore.StartDeleteDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "StartDeleteDeviceTrace()"))
+
+	if err := esTraceStore.checkExactTypes(ctx, query); err != nil {
+		return "", err
+	}
+
+	task, err := esTraceStore.deleteByQuery(query).Slices("auto").DoAsync(ctx)
+	if err != nil {
+		logger.Warn("Error starting delete by query task", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "delete by query task failed to start"),
+			trace_log.Error(err),
+		)
+
+		return "", ErrCouldNotDeleteLogs
+	}
+
+	span.SetTag("task_id", task.TaskId)
+
+	return task.TaskId, nil
+}
+
+// DeleteTaskProgress returns the progress of a delete by query task from the elastic search task API
+func (esTraceStore *ESTraceStore) DeleteTaskProgress(parentSpan opentracing.Span, ctx context.Context, taskID string) (DeleteProgress, error) {
+	span := opentracing.StartSpan(
+		"ESTraceStore.DeleteTaskProgress",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	span.SetTag("task_id", taskID)
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("task_id", taskID)).With(zap.String("function", "DeleteTaskProgress()"))
+
+	response, err := esTraceStore.ElasticSearchClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_tasks/" + url.PathEscape(taskID),
+	})
+	if elastic.IsNotFound(err) {
+		return DeleteProgress{}, ErrDeleteTaskNotFound
+	} else if err != nil {
+		logger.Warn("Error retrieving delete task", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "task request failed"),
+			trace_log.Error(err),
+		)
+
+		return DeleteProgress{}, ErrCouldNotGetDeleteTask
+	}
+
+	var task esTaskResponse
+	if err := json.Unmarshal(response.Body, &task); err != nil {
+		logger.Warn("Error decoding delete task", zap.Error(err))
+
+		return DeleteProgress{}, ErrCouldNotGetDeleteTask
+	}
+
+	progress := DeleteProgress{
+		Completed:        task.Completed,
+		Total:            task.Task.Status.Total,
+		Deleted:          task.Task.Status.Deleted,
+		VersionConflicts: task.Task.Status.VersionConflicts,
+	}
+
+	if task.Response != nil {
+		progress.Total = task.Response.Total
+		progress.Deleted = task.Response.Deleted
+		progress.VersionConflicts = task.Response.VersionConflicts
+		progress.Failures = deleteFailures(task.Response)
+	}
+
+	if task.Error != nil {
+		progress.Failures = append(progress.Failures, strings.TrimSpace(task.Error.Type+": "+task.Error.Reason))
+	}
+
+	return progress, nil
+}
+
+// deletionMapping is the mapping of the deletion index. The query and the filters are stored but not indexed
+const deletionMapping = `{
+	"mappings": {
+		"properties": {
+			"id":            {"type": "keyword"},
+			"object":        {"type": "keyword"},
+			"account_id":    {"type": "keyword"},
+			"request_id":    {"type": "keyword"},
+			"status":        {"type": "keyword"},
+			"filters":       {"type": "object", "enabled": false},
+			"query":         {"type": "object", "enabled": false},
+			"task_id":       {"type": "keyword"},
+			"total_count":   {"type": "long"},
+			"deleted_count": {"type": "long"},
+			"failures":      {"type": "text", "index": false},
+			"created_at":    {"type": "date"},
+			"updated_at":    {"type": "date"},
+			"completed_at":  {"type": "date"}
+		}
+	}
+}`
+
+// Deletion is a request to delete traces and its outcome. Deletions are kept as the audit trail of deleted traces
+type Deletion struct {
+	ID           string            `json:"id"`
+	Object       string            `json:"object"`
+	AccountID    string            `json:"account_id"`
+	RequestID    string            `json:"request_id"`
+	Status       string            `json:"status"`
+	Filters      map[string]string `json:"filters"`
+	Query        TraceQuery        `json:"query"`
+	TaskID       string            `json:"task_id,omitempty"`
+	TotalCount   int64             `json:"total_count"`
+	DeletedCount int64             `json:"deleted_count"`
+	Failures     []string          `json:"failures,omitempty"`
+	CreatedAt    string            `json:"created_at"`
+	UpdatedAt    string            `json:"updated_at"`
+	CompletedAt  string            `json:"completed_at,omitempty"`
+}
+
+// DeletionStore specifies the functions that a store of deletions should have. Deletions are never removed
+type DeletionStore interface {
+	SaveDeletion(parentSpan opentracing.Span, ctx context.Context, deletion Deletion) error
+	GetDeletion(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (Deletion, error)
+	// ListDeletions returns up to limit deletions of accountID with an id before after, newest first
+	ListDeletions(parentSpan opentracing.Span, ctx context.Context, accountID string, limit int, after string) ([]Deletion, bool, error)
+	// ListDeletionsWithStatus returns up to limit deletions of every account with status
+	ListDeletionsWithStatus(parentSpan opentracing.Span, ctx context.Context, status string, limit int) ([]Deletion, error)
+}
+
+// ESDeletionStore implements DeletionStore on a dedicated elastic search index
+type ESDeletionStore struct {
+	ElasticSearchClient *elastic.Client
+	ElasticSearchIndex  string
+	Logger              *zap.Logger
+}
+
+// NewESDeletionStore returns an ESDeletionStore on index and creates the index if it does not exist yet
+func NewESDeletionStore(logger *zap.Logger, client *elastic.Client, index string) (*ESDeletionStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+	defer cancel()
+
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		logger.Error("NewESDeletionStore(): Could not check the deletion index", zap.Error(err))
+		return nil, ErrCouldNotInitDeletionList
+	}
+
+	if !exists {
+		if _, err := client.CreateIndex(index).BodyString(deletionMapping).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+			logger.Error("NewESDeletionStore(): Could not create the deletion index", zap.Error(err))
+			return nil, ErrCouldNotInitDeletionList
+		}
+	}
+
+	return &ESDeletionStore{ElasticSearchClient: client, ElasticSearchIndex: index, Logger: logger}, nil
+}
+
+func (store *ESDeletionStore) startSpan(parentSpan opentracing.Span, ctx context.Context, function string) (opentracing.Span, *zap.Logger) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, store.Logger)
+
+	span := opentracing.StartSpan(
+		"ESDeletionStore."+function,
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+
+	logger := edge_log.WithContext(ctx, store.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", function+"()"))
+
+	return span, logger
+}
+
+// SaveDeletion creates or replaces a deletion
+func (store *ESDeletionStore) SaveDeletion(parentSpan opentracing.Span, ctx context.Context, deletion Deletion) error {
+	span, logger := store.startSpan(parentSpan, ctx, "SaveDeletion")
+	defer span.Finish()
+
+	_, err := store.ElasticSearchClient.Index().
+		Index(store.ElasticSearchIndex).
+		Id(deletion.ID).
+		BodyJson(deletion).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logger.Warn("Error storing deletion", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "index request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotSaveDeletion
+	}
+
+	return nil
+}
+
+// GetDeletion returns the deletion with id if it belongs to accountID
+func (store *ESDeletionStore) GetDeletion(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (Deletion, error) {
+	span, logger := store.startSpan(parentSpan, ctx, "GetDeletion")
+	defer span.Finish()
+
+	result, err := store.ElasticSearchClient.Get().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return Deletion{}, ErrDeletionNotFound
+	} else if err != nil {
+		logger.Warn("Error retrieving deletion", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "get request failed"),
+			trace_log.Error(err),
+		)
+
+		return Deletion{}, ErrCouldNotQueryDeletions
+	}
+
+	var deletion Deletion
+	if err := json.Unmarshal(result.Source, &deletion); err != nil {
+		logger.Warn("Error decoding deletion", zap.Error(err))
+
+		return Deletion{}, ErrCouldNotUnmarshalLogs
+	}
+
+	if deletion.AccountID != accountID {
+		return Deletion{}, ErrDeletionNotFound
+	}
+
+	return deletion, nil
+}
+
+func (store *ESDeletionStore) search(span opentracing.Span, logger *zap.Logger, ctx context.Context, query elastic.Query, limit int, after string) ([]Deletion, bool, error) {
+	search := store.ElasticSearchClient.Search().
+		Index(store.ElasticSearchIndex).
+		Query(query).
+		Sort("id", false).
+		Size(limit + 1)
+
+	if after != "" {
+		search.SearchAfter(after)
+	}
+
+	result, err := search.Do(ctx)
+	if err != nil {
+		logger.Warn("Error listing deletions", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "search query failed"),
+			trace_log.Error(err),
+		)
+
+		return nil, false, ErrCouldNotQueryDeletions
+	}
+
+	deletions := make([]Deletion, 0, len(result.Hits.Hits))
+
+	for i, hit := range result.Hits.Hits {
+		if i >= limit {
+			break
+		}
+
+		var deletion Deletion
+
+		if err := json.Unmarshal(hit.Source, &deletion); err != nil {
+			logger.Warn("Error decoding deletion", zap.Error(err))
+
+			return nil, false, ErrCouldNotUnmarshalLogs
+		}
+
+		deletions = append(deletions, deletion)
+	}
+
+	return deletions, len(result.Hits.Hits) > limit, nil
+}
+
+// ListDeletions returns up to limit deletions of accountID with an id before after, newest first
+func (store *ESDeletionStore) ListDeletions(parentSpan opentracing.Span, ctx context.Context, accountID string, limit int, after string) ([]Deletion, bool, error) {
+	span, logger := store.startSpan(parentSpan, ctx, "ListDeletions")
+	defer span.Finish()
+
+	return store.search(span, logger, ctx, elastic.NewTermQuery("account_id", accountID), limit, after)
+}
+
+// ListDeletionsWithStatus returns up to limit deletions of every account with status, newest first
+func (store *ESDeletionStore) ListDeletionsWithStatus(parentSpan opentracing.Span, ctx context.Context, status string, limit int) ([]Deletion, error) {
+	span, logger := store.startSpan(parentSpan, ctx, "ListDeletionsWithStatus")
+	defer span.Finish()
+
+	deletions, _, err := store.search(span, logger, ctx, elastic.NewTermQuery("status", status), limit, "")
+
+	return deletions, err
+}
@@ -0,0 +1,646 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	DiskTraceDB = "traces.db"
+
+	// DiskDeleteBatch is the number of traces that a transaction of DeleteDeviceTrace deletes
+	DiskDeleteBatch = 1000
+	// DiskMaxIndexDays is the longest time range in days that a search reads from the index of the days, the traces
+	// of longer time ranges are filtered by their timestamp
+	DiskMaxIndexDays = 31
+
+	diskTaskPrefix      = "disk-"
+	diskDayMilliseconds = int64(24 * time.Hour / time.Millisecond)
+)
+
+// Buckets of the trace database. Traces holds the traces by id, the others are the indexes of the traces, whose keys
+// end with the id of the trace
+var (
+	diskTraces   = []byte("traces")
+	diskAccounts = []byte("accounts")
+	diskDevices  = []byte("devices")
+	diskDays     = []byte("days")
+	diskWords    = []byte("words")
+	diskValues   = []byte("values")
+)
+
+// Errors that might be returned by DiskTraceStore
+var (
+	ErrCouldNotOpenTraceDB = errors.New("Failed to open the trace database")
+	ErrCouldNotWriteLogs   = errors.New("Failed to write the trace logs")
+)
+
+// DiskTraceStore implements TraceStore on a single node, in the bbolt database traces.db in Dir. The traces are
+// stored by id, and indexed on disk by account, by device, by account and day of their timestamp, by the words of
+// app_name, type and message and by the value of type, which are matched like MemoryTraceStore matches them.
+//
+// Every index lists the ids of its traces in order, so a search walks the indexes of its filters together in the order
+// of the ids from the cursor on and stops at the end of the page. Its memory use does not depend on the number of
+// traces, but a total count reads every trace that the indexes match. Deleted traces free their pages for new traces,
+// the database file does not shrink
+type DiskTraceStore struct {
+	Dir    string
+	Logger *zap.Logger
+
+	db *bolt.DB
+}
+
+// NewDiskTraceStore opens the trace database in dir, creating dir and the database if needed
+func NewDiskTraceStore(logger *zap.Logger, dir string) (*DiskTraceStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		logger.Error("NewDiskTraceStore(): Could not create the trace database directory", zap.String("dir", dir), zap.Error(err))
+		return nil, ErrCouldNotOpenTraceDB
+	}
+
+	// Another process holding the database would block the open forever
+	db, err := bolt.Open(filepath.Join(dir, DiskTraceDB), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		logger.Error("NewDiskTraceStore(): Could not open the trace database", zap.String("dir", dir), zap.Error(err))
+		return nil, ErrCouldNotOpenTraceDB
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{diskTraces, diskAccounts, diskDevices, diskDays, diskWords, diskValues} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		logger.Error("NewDiskTraceStore(): Could not create the buckets of the trace database", zap.String("dir", dir), zap.Error(err))
+		return nil, ErrCouldNotOpenTraceDB
+	}
+
+	return &DiskTraceStore{Dir: dir, Logger: logger, db: db}, nil
+}
+
+// diskPrefix joins parts into an index key prefix, each followed by a zero byte
+func diskPrefix(parts ...string) []byte {
+	var prefix []byte
+	for _, part := range parts {
+		prefix = append(prefix, part...)
+		prefix = append(prefix, 0)
+	}
+
+	return prefix
+}
+
+// diskDay returns the day of a timestamp in milliseconds
+func diskDay(milliseconds int64) int64 {
+	day := milliseconds / diskDayMilliseconds
+	if milliseconds%diskDayMilliseconds < 0 {
+		day--
+	}
+
+	return day
+}
+
+// diskDayPrefix returns the prefix of the traces of account in the index of the days, whose days sort in order
+func diskDayPrefix(account string, day int64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(day)^1<<63)
+
+	prefix := diskPrefix(account)
+	prefix = append(prefix, encoded[:]...)
+
+	return append(prefix, 0)
+}
+
+// diskIndexKey is an entry of an index bucket
+type diskIndexKey struct {
+	Bucket []byte
+	Key    []byte
+}
+
+// diskIndexKeys returns the index entries of trace
+func diskIndexKeys(trace Trace) []diskIndexKey {
+	id := []byte(trace.ID)
+	key := func(bucket []byte, prefix []byte) diskIndexKey {
+		return diskIndexKey{Bucket: bucket, Key: append(prefix, id...)}
+	}
+
+	keys := []diskIndexKey{
+		key(diskAccounts, diskPrefix(trace.AccountID)),
+		key(diskDevices, diskPrefix(trace.DeviceID)),
+		key(diskDays, diskDayPrefix(trace.AccountID, diskDay(trace.Timestamp))),
+		key(diskValues, diskPrefix("type", trace.Type)),
+	}
+
+	for _, field := range []struct{ name, text string }{{"app_name", trace.AppName}, {"type", trace.Type}, {"message", trace.Message}} {
+		seen := make(map[string]bool)
+
+		for _, token := range textTokens(field.text) {
+			if !seen[token] {
+				seen[token] = true
+				keys = append(keys, key(diskWords, diskPrefix(field.name, token)))
+			}
+		}
+	}
+
+	return keys
+}
+
+// put stores trace and its index entries, replacing a trace with the same id like an elastic search document
+func (diskTraceStore *DiskTraceStore) put(tx *bolt.Tx, trace Trace) error {
+	if _, err := diskTraceStore.remove(tx, []byte(trace.ID)); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(diskTraces).Put([]byte(trace.ID), value); err != nil {
+		return err
+	}
+
+	for _, index := range diskIndexKeys(trace) {
+		if err := tx.Bucket(index.Bucket).Put(index.Key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the trace with id and its index entries, and reports whether there was one
+func (diskTraceStore *DiskTraceStore) remove(tx *bolt.Tx, id []byte) (bool, error) {
+	value := tx.Bucket(diskTraces).Get(id)
+	if value == nil {
+		return false, nil
+	}
+
+	var trace Trace
+	if err := json.Unmarshal(value, &trace); err != nil {
+		return false, err
+	}
+
+	for _, index := range diskIndexKeys(trace) {
+		if err := tx.Bucket(index.Bucket).Delete(index.Key); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Bucket(diskTraces).Delete(id)
+}
+
+// diskStream lists ids in order, ascending if forward and descending otherwise
+type diskStream interface {
+	// seek returns the first id from id on, or the first id after it if strict. A nil id seeks the first id
+	seek(id []byte, strict bool) ([]byte, bool)
+}
+
+// diskPrefixStream lists the ids that end the keys with prefix of a bucket
+type diskPrefixStream struct {
+	cursor  *bolt.Cursor
+	prefix  []byte
+	forward bool
+}
+
+func (stream *diskPrefixStream) seek(id []byte, strict bool) ([]byte, bool) {
+	var key []byte
+
+	switch {
+	case id != nil:
+		key = append(append([]byte{}, stream.prefix...), id...)
+		if strict && stream.forward {
+			// The smallest key after id
+			key = append(key, 0)
+		}
+	case stream.forward || len(stream.prefix) == 0:
+		key = stream.prefix
+	default:
+		// Prefixes end with a zero byte, so the key after the last key with the prefix ends with a one
+		key = append(append([]byte{}, stream.prefix[:len(stream.prefix)-1]...), 1)
+	}
+
+	var found []byte
+	switch {
+	case stream.forward:
+		found, _ = stream.cursor.Seek(key)
+	case id == nil && len(stream.prefix) == 0:
+		found, _ = stream.cursor.Last()
+	default:
+		found, _ = stream.cursor.Seek(key)
+		if found == nil {
+			found, _ = stream.cursor.Last()
+		} else if id == nil || strict || !bytes.Equal(found, key) {
+			found, _ = stream.cursor.Prev()
+		}
+	}
+
+	if found == nil || !bytes.HasPrefix(found, stream.prefix) {
+		return nil, false
+	}
+
+	return found[len(stream.prefix):], true
+}
+
+// diskIDStream lists a single id
+type diskIDStream struct {
+	id      []byte
+	forward bool
+}
+
+func (stream *diskIDStream) seek(id []byte, strict bool) ([]byte, bool) {
+	if id == nil {
+		return stream.id, true
+	}
+
+	order := bytes.Compare(stream.id, id)
+	if !stream.forward {
+		order = -order
+	}
+
+	return stream.id, order > 0 || order == 0 && !strict
+}
+
+// diskUnion lists the ids of any of its streams
+type diskUnion struct {
+	streams []diskStream
+	forward bool
+}
+
+func (union *diskUnion) seek(id []byte, strict bool) ([]byte, bool) {
+	var first []byte
+	found := false
+
+	for _, stream := range union.streams {
+		next, ok := stream.seek(id, strict)
+		if !ok {
+			continue
+		}
+
+		if !found || (bytes.Compare(next, first) < 0) == union.forward {
+			first = next
+			found = true
+		}
+	}
+
+	return first, found
+}
+
+// diskIntersection lists the ids of all of its streams, seeking each stream to the furthest id of the others
+type diskIntersection struct {
+	streams []diskStream
+}
+
+func (intersection *diskIntersection) seek(id []byte, strict bool) ([]byte, bool) {
+	candidate, ok := intersection.streams[0].seek(id, strict)
+
+	for ok {
+		agreed := true
+
+		for _, stream := range intersection.streams[1:] {
+			next, found := stream.seek(candidate, false)
+			if !found {
+				return nil, false
+			}
+
+			if !bytes.Equal(next, candidate) {
+				candidate = next
+				agreed = false
+				break
+			}
+		}
+
+		if agreed {
+			return candidate, true
+		}
+
+		candidate, ok = intersection.streams[0].seek(candidate, false)
+	}
+
+	return nil, false
+}
+
+// stream returns the ids of the traces that the indexes match for the filters of query, a superset of the traces
+// that match query
+func (diskTraceStore *DiskTraceStore) stream(tx *bolt.Tx, query TraceQuery) diskStream {
+	forward := query.Sort
+	prefixes := func(bucket []byte, prefixes [][]byte) diskStream {
+		union := &diskUnion{forward: forward}
+		for _, prefix := range prefixes {
+			union.streams = append(union.streams, &diskPrefixStream{cursor: tx.Bucket(bucket).Cursor(), prefix: prefix, forward: forward})
+		}
+
+		return union
+	}
+
+	words := func(field string, text string) diskStream {
+		var fieldPrefixes [][]byte
+		for _, token := range textTokens(text) {
+			fieldPrefixes = append(fieldPrefixes, diskPrefix(field, token))
+		}
+
+		return prefixes(diskWords, fieldPrefixes)
+	}
+
+	var streams []diskStream
+
+	if query.ID != "" {
+		streams = append(streams, &diskIDStream{id: []byte(query.ID), forward: forward})
+	}
+
+	if query.Account != "" {
+		streams = append(streams, prefixes(diskAccounts, [][]byte{diskPrefix(query.Account)}))
+
+		if !query.After.IsZero() && !query.Before.IsZero() {
+			first := diskDay(unixMilliseconds(query.After))
+			last := diskDay(unixMilliseconds(query.Before))
+
+			if first <= last && last-first < DiskMaxIndexDays {
+				var dayPrefixes [][]byte
+				for day := first; day <= last; day++ {
+					dayPrefixes = append(dayPrefixes, diskDayPrefix(query.Account, day))
+				}
+
+				streams = append(streams, prefixes(diskDays, dayPrefixes))
+			}
+		}
+	}
+
+	if query.Device != nil {
+		var devicePrefixes [][]byte
+		for _, device := range query.Device {
+			devicePrefixes = append(devicePrefixes, diskPrefix(device))
+		}
+
+		streams = append(streams, prefixes(diskDevices, devicePrefixes))
+	}
+
+	if query.AppName != "" {
+		streams = append(streams, words("app_name", query.AppName))
+	}
+
+	if query.Type != "" {
+		streams = append(streams, words("type", query.Type))
+	}
+
+	if query.Types != nil {
+		var typePrefixes [][]byte
+		for _, traceType := range query.Types {
+			typePrefixes = append(typePrefixes, diskPrefix("type", traceType))
+		}
+
+		streams = append(streams, prefixes(diskValues, typePrefixes))
+	}
+
+	if query.Message != "" {
+		streams = append(streams, words("message", query.Message))
+	}
+
+	if len(streams) == 0 {
+		return &diskPrefixStream{cursor: tx.Bucket(diskTraces).Cursor(), forward: forward}
+	}
+
+	if len(streams) == 1 {
+		return streams[0]
+	}
+
+	return &diskIntersection{streams: streams}
+}
+
+// each calls fn with the traces matching query in the order of query, from the id after the cursor on, until fn
+// returns false
+func (diskTraceStore *DiskTraceStore) each(tx *bolt.Tx, query TraceQuery, cursor []byte, fn func(Trace) bool) error {
+	stream := diskTraceStore.stream(tx, query)
+	traces := tx.Bucket(diskTraces)
+
+	for id, ok := stream.seek(cursor, true); ok; id, ok = stream.seek(id, true) {
+		value := traces.Get(id)
+		if value == nil {
+			continue
+		}
+
+		var trace Trace
+		if err := json.Unmarshal(value, &trace); err != nil {
+			return err
+		}
+
+		if matchesTraceQuery(trace, query) && !fn(trace) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// AddDeviceTrace writes the traces to the trace database, which is synced before it returns
+func (diskTraceStore *DiskTraceStore) AddDeviceTrace(parentSpan opentracing.Span, ctx context.Context, traces []Trace) error {
+	span := opentracing.StartSpan(
+		"DiskTraceStore.AddDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	err := diskTraceStore.db.Update(func(tx *bolt.Tx) error {
+		for _, trace := range traces {
+			trace.Timestring = Date(trace.Timestamp)
+			trace.CreatedAt = Date(trace.CloudTimestamp)
+
+			if err := diskTraceStore.put(tx, trace); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		diskTraceStore.Logger.Error("AddDeviceTrace(): Could not write to the trace database", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "trace database write failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotWriteLogs
+	}
+
+	return nil
+}
+
+// SearchDeviceTrace returns a page of the traces matching query, sorted by id
+func (diskTraceStore *DiskTraceStore) SearchDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, includeTotalCount bool) (TracePage, error) {
+	span := opentracing.StartSpan(
+		"DiskTraceStore.SearchDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	var tracePage TracePage
+	tracePage.Object = "list"
+	tracePage.Limit = query.Limit
+	if query.Sort == true {
+		tracePage.Order = "ASC"
+	} else {
+		tracePage.Order = "DESC"
+	}
+
+	var cursor []byte
+	if len(query.AfterCursor) > 0 {
+		id, _ := query.AfterCursor[0].(string)
+		cursor = []byte(id)
+	}
+
+	tracePage.Data = make([]TraceResponse, 0)
+
+	err := diskTraceStore.db.View(func(tx *bolt.Tx) error {
+		err := diskTraceStore.each(tx, query, cursor, func(trace Trace) bool {
+			if len(tracePage.Data) >= int(tracePage.Limit) {
+				tracePage.HasMore = true
+				return false
+			}
+
+			response := NewTraceResponse(trace).Project(query.Fields)
+			if query.Highlight != nil {
+				response.Highlights = renderHighlights(highlightTrace(trace, query), *query.Highlight)
+			}
+
+			tracePage.Data = append(tracePage.Data, response)
+
+			return true
+		})
+
+		if err != nil || !includeTotalCount {
+			return err
+		}
+
+		// The total count is the count of the query, whatever the cursor
+		return diskTraceStore.each(tx, query, nil, func(Trace) bool {
+			tracePage.TotalCount++
+			return true
+		})
+	})
+
+	if err != nil {
+		diskTraceStore.Logger.Error("SearchDeviceTrace(): Could not read the trace database", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "trace database read failed"),
+			trace_log.Error(err),
+		)
+
+		return TracePage{}, ErrCouldNotQueryLogs
+	}
+
+	if query.AfterCursor != nil {
+		tracePage.After = query.AfterCursor[0]
+	}
+
+	return tracePage, nil
+}
+
+// DeleteDeviceTrace deletes the traces matching query, DiskDeleteBatch traces per transaction. The deletions are
+// synced before it returns
+func (diskTraceStore *DiskTraceStore) DeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (DeleteProgress, error) {
+	span := opentracing.StartSpan(
+		"DiskTraceStore.DeleteDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	var deleted int64
+
+	for {
+		var batch int
+
+		err := diskTraceStore.db.Update(func(tx *bolt.Tx) error {
+			var ids []string
+
+			err := diskTraceStore.each(tx, query, nil, func(trace Trace) bool {
+				ids = append(ids, trace.ID)
+				return len(ids) < DiskDeleteBatch
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				if _, err := diskTraceStore.remove(tx, []byte(id)); err != nil {
+					return err
+				}
+			}
+
+			batch = len(ids)
+
+			return nil
+		})
+
+		if err != nil {
+			diskTraceStore.Logger.Error("DeleteDeviceTrace(): Could not delete from the trace database", zap.Int64("deleted", deleted), zap.Error(err))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "trace database delete failed"),
+				trace_log.Error(err),
+			)
+
+			return DeleteProgress{}, ErrCouldNotDeleteLogs
+		}
+
+		deleted += int64(batch)
+
+		if batch < DiskDeleteBatch {
+			return DeleteProgress{Completed: true, Total: deleted, Deleted: deleted}, nil
+		}
+	}
+}
+
+// StartDeleteDeviceTrace deletes the traces matching query right away. The id of the task holds the number of
+// deleted traces, so that its progress is known after a restart
+func (diskTraceStore *DiskTraceStore) StartDeleteDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery) (string, error) {
+	progress, err := diskTraceStore.DeleteDeviceTrace(parentSpan, ctx, query)
+	if err != nil {
+		return "", err
+	}
+
+	return diskTaskPrefix + strconv.FormatInt(progress.Deleted, 10), nil
+}
+
+// DeleteTaskProgress returns the progress of a task started by StartDeleteDeviceTrace, which is always completed
+func (diskTraceStore *DiskTraceStore) DeleteTaskProgress(parentSpan opentracing.Span, ctx context.Context, taskID string) (DeleteProgress, error) {
+	if !strings.HasPrefix(taskID, diskTaskPrefix) {
+		return DeleteProgress{}, ErrDeleteTaskNotFound
+	}
+
+	deleted, err := strconv.ParseInt(strings.TrimPrefix(taskID, diskTaskPrefix), 10, 64)
+	if err != nil {
+		return DeleteProgress{}, ErrDeleteTaskNotFound
+	}
+
+	return DeleteProgress{Completed: true, Total: deleted, Deleted: deleted}, nil
+}
+
+// Close closes the trace database
+func (diskTraceStore *DiskTraceStore) Close() error {
+	return diskTraceStore.db.Close()
+}
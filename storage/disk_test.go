@@ -0,0 +1,25 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage/storagetest"
+
+	"go.uber.org/zap"
+)
+
+func TestDiskTraceStore(t *testing.T) {
+	storagetest.TestTraceStore(t, func(t *testing.T) (storage.TraceStore, error) {
+		store, err := storage.NewDiskTraceStore(zap.NewNop(), t.TempDir())
+		if err != nil {
+			return nil, err
+		}
+
+		t.Cleanup(func() {
+			store.Close()
+		})
+
+		return store, nil
+	})
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// documentPageSize is the number of documents that ESDocumentStore.List reads per request
+const documentPageSize = 1000
+
+// Errors that might be returned by ESDocumentStore
+var (
+	ErrDocumentNotFound       = errors.New("Could not retreive the document by this ID")
+	ErrCouldNotSaveDocument   = errors.New("Failed to store the document")
+	ErrCouldNotQueryDocuments = errors.New("Failed to query the documents")
+	ErrCouldNotInitDocuments  = errors.New("Failed to create the document index")
+)
+
+// documentMapping is the mapping of a document index. The documents are stored but not indexed
+const documentMapping = `{
+	"mappings": {
+		"properties": {
+			"id":       {"type": "keyword"},
+			"document": {"type": "object", "enabled": false}
+		}
+	}
+}`
+
+// document is the stored form of a document of ESDocumentStore
+type document struct {
+	ID       string          `json:"id"`
+	Document json.RawMessage `json:"document"`
+}
+
+// ESDocumentStore keeps JSON documents by id in a dedicated elastic search index, so that the settings of a
+// feature are shared by every replica
+type ESDocumentStore struct {
+	ElasticSearchClient *elastic.Client
+	ElasticSearchIndex  string
+	Logger              *zap.Logger
+}
+
+// NewESDocumentStore returns an ESDocumentStore on index and creates the index if it does not exist yet
+func NewESDocumentStore(logger *zap.Logger, client *elastic.Client, index string) (*ESDocumentStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+	defer cancel()
+
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		logger.Error("NewESDocumentStore(): Could not check the document index", zap.Error(err))
+		return nil, ErrCouldNotInitDocuments
+	}
+
+	if !exists {
+		if _, err := client.CreateIndex(index).BodyString(documentMapping).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+			logger.Error("NewESDocumentStore(): Could not create the document index", zap.Error(err))
+			return nil, ErrCouldNotInitDocuments
+		}
+	}
+
+	return &ESDocumentStore{ElasticSearchClient: client, ElasticSearchIndex: index, Logger: logger}, nil
+}
+
+// Save stores value as the document with id, replacing an existing one
+func (store *ESDocumentStore) Save(ctx context.Context, id string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.ElasticSearchClient.Index().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		BodyJson(document{ID: id, Document: encoded}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		store.Logger.Warn("Error storing document", zap.String("id", id), zap.Error(err))
+
+		return ErrCouldNotSaveDocument
+	}
+
+	return nil
+}
+
+// Update replaces the document with id by value, or fails with ErrDocumentNotFound if there is none. Unlike Save it
+// never creates a document, so that a document deleted meanwhile stays deleted
+func (store *ESDocumentStore) Update(ctx context.Context, id string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.ElasticSearchClient.Update().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Script(elastic.NewScript("ctx._source.document = params.document").Param("document", json.RawMessage(encoded))).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrDocumentNotFound
+	} else if err != nil {
+		store.Logger.Warn("Error updating document", zap.String("id", id), zap.Error(err))
+
+		return ErrCouldNotSaveDocument
+	}
+
+	return nil
+}
+
+// Get decodes the document with id into value
+func (store *ESDocumentStore) Get(ctx context.Context, id string, value interface{}) error {
+	result, err := store.ElasticSearchClient.Get().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrDocumentNotFound
+	} else if err != nil {
+		store.Logger.Warn("Error retrieving document", zap.String("id", id), zap.Error(err))
+
+		return ErrCouldNotQueryDocuments
+	}
+
+	var stored document
+	if err := json.Unmarshal(result.Source, &stored); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(stored.Document, value)
+}
+
+// List returns every stored document, in the order of their ids
+func (store *ESDocumentStore) List(ctx context.Context) ([]json.RawMessage, error) {
+	var documents []json.RawMessage
+	var after []interface{}
+
+	for {
+		search := store.ElasticSearchClient.Search().
+			Index(store.ElasticSearchIndex).
+			Sort("id", true).
+			Size(documentPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+
+		result, err := search.Do(ctx)
+		if err != nil {
+			store.Logger.Warn("Error listing documents", zap.Error(err))
+
+			return nil, ErrCouldNotQueryDocuments
+		}
+
+		for _, hit := range result.Hits.Hits {
+			var stored document
+			if err := json.Unmarshal(hit.Source, &stored); err != nil {
+				return nil, err
+			}
+
+			documents = append(documents, stored.Document)
+		}
+
+		if len(result.Hits.Hits) < documentPageSize {
+			return documents, nil
+		}
+
+		after = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+}
+
+// Delete removes the document with id
+func (store *ESDocumentStore) Delete(ctx context.Context, id string) error {
+	_, err := store.ElasticSearchClient.Delete().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrDocumentNotFound
+	} else if err != nil {
+		store.Logger.Warn("Error deleting document", zap.String("id", id), zap.Error(err))
+
+		return ErrCouldNotSaveDocument
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// The search engines that ESTraceStore runs on
+const (
+	EngineElasticsearch7 = "elasticsearch7"
+	EngineElasticsearch8 = "elasticsearch8"
+	EngineOpenSearch     = "opensearch"
+
+	es8CompatibleJSON   = "application/vnd.elasticsearch+json;compatible-with=7"
+	es8CompatibleNDJSON = "application/vnd.elasticsearch+x-ndjson;compatible-with=7"
+	ismTemplatePriority = 100
+)
+
+// Errors that might be returned by the search engine functions
+var (
+	ErrUnsupportedEngine    = errors.New("The search engine is not supported")
+	ErrCouldNotDetectEngine = errors.New("Failed to detect the search engine")
+)
+
+// SearchEngine is the dialect of the cluster behind ESTraceStore. Documents, bulk requests, searches with
+// search_after and total hits, aliases and rollovers share the API of elastic search 7, which the client speaks.
+// SearchEngine covers what differs between the engines
+type SearchEngine interface {
+	// Name is one of the Engine constants
+	Name() string
+	// Transport adapts the requests of the client to the engine
+	Transport(base http.RoundTripper) http.RoundTripper
+	// PutLifecyclePolicy installs policy, which rolls the indices matching pattern over on conditions
+	PutLifecyclePolicy(ctx context.Context, client *elastic.Client, policy string, pattern string, conditions RolloverConditions) error
+	// LifecycleSettings are the settings of the new indices behind alias that policy rolls over
+	LifecycleSettings(policy string, alias string) map[string]interface{}
+	// AttachLifecycle makes policy roll the existing indices behind alias over
+	AttachLifecycle(ctx context.Context, client *elastic.Client, indices []string, policy string, alias string) error
+}
+
+// NewSearchEngine returns the SearchEngine called name
+func NewSearchEngine(name string) (SearchEngine, error) {
+	switch name {
+	case EngineElasticsearch7:
+		return elasticsearch7{}, nil
+	case EngineElasticsearch8:
+		return elasticsearch8{}, nil
+	case EngineOpenSearch:
+		return openSearch{}, nil
+	}
+
+	return nil, ErrUnsupportedEngine
+}
+
+// escapeNames joins names into the comma separated list of a request path
+func escapeNames(names []string) string {
+	escaped := make([]string, 0, len(names))
+	for _, name := range names {
+		escaped = append(escaped, url.PathEscape(name))
+	}
+
+	return strings.Join(escaped, ",")
+}
+
+// esInfo is the part of the response of the root endpoint that tells the engines apart
+type esInfo struct {
+	Version struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+}
+
+// DetectSearchEngine asks the cluster at esURL for its version and returns its SearchEngine and version
+func DetectSearchEngine(ctx context.Context, httpClient *http.Client, esURL string) (SearchEngine, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	request, err := http.NewRequest("GET", strings.TrimSuffix(esURL, "/")+"/", nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	response, err := httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", ErrCouldNotDetectEngine, response.Status)
+	}
+
+	var info esInfo
+	if err := json.NewDecoder(response.Body).Decode(&info); err != nil {
+		return nil, "", err
+	}
+
+	version := info.Version.Number
+
+	// OpenSearch can report the version of elastic search 7 for older clients, its distribution tells it apart
+	if info.Version.Distribution == "opensearch" {
+		return openSearch{}, version, nil
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return nil, version, fmt.Errorf("%s: version %q", ErrCouldNotDetectEngine, version)
+	}
+
+	switch major {
+	case 7:
+		return elasticsearch7{}, version, nil
+	case 8:
+		return elasticsearch8{}, version, nil
+	}
+
+	return nil, version, ErrUnsupportedEngine
+}
+
+// rolloverConditions returns the rollover conditions as names in the lifecycle policy
+func rolloverConditions(conditions RolloverConditions, maxAge string, maxDocs string, maxSize string) map[string]interface{} {
+	rollover := map[string]interface{}{}
+
+	if conditions.MaxAge != "" {
+		rollover[maxAge] = conditions.MaxAge
+	}
+
+	if conditions.MaxDocs > 0 {
+		rollover[maxDocs] = conditions.MaxDocs
+	}
+
+	if conditions.MaxSize != "" {
+		rollover[maxSize] = conditions.MaxSize
+	}
+
+	return rollover
+}
+
+// elasticsearch7 rolls the indices over with ILM
+type elasticsearch7 struct{}
+
+func (elasticsearch7) Name() string {
+	return EngineElasticsearch7
+}
+
+func (elasticsearch7) Transport(base http.RoundTripper) http.RoundTripper {
+	return base
+}
+
+func (elasticsearch7) PutLifecyclePolicy(ctx context.Context, client *elastic.Client, policy string, pattern string, conditions RolloverConditions) error {
+	body := map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": map[string]interface{}{
+				"hot": map[string]interface{}{
+					"actions": map[string]interface{}{
+						"rollover": rolloverConditions(conditions, "max_age", "max_docs", "max_size"),
+					},
+				},
+			},
+		},
+	}
+
+	_, err := client.XPackIlmPutLifecycle().Policy(policy).BodyJson(body).Do(ctx)
+
+	return err
+}
+
+func (elasticsearch7) LifecycleSettings(policy string, alias string) map[string]interface{} {
+	return map[string]interface{}{
+		"index.lifecycle.name":           policy,
+		"index.lifecycle.rollover_alias": alias,
+	}
+}
+
+func (engine elasticsearch7) AttachLifecycle(ctx context.Context, client *elastic.Client, indices []string, policy string, alias string) error {
+	_, err := client.IndexPutSettings(indices...).BodyJson(engine.LifecycleSettings(policy, alias)).Do(ctx)
+
+	return err
+}
+
+// elasticsearch8 is elastic search 7 in the compatibility mode of elastic search 8, which accepts the requests and
+// returns the responses of version 7
+type elasticsearch8 struct {
+	elasticsearch7
+}
+
+func (elasticsearch8) Name() string {
+	return EngineElasticsearch8
+}
+
+func (elasticsearch8) Transport(base http.RoundTripper) http.RoundTripper {
+	return es8CompatibleTransport{base: base}
+}
+
+// es8CompatibleTransport asks for the compatibility mode on every request. Elastic search 8 rejects a request that
+// asks for it in only one of Accept and Content-Type
+type es8CompatibleTransport struct {
+	base http.RoundTripper
+}
+
+func (transport es8CompatibleTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Accept", es8CompatibleJSON)
+
+	switch request.Header.Get("Content-Type") {
+	case "":
+	case "application/x-ndjson":
+		request.Header.Set("Content-Type", es8CompatibleNDJSON)
+	default:
+		request.Header.Set("Content-Type", es8CompatibleJSON)
+	}
+
+	return transport.base.RoundTrip(request)
+}
+
+// openSearch rolls the indices over with the index state management plugin. ISM policies pick the indices they
+// manage by their ism_template, and are updated with optimistic concurrency control
+type openSearch struct{}
+
+func (openSearch) Name() string {
+	return EngineOpenSearch
+}
+
+func (openSearch) Transport(base http.RoundTripper) http.RoundTripper {
+	return base
+}
+
+// ismPolicy is the part of an ISM policy that PutLifecyclePolicy keeps when it updates the policy
+type ismPolicy struct {
+	SeqNo       *int64 `json:"_seq_no"`
+	PrimaryTerm *int64 `json:"_primary_term"`
+	Policy      struct {
+		ISMTemplate []struct {
+			IndexPatterns []string `json:"index_patterns"`
+		} `json:"ism_template"`
+	} `json:"policy"`
+}
+
+func (openSearch) PutLifecyclePolicy(ctx context.Context, client *elastic.Client, policy string, pattern string, conditions RolloverConditions) error {
+	path := "/_plugins/_ism/policies/" + url.PathEscape(policy)
+
+	response, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: path})
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	// Every index family has its own pattern, the patterns of the other families stay in the policy
+	patterns := []string{pattern}
+	params := url.Values{}
+
+	if err == nil {
+		var existing ismPolicy
+		if err := json.Unmarshal(response.Body, &existing); err != nil {
+			return err
+		}
+
+		for _, template := range existing.Policy.ISMTemplate {
+			for _, existingPattern := range template.IndexPatterns {
+				if existingPattern != pattern {
+					patterns = append(patterns, existingPattern)
+				}
+			}
+		}
+
+		if existing.SeqNo != nil && existing.PrimaryTerm != nil {
+			params.Set("if_seq_no", strconv.FormatInt(*existing.SeqNo, 10))
+			params.Set("if_primary_term", strconv.FormatInt(*existing.PrimaryTerm, 10))
+		}
+	}
+
+	body := map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "Rolls the trace indices over",
+			"default_state": "hot",
+			"states": []interface{}{
+				map[string]interface{}{
+					"name": "hot",
+					"actions": []interface{}{
+						map[string]interface{}{"rollover": rolloverConditions(conditions, "min_index_age", "min_doc_count", "min_size")},
+					},
+					"transitions": []interface{}{},
+				},
+			},
+			"ism_template": []interface{}{
+				map[string]interface{}{"index_patterns": patterns, "priority": ismTemplatePriority},
+			},
+		},
+	}
+
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "PUT", Path: path, Params: params, Body: body})
+
+	return err
+}
+
+func (openSearch) LifecycleSettings(policy string, alias string) map[string]interface{} {
+	// The policy is attached by its ism_template
+	return map[string]interface{}{
+		"plugins.index_state_management.rollover_alias": alias,
+	}
+}
+
+func (engine openSearch) AttachLifecycle(ctx context.Context, client *elastic.Client, indices []string, policy string, alias string) error {
+	if _, err := client.IndexPutSettings(indices...).BodyJson(engine.LifecycleSettings(policy, alias)).Do(ctx); err != nil {
+		return err
+	}
+
+	// Indices that are managed already are reported as failed indices, which is fine
+	_, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/_plugins/_ism/add/" + escapeNames(indices),
+		Body:   map[string]interface{}{"policy_id": policy},
+	})
+
+	return err
+}
@@ -0,0 +1,35 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage/storagetest"
+)
+
+func TestSearchEngines(t *testing.T) {
+	for _, engine := range []string{storage.EngineElasticsearch7, storage.EngineElasticsearch8, storage.EngineOpenSearch} {
+		t.Run(engine, func(t *testing.T) {
+			if err := storagetest.TestSearchEngine(engine); err != nil {
+				t.Fatal(err)
+			}
+
+			cluster := storagetest.NewStubCluster(engine)
+			defer cluster.Close()
+
+			storagetest.TestTraceStore(t, storagetest.NewESStore(cluster.URL, ""))
+		})
+	}
+}
+
+// TestESTraceStore runs the conformance suite against the cluster at STORAGETEST_ES_URL, such as an elasticsearch or
+// opensearch container
+func TestESTraceStore(t *testing.T) {
+	esURL := os.Getenv("STORAGETEST_ES_URL")
+	if esURL == "" {
+		t.Skip("STORAGETEST_ES_URL is not set")
+	}
+
+	storagetest.TestTraceStore(t, storagetest.NewESStore(esURL, ""))
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	ScanBatchSize   = 1000
+	ScrollKeepAlive = "2m"
+)
+
+// Errors that might be returned by the scan functions
+var (
+	ErrCouldNotScanLogs = errors.New("Failed to scan the trace logs")
+)
+
+// TraceScanStore is implemented by the trace stores that can walk a large result set more
+// efficiently than paging through SearchDeviceTrace
+type TraceScanStore interface {
+	ScanDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, batch func([]TraceResponse) error) error
+}
+
+// ScanDeviceTrace calls batch with every trace matching query, in id order and at most ScanBatchSize traces at a time.
+// It uses the scan of the store when available and pages through SearchDeviceTrace with the id cursor otherwise.
+// Scanning stops with the error of batch or the context
+func ScanDeviceTrace(store TraceStore, parentSpan opentracing.Span, ctx context.Context, query TraceQuery, batch func([]TraceResponse) error) error {
+	if scanStore, ok := store.(TraceScanStore); ok {
+		return scanStore.ScanDeviceTrace(parentSpan, ctx, query, batch)
+	}
+
+	query.Limit = ScanBatchSize
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		page, err := store.SearchDeviceTrace(parentSpan, ctx, query, false)
+		if err != nil {
+			return err
+		}
+
+		if len(page.Data) > 0 {
+			if err := batch(page.Data); err != nil {
+				return err
+			}
+
+			query.AfterCursor = []interface{}{page.Data[len(page.Data)-1].ID}
+		}
+
+		if !page.HasMore {
+			return nil
+		}
+	}
+}
+
+// ScanDeviceTrace walks the traces matching query with a scroll, so that the result is a consistent snapshot
+func (esTraceStore *ESTraceStore) ScanDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, batch func([]TraceResponse) error) error {
+	return esTraceStore.ScanTraces(parentSpan, ctx, query, func(traces []Trace) error {
+		responses := make([]TraceResponse, 0, len(traces))
+
+		for _, trace := range traces {
+			responses = append(responses, NewTraceResponse(trace))
+		}
+
+		return batch(responses)
+	})
+}
+
+// ScanTraces walks the stored traces matching query with a scroll, like ScanDeviceTrace
+func (esTraceStore *ESTraceStore) ScanTraces(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, batch func([]Trace) error) error {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore.ScanTraces",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "ScanTraces()"))
+
+	esQuery := buildESBoolQuery(query)
+
+	span.LogFields(
+		trace_log.String("event", "build es query"),
+		trace_log.String("message", "scan query prepared"),
+		trace_log.Object("esQuery", esQuery),
+	)
+
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
+	scroll := esTraceStore.ElasticSearchClient.Scroll(indices...).
+		Query(esQuery).
+		Sort("id", query.Sort).
+		Size(ScanBatchSize).
+		KeepAlive(ScrollKeepAlive)
+
+	if routing != "" {
+		scroll.Routing(routing)
+	}
+
+	defer func() {
+		// Release the scroll context even if the request context is done
+		clearCtx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+		defer cancel()
+
+		if err := scroll.Clear(clearCtx); err != nil {
+			logger.Debug("Could not clear the scroll", zap.Error(err))
+		}
+	}()
+
+	total := 0
+
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			logger.Warn("Error executing scroll query", zap.Error(err))
+
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "scroll query failed"),
+				trace_log.Error(err),
+			)
+
+			return ErrCouldNotScanLogs
+		}
+
+		traces := make([]Trace, 0, len(result.Hits.Hits))
+
+		for _, hit := range result.Hits.Hits {
+			var trace Trace
+
+			if err := json.Unmarshal(hit.Source, &trace); err != nil {
+				logger.Warn("Error decoding response as trace data", zap.Error(err))
+
+				span.LogFields(
+					trace_log.String("event", "error"),
+					trace_log.String("message", "could not decode es response"),
+					trace_log.Error(err),
+				)
+
+				return ErrCouldNotUnmarshalLogs
+			}
+
+			traces = append(traces, trace)
+		}
+
+		if err := batch(traces); err != nil {
+			return err
+		}
+
+		total += len(traces)
+	}
+
+	span.LogFields(
+		trace_log.String("event", "scan finished"),
+		trace_log.Int("traces", total),
+	)
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// traceFieldSources maps the properties of TraceResponse to the stored fields they are built from
+var traceFieldSources = map[string][]string{
+	"id":         {"id"},
+	"account_id": {"account_id"},
+	"device_id":  {"device_id"},
+	"object":     {},
+	"created_at": {"created_at"},
+	"etag":       {"created_at"},
+	"timestamp":  {"timestring"},
+	"app_name":   {"app_name"},
+	"message":    {"message"},
+	"type":       {"type"},
+}
+
+// sourceIncludes returns the stored fields needed to build the properties in fields. The id is always included
+// because it is the pagination cursor
+func sourceIncludes(fields []string) []string {
+	includes := []string{"id"}
+	seen := map[string]bool{"id": true}
+
+	for _, field := range fields {
+		for _, source := range traceFieldSources[field] {
+			if !seen[source] {
+				seen[source] = true
+				includes = append(includes, source)
+			}
+		}
+	}
+
+	return includes
+}
+
+// Project returns the response restricted to the properties in fields when it is encoded. A nil fields keeps every
+// property
+func (response TraceResponse) Project(fields []string) TraceResponse {
+	response.fields = fields
+
+	return response
+}
+
+// traceResponseJSON has the fields of TraceResponse without its MarshalJSON
+type traceResponseJSON TraceResponse
+
+// MarshalJSON encodes the properties selected by Project, in the order of TraceColumns
+func (response TraceResponse) MarshalJSON() ([]byte, error) {
+	if response.fields == nil {
+		return json.Marshal(traceResponseJSON(response))
+	}
+
+	selected := make(map[string]bool, len(response.fields))
+	for _, field := range response.fields {
+		selected[field] = true
+	}
+
+	values := map[string]interface{}{
+		"id":         response.ID,
+		"account_id": response.AccountID,
+		"device_id":  response.DeviceID,
+		"object":     response.Object,
+		"created_at": response.CreatedAt,
+		"etag":       response.ETag,
+		"timestamp":  response.Timestamp,
+		"app_name":   response.AppName,
+		"message":    response.Message,
+		"type":       response.Type,
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+
+	write := func(key string, value interface{}) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		if buffer.Len() > 1 {
+			buffer.WriteByte(',')
+		}
+
+		buffer.WriteString(`"` + key + `":`)
+		buffer.Write(encoded)
+
+		return nil
+	}
+
+	for _, column := range TraceColumns {
+		if selected[column] {
+			if err := write(column, values[column]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(response.Highlights) > 0 {
+		if err := write("highlights", response.Highlights); err != nil {
+			return nil, err
+		}
+	}
+
+	buffer.WriteByte('}')
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// FileDeletionStore implements DeletionStore with one JSON file per deletion in a local directory, for the trace
+// stores that do not run on elastic search
+type FileDeletionStore struct {
+	Dir    string
+	Logger *zap.Logger
+
+	lock sync.RWMutex
+}
+
+// NewFileDeletionStore returns a FileDeletionStore on dir, creating dir if needed
+func NewFileDeletionStore(logger *zap.Logger, dir string) (*FileDeletionStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		logger.Error("NewFileDeletionStore(): Could not create the deletion directory", zap.String("dir", dir), zap.Error(err))
+		return nil, ErrCouldNotInitDeletionList
+	}
+
+	return &FileDeletionStore{Dir: dir, Logger: logger}, nil
+}
+
+func (store *FileDeletionStore) path(id string) string {
+	return filepath.Join(store.Dir, filepath.Base(id)+".json")
+}
+
+// SaveDeletion creates or replaces a deletion, replacing the file atomically
+func (store *FileDeletionStore) SaveDeletion(parentSpan opentracing.Span, ctx context.Context, deletion Deletion) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	encoded, err := json.Marshal(deletion)
+	if err != nil {
+		return ErrCouldNotSaveDeletion
+	}
+
+	tmp := store.path(deletion.ID) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, encoded, 0600); err != nil {
+		store.Logger.Warn("SaveDeletion(): Error writing deletion", zap.String("deletion_id", deletion.ID), zap.Error(err))
+		return ErrCouldNotSaveDeletion
+	}
+
+	if err := os.Rename(tmp, store.path(deletion.ID)); err != nil {
+		store.Logger.Warn("SaveDeletion(): Error writing deletion", zap.String("deletion_id", deletion.ID), zap.Error(err))
+		return ErrCouldNotSaveDeletion
+	}
+
+	return nil
+}
+
+func (store *FileDeletionStore) read(id string) (Deletion, error) {
+	var deletion Deletion
+
+	encoded, err := ioutil.ReadFile(store.path(id))
+	if os.IsNotExist(err) {
+		return Deletion{}, ErrDeletionNotFound
+	} else if err != nil {
+		store.Logger.Warn("read(): Error reading deletion", zap.String("deletion_id", id), zap.Error(err))
+		return Deletion{}, ErrCouldNotQueryDeletions
+	}
+
+	if err := json.Unmarshal(encoded, &deletion); err != nil {
+		store.Logger.Warn("read(): Error decoding deletion", zap.String("deletion_id", id), zap.Error(err))
+		return Deletion{}, ErrCouldNotUnmarshalLogs
+	}
+
+	return deletion, nil
+}
+
+// GetDeletion returns the deletion with id if it belongs to accountID
+func (store *FileDeletionStore) GetDeletion(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (Deletion, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	deletion, err := store.read(id)
+	if err != nil {
+		return Deletion{}, err
+	}
+
+	if deletion.AccountID != accountID {
+		return Deletion{}, ErrDeletionNotFound
+	}
+
+	return deletion, nil
+}
+
+// list returns up to limit deletions that match, with an id before after, newest first
+func (store *FileDeletionStore) list(match func(Deletion) bool, limit int, after string) ([]Deletion, bool, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		store.Logger.Warn("list(): Error listing deletions", zap.Error(err))
+		return nil, false, ErrCouldNotQueryDeletions
+	}
+
+	ids := make([]string, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if after == "" || id < after {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	deletions := make([]Deletion, 0)
+
+	for _, id := range ids {
+		deletion, err := store.read(id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !match(deletion) {
+			continue
+		}
+
+		if len(deletions) == limit {
+			return deletions, true, nil
+		}
+
+		deletions = append(deletions, deletion)
+	}
+
+	return deletions, false, nil
+}
+
+// ListDeletions returns up to limit deletions of accountID with an id before after, newest first
+func (store *FileDeletionStore) ListDeletions(parentSpan opentracing.Span, ctx context.Context, accountID string, limit int, after string) ([]Deletion, bool, error) {
+	return store.list(func(deletion Deletion) bool { return deletion.AccountID == accountID }, limit, after)
+}
+
+// ListDeletionsWithStatus returns up to limit deletions of every account with status, newest first
+func (store *FileDeletionStore) ListDeletionsWithStatus(parentSpan opentracing.Span, ctx context.Context, status string, limit int) ([]Deletion, error) {
+	deletions, _, err := store.list(func(deletion Deletion) bool { return deletion.Status == status }, limit, "")
+
+	return deletions, err
+}
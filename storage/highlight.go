@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"html"
+	"strings"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+const (
+	DefaultHighlightPreTag  = "<em>"
+	DefaultHighlightPostTag = "</em>"
+	MaxHighlightTagLength   = 64
+	highlightFragmentSize   = 150
+	highlightFragments      = 3
+)
+
+// The highlighter marks matches with private use characters. Fragments are HTML-escaped before the markers are
+// replaced by the requested tags, so the tags are the only markup in a highlight
+const (
+	highlightPreMarker  = "\uE000"
+	highlightPostMarker = "\uE001"
+)
+
+// HighlightQuery asks for the matches of the text queries to be highlighted in the results
+type HighlightQuery struct {
+	PreTag  string `json:"pre_tag"`
+	PostTag string `json:"post_tag"`
+}
+
+// newESHighlight builds the highlight request for the text fields of a trace
+func newESHighlight() *elastic.Highlight {
+	return elastic.NewHighlight().
+		PreTags(highlightPreMarker).
+		PostTags(highlightPostMarker).
+		Fields(
+			elastic.NewHighlighterField("message").FragmentSize(highlightFragmentSize).NumOfFragments(highlightFragments),
+			elastic.NewHighlighterField("app_name").NumOfFragments(0),
+		)
+}
+
+// RenderHighlight HTML-escapes a marked fragment and replaces the markers by the tags of query
+func RenderHighlight(fragment string, query HighlightQuery) string {
+	escaped := html.EscapeString(fragment)
+	escaped = strings.Replace(escaped, highlightPreMarker, query.PreTag, -1)
+
+	return strings.Replace(escaped, highlightPostMarker, query.PostTag, -1)
+}
+
+// renderHighlights renders the fragments of every highlighted field. It returns nil if nothing was highlighted
+func renderHighlights(highlight map[string][]string, query HighlightQuery) map[string][]string {
+	if len(highlight) == 0 {
+		return nil
+	}
+
+	highlights := make(map[string][]string, len(highlight))
+
+	for field, fragments := range highlight {
+		rendered := make([]string, len(fragments))
+
+		for i, fragment := range fragments {
+			rendered[i] = RenderHighlight(fragment, query)
+		}
+
+		highlights[field] = rendered
+	}
+
+	return highlights
+}
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	HistogramTimeFieldDevice = "timestamp"
+	HistogramTimeFieldCloud  = "@timestamp"
+	HistogramSplitByAppName  = "app_name"
+	HistogramSplitByLevel    = "level"
+	DefaultHistogramSplits   = 10
+	MaxHistogramSplits       = 50
+	MaxHistogramBuckets      = 1000
+	autoHistogramBuckets     = 100
+)
+
+// Errors that might be returned by the histogram functions
+var (
+	ErrCouldNotAggregateLogs = errors.New("Failed to aggregate the trace logs by time")
+)
+
+// autoHistogramIntervals lists the intervals that an automatic histogram interval is picked from
+var autoHistogramIntervals = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// histogramSplitFields maps the split_by values onto the aggregatable fields of the trace mapping. The level of a
+// trace is its type
+var histogramSplitFields = map[string]string{
+	HistogramSplitByAppName: AppNameKeywordField,
+	HistogramSplitByLevel:   TypeKeywordField,
+}
+
+// TraceHistogramStore is implemented by the trace stores that can count trace volume over time
+type TraceHistogramStore interface {
+	HistogramDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query HistogramQuery) (TraceHistogram, error)
+}
+
+// HistogramQuery specifies the filters and the bucketing of a trace volume histogram. The time range of
+// the embedded TraceQuery is applied to TimeField and must be set on both ends
+type HistogramQuery struct {
+	TraceQuery
+	Interval  time.Duration `json:"interval"`
+	TimeField string        `json:"time_field"`
+	SplitBy   string        `json:"split_by"`
+	SplitSize int           `json:"split_size"`
+}
+
+// HistogramBucket is the number of traces in the interval starting at Timestamp
+type HistogramBucket struct {
+	Timestamp string `json:"timestamp"`
+	Count     uint64 `json:"count"`
+}
+
+// HistogramSeries is one zero filled series of buckets. Key is the split_by value of the series
+type HistogramSeries struct {
+	Key     string            `json:"key,omitempty"`
+	Total   uint64            `json:"total"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// TraceHistogram specifies the return result of a trace volume histogram
+type TraceHistogram struct {
+	Object    string            `json:"object"`
+	Interval  string            `json:"interval"`
+	TimeField string            `json:"time_field"`
+	Start     string            `json:"start"`
+	End       string            `json:"end"`
+	SplitBy   string            `json:"split_by,omitempty"`
+	Series    []HistogramSeries `json:"series"`
+}
+
+// IsHistogramSplitField reports whether field can be used as split_by
+func IsHistogramSplitField(field string) bool {
+	_, ok := histogramSplitFields[field]
+
+	return ok
+}
+
+// AutoHistogramInterval picks the smallest interval that keeps the number of buckets between start and end reasonable
+func AutoHistogramInterval(start time.Time, end time.Time) time.Duration {
+	span := end.Sub(start)
+
+	for _, interval := range autoHistogramIntervals {
+		if span/interval <= autoHistogramBuckets {
+			return interval
+		}
+	}
+
+	return autoHistogramIntervals[len(autoHistogramIntervals)-1]
+}
+
+// HistogramBucketCount returns the number of buckets needed to cover start to end with aligned buckets of interval
+func HistogramBucketCount(start time.Time, end time.Time, interval time.Duration) int64 {
+	first := alignHistogramBucket(unixMilliseconds(start), interval)
+	last := alignHistogramBucket(unixMilliseconds(end), interval)
+
+	return (last-first)/durationMilliseconds(interval) + 1
+}
+
+// FormatHistogramInterval formats interval the way it is accepted in the interval parameter
+func FormatHistogramInterval(interval time.Duration) string {
+	switch {
+	case interval%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", interval/(24*time.Hour))
+	case interval%time.Hour == 0:
+		return fmt.Sprintf("%dh", interval/time.Hour)
+	case interval%time.Minute == 0:
+		return fmt.Sprintf("%dm", interval/time.Minute)
+	case interval%time.Second == 0:
+		return fmt.Sprintf("%ds", interval/time.Second)
+	default:
+		return fmt.Sprintf("%dms", interval/time.Millisecond)
+	}
+}
+
+func durationMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// alignHistogramBucket returns the start of the epoch aligned bucket that contains timestamp
+func alignHistogramBucket(timestamp int64, interval time.Duration) int64 {
+	ms := durationMilliseconds(interval)
+	aligned := timestamp - timestamp%ms
+
+	if timestamp < 0 && timestamp%ms != 0 {
+		aligned -= ms
+	}
+
+	return aligned
+}
+
+// fillHistogramSeries turns the sparse counts keyed by bucket start into a zero filled series covering start to end
+func fillHistogramSeries(key string, start time.Time, end time.Time, interval time.Duration, counts map[int64]uint64) HistogramSeries {
+	ms := durationMilliseconds(interval)
+	first := alignHistogramBucket(unixMilliseconds(start), interval)
+	last := alignHistogramBucket(unixMilliseconds(end), interval)
+
+	series := HistogramSeries{
+		Key:     key,
+		Buckets: make([]HistogramBucket, 0, (last-first)/ms+1),
+	}
+
+	for bucket := first; bucket <= last; bucket += ms {
+		count := counts[bucket]
+		series.Total += count
+		series.Buckets = append(series.Buckets, HistogramBucket{
+			Timestamp: Date(bucket),
+			Count:     count,
+		})
+	}
+
+	return series
+}
+
+func newTraceHistogram(query HistogramQuery) TraceHistogram {
+	return TraceHistogram{
+		Object:    "histogram",
+		Interval:  FormatHistogramInterval(query.Interval),
+		TimeField: query.TimeField,
+		Start:     Date(alignHistogramBucket(unixMilliseconds(query.After), query.Interval)),
+		End:       Date(unixMilliseconds(query.Before)),
+		SplitBy:   query.SplitBy,
+		Series:    []HistogramSeries{},
+	}
+}
+
+func histogramCounts(histogram *elastic.AggregationBucketHistogramItems) map[int64]uint64 {
+	counts := make(map[int64]uint64)
+
+	if histogram == nil {
+		return counts
+	}
+
+	for _, bucket := range histogram.Buckets {
+		counts[int64(bucket.Key)] = uint64(bucket.DocCount)
+	}
+
+	return counts
+}
+
+// HistogramDeviceTrace counts the traces matching the query in fixed, epoch aligned intervals of the time field
+func (esTraceStore *ESTraceStore) HistogramDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query HistogramQuery) (TraceHistogram, error) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, esTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"ESTraceStore.HistogramDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, esTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "HistogramDeviceTrace()"))
+
+	// The time range is applied to the selected time field rather than the device timestamp
+	filterQuery := query.TraceQuery
+	filterQuery.After = time.Time{}
+	filterQuery.Before = time.Time{}
+
+	esQuery := buildESBoolQuery(filterQuery)
+	esQuery.Filter(elastic.NewRangeQuery(query.TimeField).
+		Gte(unixMilliseconds(query.After)).
+		Lte(unixMilliseconds(query.Before)))
+
+	dateHistogram := elastic.NewDateHistogramAggregation().
+		Field(query.TimeField).
+		FixedInterval(fmt.Sprintf("%dms", durationMilliseconds(query.Interval))).
+		MinDocCount(0).
+		ExtendedBounds(alignHistogramBucket(unixMilliseconds(query.After), query.Interval), unixMilliseconds(query.Before))
+
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
+	search := esTraceStore.ElasticSearchClient.Search().
+		Index(indices...).
+		Query(esQuery).
+		Size(0)
+
+	if routing != "" {
+		search.Routing(routing)
+	}
+
+	if query.SplitBy != "" {
+		// Without the keyword sub-field every trace would fall out of the split, and the histogram would be empty
+		if err := esTraceStore.CheckKeywordFields(ctx, histogramSplitFields[query.SplitBy]); err != nil {
+			span.LogFields(
+				trace_log.String("event", "error"),
+				trace_log.String("message", "split field missing"),
+				trace_log.Error(err),
+			)
+
+			return TraceHistogram{}, err
+		}
+
+		splitSize := query.SplitSize
+		if splitSize <= 0 {
+			splitSize = DefaultHistogramSplits
+		}
+
+		search.Aggregation("split", elastic.NewTermsAggregation().
+			Field(histogramSplitFields[query.SplitBy]).
+			Size(splitSize).
+			SubAggregation("histogram", dateHistogram))
+	} else {
+		search.Aggregation("histogram", dateHistogram)
+	}
+
+	span.LogFields(
+		trace_log.String("event", "build es query"),
+		trace_log.String("message", "histogram query prepared"),
+		trace_log.Object("esQuery", esQuery),
+	)
+
+	result, err := search.Do(ctx)
+	if err != nil {
+		logger.Warn("Error executing histogram query", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "histogram query failed"),
+			trace_log.Error(err),
+		)
+
+		return TraceHistogram{}, ErrCouldNotAggregateLogs
+	}
+
+	histogram := newTraceHistogram(query)
+
+	if query.SplitBy == "" {
+		buckets, _ := result.Aggregations.DateHistogram("histogram")
+		histogram.Series = append(histogram.Series, fillHistogramSeries("", query.After, query.Before, query.Interval, histogramCounts(buckets)))
+
+		return histogram, nil
+	}
+
+	split, ok := result.Aggregations.Terms("split")
+	if !ok {
+		logger.Warn("Missing split aggregation in histogram response")
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "could not decode es response"),
+		)
+
+		return TraceHistogram{}, ErrCouldNotUnmarshalLogs
+	}
+
+	for _, term := range split.Buckets {
+		buckets, _ := term.Aggregations.DateHistogram("histogram")
+		histogram.Series = append(histogram.Series, fillHistogramSeries(fmt.Sprintf("%v", term.Key), query.After, query.Before, query.Interval, histogramCounts(buckets)))
+	}
+
+	return histogram, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// Errors that might be returned by ESLease
+var (
+	ErrCouldNotInitLease    = errors.New("Failed to create the lease index")
+	ErrCouldNotAcquireLease = errors.New("Failed to acquire the lease")
+)
+
+// leaseMapping is the mapping of the lease index
+const leaseMapping = `{
+	"mappings": {
+		"properties": {
+			"holder":      {"type": "keyword"},
+			"acquired_at": {"type": "date"},
+			"expires_at":  {"type": "date"}
+		}
+	}
+}`
+
+// lease is the document of a lease, one per Name
+type lease struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ESLease is a lease on an elastic search document that at most one Holder has at a time. The lease is taken over
+// when it is not renewed within TTL. Concurrent updates are resolved with optimistic concurrency control
+type ESLease struct {
+	ElasticSearchClient *elastic.Client
+	ElasticSearchIndex  string
+	Name                string
+	Holder              string
+	TTL                 time.Duration
+	Logger              *zap.Logger
+
+	lock        sync.Mutex
+	seqNo       int64
+	primaryTerm int64
+	held        bool
+}
+
+// NewESLease returns the lease Name for holder on index and creates the index if it does not exist yet
+func NewESLease(logger *zap.Logger, client *elastic.Client, index string, name string, holder string, ttl time.Duration) (*ESLease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+	defer cancel()
+
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		logger.Error("NewESLease(): Could not check the lease index", zap.Error(err))
+		return nil, ErrCouldNotInitLease
+	}
+
+	if !exists {
+		if _, err := client.CreateIndex(index).BodyString(leaseMapping).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+			logger.Error("NewESLease(): Could not create the lease index", zap.Error(err))
+			return nil, ErrCouldNotInitLease
+		}
+	}
+
+	return &ESLease{ElasticSearchClient: client, ElasticSearchIndex: index, Name: name, Holder: holder, TTL: ttl, Logger: logger}, nil
+}
+
+// Acquire takes or renews the lease and reports whether Holder has it until TTL from now
+func (esLease *ESLease) Acquire(ctx context.Context) (bool, error) {
+	esLease.lock.Lock()
+	defer esLease.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	current := lease{Holder: esLease.Holder, AcquiredAt: now, ExpiresAt: now.Add(esLease.TTL)}
+
+	result, err := esLease.ElasticSearchClient.Get().Index(esLease.ElasticSearchIndex).Id(esLease.Name).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return esLease.write(ctx, current, esLease.ElasticSearchClient.Index().OpType("create"))
+	} else if err != nil {
+		esLease.held = false
+		esLease.Logger.Warn("Acquire(): Could not read the lease", zap.String("lease", esLease.Name), zap.Error(err))
+		return false, ErrCouldNotAcquireLease
+	}
+
+	var previous lease
+	if err := json.Unmarshal(result.Source, &previous); err != nil {
+		esLease.held = false
+		esLease.Logger.Warn("Acquire(): Could not decode the lease", zap.String("lease", esLease.Name), zap.Error(err))
+		return false, ErrCouldNotAcquireLease
+	}
+
+	if previous.Holder != esLease.Holder && previous.ExpiresAt.After(now) {
+		esLease.held = false
+		return false, nil
+	}
+
+	if previous.Holder == esLease.Holder {
+		current.AcquiredAt = previous.AcquiredAt
+	}
+
+	if result.SeqNo == nil || result.PrimaryTerm == nil {
+		esLease.held = false
+		return false, ErrCouldNotAcquireLease
+	}
+
+	return esLease.write(ctx, current, esLease.ElasticSearchClient.Index().IfSeqNo(*result.SeqNo).IfPrimaryTerm(*result.PrimaryTerm))
+}
+
+// write stores the lease with the concurrency condition of request, a conflict means another holder won
+func (esLease *ESLease) write(ctx context.Context, current lease, request *elastic.IndexService) (bool, error) {
+	response, err := request.Index(esLease.ElasticSearchIndex).Id(esLease.Name).BodyJson(current).Refresh("true").Do(ctx)
+	if elastic.IsConflict(err) {
+		esLease.held = false
+		return false, nil
+	} else if err != nil {
+		esLease.held = false
+		esLease.Logger.Warn("write(): Could not write the lease", zap.String("lease", esLease.Name), zap.Error(err))
+		return false, ErrCouldNotAcquireLease
+	}
+
+	esLease.seqNo = response.SeqNo
+	esLease.primaryTerm = response.PrimaryTerm
+	esLease.held = true
+
+	return true, nil
+}
+
+// Release gives the lease up if Holder has it, so that another holder can take it without waiting for TTL
+func (esLease *ESLease) Release(ctx context.Context) error {
+	esLease.lock.Lock()
+	defer esLease.lock.Unlock()
+
+	if !esLease.held {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	esLease.held = false
+
+	_, err := esLease.ElasticSearchClient.Delete().Index(esLease.ElasticSearchIndex).Id(esLease.Name).IfSeqNo(esLease.seqNo).IfPrimaryTerm(esLease.primaryTerm).Do(ctx)
+	if elastic.IsConflict(err) || elastic.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
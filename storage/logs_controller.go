@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
@@ -38,16 +41,19 @@ type Trace struct {
 
 // TraceResponse struct specifies the attibutes of device trace
 type TraceResponse struct {
-	AccountID      string `json:"account_id"`
-	DeviceID       string `json:"device_id"`
-	ID             string `json:"id"`
-	Object         string `json:"object"`
-	CreatedAt      string `json:"created_at"`
-	ETag           string `json:"etag"`
-	Timestamp      string `json:"timestamp"`
-	AppName        string `json:"app_name"`
-	Message        string `json:"message"`
-	Type           string `json:"type"`
+	AccountID      string              `json:"account_id"`
+	DeviceID       string              `json:"device_id"`
+	ID             string              `json:"id"`
+	Object         string              `json:"object"`
+	CreatedAt      string              `json:"created_at"`
+	ETag           string              `json:"etag"`
+	Timestamp      string              `json:"timestamp"`
+	AppName        string              `json:"app_name"`
+	Message        string              `json:"message"`
+	Type           string              `json:"type"`
+	Highlights     map[string][]string `json:"highlights,omitempty"`
+
+	fields []string
 }
 
 // TracePageecifies the return result for paginated trace data
@@ -59,21 +65,34 @@ type TracePage struct {
 	HasMore    bool            `json:"has_more"`
 	Data       []TraceResponse `json:"data"`
 	TotalCount uint64          `json:"total_count,omitempty"`
+	TimeRange  *TimeRange      `json:"time_range,omitempty"`
+}
+
+// TimeRange is the resolved time range of a query, as RFC3339 timestamps with milliseconds
+type TimeRange struct {
+	Gte string `json:"timestamp__gte,omitempty"`
+	Lte string `json:"timestamp__lte,omitempty"`
 }
 
 // TraceQuery struct specifies what attributes that a trace query should have. The query would based on these terms
 type TraceQuery struct {
-	ID          string        `json:"id"`
-	Device      []string      `json:"device_id"`
-	Account     string        `json:"account_id"`
-	After       time.Time     `json:"after"`
-	Before      time.Time     `json:"before"`
-	AppName     string        `json:"app_name"`
-	Type        string        `json:"type"`
-	Limit       uint64        `json:"limit"`
-	Message     string        `json:"message"`
-	Sort        bool          `json:"sort"`
-	AfterCursor []interface{} `json:"cursor"`
+	ID            string          `json:"id"`
+	Device        []string        `json:"device_id"`
+	Account       string          `json:"account_id"`
+	After         time.Time       `json:"after"`
+	Before        time.Time       `json:"before"`
+	CreatedAfter  time.Time       `json:"created_after"`
+	CreatedBefore time.Time       `json:"created_before"`
+	AppName       string          `json:"app_name"`
+	Type          string          `json:"type"`
+	Types         []string        `json:"types,omitempty"`
+	ExcludeTypes  []string        `json:"exclude_types,omitempty"`
+	Limit         uint64          `json:"limit"`
+	Message       string          `json:"message"`
+	Sort          bool            `json:"sort"`
+	AfterCursor   []interface{}   `json:"cursor"`
+	Highlight     *HighlightQuery `json:"highlight,omitempty"`
+	Fields        []string        `json:"fields,omitempty"`
 }
 
 // ESTraceStore implements the elastic search version of the TraceStore interface
@@ -81,6 +100,8 @@ type ESTraceStore struct {
 	ElasticSearchClient *elastic.Client
 	ElasticSearchAlias  string
 	ElasticActiveAlias  string
+	Routing             *IndexRouting
+	Engine              SearchEngine
 	Logger              *zap.Logger
 }
 
@@ -118,11 +139,43 @@ func Date(timestamp int64) string {
 	return time.Unix(t_sec, t_nsec).UTC().Format("2006-01-02T15:04:05.000Z");
 }
 
+// IDTimestamp returns the milliseconds that a trace id generated by the service starts with, which are the
+// @timestamp of the trace. It returns false for ids in another format
+func IDTimestamp(id string) (int64, bool) {
+	if len(id) != 32 {
+		return 0, false
+	}
+
+	if _, err := hex.DecodeString(id); err != nil {
+		return 0, false
+	}
+
+	milliseconds, err := strconv.ParseInt(id[:12], 16, 64)
+
+	return milliseconds, err == nil
+}
+
+// NewTraceResponse converts a stored trace into its API representation
+func NewTraceResponse(trace Trace) TraceResponse {
+	return TraceResponse {
+		AccountID  : trace.AccountID,
+		DeviceID   : trace.DeviceID,
+		ID         : trace.ID,
+		Object     : "device-trace",
+		CreatedAt  : trace.CreatedAt,
+		ETag       : trace.CreatedAt,
+		Timestamp  : trace.Timestring,
+		Type       : trace.Type,
+		AppName    : trace.AppName,
+		Message    : trace.Message,
+	}
+}
+
 func buildESBoolQuery(query TraceQuery) *elastic.BoolQuery {
 	esQuery := elastic.NewBoolQuery()
 
-	// Handle the device_id query term
-	if len(query.Device) > 0 {
+	// Handle the device_id query term. An empty device list matches no trace
+	if query.Device != nil {
 		var devices []interface{}
 		for _, device := range query.Device {
 			devices = append(devices, interface{}(device))
@@ -149,6 +202,19 @@ func buildESBoolQuery(query TraceQuery) *elastic.BoolQuery {
 		esQuery.Must(typeQuery)
 	}
 
+	// Handle the types and the excluded types, whose names are matched exactly on the keyword sub-field
+	if query.Types != nil {
+		var types []interface{}
+		for _, traceType := range query.Types {
+			types = append(types, interface{}(traceType))
+		}
+		esQuery.Must(elastic.NewTermsQuery(TypeKeywordField, types...))
+	}
+
+	for _, excludedType := range query.ExcludeTypes {
+		esQuery.MustNot(elastic.NewTermQuery(TypeKeywordField, excludedType))
+	}
+
 	// Handle the text query term
 	if query.Message != "" {
 		textQuery := elastic.NewMatchQuery("message", query.Message)
@@ -173,6 +239,21 @@ func buildESBoolQuery(query TraceQuery) *elastic.BoolQuery {
 		esQuery.Filter(timeRangeQuery)
 	}
 
+	// Handle the ingestion time query terms
+	if !query.CreatedBefore.IsZero() || !query.CreatedAfter.IsZero() {
+		createdQuery := elastic.NewRangeQuery("@timestamp")
+
+		if !query.CreatedBefore.IsZero() {
+			createdQuery = createdQuery.Lte(unixMilliseconds(query.CreatedBefore))
+		}
+
+		if !query.CreatedAfter.IsZero() {
+			createdQuery = createdQuery.Gte(unixMilliseconds(query.CreatedAfter))
+		}
+
+		esQuery.Filter(createdQuery)
+	}
+
 	// Handle the trace id query term
 	if query.ID != "" {
 		IDQuery := elastic.NewTermQuery("id", query.ID)
@@ -202,16 +283,40 @@ func extractKeyFromContext(ctx context.Context, logger *zap.Logger) (interface{}
 	return requestID, accountID
 }
 
-// NewESTraceStore function initliaze an instance of ESTraceStore, establish the connection to elastic search by provided URL and index
-func NewESTraceStore(logger *zap.Logger, esURL string, esSearchAlias string, esActiveAlias string) (*ESTraceStore, error) {
-	client, err := elastic.NewClient(elastic.SetSniff(false), elastic.SetURL(esURL))
+// NewESTraceStore function initliaze an instance of ESTraceStore, establish the connection to elastic search by provided URL and index.
+// engine is one of the Engine constants, the engine is detected from the cluster if empty
+func NewESTraceStore(logger *zap.Logger, esURL string, esSearchAlias string, esActiveAlias string, engine string) (*ESTraceStore, error) {
+	var searchEngine SearchEngine
+	var err error
+
+	if engine == "" {
+		var version string
+
+		searchEngine, version, err = DetectSearchEngine(context.Background(), http.DefaultClient, esURL)
+		if err != nil {
+			logger.Error("NewESTraceStore(): Could not detect the search engine", zap.String("version", version), zap.Error(err))
+			return &ESTraceStore{}, ErrCouldNotInitES
+		}
+
+		logger.Info("NewESTraceStore(): Detected the search engine", zap.String("engine", searchEngine.Name()), zap.String("version", version))
+	} else {
+		searchEngine, err = NewSearchEngine(engine)
+		if err != nil {
+			logger.Error("NewESTraceStore(): An error occured inside of NewESTraceStore()", zap.String("engine", engine), zap.Error(err))
+			return &ESTraceStore{}, ErrCouldNotInitES
+		}
+	}
+
+	httpClient := &http.Client{Transport: searchEngine.Transport(http.DefaultTransport)}
+
+	client, err := elastic.NewClient(elastic.SetSniff(false), elastic.SetURL(esURL), elastic.SetHttpClient(httpClient))
 
 	if err != nil {
 		logger.Error("NewESTraceStore(): An error occured inside of NewESTraceStore()", zap.Error(err))
 		return &ESTraceStore{}, ErrCouldNotInitES
 	}
 
-	return &ESTraceStore{ElasticSearchClient: client, ElasticSearchAlias: esSearchAlias, ElasticActiveAlias: esActiveAlias, Logger: logger}, nil
+	return &ESTraceStore{ElasticSearchClient: client, ElasticSearchAlias: esSearchAlias, ElasticActiveAlias: esActiveAlias, Engine: searchEngine, Logger: logger}, nil
 }
 
 // AddDeviceTrace function adds trace logs to the elastic search server which is specified by the instance of ESTraceStore
@@ -233,7 +338,14 @@ func (esTraceStore *ESTraceStore) AddDeviceTrace(parentSpan opentracing.Span, ct
 	for _, log := range logs {
 		log.Timestring = Date(log.Timestamp)
 		log.CreatedAt = Date(log.CloudTimestamp)
-		bulkRequest.Add(elastic.NewBulkIndexRequest().Doc(log))
+
+		index, routing := esTraceStore.writeTarget(log.AccountID)
+		indexRequest := elastic.NewBulkIndexRequest().Index(index).Doc(log)
+		if routing != "" {
+			indexRequest.Routing(routing)
+		}
+
+		bulkRequest.Add(indexRequest)
 	}
 
 	logger.Debug("Content of bulk request", zap.Any("content", logs))
@@ -287,6 +399,15 @@ func (esTraceStore *ESTraceStore) AddDeviceTrace(parentSpan opentracing.Span, ct
 	return nil
 }
 
+// Refresh makes the traces added so far searchable, elastic search refreshes the indices every second otherwise
+func (esTraceStore *ESTraceStore) Refresh(ctx context.Context) error {
+	indices, _ := esTraceStore.searchTarget("")
+
+	_, err := esTraceStore.ElasticSearchClient.Refresh(indices...).Do(ctx)
+
+	return err
+}
+
 // SearchDeviceTrace return an object with trace logs and its base entity information, list wrapper and pagination data
 func (esTraceStore *ESTraceStore) SearchDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, includeTotalCount bool) (TracePage, error) {
 	// Extract the RequestID and the AccountID
@@ -308,13 +429,19 @@ func (esTraceStore *ESTraceStore) SearchDeviceTrace(parentSpan opentracing.Span,
 		trace_log.Object("esQuery", esQuery),
 	)
 
+	indices, routing := esTraceStore.searchTarget(query.Account)
+
 	search := esTraceStore.ElasticSearchClient.Search().
-		Index(esTraceStore.ElasticSearchAlias).
+		Index(indices...).
 		Query(esQuery).
 		Sort("id", query.Sort).
 		From(0).
 		Size(int(query.Limit) + 1) // ask for one more result than necessary to populate has_more
 
+	if routing != "" {
+		search.Routing(routing)
+	}
+
 	if includeTotalCount {
 		search.TrackTotalHits(true)
 	}
@@ -323,6 +450,14 @@ func (esTraceStore *ESTraceStore) SearchDeviceTrace(parentSpan opentracing.Span,
 		search.SearchAfter(query.AfterCursor...)
 	}
 
+	if query.Highlight != nil {
+		search.Highlight(newESHighlight())
+	}
+
+	if query.Fields != nil {
+		search.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(sourceIncludes(query.Fields)...))
+	}
+
 	result, err := search.Do(context.Background())
 	if err != nil {
 		logger.Warn("Error executing search query", zap.Error(err))
@@ -346,38 +481,28 @@ func (esTraceStore *ESTraceStore) SearchDeviceTrace(parentSpan opentracing.Span,
 	}
 
 	if includeTotalCount {
-		tracePage.TotalCount = uint64(result.Hits.TotalHits.Value)
+		tracePage.TotalCount = uint64(result.TotalHits())
 	}
 
 	tracePage.HasMore = len(result.Hits.Hits) > int(tracePage.Limit)
 	tracePage.Data = make([]TraceResponse, 0, len(result.Hits.Hits))
 
-	if result.Hits.TotalHits.Value > 0 {
+	if len(result.Hits.Hits) > 0 {
 		for i, hit := range result.Hits.Hits {
 			if i >= int(tracePage.Limit) {
 				break
 			}
 
 			var trace Trace
-			var traceResponse TraceResponse
 
 			err = json.Unmarshal(hit.Source, &trace)
 			if err == nil {
-
-				traceResponse = TraceResponse {
-					AccountID  : trace.AccountID,
-					DeviceID   : trace.DeviceID,
-					ID         : trace.ID,
-					Object     : "device-trace",
-					CreatedAt  : trace.CreatedAt,
-					ETag       : trace.CreatedAt,
-					Timestamp  : trace.Timestring,
-					Type       : trace.Type,
-					AppName    : trace.AppName,
-					Message    : trace.Message,
+				response := NewTraceResponse(trace).Project(query.Fields)
+				if query.Highlight != nil {
+					response.Highlights = renderHighlights(hit.Highlight, *query.Highlight)
 				}
 
-				tracePage.Data = append(tracePage.Data, traceResponse)
+				tracePage.Data = append(tracePage.Data, response)
 			} else {
 				logger.Warn("Error decoding response as trace data: %v", zap.Error(err))
 
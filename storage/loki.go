@@ -0,0 +1,705 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// DefaultLokiMaxLookback is how far back the searches can look
+	DefaultLokiMaxLookback = 720 * time.Hour
+	// DefaultLokiQueryWindow is the longest time range of a single query, within the max_query_length of Loki
+	DefaultLokiQueryWindow = 720 * time.Hour
+	// LokiBatchSize is the number of log lines asked for in a query, within the max_entries_limit_per_query of Loki
+	LokiBatchSize = 1000
+
+	lokiPushPath       = "/loki/api/v1/push"
+	lokiQueryRangePath = "/loki/api/v1/query_range"
+	lokiQueryPath      = "/loki/api/v1/query"
+
+	// lokiWordBoundary is a character that is not part of a word for the standard analyzer
+	lokiWordBoundary = `[^\p{L}\p{Nd}_]`
+)
+
+// Errors that might be returned by LokiTraceStore
+var (
+	ErrCouldNotPushLogs    = errors.New("Failed to push the trace logs to Loki")
+	ErrQueryBeyondLookback = errors.New("The time range starts before the traces that can be searched")
+)
+
+// LokiTraceStore implements TraceStore on Grafana Loki. A trace is a log line of its message at its @timestamp in the
+// stream of its labels {account_id, device_id, app_name, type}. The id and the device timestamp of the trace are
+// structured metadata of the line, which needs Loki 2.9 or newer with structured metadata enabled.
+//
+// Searches are translated into LogQL and return the traces in the order of their ids, like ESTraceStore. The ids
+// that the service generates start with the @timestamp, so the lines are read in the order of their time and a page
+// continues from the time in the id of the cursor, whether the trace of the cursor exists or not. Device timestamps
+// are filters on the metadata. Searches look back at most MaxLookback from now and those whose time range starts
+// earlier are rejected with ErrQueryBeyondLookback. A lookback longer than QueryWindow is queried window by window
+type LokiTraceStore struct {
+	URL         string
+	Tenant      string
+	MaxLookback time.Duration
+	QueryWindow time.Duration
+	Client      *http.Client
+	Logger      *zap.Logger
+}
+
+// NewLokiTraceStore returns a LokiTraceStore on the Loki at lokiURL. tenant is sent as X-Scope-OrgID if not empty
+func NewLokiTraceStore(logger *zap.Logger, lokiURL string, tenant string) *LokiTraceStore {
+	return &LokiTraceStore{
+		URL:         strings.TrimSuffix(lokiURL, "/"),
+		Tenant:      tenant,
+		MaxLookback: DefaultLokiMaxLookback,
+		QueryWindow: DefaultLokiQueryWindow,
+		Client:      &http.Client{Timeout: CtxTimeout},
+		Logger:      logger,
+	}
+}
+
+// lokiStream is a stream of the push and query APIs. Values are the timestamp in nanoseconds, the line and, when
+// pushed, its structured metadata
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// lokiEntry is a trace that a query returned
+type lokiEntry struct {
+	Trace Trace
+}
+
+// time is the time of the log line, the @timestamp of the trace in milliseconds
+func (entry lokiEntry) time() int64 {
+	return entry.Trace.CloudTimestamp
+}
+
+func (entry lokiEntry) before(other lokiEntry) bool {
+	return entry.Trace.ID < other.Trace.ID
+}
+
+func (lokiTraceStore *LokiTraceStore) do(ctx context.Context, method string, path string, params url.Values, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	target := lokiTraceStore.URL + path
+	if params != nil {
+		target += "?" + params.Encode()
+	}
+
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	if lokiTraceStore.Tenant != "" {
+		request.Header.Set("X-Scope-OrgID", lokiTraceStore.Tenant)
+	}
+
+	response, err := lokiTraceStore.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	return responseBody, nil
+}
+
+// AddDeviceTrace pushes the traces to Loki, in one stream per set of labels
+func (lokiTraceStore *LokiTraceStore) AddDeviceTrace(parentSpan opentracing.Span, ctx context.Context, traces []Trace) error {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, lokiTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"LokiTraceStore.AddDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, lokiTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "AddDeviceTrace()"))
+
+	streams := make(map[string]*lokiStream)
+	var order []string
+
+	for _, trace := range traces {
+		labels := map[string]string{
+			"account_id": trace.AccountID,
+			"device_id":  trace.DeviceID,
+			"app_name":   trace.AppName,
+			"type":       trace.Type,
+		}
+
+		key := encodeJSON(labels)
+		if _, ok := streams[key]; !ok {
+			streams[key] = &lokiStream{Stream: labels}
+			order = append(order, key)
+		}
+
+		metadata := map[string]string{
+			"id":        trace.ID,
+			"timestamp": strconv.FormatInt(trace.Timestamp, 10),
+		}
+
+		streams[key].Values = append(streams[key].Values, []interface{}{
+			strconv.FormatInt(trace.CloudTimestamp*int64(time.Millisecond), 10),
+			trace.Message,
+			metadata,
+		})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+
+	for _, key := range order {
+		push.Streams = append(push.Streams, streams[key])
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return ErrCouldNotPushLogs
+	}
+
+	if _, err := lokiTraceStore.do(ctx, "POST", lokiPushPath, nil, body); err != nil {
+		logger.Warn("Fail to push the traces", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "push request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotPushLogs
+	}
+
+	return nil
+}
+
+// lokiWords returns a regular expression that matches any of the words of query, or false if query has no words
+func lokiWords(query string) (string, bool) {
+	words := textTokens(query)
+	if len(words) == 0 {
+		return "", false
+	}
+
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+
+	return "(" + strings.Join(words, "|") + ")", true
+}
+
+// lokiLabelWords returns a label matcher regular expression for a text field, which Loki anchors to the whole value
+func lokiLabelWords(query string) (string, bool) {
+	words, ok := lokiWords(query)
+	if !ok {
+		return "", false
+	}
+
+	return "(?i)(|.*" + lokiWordBoundary + ")" + words + "(|" + lokiWordBoundary + ".*)", true
+}
+
+// buildLogQL translates the filters of query into a LogQL log query, as buildESBoolQuery does. It returns false if
+// query matches nothing
+func buildLogQL(query TraceQuery) (string, bool) {
+	var matchers []string
+
+	if query.Account != "" {
+		matchers = append(matchers, "account_id="+strconv.Quote(query.Account))
+	} else {
+		matchers = append(matchers, `account_id=~".+"`)
+	}
+
+	if query.Device != nil {
+		switch len(query.Device) {
+		case 0:
+			return "", false
+		case 1:
+			matchers = append(matchers, "device_id="+strconv.Quote(query.Device[0]))
+		default:
+			devices := make([]string, 0, len(query.Device))
+			for _, device := range query.Device {
+				devices = append(devices, regexp.QuoteMeta(device))
+			}
+
+			matchers = append(matchers, "device_id=~"+strconv.Quote(strings.Join(devices, "|")))
+		}
+	}
+
+	if query.AppName != "" {
+		words, ok := lokiLabelWords(query.AppName)
+		if !ok {
+			return "", false
+		}
+
+		matchers = append(matchers, "app_name=~"+strconv.Quote(words))
+	}
+
+	if query.Type != "" {
+		words, ok := lokiLabelWords(query.Type)
+		if !ok {
+			return "", false
+		}
+
+		matchers = append(matchers, "type=~"+strconv.Quote(words))
+	}
+
+	if query.Types != nil {
+		if len(query.Types) == 0 {
+			return "", false
+		}
+
+		types := make([]string, 0, len(query.Types))
+		for _, traceType := range query.Types {
+			types = append(types, regexp.QuoteMeta(traceType))
+		}
+
+		matchers = append(matchers, "type=~"+strconv.Quote(strings.Join(types, "|")))
+	}
+
+	for _, excludedType := range query.ExcludeTypes {
+		matchers = append(matchers, "type!="+strconv.Quote(excludedType))
+	}
+
+	logQL := "{" + strings.Join(matchers, ", ") + "}"
+
+	if query.Message != "" {
+		words, ok := lokiWords(query.Message)
+		if !ok {
+			return "", false
+		}
+
+		logQL += " |~ " + strconv.Quote("(?i)(^|"+lokiWordBoundary+")"+words+"($|"+lokiWordBoundary+")")
+	}
+
+	if query.ID != "" {
+		logQL += " | id=" + strconv.Quote(query.ID)
+	}
+
+	if !query.After.IsZero() {
+		logQL += " | timestamp >= " + strconv.FormatInt(unixMilliseconds(query.After), 10)
+	}
+
+	if !query.Before.IsZero() {
+		logQL += " | timestamp <= " + strconv.FormatInt(unixMilliseconds(query.Before), 10)
+	}
+
+	return logQL, true
+}
+
+// timeRange returns the range of the @timestamp of the traces of query in milliseconds, start included and end
+// excluded. The device timestamps do not bound the @timestamp, so the range starts MaxLookback ago or at CreatedAfter,
+// whichever is later. It fails with ErrQueryBeyondLookback if the device time range of query starts or ends before
+// MaxLookback ago
+func (lokiTraceStore *LokiTraceStore) timeRange(query TraceQuery) (int64, int64, error) {
+	now := unixMilliseconds(time.Now())
+	oldest := now - int64(lokiTraceStore.MaxLookback/time.Millisecond)
+
+	if !query.After.IsZero() && unixMilliseconds(query.After) < oldest {
+		return 0, 0, ErrQueryBeyondLookback
+	}
+
+	if !query.Before.IsZero() && unixMilliseconds(query.Before) < oldest {
+		return 0, 0, ErrQueryBeyondLookback
+	}
+
+	end := now + 1
+	if !query.CreatedBefore.IsZero() && unixMilliseconds(query.CreatedBefore)+1 < end {
+		end = unixMilliseconds(query.CreatedBefore) + 1
+	}
+
+	start := oldest
+	if !query.CreatedAfter.IsZero() && unixMilliseconds(query.CreatedAfter) > start {
+		start = unixMilliseconds(query.CreatedAfter)
+	}
+
+	return start, end, nil
+}
+
+// windows splits [start, end) into time ranges of at most QueryWindow, in the order of forward
+func (lokiTraceStore *LokiTraceStore) windows(start int64, end int64, forward bool) [][2]int64 {
+	size := int64(lokiTraceStore.QueryWindow / time.Millisecond)
+	if size <= 0 {
+		size = end - start
+	}
+
+	var windows [][2]int64
+
+	for windowStart := start; windowStart < end; windowStart += size {
+		windowEnd := windowStart + size
+		if windowEnd > end {
+			windowEnd = end
+		}
+
+		windows = append(windows, [2]int64{windowStart, windowEnd})
+	}
+
+	if !forward {
+		for i, j := 0, len(windows)-1; i < j; i, j = i+1, j-1 {
+			windows[i], windows[j] = windows[j], windows[i]
+		}
+	}
+
+	return windows
+}
+
+// queryRange returns up to limit traces of logQL whose @timestamp is in [start, end), in the order of forward
+func (lokiTraceStore *LokiTraceStore) queryRange(ctx context.Context, logQL string, start int64, end int64, forward bool, limit int) ([]lokiEntry, error) {
+	direction := "backward"
+	if forward {
+		direction = "forward"
+	}
+
+	params := url.Values{}
+	params.Set("query", logQL)
+	params.Set("start", strconv.FormatInt(start*int64(time.Millisecond), 10))
+	params.Set("end", strconv.FormatInt(end*int64(time.Millisecond), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", direction)
+
+	body, err := lokiTraceStore.do(ctx, "GET", lokiQueryRangePath, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Data struct {
+			Result []lokiStream `json:"result"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	var entries []lokiEntry
+
+	for _, stream := range response.Data.Result {
+		for _, value := range stream.Values {
+			if len(value) < 2 {
+				return nil, ErrCouldNotUnmarshalLogs
+			}
+
+			timestamp, _ := value[0].(string)
+			line, _ := value[1].(string)
+
+			nanoseconds, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			deviceTimestamp, _ := strconv.ParseInt(stream.Stream["timestamp"], 10, 64)
+
+			trace := Trace{
+				AccountID:      stream.Stream["account_id"],
+				DeviceID:       stream.Stream["device_id"],
+				ID:             stream.Stream["id"],
+				Timestamp:      deviceTimestamp,
+				AppName:        stream.Stream["app_name"],
+				Message:        line,
+				Type:           stream.Stream["type"],
+				CloudTimestamp: nanoseconds / int64(time.Millisecond),
+			}
+
+			trace.Timestring = Date(trace.Timestamp)
+			trace.CreatedAt = Date(trace.CloudTimestamp)
+
+			entries = append(entries, lokiEntry{Trace: trace})
+		}
+	}
+
+	// The entries come grouped by stream
+	sort.SliceStable(entries, func(i, j int) bool {
+		if forward {
+			return entries[i].time() < entries[j].time()
+		}
+
+		return entries[i].time() > entries[j].time()
+	})
+
+	return entries, nil
+}
+
+// collect pages through [start, end) window by window in the order of forward, and returns the traces of logQL that
+// keep accepts. It stops once it has more than limit traces and every trace with the time of the last of them, so that
+// the traces of the same millisecond can be sorted by id
+func (lokiTraceStore *LokiTraceStore) collect(ctx context.Context, logQL string, start int64, end int64, forward bool, limit int, keep func(lokiEntry) bool) ([]lokiEntry, error) {
+	var collected []lokiEntry
+	full := false
+	var lastTimestamp int64
+
+	for _, window := range lokiTraceStore.windows(start, end, forward) {
+		windowStart, windowEnd := window[0], window[1]
+
+		// The ids already seen with the timestamp that the next query of the window starts from
+		var boundary int64 = -1
+		seen := make(map[string]bool)
+
+		for {
+			batch, err := lokiTraceStore.queryRange(ctx, logQL, windowStart, windowEnd, forward, LokiBatchSize)
+			if err != nil {
+				return nil, err
+			}
+
+			progress := false
+
+			for _, entry := range batch {
+				if full && entry.time() != lastTimestamp {
+					return collected, nil
+				}
+
+				if entry.time() != boundary {
+					boundary = entry.time()
+					seen = make(map[string]bool)
+				}
+
+				if seen[entry.Trace.ID] {
+					continue
+				}
+
+				seen[entry.Trace.ID] = true
+				progress = true
+
+				if keep(entry) {
+					collected = append(collected, entry)
+
+					if len(collected) > limit && !full {
+						full = true
+						lastTimestamp = entry.time()
+					}
+				}
+			}
+
+			if len(batch) < LokiBatchSize {
+				break
+			}
+
+			if !progress {
+				lokiTraceStore.Logger.Warn("collect(): More traces than a batch share a timestamp, some are skipped", zap.Int64("timestamp", boundary))
+				break
+			}
+
+			// The window continues from the timestamp of the last trace, whose traces are fetched again
+			if forward {
+				windowStart = boundary
+			} else {
+				windowEnd = boundary + 1
+			}
+		}
+	}
+
+	return collected, nil
+}
+
+// count returns the number of traces of logQL in [start, end)
+func (lokiTraceStore *LokiTraceStore) count(ctx context.Context, logQL string, start int64, end int64) (uint64, error) {
+	var total uint64
+
+	for _, window := range lokiTraceStore.windows(start, end, true) {
+		// count_over_time counts the range before the evaluation time, with the evaluation time included
+		params := url.Values{}
+		params.Set("query", fmt.Sprintf("sum(count_over_time(%s [%dms]))", logQL, window[1]-window[0]))
+		params.Set("time", strconv.FormatInt((window[1]-1)*int64(time.Millisecond), 10))
+
+		body, err := lokiTraceStore.do(ctx, "GET", lokiQueryPath, params, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		var response struct {
+			Data struct {
+				Result []struct {
+					Value []interface{} `json:"value"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+
+		if err := json.Unmarshal(body, &response); err != nil {
+			return 0, err
+		}
+
+		for _, sample := range response.Data.Result {
+			if len(sample.Value) != 2 {
+				return 0, ErrCouldNotUnmarshalLogs
+			}
+
+			value, _ := sample.Value[1].(string)
+
+			count, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, err
+			}
+
+			total += uint64(count)
+		}
+	}
+
+	return total, nil
+}
+
+// SearchDeviceTrace returns a page of the traces matching query, sorted by id
+func (lokiTraceStore *LokiTraceStore) SearchDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, includeTotalCount bool) (TracePage, error) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, lokiTraceStore.Logger)
+
+	span := opentracing.StartSpan(
+		"LokiTraceStore.SearchDeviceTrace",
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+	defer span.Finish()
+
+	logger := edge_log.WithContext(ctx, lokiTraceStore.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", "SearchDeviceTrace()"))
+
+	var tracePage TracePage
+	tracePage.Object = "list"
+	tracePage.Limit = query.Limit
+	tracePage.Data = make([]TraceResponse, 0)
+	if query.Sort == true {
+		tracePage.Order = "ASC"
+	} else {
+		tracePage.Order = "DESC"
+	}
+
+	if query.AfterCursor != nil {
+		tracePage.After = query.AfterCursor[0]
+	}
+
+	logQL, ok := buildLogQL(query)
+	if !ok {
+		return tracePage, nil
+	}
+
+	span.LogFields(
+		trace_log.String("event", "build logql query"),
+		trace_log.String("message", "search query prepared"),
+		trace_log.String("logQL", logQL),
+	)
+
+	fail := func(err error) (TracePage, error) {
+		logger.Warn("Error executing LogQL query", zap.String("logQL", logQL), zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "logql query failed"),
+			trace_log.Error(err),
+		)
+
+		return TracePage{}, ErrCouldNotQueryLogs
+	}
+
+	start, end, err := lokiTraceStore.timeRange(query)
+	if err != nil {
+		logger.Warn("The time range of the query starts before the lookback", zap.Duration("max_lookback", lokiTraceStore.MaxLookback))
+
+		return TracePage{}, err
+	}
+
+	if includeTotalCount {
+		total, err := lokiTraceStore.count(ctx, logQL, start, end)
+		if err != nil {
+			return fail(err)
+		}
+
+		tracePage.TotalCount = total
+	}
+
+	keep := func(lokiEntry) bool { return true }
+
+	// The page continues after the id of the cursor, from the time that the id starts with. The trace of an id in
+	// another format is looked up among the traces of the account for its time
+	if len(query.AfterCursor) > 0 {
+		cursorID, _ := query.AfterCursor[0].(string)
+		cursor := lokiEntry{Trace: Trace{ID: cursorID}}
+
+		cursorTime, ok := IDTimestamp(cursorID)
+		if !ok {
+			cursorLogQL, _ := buildLogQL(TraceQuery{Account: query.Account, ID: cursorID})
+
+			found, err := lokiTraceStore.collect(ctx, cursorLogQL, start, end, query.Sort, 0, keep)
+			if err != nil {
+				return fail(err)
+			}
+
+			if len(found) == 0 {
+				return tracePage, nil
+			}
+
+			cursorTime = found[0].time()
+		}
+
+		if query.Sort {
+			if cursorTime > start {
+				start = cursorTime
+			}
+
+			keep = func(entry lokiEntry) bool { return cursor.before(entry) }
+		} else {
+			if cursorTime+1 < end {
+				end = cursorTime + 1
+			}
+
+			keep = func(entry lokiEntry) bool { return entry.before(cursor) }
+		}
+	}
+
+	entries, err := lokiTraceStore.collect(ctx, logQL, start, end, query.Sort, int(query.Limit), keep)
+	if err != nil {
+		return fail(err)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if query.Sort {
+			return entries[i].before(entries[j])
+		}
+
+		return entries[j].before(entries[i])
+	})
+
+	tracePage.HasMore = len(entries) > int(query.Limit)
+	if tracePage.HasMore {
+		entries = entries[:query.Limit]
+	}
+
+	for _, entry := range entries {
+		response := NewTraceResponse(entry.Trace).Project(query.Fields)
+		if query.Highlight != nil {
+			response.Highlights = renderHighlights(highlightTrace(entry.Trace, query), *query.Highlight)
+		}
+
+		tracePage.Data = append(tracePage.Data, response)
+	}
+
+	return tracePage, nil
+}
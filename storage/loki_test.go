@@ -0,0 +1,68 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage/storagetest"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// fixtureLookback is a lookback that covers the traces of the fixture
+func fixtureLookback() time.Duration {
+	oldest := time.Now()
+	for _, trace := range storagetest.Fixture() {
+		if timestamp := time.Unix(0, trace.Timestamp*int64(time.Millisecond)); timestamp.Before(oldest) {
+			oldest = timestamp
+		}
+	}
+
+	return time.Since(oldest) + 24*time.Hour
+}
+
+func TestLokiTraceStore(t *testing.T) {
+	stub := storagetest.NewStubLoki()
+	defer stub.Close()
+
+	storagetest.TestTraceStore(t, func(t *testing.T) (storage.TraceStore, error) {
+		stub.Reset()
+
+		store := storage.NewLokiTraceStore(zap.NewNop(), stub.URL, "")
+		store.MaxLookback = fixtureLookback()
+
+		return store, nil
+	})
+}
+
+func TestLokiTraceStoreLookback(t *testing.T) {
+	stub := storagetest.NewStubLoki()
+	defer stub.Close()
+
+	store := storage.NewLokiTraceStore(zap.NewNop(), stub.URL, "")
+
+	span := opentracing.StartSpan("TestLokiTraceStoreLookback")
+	defer span.Finish()
+
+	ctx := context.WithValue(context.Background(), httputil.ContextKeyRequestID, "test")
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, "account")
+
+	queries := map[string]storage.TraceQuery{
+		"start before the lookback": {Account: "account", Limit: 10, After: time.Now().Add(-storage.DefaultLokiMaxLookback - time.Hour)},
+		"end before the lookback":   {Account: "account", Limit: 10, Before: time.Now().Add(-storage.DefaultLokiMaxLookback - time.Hour)},
+	}
+
+	for name, query := range queries {
+		if _, err := store.SearchDeviceTrace(span, ctx, query, true); err != storage.ErrQueryBeyondLookback {
+			t.Errorf("%s: error %v, want %v", name, err, storage.ErrQueryBeyondLookback)
+		}
+	}
+
+	if _, err := store.SearchDeviceTrace(span, ctx, storage.TraceQuery{Account: "account", Limit: 10, After: time.Now().Add(-time.Hour)}, true); err != nil {
+		t.Errorf("start within the lookback: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DefaultMemoryMaxTraces = 100000
+)
+
+// MemoryTraceStore implements TraceStore in memory, for running the service locally and for tests. It follows the
+// query semantics of ESTraceStore. Text fields match like the standard analyzer of elastic search, on any of the
+// lower cased words of the query. The oldest traces are dropped once it holds MaxTraces
+type MemoryTraceStore struct {
+	MaxTraces int
+
+	lock   sync.RWMutex
+	traces []Trace
+}
+
+// NewMemoryTraceStore returns an empty MemoryTraceStore that holds up to maxTraces traces, or any number if 0
+func NewMemoryTraceStore(maxTraces int) *MemoryTraceStore {
+	return &MemoryTraceStore{MaxTraces: maxTraces}
+}
+
+// AddDeviceTrace stores the traces
+func (memoryTraceStore *MemoryTraceStore) AddDeviceTrace(parentSpan opentracing.Span, ctx context.Context, traces []Trace) error {
+	memoryTraceStore.lock.Lock()
+	defer memoryTraceStore.lock.Unlock()
+
+	for _, trace := range traces {
+		trace.Timestring = Date(trace.Timestamp)
+		trace.CreatedAt = Date(trace.CloudTimestamp)
+		memoryTraceStore.traces = append(memoryTraceStore.traces, trace)
+	}
+
+	if memoryTraceStore.MaxTraces > 0 && len(memoryTraceStore.traces) > memoryTraceStore.MaxTraces {
+		dropped := len(memoryTraceStore.traces) - memoryTraceStore.MaxTraces
+		memoryTraceStore.traces = append([]Trace(nil), memoryTraceStore.traces[dropped:]...)
+	}
+
+	return nil
+}
+
+// SearchDeviceTrace returns a page of the traces matching query, sorted by id
+func (memoryTraceStore *MemoryTraceStore) SearchDeviceTrace(parentSpan opentracing.Span, ctx context.Context, query TraceQuery, includeTotalCount bool) (TracePage, error) {
+	memoryTraceStore.lock.RLock()
+	matched := make([]Trace, 0)
+	for _, trace := range memoryTraceStore.traces {
+		if matchesTraceQuery(trace, query) {
+			matched = append(matched, trace)
+		}
+	}
+	memoryTraceStore.lock.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if query.Sort {
+			return matched[i].ID < matched[j].ID
+		}
+
+		return matched[i].ID > matched[j].ID
+	})
+
+	var tracePage TracePage
+	tracePage.Object = "list"
+	tracePage.Limit = query.Limit
+	if query.Sort == true {
+		tracePage.Order = "ASC"
+	} else {
+		tracePage.Order = "DESC"
+	}
+
+	// The total count is the count of the query, whatever the cursor
+	if includeTotalCount {
+		tracePage.TotalCount = uint64(len(matched))
+	}
+
+	if len(query.AfterCursor) > 0 {
+		cursor, _ := query.AfterCursor[0].(string)
+
+		start := sort.Search(len(matched), func(i int) bool {
+			if query.Sort {
+				return matched[i].ID > cursor
+			}
+
+			return matched[i].ID < cursor
+		})
+
+		matched = matched[start:]
+	}
+
+	tracePage.HasMore = len(matched) > int(tracePage.Limit)
+	if tracePage.HasMore {
+		matched = matched[:tracePage.Limit]
+	}
+
+	tracePage.Data = make([]TraceResponse, 0, len(matched))
+	for _, trace := range matched {
+		response := NewTraceResponse(trace).Project(query.Fields)
+		if query.Highlight != nil {
+			response.Highlights = renderHighlights(highlightTrace(trace, query), *query.Highlight)
+		}
+
+		tracePage.Data = append(tracePage.Data, response)
+	}
+
+	if query.AfterCursor != nil {
+		tracePage.After = query.AfterCursor[0]
+	}
+
+	return tracePage, nil
+}
+
+// matchesTraceQuery reports whether trace matches the filters of query, as buildESBoolQuery does
+func matchesTraceQuery(trace Trace, query TraceQuery) bool {
+	if query.Device != nil && !containsString(query.Device, trace.DeviceID) {
+		return false
+	}
+
+	if query.Account != "" && trace.AccountID != query.Account {
+		return false
+	}
+
+	if query.AppName != "" && !matchesText(trace.AppName, query.AppName) {
+		return false
+	}
+
+	if query.Type != "" && !matchesText(trace.Type, query.Type) {
+		return false
+	}
+
+	if query.Types != nil && !containsString(query.Types, trace.Type) {
+		return false
+	}
+
+	if containsString(query.ExcludeTypes, trace.Type) {
+		return false
+	}
+
+	if query.Message != "" && !matchesText(trace.Message, query.Message) {
+		return false
+	}
+
+	if !query.Before.IsZero() && trace.Timestamp > unixMilliseconds(query.Before) {
+		return false
+	}
+
+	if !query.After.IsZero() && trace.Timestamp < unixMilliseconds(query.After) {
+		return false
+	}
+
+	if !query.CreatedBefore.IsZero() && trace.CloudTimestamp > unixMilliseconds(query.CreatedBefore) {
+		return false
+	}
+
+	if !query.CreatedAfter.IsZero() && trace.CloudTimestamp < unixMilliseconds(query.CreatedAfter) {
+		return false
+	}
+
+	if query.ID != "" && trace.ID != query.ID {
+		return false
+	}
+
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWordRune reports whether r is part of a word for the standard analyzer
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// textTokens splits text into lower cased words
+func textTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// matchesText reports whether text has any of the words of query. A query without words matches nothing
+func matchesText(text string, query string) bool {
+	words := make(map[string]bool)
+	for _, token := range textTokens(query) {
+		words[token] = true
+	}
+
+	for _, token := range textTokens(text) {
+		if words[token] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// highlightTrace marks the words of the text queries in the fields they were searched in, like newESHighlight
+func highlightTrace(trace Trace, query TraceQuery) map[string][]string {
+	highlight := make(map[string][]string)
+
+	if query.Message != "" {
+		if marked, ok := markWords(trace.Message, query.Message); ok {
+			highlight["message"] = []string{marked}
+		}
+	}
+
+	if query.AppName != "" {
+		if marked, ok := markWords(trace.AppName, query.AppName); ok {
+			highlight["app_name"] = []string{marked}
+		}
+	}
+
+	return highlight
+}
+
+// markWords surrounds the words of text that are in query with the highlight markers
+func markWords(text string, query string) (string, bool) {
+	words := make(map[string]bool)
+	for _, token := range textTokens(query) {
+		words[token] = true
+	}
+
+	var marked strings.Builder
+	var word strings.Builder
+	found := false
+
+	flush := func() {
+		if word.Len() == 0 {
+			return
+		}
+
+		if words[strings.ToLower(word.String())] {
+			found = true
+			marked.WriteString(highlightPreMarker + word.String() + highlightPostMarker)
+		} else {
+			marked.WriteString(word.String())
+		}
+
+		word.Reset()
+	}
+
+	for _, r := range text {
+		if isWordRune(r) {
+			word.WriteRune(r)
+			continue
+		}
+
+		flush()
+		marked.WriteRune(r)
+	}
+
+	flush()
+
+	return marked.String(), found
+}
@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage/storagetest"
+)
+
+func TestMemoryTraceStore(t *testing.T) {
+	storagetest.TestTraceStore(t, func(t *testing.T) (storage.TraceStore, error) {
+		return storage.NewMemoryTraceStore(0), nil
+	})
+}
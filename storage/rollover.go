@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// RolloverConditions are the conditions of which any rolls the active index over. Empty conditions are not set
+type RolloverConditions struct {
+	MaxAge  string
+	MaxDocs int64
+	MaxSize string
+}
+
+// Empty reports whether no condition is set. A rollover without conditions is unconditional
+func (conditions RolloverConditions) Empty() bool {
+	return conditions.MaxAge == "" && conditions.MaxDocs <= 0 && conditions.MaxSize == ""
+}
+
+// RolloverResult is the outcome of a rollover request
+type RolloverResult struct {
+	RolledOver bool
+	OldIndex   string
+	NewIndex   string
+	Conditions map[string]bool
+}
+
+// RolloverIndex rolls the index behind alias over to a new index if any of conditions is met. alias is one of
+// ActiveAliases
+func (esTraceStore *ESTraceStore) RolloverIndex(ctx context.Context, alias string, conditions RolloverConditions) (RolloverResult, error) {
+	if conditions.Empty() {
+		return RolloverResult{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CtxTimeout)
+	defer cancel()
+
+	request := esTraceStore.ElasticSearchClient.RolloverIndex(alias)
+
+	if conditions.MaxAge != "" {
+		request.AddMaxIndexAgeCondition(conditions.MaxAge)
+	}
+
+	if conditions.MaxDocs > 0 {
+		request.AddMaxIndexDocsCondition(conditions.MaxDocs)
+	}
+
+	if conditions.MaxSize != "" {
+		request.AddCondition("max_size", conditions.MaxSize)
+	}
+
+	response, err := request.Do(ctx)
+	if err != nil {
+		esTraceStore.Logger.Error("RolloverIndex(): Could not roll the active index over", zap.String("alias", alias), zap.Error(err))
+		return RolloverResult{}, ErrCouldNotRollOverLog
+	}
+
+	return RolloverResult{RolledOver: response.RolledOver, OldIndex: response.OldIndex, NewIndex: response.NewIndex, Conditions: response.Conditions}, nil
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+const (
+	// TenantModeIndex places the traces of an account in a dedicated index family
+	TenantModeIndex = "index"
+	// TenantModeRouting keeps the traces of an account in the shared indices, on the shard of its account id
+	TenantModeRouting = "routing"
+
+	DefaultTenantIndexPrefix = "device-trace-tenant"
+)
+
+// Errors that might be returned by the tenant routing
+var (
+	ErrInvalidTenantRouting  = errors.New("Invalid tenant routing configuration")
+	ErrTenantNotRouted       = errors.New("The account has no tenant routing")
+	ErrCouldNotMigrateTenant = errors.New("Failed to migrate the traces of the tenant")
+)
+
+var (
+	validTenantFamily         = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+	tenantMigrationIndexChars = regexp.MustCompile(`[^a-z0-9_-]`)
+)
+
+// Tenant is the routing of the traces of one account. Until Migrated is set, searches also cover the traces the
+// account wrote before it was routed
+type Tenant struct {
+	AccountID string `json:"account_id"`
+	Mode      string `json:"mode"`
+	Family    string `json:"family,omitempty"`
+	Migrated  bool   `json:"migrated"`
+}
+
+// IndexRouting routes the traces of designated accounts away from the shared aliases. Accounts without a tenant
+// use the shared aliases
+type IndexRouting struct {
+	Tenants      map[string]Tenant
+	FamilyPrefix string
+}
+
+// LoadIndexRouting reads the tenants from the JSON file at path, in the form {"tenants": [...]}
+func LoadIndexRouting(path string, familyPrefix string) (*IndexRouting, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Tenants []Tenant `json:"tenants"`
+	}
+
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrInvalidTenantRouting, err)
+	}
+
+	routing := &IndexRouting{Tenants: make(map[string]Tenant, len(file.Tenants)), FamilyPrefix: familyPrefix}
+
+	for _, tenant := range file.Tenants {
+		if tenant.AccountID == "" {
+			return nil, fmt.Errorf("%s: a tenant has no account_id", ErrInvalidTenantRouting)
+		}
+
+		if _, ok := routing.Tenants[tenant.AccountID]; ok {
+			return nil, fmt.Errorf("%s: account %s is listed twice", ErrInvalidTenantRouting, tenant.AccountID)
+		}
+
+		switch tenant.Mode {
+		case TenantModeIndex:
+			if !validTenantFamily.MatchString(tenant.Family) {
+				return nil, fmt.Errorf("%s: account %s needs a family of lower case letters, digits and underscores", ErrInvalidTenantRouting, tenant.AccountID)
+			}
+		case TenantModeRouting:
+			if tenant.Family != "" {
+				return nil, fmt.Errorf("%s: account %s is routed, it cannot have a family", ErrInvalidTenantRouting, tenant.AccountID)
+			}
+		default:
+			return nil, fmt.Errorf("%s: account %s has mode '%s', acceptable modes are index and routing", ErrInvalidTenantRouting, tenant.AccountID, tenant.Mode)
+		}
+
+		routing.Tenants[tenant.AccountID] = tenant
+	}
+
+	return routing, nil
+}
+
+// Tenant returns the tenant of accountID, if it has one
+func (routing *IndexRouting) Tenant(accountID string) (Tenant, bool) {
+	if routing == nil {
+		return Tenant{}, false
+	}
+
+	tenant, ok := routing.Tenants[accountID]
+
+	return tenant, ok
+}
+
+// Families returns the dedicated index families, sorted
+func (routing *IndexRouting) Families() []string {
+	if routing == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var families []string
+
+	for _, tenant := range routing.Tenants {
+		if tenant.Mode == TenantModeIndex && !seen[tenant.Family] {
+			seen[tenant.Family] = true
+			families = append(families, tenant.Family)
+		}
+	}
+
+	sort.Strings(families)
+
+	return families
+}
+
+// FamilyAliases returns the active and the search alias of an index family
+func (routing *IndexRouting) FamilyAliases(family string) (string, string) {
+	prefix := routing.FamilyPrefix + "-" + family
+
+	return prefix + "-active-logs", prefix + "-search-logs"
+}
+
+// ActiveAliases returns the shared active alias and the active alias of every index family
+func (esTraceStore *ESTraceStore) ActiveAliases() []string {
+	aliases := []string{esTraceStore.ElasticActiveAlias}
+
+	for _, family := range esTraceStore.Routing.Families() {
+		active, _ := esTraceStore.Routing.FamilyAliases(family)
+		aliases = append(aliases, active)
+	}
+
+	return aliases
+}
+
+// writeTarget returns the index and the routing that the traces of accountID are written with
+func (esTraceStore *ESTraceStore) writeTarget(accountID string) (string, string) {
+	tenant, ok := esTraceStore.Routing.Tenant(accountID)
+	if !ok {
+		return esTraceStore.ElasticActiveAlias, ""
+	}
+
+	if tenant.Mode == TenantModeRouting {
+		return esTraceStore.ElasticActiveAlias, accountID
+	}
+
+	active, _ := esTraceStore.Routing.FamilyAliases(tenant.Family)
+
+	return active, ""
+}
+
+// searchTarget returns the indices and the routing that the traces of accountID are searched with. Queries without
+// an account search every index family
+func (esTraceStore *ESTraceStore) searchTarget(accountID string) ([]string, string) {
+	if accountID == "" {
+		indices := []string{esTraceStore.ElasticSearchAlias}
+
+		for _, family := range esTraceStore.Routing.Families() {
+			_, search := esTraceStore.Routing.FamilyAliases(family)
+			indices = append(indices, search)
+		}
+
+		return indices, ""
+	}
+
+	tenant, ok := esTraceStore.Routing.Tenant(accountID)
+	if !ok {
+		return []string{esTraceStore.ElasticSearchAlias}, ""
+	}
+
+	if tenant.Mode == TenantModeRouting {
+		if tenant.Migrated {
+			return []string{esTraceStore.ElasticSearchAlias}, accountID
+		}
+
+		// Traces written before the account was routed can be on any shard
+		return []string{esTraceStore.ElasticSearchAlias}, ""
+	}
+
+	_, search := esTraceStore.Routing.FamilyAliases(tenant.Family)
+
+	if tenant.Migrated {
+		return []string{search}, ""
+	}
+
+	return []string{search, esTraceStore.ElasticSearchAlias}, ""
+}
+
+// TenantMigration is the outcome of moving the traces of a tenant
+type TenantMigration struct {
+	AccountID string `json:"account_id"`
+	Mode      string `json:"mode"`
+	Moved     int64  `json:"moved"`
+	Deleted   int64  `json:"deleted"`
+}
+
+// MigrateTenant moves the traces that accountID wrote before it was routed to where its tenant routes them. The
+// traces are copied before the originals are deleted, so that none are missing while it runs
+func (esTraceStore *ESTraceStore) MigrateTenant(ctx context.Context, accountID string) (TenantMigration, error) {
+	tenant, ok := esTraceStore.Routing.Tenant(accountID)
+	if !ok {
+		return TenantMigration{}, ErrTenantNotRouted
+	}
+
+	logger := esTraceStore.Logger.With(zap.String("account_id", accountID)).With(zap.String("function", "MigrateTenant()"))
+	migration := TenantMigration{AccountID: accountID, Mode: tenant.Mode}
+
+	accountQuery := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("account_id", accountID))
+
+	if tenant.Mode == TenantModeIndex {
+		active, _ := esTraceStore.Routing.FamilyAliases(tenant.Family)
+
+		// Traces that were copied by an earlier run already exist with the same id
+		moved, err := esTraceStore.ElasticSearchClient.Reindex().
+			Source(elastic.NewReindexSource().Index(esTraceStore.ElasticSearchAlias).Query(accountQuery)).
+			Destination(elastic.NewReindexDestination().Index(active).OpType("create")).
+			Conflicts("proceed").
+			Slices("auto").
+			Refresh("true").
+			WaitForCompletion(true).
+			Do(ctx)
+		if err != nil {
+			logger.Error("Could not copy the traces to the index family", zap.String("family", tenant.Family), zap.Error(err))
+			return migration, ErrCouldNotMigrateTenant
+		}
+
+		migration.Moved = moved.Created
+
+		deleted, err := esTraceStore.ElasticSearchClient.DeleteByQuery(esTraceStore.ElasticSearchAlias).
+			Query(accountQuery).
+			ProceedOnVersionConflict().
+			Slices("auto").
+			Refresh("true").
+			Do(ctx)
+		if err != nil {
+			logger.Error("Could not delete the copied traces from the shared indices", zap.Error(err))
+			return migration, ErrCouldNotMigrateTenant
+		}
+
+		migration.Deleted = deleted.Deleted
+
+		return migration, nil
+	}
+
+	// An index cannot be reindexed into itself, the unrouted traces are copied through a temporary index
+	unrouted := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("account_id", accountID)).
+		MustNot(elastic.NewTermQuery("_routing", accountID))
+	temporary := "tenant-migration-" + tenantMigrationIndexChars.ReplaceAllString(strings.ToLower(esTraceStore.ElasticActiveAlias+"-"+accountID), "_")
+
+	if _, err := esTraceStore.ElasticSearchClient.DeleteIndex(temporary).Do(ctx); err != nil && !elastic.IsNotFound(err) {
+		logger.Error("Could not remove the temporary index of an earlier run", zap.String("index", temporary), zap.Error(err))
+		return migration, ErrCouldNotMigrateTenant
+	}
+
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+		defer cancel()
+
+		if _, err := esTraceStore.ElasticSearchClient.DeleteIndex(temporary).Do(cleanupCtx); err != nil && !elastic.IsNotFound(err) {
+			logger.Warn("Could not remove the temporary index", zap.String("index", temporary), zap.Error(err))
+		}
+	}()
+
+	if _, err := esTraceStore.ElasticSearchClient.CreateIndex(temporary).BodyJson(map[string]interface{}{"mappings": traceMappings}).Do(ctx); err != nil {
+		logger.Error("Could not create the temporary index", zap.String("index", temporary), zap.Error(err))
+		return migration, ErrCouldNotMigrateTenant
+	}
+
+	if _, err := esTraceStore.ElasticSearchClient.Reindex().
+		Source(elastic.NewReindexSource().Index(esTraceStore.ElasticSearchAlias).Query(unrouted)).
+		Destination(elastic.NewReindexDestination().Index(temporary)).
+		Slices("auto").
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(ctx); err != nil {
+		logger.Error("Could not copy the traces to the temporary index", zap.String("index", temporary), zap.Error(err))
+		return migration, ErrCouldNotMigrateTenant
+	}
+
+	moved, err := esTraceStore.ElasticSearchClient.Reindex().
+		Source(elastic.NewReindexSource().Index(temporary)).
+		Destination(elastic.NewReindexDestination().Index(esTraceStore.ElasticActiveAlias)).
+		Script(elastic.NewScript("ctx._routing = ctx._source.account_id")).
+		Slices("auto").
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(ctx)
+	if err != nil {
+		logger.Error("Could not copy the traces back with their routing", zap.Error(err))
+		return migration, ErrCouldNotMigrateTenant
+	}
+
+	migration.Moved = moved.Created + moved.Updated
+
+	deleted, err := esTraceStore.ElasticSearchClient.DeleteByQuery(esTraceStore.ElasticSearchAlias).
+		Query(unrouted).
+		ProceedOnVersionConflict().
+		Slices("auto").
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		logger.Error("Could not delete the unrouted traces", zap.Error(err))
+		return migration, ErrCouldNotMigrateTenant
+	}
+
+	migration.Deleted = deleted.Deleted
+
+	return migration, nil
+}
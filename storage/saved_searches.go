@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	edge_log "github.com/armPelionEdge/edge-gw-trace-service/log"
+
+	"go.uber.org/zap"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	trace_log "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	MaxSavedSearchesPerAccount = 100
+	MaxSavedSearchNameLength   = 128
+)
+
+// TraceColumns lists the columns of a trace that a saved search can display
+var TraceColumns = []string{"id", "account_id", "device_id", "object", "created_at", "etag", "timestamp", "app_name", "message", "type"}
+
+// Errors that might be returned by the functions of SavedSearchStore
+var (
+	ErrSavedSearchNotFound     = errors.New("Could not retreive saved search by this ID")
+	ErrCouldNotSaveSearch      = errors.New("Failed to store the saved search")
+	ErrCouldNotQuerySearches   = errors.New("Failed to query the saved searches")
+	ErrCouldNotInitSavedSearch = errors.New("Failed to create the saved search index")
+)
+
+// savedSearchMapping is the mapping of the saved search index. The filters are stored but not indexed
+const savedSearchMapping = `{
+	"mappings": {
+		"properties": {
+			"id":         {"type": "keyword"},
+			"account_id": {"type": "keyword"},
+			"name":       {"type": "keyword"},
+			"filters":    {"type": "object", "enabled": false},
+			"order":      {"type": "keyword"},
+			"columns":    {"type": "keyword"},
+			"created_at": {"type": "date"},
+			"updated_at": {"type": "date"}
+		}
+	}
+}`
+
+// SavedSearch is a named set of trace filters and display preferences of an account
+type SavedSearch struct {
+	ID        string            `json:"id"`
+	Object    string            `json:"object"`
+	AccountID string            `json:"account_id"`
+	Name      string            `json:"name"`
+	Filters   map[string]string `json:"filters"`
+	Order     string            `json:"order,omitempty"`
+	Columns   []string          `json:"columns"`
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at"`
+}
+
+// SavedSearchStore specifies the functions that a store of saved searches should have. Every function is
+// scoped to an account, saved searches of other accounts are not found
+type SavedSearchStore interface {
+	CreateSavedSearch(parentSpan opentracing.Span, ctx context.Context, search SavedSearch) error
+	GetSavedSearch(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (SavedSearch, error)
+	ListSavedSearches(parentSpan opentracing.Span, ctx context.Context, accountID string) ([]SavedSearch, error)
+	UpdateSavedSearch(parentSpan opentracing.Span, ctx context.Context, search SavedSearch) error
+	DeleteSavedSearch(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) error
+}
+
+// ESSavedSearchStore implements SavedSearchStore on a dedicated elastic search index
+type ESSavedSearchStore struct {
+	ElasticSearchClient *elastic.Client
+	ElasticSearchIndex  string
+	Logger              *zap.Logger
+}
+
+// IsTraceColumn reports whether column is one of TraceColumns
+func IsTraceColumn(column string) bool {
+	for _, traceColumn := range TraceColumns {
+		if column == traceColumn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewESSavedSearchStore returns an ESSavedSearchStore on index and creates the index if it does not exist yet
+func NewESSavedSearchStore(logger *zap.Logger, client *elastic.Client, index string) (*ESSavedSearchStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CtxTimeout)
+	defer cancel()
+
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		logger.Error("NewESSavedSearchStore(): Could not check the saved search index", zap.Error(err))
+		return nil, ErrCouldNotInitSavedSearch
+	}
+
+	if !exists {
+		if _, err := client.CreateIndex(index).BodyString(savedSearchMapping).Do(ctx); err != nil && !elastic.IsStatusCode(err, 400) {
+			logger.Error("NewESSavedSearchStore(): Could not create the saved search index", zap.Error(err))
+			return nil, ErrCouldNotInitSavedSearch
+		}
+	}
+
+	return &ESSavedSearchStore{ElasticSearchClient: client, ElasticSearchIndex: index, Logger: logger}, nil
+}
+
+func (store *ESSavedSearchStore) startSpan(parentSpan opentracing.Span, ctx context.Context, function string) (opentracing.Span, *zap.Logger) {
+	// Extract the RequestID and the AccountID
+	requestID, accountID := extractKeyFromContext(ctx, store.Logger)
+
+	span := opentracing.StartSpan(
+		"ESSavedSearchStore."+function,
+		opentracing.ChildOf(parentSpan.Context()))
+	span.SetTag("component", "storage")
+
+	logger := edge_log.WithContext(ctx, store.Logger).With(zap.String("request_id", requestID.(string))).With(zap.String("account_id", accountID.(string))).With(zap.String("function", function+"()"))
+
+	return span, logger
+}
+
+// CreateSavedSearch stores a new saved search
+func (store *ESSavedSearchStore) CreateSavedSearch(parentSpan opentracing.Span, ctx context.Context, search SavedSearch) error {
+	span, logger := store.startSpan(parentSpan, ctx, "CreateSavedSearch")
+	defer span.Finish()
+
+	_, err := store.ElasticSearchClient.Index().
+		Index(store.ElasticSearchIndex).
+		Id(search.ID).
+		OpType("create").
+		BodyJson(search).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logger.Warn("Error storing saved search", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "index request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotSaveSearch
+	}
+
+	return nil
+}
+
+// GetSavedSearch returns the saved search with id if it belongs to accountID
+func (store *ESSavedSearchStore) GetSavedSearch(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) (SavedSearch, error) {
+	span, logger := store.startSpan(parentSpan, ctx, "GetSavedSearch")
+	defer span.Finish()
+
+	result, err := store.ElasticSearchClient.Get().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return SavedSearch{}, ErrSavedSearchNotFound
+	} else if err != nil {
+		logger.Warn("Error retrieving saved search", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "get request failed"),
+			trace_log.Error(err),
+		)
+
+		return SavedSearch{}, ErrCouldNotQuerySearches
+	}
+
+	var search SavedSearch
+	if err := json.Unmarshal(result.Source, &search); err != nil {
+		logger.Warn("Error decoding saved search", zap.Error(err))
+
+		return SavedSearch{}, ErrCouldNotUnmarshalLogs
+	}
+
+	if search.AccountID != accountID {
+		return SavedSearch{}, ErrSavedSearchNotFound
+	}
+
+	return search, nil
+}
+
+// ListSavedSearches returns the saved searches of accountID, oldest first
+func (store *ESSavedSearchStore) ListSavedSearches(parentSpan opentracing.Span, ctx context.Context, accountID string) ([]SavedSearch, error) {
+	span, logger := store.startSpan(parentSpan, ctx, "ListSavedSearches")
+	defer span.Finish()
+
+	result, err := store.ElasticSearchClient.Search().
+		Index(store.ElasticSearchIndex).
+		Query(elastic.NewTermQuery("account_id", accountID)).
+		Sort("created_at", true).
+		Sort("id", true).
+		Size(MaxSavedSearchesPerAccount).
+		Do(ctx)
+	if err != nil {
+		logger.Warn("Error listing saved searches", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "search query failed"),
+			trace_log.Error(err),
+		)
+
+		return nil, ErrCouldNotQuerySearches
+	}
+
+	searches := make([]SavedSearch, 0, len(result.Hits.Hits))
+
+	for _, hit := range result.Hits.Hits {
+		var search SavedSearch
+
+		if err := json.Unmarshal(hit.Source, &search); err != nil {
+			logger.Warn("Error decoding saved search", zap.Error(err))
+
+			return nil, ErrCouldNotUnmarshalLogs
+		}
+
+		searches = append(searches, search)
+	}
+
+	return searches, nil
+}
+
+// UpdateSavedSearch replaces a saved search. The caller must have checked that it belongs to the account
+func (store *ESSavedSearchStore) UpdateSavedSearch(parentSpan opentracing.Span, ctx context.Context, search SavedSearch) error {
+	span, logger := store.startSpan(parentSpan, ctx, "UpdateSavedSearch")
+	defer span.Finish()
+
+	_, err := store.ElasticSearchClient.Index().
+		Index(store.ElasticSearchIndex).
+		Id(search.ID).
+		BodyJson(search).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logger.Warn("Error storing saved search", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "index request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotSaveSearch
+	}
+
+	return nil
+}
+
+// DeleteSavedSearch removes the saved search with id if it belongs to accountID
+func (store *ESSavedSearchStore) DeleteSavedSearch(parentSpan opentracing.Span, ctx context.Context, accountID string, id string) error {
+	span, logger := store.startSpan(parentSpan, ctx, "DeleteSavedSearch")
+	defer span.Finish()
+
+	if _, err := store.GetSavedSearch(span, ctx, accountID, id); err != nil {
+		return err
+	}
+
+	_, err := store.ElasticSearchClient.Delete().
+		Index(store.ElasticSearchIndex).
+		Id(id).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrSavedSearchNotFound
+	} else if err != nil {
+		logger.Warn("Error deleting saved search", zap.Error(err))
+
+		span.LogFields(
+			trace_log.String("event", "error"),
+			trace_log.String("message", "delete request failed"),
+			trace_log.Error(err),
+		)
+
+		return ErrCouldNotSaveSearch
+	}
+
+	return nil
+}
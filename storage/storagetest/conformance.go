@@ -0,0 +1,264 @@
+// Package storagetest checks that a storage.TraceStore follows the query semantics of the service. Every backend
+// runs TestTraceStore from its tests
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Refresher is implemented by the stores whose added traces are not searchable right away
+type Refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// NewStore returns an empty store for a single case, which is cleaned up with t. Stores are not shared between cases
+type NewStore func(t *testing.T) (storage.TraceStore, error)
+
+// Case is one query against the fixture traces and the page it must return
+type Case struct {
+	Name       string
+	Query      storage.TraceQuery
+	TotalCount bool
+
+	IDs        []string
+	HasMore    bool
+	WantTotal  uint64
+	Highlights map[string]map[string][]string
+}
+
+const (
+	accountA = "account-a"
+	accountB = "account-b"
+	deviceA1 = "device-a1"
+	deviceA2 = "device-a2"
+	deviceB1 = "device-b1"
+)
+
+var base = time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// createdAt returns the @timestamp of the fixture trace n, half a second after its timestamp at minute n-1
+func createdAt(n int) int64 {
+	return milliseconds(at(n-1)) + 500
+}
+
+// traceID returns an id in the format of the service, which starts with the hex milliseconds of created
+func traceID(created int64, suffix int) string {
+	return fmt.Sprintf("%012x%020x", created, suffix)
+}
+
+// id returns the id of the fixture trace n
+func id(n int) string {
+	return traceID(createdAt(n), n)
+}
+
+// Fixture returns the traces that every case is run against. Their ids are in the format of the service and sort in
+// the order of their timestamps
+func Fixture() []storage.Trace {
+	trace := func(n int, account string, device string, appName string, traceType string, message string) storage.Trace {
+		return storage.Trace{
+			ID:             id(n),
+			AccountID:      account,
+			DeviceID:       device,
+			Timestamp:      milliseconds(at(n - 1)),
+			AppName:        appName,
+			Type:           traceType,
+			Message:        message,
+			CloudTimestamp: createdAt(n),
+		}
+	}
+
+	return []storage.Trace{
+		trace(1, accountA, deviceA1, "edge-core", "info", "Gateway started"),
+		trace(2, accountA, deviceA1, "edge-core", "error", "Connection to cloud lost"),
+		trace(3, accountA, deviceA2, "maestro", "info", "Network interface eth0 up"),
+		trace(4, accountA, deviceA2, "maestro", "debug", "DHCP lease renewed"),
+		trace(5, accountA, deviceA1, "edge-core", "warning", "Connection to cloud slow"),
+		trace(6, accountA, deviceA2, "relay-term", "error", "Terminal session failed"),
+		trace(7, accountB, deviceB1, "edge-core", "error", "Connection refused"),
+		trace(8, accountB, deviceB1, "maestro", "info", "Gateway started"),
+	}
+}
+
+// Cases returns the cases of the conformance suite
+func Cases() []Case {
+	return []Case{
+		{Name: "account", Query: storage.TraceQuery{Account: accountA, Limit: 10, Sort: true}, IDs: []string{id(1), id(2), id(3), id(4), id(5), id(6)}},
+		{Name: "descending", Query: storage.TraceQuery{Account: accountA, Limit: 10}, IDs: []string{id(6), id(5), id(4), id(3), id(2), id(1)}},
+		{Name: "other account", Query: storage.TraceQuery{Account: accountB, Limit: 10, Sort: true}, IDs: []string{id(7), id(8)}},
+		{Name: "unknown account", Query: storage.TraceQuery{Account: "account-c", Limit: 10}, IDs: []string{}},
+		{Name: "device", Query: storage.TraceQuery{Account: accountA, Device: []string{deviceA2}, Limit: 10, Sort: true}, IDs: []string{id(3), id(4), id(6)}},
+		{Name: "devices", Query: storage.TraceQuery{Account: accountA, Device: []string{deviceA1, deviceA2}, Limit: 10, Sort: true}, IDs: []string{id(1), id(2), id(3), id(4), id(5), id(6)}},
+		{Name: "no devices", Query: storage.TraceQuery{Account: accountA, Device: []string{}, Limit: 10}, IDs: []string{}},
+		{Name: "device of another account", Query: storage.TraceQuery{Account: accountA, Device: []string{deviceB1}, Limit: 10}, IDs: []string{}},
+		{Name: "app name", Query: storage.TraceQuery{Account: accountA, AppName: "maestro", Limit: 10, Sort: true}, IDs: []string{id(3), id(4)}},
+		{Name: "app name word", Query: storage.TraceQuery{Account: accountA, AppName: "Core", Limit: 10, Sort: true}, IDs: []string{id(1), id(2), id(5)}},
+		{Name: "type", Query: storage.TraceQuery{Account: accountA, Type: "error", Limit: 10, Sort: true}, IDs: []string{id(2), id(6)}},
+		{Name: "types", Query: storage.TraceQuery{Account: accountA, Types: []string{"error", "debug"}, Limit: 10, Sort: true}, IDs: []string{id(2), id(4), id(6)}},
+		{Name: "types are exact", Query: storage.TraceQuery{Account: accountA, Types: []string{"Error"}, Limit: 10}, IDs: []string{}},
+		{Name: "excluded types", Query: storage.TraceQuery{Account: accountA, ExcludeTypes: []string{"info", "debug"}, Limit: 10, Sort: true}, IDs: []string{id(2), id(5), id(6)}},
+		{Name: "message word", Query: storage.TraceQuery{Account: accountA, Message: "connection", Limit: 10, Sort: true}, IDs: []string{id(2), id(5)}},
+		{Name: "message any word", Query: storage.TraceQuery{Account: accountA, Message: "lost started", Limit: 10, Sort: true}, IDs: []string{id(1), id(2)}},
+		{Name: "message without words", Query: storage.TraceQuery{Account: accountA, Message: "!!", Limit: 10}, IDs: []string{}},
+		{Name: "time range", Query: storage.TraceQuery{Account: accountA, After: at(1), Before: at(3), Limit: 10, Sort: true}, IDs: []string{id(2), id(3), id(4)}},
+		{Name: "after", Query: storage.TraceQuery{Account: accountA, After: at(4), Limit: 10, Sort: true}, IDs: []string{id(5), id(6)}},
+		{Name: "before", Query: storage.TraceQuery{Account: accountA, Before: at(0), Limit: 10, Sort: true}, IDs: []string{id(1)}},
+		{Name: "created before", Query: storage.TraceQuery{Account: accountA, CreatedBefore: at(2).Add(500 * time.Millisecond), Limit: 10, Sort: true}, IDs: []string{id(1), id(2), id(3)}},
+		{Name: "created after", Query: storage.TraceQuery{Account: accountA, CreatedAfter: at(3).Add(500 * time.Millisecond), Limit: 10, Sort: true}, IDs: []string{id(4), id(5), id(6)}},
+		{Name: "created after with cursor", Query: storage.TraceQuery{Account: accountA, CreatedAfter: at(3), Limit: 10, AfterCursor: []interface{}{id(6)}}, IDs: []string{id(5), id(4)}},
+		{Name: "id", Query: storage.TraceQuery{Account: accountA, ID: id(4), Limit: 10}, IDs: []string{id(4)}},
+		{Name: "id of another account", Query: storage.TraceQuery{Account: accountA, ID: id(7), Limit: 10}, IDs: []string{}},
+		{Name: "combined", Query: storage.TraceQuery{Account: accountA, Device: []string{deviceA1}, AppName: "edge-core", Type: "error", Message: "cloud", Limit: 10}, IDs: []string{id(2)}},
+		{Name: "has more", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true}, IDs: []string{id(1), id(2)}, HasMore: true},
+		{Name: "exact limit", Query: storage.TraceQuery{Account: accountA, Type: "error", Limit: 2, Sort: true}, IDs: []string{id(2), id(6)}},
+		{Name: "cursor", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true, AfterCursor: []interface{}{id(2)}}, IDs: []string{id(3), id(4)}, HasMore: true},
+		{Name: "last page", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true, AfterCursor: []interface{}{id(4)}}, IDs: []string{id(5), id(6)}},
+		{Name: "descending cursor", Query: storage.TraceQuery{Account: accountA, Limit: 2, AfterCursor: []interface{}{id(3)}}, IDs: []string{id(2), id(1)}},
+		{Name: "cursor that does not exist", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true, AfterCursor: []interface{}{traceID(createdAt(2)+200, 0)}}, IDs: []string{id(3), id(4)}, HasMore: true},
+		{Name: "descending cursor that does not exist", Query: storage.TraceQuery{Account: accountA, Limit: 2, AfterCursor: []interface{}{traceID(createdAt(2)+200, 0)}}, IDs: []string{id(2), id(1)}},
+		{Name: "total count", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true}, TotalCount: true, IDs: []string{id(1), id(2)}, HasMore: true, WantTotal: 6},
+		{Name: "total count with cursor", Query: storage.TraceQuery{Account: accountA, Limit: 2, Sort: true, AfterCursor: []interface{}{id(4)}}, TotalCount: true, IDs: []string{id(5), id(6)}, WantTotal: 6},
+		{
+			Name:       "highlight",
+			Query:      storage.TraceQuery{Account: accountA, Message: "cloud", Limit: 10, Sort: true, Highlight: &storage.HighlightQuery{PreTag: "[", PostTag: "]"}},
+			IDs:        []string{id(2), id(5)},
+			Highlights: map[string]map[string][]string{id(2): {"message": {"Connection to [cloud] lost"}}, id(5): {"message": {"Connection to [cloud] slow"}}},
+		},
+	}
+}
+
+// TestTraceStore runs every case as a subtest of t against a store of newStore that holds the Fixture
+func TestTraceStore(t *testing.T, newStore NewStore) {
+	for _, c := range Cases() {
+		c := c
+
+		t.Run(c.Name, func(t *testing.T) {
+			runCase(t, newStore, c)
+		})
+	}
+
+	t.Run("response", func(t *testing.T) {
+		checkResponse(t, newStore)
+	})
+}
+
+// fill returns a store of newStore with the Fixture, searchable
+func fill(t *testing.T, newStore NewStore) (storage.TraceStore, opentracing.Span, context.Context) {
+	store, err := newStore(t)
+	if err != nil {
+		t.Fatalf("new store: %s", err)
+	}
+
+	span := opentracing.NoopTracer{}.StartSpan("storagetest")
+	ctx := context.WithValue(context.Background(), httputil.ContextKeyRequestID, "storagetest")
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, accountA)
+
+	if err := store.AddDeviceTrace(span, ctx, Fixture()); err != nil {
+		t.Fatalf("AddDeviceTrace: %s", err)
+	}
+
+	if refresher, ok := store.(Refresher); ok {
+		if err := refresher.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh: %s", err)
+		}
+	}
+
+	return store, span, ctx
+}
+
+func runCase(t *testing.T, newStore NewStore, c Case) {
+	store, span, ctx := fill(t, newStore)
+
+	page, err := store.SearchDeviceTrace(span, ctx, c.Query, c.TotalCount)
+	if err != nil {
+		t.Fatalf("SearchDeviceTrace: %s", err)
+	}
+
+	ids := make([]string, 0, len(page.Data))
+	for _, trace := range page.Data {
+		ids = append(ids, trace.ID)
+	}
+
+	if !reflect.DeepEqual(ids, c.IDs) {
+		t.Errorf("got ids %v, want %v", ids, c.IDs)
+	}
+
+	if page.HasMore != c.HasMore {
+		t.Errorf("got has_more %t, want %t", page.HasMore, c.HasMore)
+	}
+
+	if c.TotalCount && page.TotalCount != c.WantTotal {
+		t.Errorf("got total_count %d, want %d", page.TotalCount, c.WantTotal)
+	}
+
+	if page.Limit != c.Query.Limit {
+		t.Errorf("got limit %d, want %d", page.Limit, c.Query.Limit)
+	}
+
+	wantOrder := "DESC"
+	if c.Query.Sort {
+		wantOrder = "ASC"
+	}
+
+	if page.Order != wantOrder {
+		t.Errorf("got order %s, want %s", page.Order, wantOrder)
+	}
+
+	if len(c.Query.AfterCursor) > 0 && page.After != c.Query.AfterCursor[0] {
+		t.Errorf("got after %v, want %v", page.After, c.Query.AfterCursor[0])
+	}
+
+	for _, trace := range page.Data {
+		if c.Highlights != nil && !reflect.DeepEqual(trace.Highlights, c.Highlights[trace.ID]) {
+			t.Errorf("got highlights %v of %s, want %v", trace.Highlights, trace.ID, c.Highlights[trace.ID])
+		}
+	}
+}
+
+// checkResponse checks that a stored trace is returned with every property of its API representation
+func checkResponse(t *testing.T, newStore NewStore) {
+	store, span, ctx := fill(t, newStore)
+
+	page, err := store.SearchDeviceTrace(span, ctx, storage.TraceQuery{Account: accountA, ID: id(2), Limit: 1}, false)
+	if err != nil {
+		t.Fatalf("SearchDeviceTrace: %s", err)
+	}
+
+	if len(page.Data) != 1 {
+		t.Fatalf("got %d traces, want 1", len(page.Data))
+	}
+
+	var fixture storage.Trace
+	for _, trace := range Fixture() {
+		if trace.ID == id(2) {
+			fixture = trace
+		}
+	}
+
+	fixture.Timestring = storage.Date(fixture.Timestamp)
+	fixture.CreatedAt = storage.Date(fixture.CloudTimestamp)
+
+	want := storage.NewTraceResponse(fixture)
+	got := page.Data[0]
+
+	if got.AccountID != want.AccountID || got.DeviceID != want.DeviceID || got.Object != want.Object || got.CreatedAt != want.CreatedAt ||
+		got.ETag != want.ETag || got.Timestamp != want.Timestamp || got.AppName != want.AppName || got.Message != want.Message || got.Type != want.Type {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
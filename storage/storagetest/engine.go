@@ -0,0 +1,842 @@
+package storagetest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armPelionEdge/edge-gw-trace-service/httputil"
+	"github.com/armPelionEdge/edge-gw-trace-service/storage"
+
+	"go.uber.org/zap"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	stubSearchAlias = "stub-search-logs"
+	stubActiveAlias = "stub-active-logs"
+)
+
+// stubScriptTemplate is the index template of the setup script as the cluster returns it, without a version and with
+// nested settings
+const stubScriptTemplate = `{
+	"index_patterns": ["` + stubActiveAlias + `-*"],
+	"settings": {"index": {"number_of_shards": "1", "number_of_replicas": "1", "routing": {"allocation": {"total_shards_per_node": "2"}}}},
+	"aliases": {"` + stubSearchAlias + `": {}}
+}`
+
+// stubVersions are the responses of the root endpoint of each engine
+var stubVersions = map[string]string{
+	storage.EngineElasticsearch7: `{"version": {"number": "7.10.2", "build_flavor": "default"}, "tagline": "You Know, for Search"}`,
+	storage.EngineElasticsearch8: `{"version": {"number": "8.11.1", "build_flavor": "default"}, "tagline": "You Know, for Search"}`,
+	storage.EngineOpenSearch:     `{"version": {"distribution": "opensearch", "number": "2.11.0"}, "tagline": "The OpenSearch Project: https://opensearch.org/"}`,
+}
+
+// StubRequest is a request that a StubCluster received
+type StubRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+type stubPolicy struct {
+	body  json.RawMessage
+	seqNo int64
+}
+
+// StubCluster is an httptest stand-in for a cluster of one search engine. It answers the requests of ESTraceStore
+// and Bootstrap like the engine does, including the lifecycle APIs and the media types it accepts, and keeps the
+// documents it is sent in their indices. Searches evaluate the query, sort and search_after of ESTraceStore on the
+// indices and aliases they target
+type StubCluster struct {
+	Engine string
+	URL    string
+
+	server    *httptest.Server
+	lock      sync.Mutex
+	requests  []StubRequest
+	documents map[string]map[string]json.RawMessage
+	indices   map[string]bool
+	aliases   map[string][]string
+	templates map[string]json.RawMessage
+	policies  map[string]stubPolicy
+}
+
+// NewStubCluster starts a StubCluster of engine, one of the storage Engine constants
+func NewStubCluster(engine string) *StubCluster {
+	cluster := &StubCluster{
+		Engine:    engine,
+		documents: make(map[string]map[string]json.RawMessage),
+		indices:   make(map[string]bool),
+		aliases:   make(map[string][]string),
+		templates: make(map[string]json.RawMessage),
+		policies:  make(map[string]stubPolicy),
+	}
+
+	cluster.server = httptest.NewServer(http.HandlerFunc(cluster.serveHTTP))
+	cluster.URL = cluster.server.URL
+
+	return cluster
+}
+
+// Close shuts the cluster down
+func (cluster *StubCluster) Close() {
+	cluster.server.Close()
+}
+
+// Requests returns the requests that the cluster received, in order
+func (cluster *StubCluster) Requests() []StubRequest {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	return append([]StubRequest(nil), cluster.requests...)
+}
+
+// Request returns the last request with method whose path starts with prefix
+func (cluster *StubCluster) Request(method string, prefix string) (StubRequest, bool) {
+	requests := cluster.Requests()
+
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Method == method && strings.HasPrefix(requests[i].Path, prefix) {
+			return requests[i], true
+		}
+	}
+
+	return StubRequest{}, false
+}
+
+func stubError(w http.ResponseWriter, status int, errorType string, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  map[string]interface{}{"type": errorType, "reason": reason},
+		"status": status,
+	})
+}
+
+func stubJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// checkMediaTypes rejects the requests that the engine would reject for their Accept and Content-Type
+func (cluster *StubCluster) checkMediaTypes(r *http.Request, body []byte) (string, bool) {
+	accept := r.Header.Get("Accept")
+	contentType := r.Header.Get("Content-Type")
+
+	if cluster.Engine != storage.EngineElasticsearch8 {
+		if strings.Contains(accept, "vnd.elasticsearch") || strings.Contains(contentType, "vnd.elasticsearch") {
+			return "media type " + accept + " is not supported", false
+		}
+
+		return "", true
+	}
+
+	// The root endpoint is what clients ask for the version, before they know the engine
+	if r.URL.Path == "/" {
+		return "", true
+	}
+
+	if !strings.Contains(accept, "compatible-with=7") {
+		return "the request does not ask for the compatibility with version 7", false
+	}
+
+	if len(body) > 0 && !strings.Contains(contentType, "compatible-with=7") {
+		return "A compatible version is required on both Content-Type and Accept headers if either one has requested a compatible version", false
+	}
+
+	return "", true
+}
+
+func (cluster *StubCluster) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	cluster.requests = append(cluster.requests, StubRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header.Clone(), Body: body})
+
+	if reason, ok := cluster.checkMediaTypes(r, body); !ok {
+		stubError(w, http.StatusBadRequest, "media_type_header_exception", reason)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(stubVersions[cluster.Engine]))
+	case path == "_bulk" || strings.HasSuffix(path, "/_bulk"):
+		target := ""
+		if len(parts) == 2 {
+			target = parts[0]
+		}
+
+		cluster.bulk(w, target, body)
+	case strings.HasSuffix(path, "/_search") || path == "_search":
+		target := "_all"
+		if len(parts) == 2 {
+			target = parts[0]
+		}
+
+		cluster.search(w, target, body)
+	case parts[0] == "_template" && len(parts) == 2:
+		cluster.template(w, r.Method, parts[1], body)
+	case parts[0] == "_ilm" && len(parts) == 3 && parts[1] == "policy":
+		if cluster.Engine == storage.EngineOpenSearch {
+			stubError(w, http.StatusBadRequest, "illegal_argument_exception", "no handler found for uri ["+r.URL.Path+"] and method ["+r.Method+"]")
+			return
+		}
+
+		stubJSON(w, map[string]interface{}{"acknowledged": true})
+	case parts[0] == "_plugins" && len(parts) >= 3 && parts[1] == "_ism":
+		if cluster.Engine != storage.EngineOpenSearch {
+			stubError(w, http.StatusBadRequest, "illegal_argument_exception", "no handler found for uri ["+r.URL.Path+"] and method ["+r.Method+"]")
+			return
+		}
+
+		cluster.ism(w, r, parts[2:], body)
+	case parts[len(parts)-1] == "_refresh":
+		// Documents are searchable once they are stored
+		stubJSON(w, map[string]interface{}{"_shards": map[string]int{"total": 1, "successful": 1, "failed": 0}})
+	case path == "_aliases":
+		cluster.updateAliases(w, body)
+	case len(parts) == 2 && parts[1] == "_rollover":
+		cluster.rollover(w, parts[0])
+	case len(parts) == 2 && parts[1] == "_settings" && r.Method == "GET":
+		stubJSON(w, map[string]interface{}{})
+	case len(parts) == 2 && (parts[1] == "_settings" || parts[1] == "_mapping"):
+		stubJSON(w, map[string]interface{}{"acknowledged": true})
+	case len(parts) == 1 && r.Method == "HEAD":
+		if !cluster.indices[parts[0]] && len(cluster.aliases[parts[0]]) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1 && r.Method == "PUT":
+		cluster.createIndex(w, parts[0], body)
+	case len(parts) == 1 && r.Method == "DELETE":
+		cluster.deleteIndex(w, parts[0])
+	default:
+		stubError(w, http.StatusNotFound, "stub_exception", "the stub does not serve "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// resolve returns the indices of a comma separated list of indices, aliases and patterns, or an error naming the
+// first one that does not exist
+func (cluster *StubCluster) resolve(target string) ([]string, string) {
+	seen := make(map[string]bool)
+	var indices []string
+
+	add := func(index string) {
+		if !seen[index] {
+			seen[index] = true
+			indices = append(indices, index)
+		}
+	}
+
+	for _, name := range strings.Split(target, ",") {
+		switch {
+		case cluster.indices[name]:
+			add(name)
+		case len(cluster.aliases[name]) > 0:
+			for _, index := range cluster.aliases[name] {
+				add(index)
+			}
+		case name == "_all" || strings.HasSuffix(name, "*"):
+			for index := range cluster.indices {
+				if name == "_all" || strings.HasPrefix(index, strings.TrimSuffix(name, "*")) {
+					add(index)
+				}
+			}
+		default:
+			return nil, name
+		}
+	}
+
+	sort.Strings(indices)
+
+	return indices, ""
+}
+
+// writeIndex returns the index that a write to name goes to, the write index of an alias, and creates a missing
+// index like the engines do
+func (cluster *StubCluster) writeIndex(name string) string {
+	if indices := cluster.aliases[name]; len(indices) > 0 {
+		return indices[0]
+	}
+
+	if !cluster.indices[name] {
+		cluster.addIndex(name, nil)
+	}
+
+	return name
+}
+
+// addIndex creates index with aliases, and with the aliases of the templates whose patterns match it
+func (cluster *StubCluster) addIndex(index string, aliases []string) {
+	cluster.indices[index] = true
+	cluster.documents[index] = make(map[string]json.RawMessage)
+
+	for _, body := range cluster.templates {
+		var template struct {
+			IndexPatterns []string               `json:"index_patterns"`
+			Aliases       map[string]interface{} `json:"aliases"`
+		}
+
+		json.Unmarshal(body, &template)
+
+		for _, pattern := range template.IndexPatterns {
+			if strings.HasPrefix(index, strings.TrimSuffix(pattern, "*")) {
+				for alias := range template.Aliases {
+					aliases = append(aliases, alias)
+				}
+			}
+		}
+	}
+
+	for _, alias := range aliases {
+		cluster.addAlias(index, alias, false)
+	}
+}
+
+// addAlias adds index to alias, as its write index if write
+func (cluster *StubCluster) addAlias(index string, alias string, write bool) {
+	for _, existing := range cluster.aliases[alias] {
+		if existing == index {
+			return
+		}
+	}
+
+	if write {
+		cluster.aliases[alias] = append([]string{index}, cluster.aliases[alias]...)
+	} else {
+		cluster.aliases[alias] = append(cluster.aliases[alias], index)
+	}
+}
+
+func (cluster *StubCluster) removeAlias(index string, alias string) {
+	var indices []string
+	for _, existing := range cluster.aliases[alias] {
+		if existing != index {
+			indices = append(indices, existing)
+		}
+	}
+
+	cluster.aliases[alias] = indices
+}
+
+func (cluster *StubCluster) bulk(w http.ResponseWriter, target string, body []byte) {
+	items := make([]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+			stubError(w, http.StatusBadRequest, "parse_exception", "malformed bulk request")
+			return
+		}
+
+		source := json.RawMessage(append([]byte(nil), scanner.Bytes()...))
+
+		for _, meta := range action {
+			name := meta.Index
+			if name == "" {
+				name = target
+			}
+
+			if name == "" {
+				stubError(w, http.StatusBadRequest, "action_request_validation_exception", "index is missing")
+				return
+			}
+
+			id := meta.ID
+			if id == "" {
+				id = strconv.Itoa(len(cluster.requests)) + "-" + strconv.Itoa(len(items))
+			}
+
+			if _, err := newStubDocument("", id, source); err != nil {
+				stubError(w, http.StatusBadRequest, "parse_exception", "malformed document")
+				return
+			}
+
+			index := cluster.writeIndex(name)
+			cluster.documents[index][id] = source
+
+			items = append(items, map[string]interface{}{
+				"index": map[string]interface{}{"_index": index, "_id": id, "status": 201, "result": "created"},
+			})
+		}
+	}
+
+	stubJSON(w, map[string]interface{}{"took": 1, "errors": false, "items": items})
+}
+
+// search evaluates a search request on the indices of target
+func (cluster *StubCluster) search(w http.ResponseWriter, target string, body []byte) {
+	var request struct {
+		Query          json.RawMessage       `json:"query"`
+		Size           *int                  `json:"size"`
+		Sort           json.RawMessage       `json:"sort"`
+		SearchAfter    []interface{}         `json:"search_after"`
+		TrackTotalHits interface{}           `json:"track_total_hits"`
+		Highlight      *stubHighlightRequest `json:"highlight"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if len(body) > 0 {
+		if err := decoder.Decode(&request); err != nil {
+			stubError(w, http.StatusBadRequest, "parse_exception", err.Error())
+			return
+		}
+	}
+
+	indices, missing := cluster.resolve(target)
+	if missing != "" {
+		stubError(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+missing+"]")
+		return
+	}
+
+	fields, err := parseStubSort(request.Sort)
+	if err != nil {
+		stubError(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	matched := make([]stubDocument, 0)
+
+	for _, index := range indices {
+		for id, raw := range cluster.documents[index] {
+			document, err := newStubDocument(index, id, raw)
+			if err != nil {
+				stubError(w, http.StatusInternalServerError, "stub_exception", err.Error())
+				return
+			}
+
+			ok, err := stubMatches(request.Query, document)
+			if err != nil {
+				stubError(w, http.StatusBadRequest, "parsing_exception", err.Error())
+				return
+			}
+
+			if ok {
+				matched = append(matched, document)
+			}
+		}
+	}
+
+	sortStubDocuments(matched, fields)
+	total := len(matched)
+
+	if len(request.SearchAfter) > 0 {
+		start := sort.Search(len(matched), func(i int) bool {
+			return compareStubSort(fields, matched[i].sortValues(fields), request.SearchAfter) > 0
+		})
+
+		matched = matched[start:]
+	}
+
+	size := 10
+	if request.Size != nil {
+		size = *request.Size
+	}
+
+	if len(matched) > size {
+		matched = matched[:size]
+	}
+
+	hits := make([]interface{}, 0, len(matched))
+	for _, document := range matched {
+		hit := map[string]interface{}{"_index": document.Index, "_id": document.ID, "_source": document.Raw}
+
+		if len(fields) > 0 {
+			hit["sort"] = document.sortValues(fields)
+		}
+
+		if request.Highlight != nil {
+			if highlight := stubHighlight(request.Query, *request.Highlight, document); len(highlight) > 0 {
+				hit["highlight"] = highlight
+			}
+		}
+
+		hits = append(hits, hit)
+	}
+
+	// Without track_total_hits the engines count up to 10000 hits
+	relation := "eq"
+	if request.TrackTotalHits != true && total > 10000 {
+		total = 10000
+		relation = "gte"
+	}
+
+	stubJSON(w, map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"hits": map[string]interface{}{
+			"total": map[string]interface{}{"value": total, "relation": relation},
+			"hits":  hits,
+		},
+	})
+}
+
+// updateAliases applies the add and remove actions of an aliases request
+func (cluster *StubCluster) updateAliases(w http.ResponseWriter, body []byte) {
+	var request struct {
+		Actions []map[string]struct {
+			Index        string `json:"index"`
+			Alias        string `json:"alias"`
+			IsWriteIndex bool   `json:"is_write_index"`
+		} `json:"actions"`
+	}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		stubError(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	for _, action := range request.Actions {
+		for kind, alias := range action {
+			switch kind {
+			case "add":
+				cluster.addAlias(alias.Index, alias.Alias, alias.IsWriteIndex)
+			case "remove":
+				cluster.removeAlias(alias.Index, alias.Alias)
+			}
+		}
+	}
+
+	stubJSON(w, map[string]interface{}{"acknowledged": true})
+}
+
+// rollover creates the next index of an alias and makes it the write index
+func (cluster *StubCluster) rollover(w http.ResponseWriter, alias string) {
+	indices := cluster.aliases[alias]
+	if len(indices) == 0 {
+		stubError(w, http.StatusBadRequest, "illegal_argument_exception", "rollover target ["+alias+"] does not exist")
+		return
+	}
+
+	oldIndex := indices[0]
+	number, _ := strconv.Atoi(strings.TrimPrefix(oldIndex, alias+"-"))
+	newIndex := fmt.Sprintf("%s-%06d", alias, number+1)
+
+	cluster.removeAlias(oldIndex, alias)
+	cluster.addIndex(newIndex, nil)
+	cluster.addAlias(newIndex, alias, true)
+
+	stubJSON(w, map[string]interface{}{
+		"acknowledged": true,
+		"rolled_over":  true,
+		"old_index":    oldIndex,
+		"new_index":    newIndex,
+		"conditions":   map[string]bool{},
+	})
+}
+
+func (cluster *StubCluster) template(w http.ResponseWriter, method string, name string, body []byte) {
+	if method == "PUT" {
+		cluster.templates[name] = body
+		stubJSON(w, map[string]interface{}{"acknowledged": true})
+		return
+	}
+
+	template, ok := cluster.templates[name]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+		return
+	}
+
+	stubJSON(w, map[string]json.RawMessage{name: template})
+}
+
+// ism serves the ISM API, which rejects policy updates without the sequence number of the current policy
+func (cluster *StubCluster) ism(w http.ResponseWriter, r *http.Request, parts []string, body []byte) {
+	if parts[0] == "add" {
+		stubJSON(w, map[string]interface{}{"updated_indices": 1, "failures": false, "failed_indices": []interface{}{}})
+		return
+	}
+
+	if parts[0] != "policies" || len(parts) != 2 {
+		stubError(w, http.StatusNotFound, "stub_exception", "the stub does not serve "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	name := parts[1]
+	policy, exists := cluster.policies[name]
+
+	switch r.Method {
+	case "GET":
+		if !exists {
+			stubError(w, http.StatusNotFound, "status_exception", "Policy not found")
+			return
+		}
+
+		var document map[string]json.RawMessage
+		json.Unmarshal(policy.body, &document)
+
+		stubJSON(w, map[string]interface{}{"_id": name, "_seq_no": policy.seqNo, "_primary_term": 1, "policy": document["policy"]})
+	case "PUT":
+		if exists && r.URL.Query().Get("if_seq_no") != strconv.FormatInt(policy.seqNo, 10) {
+			stubError(w, http.StatusConflict, "version_conflict_engine_exception", "the policy was changed or exists already")
+			return
+		}
+
+		cluster.policies[name] = stubPolicy{body: body, seqNo: policy.seqNo + 1}
+		stubJSON(w, map[string]interface{}{"_id": name, "_seq_no": policy.seqNo + 1, "_primary_term": 1})
+	default:
+		stubError(w, http.StatusMethodNotAllowed, "stub_exception", "method not allowed")
+	}
+}
+
+func (cluster *StubCluster) createIndex(w http.ResponseWriter, index string, body []byte) {
+	if cluster.indices[index] {
+		stubError(w, http.StatusBadRequest, "resource_already_exists_exception", "index ["+index+"] already exists")
+		return
+	}
+
+	var request struct {
+		Aliases map[string]interface{} `json:"aliases"`
+	}
+
+	json.Unmarshal(body, &request)
+
+	var aliases []string
+	for alias := range request.Aliases {
+		aliases = append(aliases, alias)
+	}
+
+	cluster.addIndex(index, aliases)
+	stubJSON(w, map[string]interface{}{"acknowledged": true, "index": index})
+}
+
+func (cluster *StubCluster) deleteIndex(w http.ResponseWriter, index string) {
+	if !cluster.indices[index] {
+		stubError(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+index+"]")
+		return
+	}
+
+	delete(cluster.indices, index)
+	delete(cluster.documents, index)
+
+	for alias := range cluster.aliases {
+		cluster.removeAlias(index, alias)
+	}
+
+	stubJSON(w, map[string]interface{}{"acknowledged": true})
+}
+
+// NewESStore returns a NewStore of ESTraceStores on the cluster at esURL, which detect the engine if it is empty.
+// Every store has its own trace index with the mappings of the schema, which is deleted with t
+func NewESStore(esURL string, engine string) NewStore {
+	count := 0
+
+	return func(t *testing.T) (storage.TraceStore, error) {
+		store, err := storage.NewESTraceStore(zap.NewNop(), esURL, "", "", engine)
+		if err != nil {
+			return nil, err
+		}
+
+		count++
+		index := fmt.Sprintf("storagetest-%d-%d", time.Now().UnixNano(), count)
+		span := opentracing.NoopTracer{}.StartSpan("storagetest")
+
+		if err := store.CreateTraceIndex(span, context.Background(), index); err != nil {
+			return nil, err
+		}
+
+		t.Cleanup(func() {
+			store.DeleteTraceIndex(span, context.Background(), index)
+		})
+
+		return store.IndexTraceStore(index), nil
+	}
+}
+
+// TestSearchEngine runs ESTraceStore and Bootstrap against a StubCluster of engine. It checks that the engine is
+// detected, that the schema and its lifecycle policy are installed with the API of the engine, and that bulk
+// requests, search_after paging, total hits and rollovers work with the media types the engine accepts
+func TestSearchEngine(engine string) error {
+	cluster := NewStubCluster(engine)
+	defer cluster.Close()
+
+	var failures []string
+	fail := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+
+	store, err := storage.NewESTraceStore(zap.NewNop(), cluster.URL, stubSearchAlias, stubActiveAlias, "")
+	if err != nil {
+		return fmt.Errorf("%s: NewESTraceStore: %s", engine, err)
+	}
+
+	if store.Engine.Name() != engine {
+		return fmt.Errorf("%s: detected %s", engine, store.Engine.Name())
+	}
+
+	span := opentracing.StartSpan("storagetest.TestSearchEngine")
+	defer span.Finish()
+
+	ctx := context.WithValue(context.Background(), httputil.ContextKeyRequestID, "storagetest")
+	ctx = context.WithValue(ctx, httputil.ContextKeyAccountID, accountA)
+
+	// The cluster was set up with the setup script, whose settings the bootstrap keeps
+	cluster.lock.Lock()
+	cluster.templates[stubActiveAlias] = json.RawMessage(stubScriptTemplate)
+	cluster.lock.Unlock()
+
+	// The second run updates the lifecycle policy that the first run installed
+	for run := 1; run <= 2; run++ {
+		if _, err := storage.NewBootstrap(zap.NewNop(), store).Run(ctx); err != nil {
+			fail("bootstrap run %d: %s", run, err)
+		}
+	}
+
+	checkLifecycle(cluster, fail)
+	checkTemplateSettings(cluster, fail)
+
+	if err := store.AddDeviceTrace(span, ctx, Fixture()); err != nil {
+		fail("AddDeviceTrace: %s", err)
+	}
+
+	var cursor []interface{}
+
+	for _, want := range [][]string{{id(1), id(2), id(3)}, {id(4), id(5), id(6)}, {id(7), id(8)}} {
+		page, err := store.SearchDeviceTrace(span, ctx, storage.TraceQuery{Limit: 3, Sort: true, AfterCursor: cursor}, true)
+		if err != nil {
+			fail("SearchDeviceTrace after %v: %s", cursor, err)
+			break
+		}
+
+		var ids []string
+		for _, trace := range page.Data {
+			ids = append(ids, trace.ID)
+		}
+
+		if !reflect.DeepEqual(ids, want) {
+			fail("SearchDeviceTrace after %v: ids %v, want %v", cursor, ids, want)
+		}
+
+		if page.TotalCount != uint64(len(Fixture())) {
+			fail("SearchDeviceTrace after %v: total count %d, want %d", cursor, page.TotalCount, len(Fixture()))
+		}
+
+		if page.HasMore != (len(want) == 3) {
+			fail("SearchDeviceTrace after %v: has_more %t", cursor, page.HasMore)
+		}
+
+		if len(page.Data) == 0 {
+			break
+		}
+
+		cursor = []interface{}{page.Data[len(page.Data)-1].ID}
+	}
+
+	if request, ok := cluster.Request("POST", "/"+stubSearchAlias+"/_search"); ok {
+		if !bytes.Contains(request.Body, []byte(`"search_after":["`+id(6)+`"]`)) || !bytes.Contains(request.Body, []byte(`"track_total_hits":true`)) {
+			fail("search request %s does not page with search_after and track the total hits", request.Body)
+		}
+	} else {
+		fail("no search request on %s", stubSearchAlias)
+	}
+
+	result, err := store.RolloverIndex(ctx, stubActiveAlias, storage.RolloverConditions{MaxDocs: 1})
+	if err != nil || !result.RolledOver {
+		fail("RolloverIndex: %+v, %v", result, err)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s:\n%s", engine, strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
+
+// checkTemplateSettings checks that the template kept the settings of the setup script
+func checkTemplateSettings(cluster *StubCluster, fail func(string, ...interface{})) {
+	request, ok := cluster.Request("PUT", "/_template/"+stubActiveAlias)
+	if !ok {
+		return
+	}
+
+	var template struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+
+	if err := json.Unmarshal(request.Body, &template); err != nil {
+		fail("index template %s: %s", request.Body, err)
+		return
+	}
+
+	want := map[string]interface{}{
+		"index.number_of_shards":                         "1",
+		"index.number_of_replicas":                       "1",
+		"index.routing.allocation.total_shards_per_node": "2",
+	}
+
+	for name, value := range want {
+		if template.Settings[name] != value {
+			fail("index template %s sets %s to %v, want %v", request.Body, name, template.Settings[name], value)
+		}
+	}
+
+	engine, _ := storage.NewSearchEngine(cluster.Engine)
+	if len(template.Settings) != len(want)+len(engine.LifecycleSettings(storage.DefaultILMPolicy, stubActiveAlias)) {
+		fail("index template %s has other settings than the script and the lifecycle", request.Body)
+	}
+}
+
+// checkLifecycle checks that the lifecycle policy was installed with the API of the engine, and that the template
+// makes the new indices use it
+func checkLifecycle(cluster *StubCluster, fail func(string, ...interface{})) {
+	policyPath := "/_ilm/policy/" + storage.DefaultILMPolicy
+	settingName := "index.lifecycle.name"
+
+	if cluster.Engine == storage.EngineOpenSearch {
+		policyPath = "/_plugins/_ism/policies/" + storage.DefaultILMPolicy
+		settingName = "plugins.index_state_management.rollover_alias"
+
+		request, ok := cluster.Request("PUT", policyPath)
+		if ok && !bytes.Contains(request.Body, []byte(`"index_patterns":["`+stubActiveAlias+`-*"]`)) {
+			fail("ISM policy %s does not manage %s-*", request.Body, stubActiveAlias)
+		}
+	}
+
+	if _, ok := cluster.Request("PUT", policyPath); !ok {
+		fail("no lifecycle policy installed at %s", policyPath)
+	}
+
+	request, ok := cluster.Request("PUT", "/_template/"+stubActiveAlias)
+	if !ok {
+		fail("no index template installed")
+		return
+	}
+
+	if !bytes.Contains(request.Body, []byte(`"`+settingName+`"`)) {
+		fail("index template %s does not set %s", request.Body, settingName)
+	}
+}
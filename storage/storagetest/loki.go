@@ -0,0 +1,463 @@
+package storagetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stubLokiEntry struct {
+	labels    map[string]string
+	timestamp int64
+	line      string
+}
+
+// StubLoki is an httptest stand-in for the push and query APIs of Loki. It evaluates the subset of LogQL that
+// LokiTraceStore writes: a stream selector, line filters, label filters and sum(count_over_time(...)). Structured
+// metadata is returned with the stream labels, like Loki does by default
+type StubLoki struct {
+	URL string
+
+	server  *httptest.Server
+	lock    sync.Mutex
+	entries []stubLokiEntry
+}
+
+// NewStubLoki starts an empty StubLoki
+func NewStubLoki() *StubLoki {
+	stub := &StubLoki{}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serveHTTP))
+	stub.URL = stub.server.URL
+
+	return stub
+}
+
+// Close shuts the stub down
+func (stub *StubLoki) Close() {
+	stub.server.Close()
+}
+
+// Reset drops every pushed log line
+func (stub *StubLoki) Reset() {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+
+	stub.entries = nil
+}
+
+func lokiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+func (stub *StubLoki) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/loki/api/v1/push":
+		stub.push(w, r)
+	case "/loki/api/v1/query_range":
+		stub.queryRange(w, r)
+	case "/loki/api/v1/query":
+		stub.query(w, r)
+	default:
+		lokiError(w, http.StatusNotFound, "404 page not found")
+	}
+}
+
+func (stub *StubLoki) push(w http.ResponseWriter, r *http.Request) {
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"streams"`
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &push); err != nil {
+		lokiError(w, http.StatusBadRequest, "loghttp.PushRequest: %s", err)
+		return
+	}
+
+	for _, stream := range push.Streams {
+		for _, value := range stream.Values {
+			if len(value) < 2 || len(value) > 3 {
+				lokiError(w, http.StatusBadRequest, "a value has %d elements", len(value))
+				return
+			}
+
+			timestamp, _ := value[0].(string)
+			line, _ := value[1].(string)
+
+			nanoseconds, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				lokiError(w, http.StatusBadRequest, "invalid timestamp %q", timestamp)
+				return
+			}
+
+			labels := make(map[string]string)
+			for name, value := range stream.Stream {
+				// Loki drops the labels without a value
+				if value != "" {
+					labels[name] = value
+				}
+			}
+
+			if len(value) == 3 {
+				metadata, ok := value[2].(map[string]interface{})
+				if !ok {
+					lokiError(w, http.StatusBadRequest, "structured metadata is not an object")
+					return
+				}
+
+				for name, value := range metadata {
+					labels[name] = fmt.Sprint(value)
+				}
+			}
+
+			stub.entries = append(stub.entries, stubLokiEntry{labels: labels, timestamp: nanoseconds, line: line})
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stubLogQL is a parsed log query
+type stubLogQL struct {
+	filters []func(stubLokiEntry) bool
+}
+
+func (logQL stubLogQL) matches(entry stubLokiEntry) bool {
+	for _, filter := range logQL.filters {
+		if !filter(entry) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stubParser reads the LogQL that LokiTraceStore writes
+type stubParser struct {
+	input string
+	pos   int
+}
+
+func (parser *stubParser) skipSpaces() {
+	for parser.pos < len(parser.input) && parser.input[parser.pos] == ' ' {
+		parser.pos++
+	}
+}
+
+func (parser *stubParser) consume(token string) bool {
+	parser.skipSpaces()
+
+	if strings.HasPrefix(parser.input[parser.pos:], token) {
+		parser.pos += len(token)
+		return true
+	}
+
+	return false
+}
+
+func (parser *stubParser) name() string {
+	parser.skipSpaces()
+
+	start := parser.pos
+	for parser.pos < len(parser.input) {
+		c := parser.input[parser.pos]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			break
+		}
+
+		parser.pos++
+	}
+
+	return parser.input[start:parser.pos]
+}
+
+func (parser *stubParser) str() (string, error) {
+	parser.skipSpaces()
+
+	quoted, err := strconv.QuotedPrefix(parser.input[parser.pos:])
+	if err != nil {
+		return "", fmt.Errorf("parse error at %d: expected a string", parser.pos)
+	}
+
+	parser.pos += len(quoted)
+
+	return strconv.Unquote(quoted)
+}
+
+// matcher reads a label matcher, whose regular expressions are anchored to the whole value, or a numeric comparison
+// of a label
+func (parser *stubParser) matcher() (func(stubLokiEntry) bool, error) {
+	label := parser.name()
+	if label == "" {
+		return nil, fmt.Errorf("parse error at %d: expected a label", parser.pos)
+	}
+
+	comparisons := []struct {
+		operator string
+		compare  func(value, number float64) bool
+	}{
+		{"<=", func(value, number float64) bool { return value <= number }},
+		{">=", func(value, number float64) bool { return value >= number }},
+		{"<", func(value, number float64) bool { return value < number }},
+		{">", func(value, number float64) bool { return value > number }},
+	}
+
+	for _, comparison := range comparisons {
+		if !parser.consume(comparison.operator) {
+			continue
+		}
+
+		number, err := strconv.ParseFloat(parser.name(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse error at %d: expected a number", parser.pos)
+		}
+
+		compare := comparison.compare
+
+		return func(entry stubLokiEntry) bool {
+			value, err := strconv.ParseFloat(entry.labels[label], 64)
+
+			return err == nil && compare(value, number)
+		}, nil
+	}
+
+	var operator string
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if parser.consume(candidate) {
+			operator = candidate
+			break
+		}
+	}
+
+	value, err := parser.str()
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "=":
+		return func(entry stubLokiEntry) bool { return entry.labels[label] == value }, nil
+	case "!=":
+		return func(entry stubLokiEntry) bool { return entry.labels[label] != value }, nil
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+
+		negate := operator == "!~"
+
+		return func(entry stubLokiEntry) bool { return re.MatchString(entry.labels[label]) != negate }, nil
+	}
+
+	return nil, fmt.Errorf("parse error at %d: expected an operator", parser.pos)
+}
+
+func parseStubLogQL(input string) (stubLogQL, error) {
+	parser := &stubParser{input: input}
+	var logQL stubLogQL
+
+	if !parser.consume("{") {
+		return logQL, fmt.Errorf("parse error: expected a stream selector")
+	}
+
+	for {
+		filter, err := parser.matcher()
+		if err != nil {
+			return logQL, err
+		}
+
+		logQL.filters = append(logQL.filters, filter)
+
+		if parser.consume("}") {
+			break
+		}
+
+		if !parser.consume(",") {
+			return logQL, fmt.Errorf("parse error at %d: expected , or }", parser.pos)
+		}
+	}
+
+	for {
+		parser.skipSpaces()
+		if parser.pos == len(parser.input) {
+			return logQL, nil
+		}
+
+		switch {
+		case parser.consume("|~"), parser.consume("!~"):
+			negate := parser.input[parser.pos-2] == '!'
+
+			value, err := parser.str()
+			if err != nil {
+				return logQL, err
+			}
+
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return logQL, err
+			}
+
+			logQL.filters = append(logQL.filters, func(entry stubLokiEntry) bool { return re.MatchString(entry.line) != negate })
+		case parser.consume("|="):
+			value, err := parser.str()
+			if err != nil {
+				return logQL, err
+			}
+
+			logQL.filters = append(logQL.filters, func(entry stubLokiEntry) bool { return strings.Contains(entry.line, value) })
+		case parser.consume("|"):
+			filter, err := parser.matcher()
+			if err != nil {
+				return logQL, err
+			}
+
+			logQL.filters = append(logQL.filters, filter)
+		default:
+			return logQL, fmt.Errorf("parse error at %d: unexpected %q", parser.pos, parser.input[parser.pos:])
+		}
+	}
+}
+
+func nanosecondsParam(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (stub *StubLoki) queryRange(w http.ResponseWriter, r *http.Request) {
+	logQL, err := parseStubLogQL(r.URL.Query().Get("query"))
+	if err != nil {
+		lokiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	start, err := nanosecondsParam(r, "start", time.Now().Add(-time.Hour).UnixNano())
+	if err != nil {
+		lokiError(w, http.StatusBadRequest, "invalid start: %s", err)
+		return
+	}
+
+	end, err := nanosecondsParam(r, "end", time.Now().UnixNano())
+	if err != nil {
+		lokiError(w, http.StatusBadRequest, "invalid end: %s", err)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil {
+		limit = 100
+	}
+
+	forward := r.URL.Query().Get("direction") == "forward"
+
+	var matched []stubLokiEntry
+	for _, entry := range stub.entries {
+		if entry.timestamp >= start && entry.timestamp < end && logQL.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if forward {
+			return matched[i].timestamp < matched[j].timestamp
+		}
+
+		return matched[i].timestamp > matched[j].timestamp
+	})
+
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+
+	// The entries are returned grouped by their labels
+	var order []string
+	streams := make(map[string]map[string]interface{})
+
+	for _, entry := range matched {
+		key := fmt.Sprint(entry.labels)
+
+		if _, ok := streams[key]; !ok {
+			streams[key] = map[string]interface{}{"stream": entry.labels, "values": [][]string{}}
+			order = append(order, key)
+		}
+
+		streams[key]["values"] = append(streams[key]["values"].([][]string), []string{strconv.FormatInt(entry.timestamp, 10), entry.line})
+	}
+
+	result := make([]interface{}, 0, len(order))
+	for _, key := range order {
+		result = append(result, streams[key])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": "streams", "result": result},
+	})
+}
+
+var stubCountQuery = regexp.MustCompile(`^sum\(count_over_time\((.*) \[(\d+)ms\]\)\)$`)
+
+func (stub *StubLoki) query(w http.ResponseWriter, r *http.Request) {
+	match := stubCountQuery.FindStringSubmatch(r.URL.Query().Get("query"))
+	if match == nil {
+		lokiError(w, http.StatusBadRequest, "the stub only evaluates sum(count_over_time(<log query> [<n>ms]))")
+		return
+	}
+
+	logQL, err := parseStubLogQL(match[1])
+	if err != nil {
+		lokiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	milliseconds, _ := strconv.ParseInt(match[2], 10, 64)
+
+	at, err := nanosecondsParam(r, "time", time.Now().UnixNano())
+	if err != nil {
+		lokiError(w, http.StatusBadRequest, "invalid time: %s", err)
+		return
+	}
+
+	// count_over_time counts the range before the evaluation time, with the evaluation time included
+	from := at - milliseconds*int64(time.Millisecond)
+	count := 0
+
+	for _, entry := range stub.entries {
+		if entry.timestamp > from && entry.timestamp <= at && logQL.matches(entry) {
+			count++
+		}
+	}
+
+	result := []interface{}{}
+	if count > 0 {
+		result = append(result, map[string]interface{}{
+			"metric": map[string]string{},
+			"value":  []interface{}{float64(at) / float64(time.Second), strconv.Itoa(count)},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": "vector", "result": result},
+	})
+}
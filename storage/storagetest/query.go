@@ -0,0 +1,624 @@
+package storagetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// stubTextFields are the text fields of the trace mappings, which are analyzed into lower cased words. Their keyword
+// sub-fields and the other fields hold the whole value
+var stubTextFields = map[string]bool{
+	"app_name": true,
+	"level":    true,
+	"message":  true,
+	"type":     true,
+}
+
+// stubKeywordLength is the ignore_above of the keyword sub-fields, longer values are not indexed in them
+const stubKeywordLength = 256
+
+// stubDocument is a document of an index, with its source decoded for the queries
+type stubDocument struct {
+	Index  string
+	ID     string
+	Raw    json.RawMessage
+	Source map[string]interface{}
+}
+
+func newStubDocument(index string, id string, raw json.RawMessage) (stubDocument, error) {
+	var source map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&source); err != nil {
+		return stubDocument{}, err
+	}
+
+	return stubDocument{Index: index, ID: id, Raw: raw, Source: source}, nil
+}
+
+// field returns the indexed values of field in the document, the words of a text field
+func (document stubDocument) field(field string) []string {
+	name := strings.TrimSuffix(field, ".keyword")
+	keyword := name != field
+
+	var value interface{}
+	if name == "_id" {
+		value = document.ID
+	} else {
+		value = document.Source[name]
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	text := fmt.Sprint(value)
+
+	if keyword {
+		if len(text) > stubKeywordLength {
+			return nil
+		}
+
+		return []string{text}
+	}
+
+	if stubTextFields[name] {
+		return stubWords(text)
+	}
+
+	return []string{text}
+}
+
+// stubWords splits text into lower cased words like the standard analyzer
+func stubWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// stubClauses decodes the clauses of a bool query occurrence, a single query or a list of them
+func stubClauses(raw json.RawMessage) ([]json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		var clauses []json.RawMessage
+		err := json.Unmarshal(raw, &clauses)
+
+		return clauses, err
+	}
+
+	return []json.RawMessage{raw}, nil
+}
+
+// stubFieldQuery decodes a query on a single field, such as {"message": {"query": "x"}} or {"message": "x"}, into
+// its field and parameters. The short form is returned under key
+func stubFieldQuery(raw json.RawMessage, key string) (string, map[string]interface{}, error) {
+	var fields map[string]json.RawMessage
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&fields); err != nil {
+		return "", nil, err
+	}
+
+	for field, value := range fields {
+		if strings.HasPrefix(field, "_") && field != "_id" {
+			continue
+		}
+
+		var params map[string]interface{}
+
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+			if err := decoder.Decode(&params); err != nil {
+				return "", nil, err
+			}
+		} else {
+			var short interface{}
+			if err := decoder.Decode(&short); err != nil {
+				return "", nil, err
+			}
+
+			params = map[string]interface{}{key: short}
+		}
+
+		return field, params, nil
+	}
+
+	return "", nil, fmt.Errorf("query without a field: %s", raw)
+}
+
+// stubTerm returns the value of a term as the fields hold it
+func stubTerm(value interface{}) string {
+	return fmt.Sprint(value)
+}
+
+// stubNumber returns the number of a range bound or a field value, dates in milliseconds
+func stubNumber(value interface{}) (float64, error) {
+	text := fmt.Sprint(value)
+
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return number, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return 0, fmt.Errorf("not a number or a date: %s", text)
+	}
+
+	return float64(t.UnixNano() / int64(time.Millisecond)), nil
+}
+
+// inRange reports whether value is within the bounds of a range query, in both the from/to and the gte/lte forms
+func inRange(value float64, params map[string]interface{}) (bool, error) {
+	bounds := []struct {
+		name  string
+		lower bool
+		equal bool
+	}{
+		{"gte", true, true}, {"gt", true, false}, {"lte", false, true}, {"lt", false, false},
+		{"from", true, params["include_lower"] != false}, {"to", false, params["include_upper"] != false},
+	}
+
+	for _, bound := range bounds {
+		raw, ok := params[bound.name]
+		if !ok || raw == nil {
+			continue
+		}
+
+		limit, err := stubNumber(raw)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case bound.lower && bound.equal && value < limit,
+			bound.lower && !bound.equal && value <= limit,
+			!bound.lower && bound.equal && value > limit,
+			!bound.lower && !bound.equal && value >= limit:
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// stubMatches reports whether document matches a query of the query DSL. It evaluates the queries that ESTraceStore
+// sends: bool, term, terms, ids, match, range, exists and match_all. Other queries fail, so that a stub that does not
+// understand a query cannot pass a test by matching every document
+func stubMatches(raw json.RawMessage, document stubDocument) (bool, error) {
+	if len(raw) == 0 {
+		return true, nil
+	}
+
+	var query map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &query); err != nil {
+		return false, err
+	}
+
+	if len(query) != 1 {
+		return false, fmt.Errorf("query with %d types: %s", len(query), raw)
+	}
+
+	for kind, body := range query {
+		switch kind {
+		case "match_all":
+			return true, nil
+		case "bool":
+			return stubBool(body, document)
+		case "term", "match":
+			field, params, err := stubFieldQuery(body, map[string]string{"term": "value", "match": "query"}[kind])
+			if err != nil {
+				return false, err
+			}
+
+			values := document.field(field)
+
+			if kind == "term" {
+				return containsValue(values, stubTerm(params["value"])), nil
+			}
+
+			words := []string{stubTerm(params["query"])}
+			if stubTextFields[field] {
+				words = stubWords(words[0])
+			}
+
+			matched := 0
+			for _, word := range words {
+				if containsValue(values, word) {
+					matched++
+				}
+			}
+
+			if params["operator"] == "and" || params["operator"] == "AND" {
+				return len(words) > 0 && matched == len(words), nil
+			}
+
+			return matched > 0, nil
+		case "terms":
+			var fields map[string][]interface{}
+			if err := json.Unmarshal(body, &fields); err != nil {
+				return false, err
+			}
+
+			for field, terms := range fields {
+				values := document.field(field)
+				for _, term := range terms {
+					if containsValue(values, stubTerm(term)) {
+						return true, nil
+					}
+				}
+			}
+
+			return false, nil
+		case "ids":
+			var ids struct {
+				Values []string `json:"values"`
+			}
+
+			if err := json.Unmarshal(body, &ids); err != nil {
+				return false, err
+			}
+
+			return containsValue(ids.Values, document.ID), nil
+		case "exists":
+			var exists struct {
+				Field string `json:"field"`
+			}
+
+			if err := json.Unmarshal(body, &exists); err != nil {
+				return false, err
+			}
+
+			return len(document.field(exists.Field)) > 0, nil
+		case "range":
+			field, params, err := stubFieldQuery(body, "")
+			if err != nil {
+				return false, err
+			}
+
+			values := document.field(field)
+			if len(values) == 0 {
+				return false, nil
+			}
+
+			value, err := stubNumber(values[0])
+			if err != nil {
+				return false, err
+			}
+
+			return inRange(value, params)
+		default:
+			return false, fmt.Errorf("the stub does not evaluate [%s] queries", kind)
+		}
+	}
+
+	return false, nil
+}
+
+// stubBool evaluates a bool query. Without must and filter clauses, one of the should clauses has to match
+func stubBool(body json.RawMessage, document stubDocument) (bool, error) {
+	var occurrences struct {
+		Must               json.RawMessage `json:"must"`
+		Filter             json.RawMessage `json:"filter"`
+		MustNot            json.RawMessage `json:"must_not"`
+		Should             json.RawMessage `json:"should"`
+		MinimumShouldMatch interface{}     `json:"minimum_should_match"`
+	}
+
+	if err := json.Unmarshal(body, &occurrences); err != nil {
+		return false, err
+	}
+
+	required := 0
+
+	for _, occurrence := range []json.RawMessage{occurrences.Must, occurrences.Filter} {
+		clauses, err := stubClauses(occurrence)
+		if err != nil {
+			return false, err
+		}
+
+		for _, clause := range clauses {
+			required++
+
+			if matched, err := stubMatches(clause, document); err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+
+	clauses, err := stubClauses(occurrences.MustNot)
+	if err != nil {
+		return false, err
+	}
+
+	for _, clause := range clauses {
+		if matched, err := stubMatches(clause, document); err != nil || matched {
+			return false, err
+		}
+	}
+
+	clauses, err = stubClauses(occurrences.Should)
+	if err != nil || len(clauses) == 0 {
+		return err == nil, err
+	}
+
+	minimum := 0
+	if required == 0 {
+		minimum = 1
+	}
+
+	if occurrences.MinimumShouldMatch != nil {
+		if minimum, err = strconv.Atoi(fmt.Sprint(occurrences.MinimumShouldMatch)); err != nil {
+			return false, err
+		}
+	}
+
+	matched := 0
+	for _, clause := range clauses {
+		ok, err := stubMatches(clause, document)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			matched++
+		}
+	}
+
+	return matched >= minimum, nil
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stubQueryWords returns the words that the match queries outside of must_not look for in field, which the highlighter
+// marks
+func stubQueryWords(raw json.RawMessage, field string, words map[string]bool) {
+	var query map[string]json.RawMessage
+	if len(raw) == 0 || json.Unmarshal(raw, &query) != nil {
+		return
+	}
+
+	if body, ok := query["match"]; ok {
+		if matchField, params, err := stubFieldQuery(body, "query"); err == nil && matchField == field {
+			for _, word := range stubWords(stubTerm(params["query"])) {
+				words[word] = true
+			}
+		}
+	}
+
+	if body, ok := query["bool"]; ok {
+		var occurrences map[string]json.RawMessage
+		json.Unmarshal(body, &occurrences)
+
+		for _, name := range []string{"must", "filter", "should"} {
+			clauses, _ := stubClauses(occurrences[name])
+			for _, clause := range clauses {
+				stubQueryWords(clause, field, words)
+			}
+		}
+	}
+}
+
+// stubHighlight marks the words of the match queries in the highlighted fields of document. Every value is returned
+// as a single fragment
+func stubHighlight(query json.RawMessage, highlight stubHighlightRequest, document stubDocument) map[string][]string {
+	marked := make(map[string][]string)
+
+	for field := range highlight.Fields {
+		words := make(map[string]bool)
+		stubQueryWords(query, field, words)
+
+		text, ok := document.Source[field].(string)
+		if !ok || len(words) == 0 {
+			continue
+		}
+
+		var fragment strings.Builder
+		found := false
+		start := -1
+
+		flush := func(end int) {
+			if start < 0 {
+				return
+			}
+
+			word := text[start:end]
+			if words[strings.ToLower(word)] {
+				found = true
+				fragment.WriteString(highlight.PreTags[0] + word + highlight.PostTags[0])
+			} else {
+				fragment.WriteString(word)
+			}
+
+			start = -1
+		}
+
+		for i, r := range text {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+				if start < 0 {
+					start = i
+				}
+
+				continue
+			}
+
+			flush(i)
+			fragment.WriteRune(r)
+		}
+
+		flush(len(text))
+
+		if found {
+			marked[field] = []string{fragment.String()}
+		}
+	}
+
+	return marked
+}
+
+// stubHighlightRequest is the highlight of a search request
+type stubHighlightRequest struct {
+	PreTags  []string                   `json:"pre_tags"`
+	PostTags []string                   `json:"post_tags"`
+	Fields   map[string]json.RawMessage `json:"fields"`
+}
+
+// stubSortField is a field of the sort of a search request
+type stubSortField struct {
+	Field      string
+	Descending bool
+}
+
+// parseStubSort decodes the sort of a search request, whose fields are names or objects with an order
+func parseStubSort(raw json.RawMessage) ([]stubSortField, error) {
+	clauses, err := stubClauses(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []stubSortField
+
+	for _, clause := range clauses {
+		var name string
+		if json.Unmarshal(clause, &name) == nil {
+			fields = append(fields, stubSortField{Field: name, Descending: name == "_score"})
+			continue
+		}
+
+		var object map[string]struct {
+			Order string `json:"order"`
+		}
+
+		if err := json.Unmarshal(clause, &object); err != nil {
+			return nil, err
+		}
+
+		for field, options := range object {
+			fields = append(fields, stubSortField{Field: field, Descending: options.Order == "desc"})
+		}
+	}
+
+	return fields, nil
+}
+
+// sortValues returns the values of the sort fields of document, which the hits return and search_after compares
+func (document stubDocument) sortValues(fields []stubSortField) []interface{} {
+	values := make([]interface{}, 0, len(fields))
+
+	for _, field := range fields {
+		indexed := document.field(field.Field)
+		if len(indexed) == 0 {
+			values = append(values, nil)
+			continue
+		}
+
+		// Numbers and dates sort by their value, in milliseconds
+		if number, ok := document.Source[field.Field].(json.Number); ok {
+			value, _ := number.Float64()
+			values = append(values, value)
+			continue
+		}
+
+		values = append(values, indexed[0])
+	}
+
+	return values
+}
+
+// stubSortNumber returns a numeric sort value, of a document or of search_after
+func stubSortNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case json.Number:
+		value, err := number.Float64()
+		return value, err == nil
+	}
+
+	return 0, false
+}
+
+// compareStubValues orders two sort values, missing values last
+func compareStubValues(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	x, xNumber := stubSortNumber(a)
+	y, yNumber := stubSortNumber(b)
+
+	if xNumber && yNumber {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compareStubSort orders two lists of sort values by fields
+func compareStubSort(fields []stubSortField, a []interface{}, b []interface{}) int {
+	for i, field := range fields {
+		if i >= len(a) || i >= len(b) {
+			break
+		}
+
+		order := compareStubValues(a[i], b[i])
+		if field.Descending && a[i] != nil && b[i] != nil {
+			order = -order
+		}
+
+		if order != 0 {
+			return order
+		}
+	}
+
+	return 0
+}
+
+// sortStubDocuments sorts documents by fields, and by index and id on ties
+func sortStubDocuments(documents []stubDocument, fields []stubSortField) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		if order := compareStubSort(fields, documents[i].sortValues(fields), documents[j].sortValues(fields)); order != 0 {
+			return order < 0
+		}
+
+		if documents[i].Index != documents[j].Index {
+			return documents[i].Index < documents[j].Index
+		}
+
+		return documents[i].ID < documents[j].ID
+	})
+}
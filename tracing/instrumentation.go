@@ -1,7 +1,10 @@
 package tracing
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/opentracing/opentracing-go"
@@ -47,3 +50,30 @@ func (w *responseCodeCaptureWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Flush sends buffered data to the client if the underlying writer supports it
+func (w *responseCodeCaptureWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler if the underlying writer supports it, as a WebSocket upgrade needs
+func (w *responseCodeCaptureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err == nil {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+
+	return conn, readWriter, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (w *responseCodeCaptureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}